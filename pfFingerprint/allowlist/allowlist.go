@@ -0,0 +1,141 @@
+//Package allowlist builds the lists of pages that are accessed in every (or most) executions of the victim.
+//Tracking only these pages reduces the noise of the attacks. Used by buildAllowList and refineAllowList
+package allowlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//ParseRuns parses the json events between each "Start" and "Stop" line of a trace generator log. Each pair is
+//one run. Plain text events are skipped
+func ParseRuns(r io.Reader) ([][]*sevStep.Event, error) {
+	sc := bufio.NewScanner(r)
+	sc.Split(bufio.ScanLines)
+
+	eventsByRuns := make([][]*sevStep.Event, 0)
+	eventsSingleRun := make([]*sevStep.Event, 0)
+	printedWarningNonJSON := false
+	printedWarningNoRIP := false
+
+	insideTrace := false
+
+	for sc.Scan() {
+		line := strings.TrimLeft(sc.Text(), " ")
+
+		if strings.HasPrefix(line, "Start") {
+			if insideTrace {
+				log.Printf("Encountered \"Start\" while inside trace, this should not happen!")
+			}
+			insideTrace = true
+		}
+
+		if !insideTrace {
+			continue
+		}
+
+		if strings.HasPrefix(line, "Stop") {
+			eventsByRuns = append(eventsByRuns, eventsSingleRun)
+			eventsSingleRun = make([]*sevStep.Event, 0)
+			insideTrace = false
+			continue
+		}
+
+		if !strings.HasPrefix(line, "{") {
+			if !printedWarningNonJSON {
+				log.Printf("omiting non json lines")
+			}
+			printedWarningNonJSON = true
+			continue
+		}
+
+		v, err := sevStep.ParseEventFromJSON(line)
+		if err != nil {
+			return nil, fmt.Errorf("ParseEventFromJSON failed on %s : %v", line, err)
+		}
+
+		if !v.HaveRipInfo && !printedWarningNoRIP {
+			log.Printf("Some entries do not have RIP info")
+			printedWarningNoRIP = true
+		}
+
+		eventsSingleRun = append(eventsSingleRun, v)
+
+	}
+	if sc.Err() != nil {
+		return nil, fmt.Errorf("scanner error : %v", sc.Err())
+	}
+	return eventsByRuns, nil
+}
+
+//RunSets returns the set of faulted gpas for each run. If excludeKernel is set, faults with a kernel space
+//RIP are skipped
+func RunSets(eventsByRun [][]*sevStep.Event, excludeKernel bool) []map[uint64]bool {
+	runSets := make([]map[uint64]bool, len(eventsByRun))
+	for runIDX, eventsInRun := range eventsByRun {
+		runSets[runIDX] = make(map[uint64]bool)
+		for _, v := range eventsInRun {
+			if excludeKernel && v.RIP >= 0xffff800000000000 {
+				continue
+			}
+			runSets[runIDX][v.FaultedGPA] = true
+		}
+	}
+	return runSets
+}
+
+//Intersect returns the gpas that are contained in all runs
+func Intersect(runs []map[uint64]bool) map[uint64]bool {
+	return AtLeast(runs, 1)
+}
+
+//AtLeast returns the gpas that are contained in at least the given fraction of the runs. A fraction of 1
+//is the intersection, every fraction <= 0 the union of all runs
+func AtLeast(runs []map[uint64]bool, fraction float64) map[uint64]bool {
+	counts := make(map[uint64]int)
+	for _, run := range runs {
+		for k, v := range run {
+			if v {
+				counts[k]++
+			}
+		}
+	}
+	result := make(map[uint64]bool)
+	for k, v := range counts {
+		//tolerance for fractions like 0.7 that are not exact in floating point
+		if float64(v) >= fraction*float64(len(runs))-1e-9 {
+			result[k] = true
+		}
+	}
+	return result
+}
+
+//Sorted returns the gpas of set in ascending order
+func Sorted(set map[uint64]bool) []uint64 {
+	gpas := make([]uint64, 0, len(set))
+	for k, v := range set {
+		if v {
+			gpas = append(gpas, k)
+		}
+	}
+	sort.Slice(gpas, func(i, j int) bool {
+		return gpas[i] < gpas[j]
+	})
+	return gpas
+}
+
+//Write writes the gpas of set in ascending order in the format of session.ParseAllowList
+func Write(w io.Writer, set map[uint64]bool) error {
+	for _, v := range Sorted(set) {
+		if _, err := fmt.Fprintf(w, "0x%x\n", v); err != nil {
+			return fmt.Errorf("failed to write allow list : %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package allowlist
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func set(gpas ...uint64) map[uint64]bool {
+	s := make(map[uint64]bool)
+	for _, v := range gpas {
+		s[v] = true
+	}
+	return s
+}
+
+func TestParseRuns(t *testing.T) {
+	input := strings.Join([]string{
+		`{"id":0,"faulted_gpa":4096}`,
+		"Start 1",
+		`{"id":1,"faulted_gpa":8192}`,
+		"some plain line",
+		"Stop 1",
+		"Start 2",
+		`{"id":2,"faulted_gpa":12288,"rip":18446744071562067968,"have_rip_info":true}`,
+		`{"id":3,"faulted_gpa":8192}`,
+		"Stop 2",
+	}, "\n")
+	runs, err := ParseRuns(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseRuns() error = %v", err)
+	}
+	if len(runs) != 2 || len(runs[0]) != 1 || len(runs[1]) != 2 {
+		t.Fatalf("ParseRuns() got %v runs", len(runs))
+	}
+	got := RunSets(runs, true)
+	if want := []map[uint64]bool{set(0x2000), set(0x2000)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RunSets() got = %v, want %v", got, want)
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	runs := []map[uint64]bool{set(1, 2, 3), set(1, 2), set(1, 3), set(1, 2, 4)}
+	tests := []struct {
+		name     string
+		fraction float64
+		want     map[uint64]bool
+	}{
+		{name: "Intersection", fraction: 1, want: set(1)},
+		{name: "Three quarters", fraction: 0.75, want: set(1, 2)},
+		{name: "Half", fraction: 0.5, want: set(1, 2, 3)},
+		{name: "Union", fraction: 0, want: set(1, 2, 3, 4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AtLeast(runs, tt.fraction); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AtLeast() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := Intersect(nil); len(got) != 0 {
+		t.Errorf("Intersect() of no runs got = %v", got)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Write(buf, map[uint64]bool{0x3000: true, 0x1000: true, 0x2000: false}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got, want := buf.String(), "0x1000\n0x3000\n"; got != want {
+		t.Errorf("Write() got = %q, want %q", got, want)
+	}
+}
+
+func TestRefiner(t *testing.T) {
+	r, err := NewRefiner(nil, 1, 2)
+	if err != nil {
+		t.Fatalf("NewRefiner() error = %v", err)
+	}
+	rounds := []struct {
+		runs     []map[uint64]bool
+		wantList map[uint64]bool
+		wantDone bool
+	}{
+		//first round tracks all pages
+		{runs: []map[uint64]bool{set(1, 2, 3, 4), set(1, 2, 3)}, wantList: set(1, 2, 3)},
+		//page 5 is not on the list and must be ignored
+		{runs: []map[uint64]bool{set(1, 2, 5), set(1, 2, 3, 5)}, wantList: set(1, 2)},
+		{runs: []map[uint64]bool{set(1, 2), set(1, 2)}, wantList: set(1, 2)},
+		{runs: []map[uint64]bool{set(1, 2), set(1, 2)}, wantList: set(1, 2), wantDone: true},
+	}
+	for i, v := range rounds {
+		done, reason, err := r.Round(v.runs)
+		if err != nil {
+			t.Fatalf("Round() %v error = %v", i, err)
+		}
+		if done != v.wantDone {
+			t.Errorf("Round() %v done = %v (%v), want %v", i, done, reason, v.wantDone)
+		}
+		if !reflect.DeepEqual(r.List(), v.wantList) {
+			t.Errorf("Round() %v list = %v, want %v", i, r.List(), v.wantList)
+		}
+	}
+
+	wantStats := []PageStats{
+		{GPA: 1, Present: 8, Tracked: 8},
+		{GPA: 2, Present: 8, Tracked: 8},
+		{GPA: 3, Present: 3, Tracked: 4},
+		{GPA: 4, Present: 1, Tracked: 2},
+	}
+	if got := r.Stats(); !reflect.DeepEqual(got, wantStats) {
+		t.Errorf("Stats() got = %v, want %v", got, wantStats)
+	}
+	buf := &bytes.Buffer{}
+	if err := r.WriteStats(buf); err != nil {
+		t.Fatalf("WriteStats() error = %v", err)
+	}
+	if got := strings.Split(buf.String(), "\n")[2]; got != "0x3 3/4 75.0% dropped" {
+		t.Errorf("WriteStats() line = %q", got)
+	}
+}
+
+func TestRefiner_Threshold(t *testing.T) {
+	r, err := NewRefiner([]uint64{1, 2, 3}, 0.5, 1)
+	if err != nil {
+		t.Fatalf("NewRefiner() error = %v", err)
+	}
+	//a page that only shows up in half of the runs is kept, the list does not shrink
+	done, _, err := r.Round([]map[uint64]bool{set(1, 2), set(1, 3), set(1)})
+	if err != nil {
+		t.Fatalf("Round() error = %v", err)
+	}
+	if want := set(1); !reflect.DeepEqual(r.List(), want) || done {
+		t.Errorf("Round() list = %v, done = %v, want %v", r.List(), done, want)
+	}
+	done, _, _ = r.Round([]map[uint64]bool{set(1), set()})
+	if !done || !reflect.DeepEqual(r.List(), set(1)) {
+		t.Errorf("Round() list = %v, done = %v, want done", r.List(), done)
+	}
+
+	if _, err := NewRefiner(nil, 0, 1); err == nil {
+		t.Errorf("NewRefiner() accepted presence 0")
+	}
+}
@@ -0,0 +1,175 @@
+package allowlist
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+//PageStats counts in how many of the runs, in which a page has been tracked, it was accessed
+type PageStats struct {
+	GPA     uint64
+	Present int
+	Tracked int
+}
+
+//Fraction returns the share of the tracked runs in which the page was present
+func (p PageStats) Fraction() float64 {
+	if p.Tracked == 0 {
+		return 0
+	}
+	return float64(p.Present) / float64(p.Tracked)
+}
+
+//Refiner shrinks an allow list over several rounds of traces, where each round is traced with the list of the
+//previous one. The list of a round are the pages of the previous list that are present in at least
+//MinPresence of the round's runs. The refinement is done once the list did not shrink for StableRounds
+//consecutive rounds
+type Refiner struct {
+	//MinPresence is the fraction of runs a page has to be present in. 1 means strict intersection
+	MinPresence float64
+	//StableRounds is the number of rounds without shrinking after which the refinement is done
+	StableRounds int
+	//list is nil while all pages are tracked
+	list      map[uint64]bool
+	rounds    int
+	noShrink  int
+	unchanged int
+	stats     map[uint64]*PageStats
+}
+
+//NewRefiner starts with the given allow list. A nil list means that the first round tracks all pages
+func NewRefiner(initial []uint64, minPresence float64, stableRounds int) (*Refiner, error) {
+	if minPresence <= 0 || minPresence > 1 {
+		return nil, fmt.Errorf("min presence has to be in (0,1], got %v", minPresence)
+	}
+	if stableRounds < 1 {
+		return nil, fmt.Errorf("stable rounds has to be at least 1, got %v", stableRounds)
+	}
+	r := &Refiner{
+		MinPresence:  minPresence,
+		StableRounds: stableRounds,
+		stats:        make(map[uint64]*PageStats),
+	}
+	if initial != nil {
+		r.list = make(map[uint64]bool, len(initial))
+		for _, v := range initial {
+			r.list[v] = true
+		}
+	}
+	return r, nil
+}
+
+//List returns the current allow list. Nil if no round has been done and there was no initial list
+func (r *Refiner) List() map[uint64]bool {
+	return r.list
+}
+
+//Rounds returns the number of completed rounds
+func (r *Refiner) Rounds() int {
+	return r.rounds
+}
+
+//Round updates the list with the runs of a round, that has been traced with the current List. Returns true
+//once the refinement is done, together with the reason. Pages outside of the current list are ignored, they
+//can only show up due to noise
+func (r *Refiner) Round(runs []map[uint64]bool) (bool, string, error) {
+	if len(runs) == 0 {
+		return false, "", fmt.Errorf("round without runs")
+	}
+
+	//pages that could have been accessed in this round
+	tracked := r.list
+	if tracked == nil {
+		tracked = make(map[uint64]bool)
+		for _, run := range runs {
+			for k, v := range run {
+				if v {
+					tracked[k] = true
+				}
+			}
+		}
+	}
+	for k := range tracked {
+		s, ok := r.stats[k]
+		if !ok {
+			s = &PageStats{GPA: k}
+			r.stats[k] = s
+		}
+		s.Tracked += len(runs)
+		for _, run := range runs {
+			if run[k] {
+				s.Present++
+			}
+		}
+	}
+
+	next := AtLeast(runs, r.MinPresence)
+	for k := range next {
+		if !tracked[k] {
+			delete(next, k)
+		}
+	}
+
+	r.rounds++
+	shrunk := r.list == nil || len(next) < len(r.list)
+	if shrunk {
+		r.noShrink = 0
+	} else {
+		r.noShrink++
+	}
+	if r.list != nil && sameSet(next, r.list) {
+		r.unchanged++
+	} else {
+		r.unchanged = 0
+	}
+	r.list = next
+
+	switch {
+	case len(next) == 0:
+		return true, "allow list is empty", nil
+	case r.unchanged >= r.StableRounds:
+		return true, fmt.Sprintf("allow list stable for %v rounds", r.unchanged), nil
+	case r.noShrink >= r.StableRounds:
+		return true, fmt.Sprintf("allow list did not shrink for %v rounds", r.noShrink), nil
+	}
+	return false, "", nil
+}
+
+func sameSet(a, b map[uint64]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+//Stats returns the presence statistics of all pages that have been tracked in any round, ordered by gpa
+func (r *Refiner) Stats() []PageStats {
+	stats := make([]PageStats, 0, len(r.stats))
+	for _, v := range r.stats {
+		stats = append(stats, *v)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].GPA < stats[j].GPA
+	})
+	return stats
+}
+
+//WriteStats writes one line per page with its presence and whether it is part of the current list
+func (r *Refiner) WriteStats(w io.Writer) error {
+	for _, v := range r.Stats() {
+		status := "dropped"
+		if r.list[v.GPA] {
+			status = "kept"
+		}
+		if _, err := fmt.Fprintf(w, "0x%x %v/%v %.1f%% %v\n", v.GPA, v.Present, v.Tracked, 100*v.Fraction(), status); err != nil {
+			return fmt.Errorf("failed to write page stats : %v", err)
+		}
+	}
+	return nil
+}
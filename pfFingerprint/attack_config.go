@@ -6,6 +6,10 @@ type OSSLAttackConfigECDH struct {
 	BaseGPA     uint64 `json:"base_gpa"`
 	Fe64GPA     uint64 `json:"fe_64_gpa"`
 	StackBufGPA uint64 `json:"stack_buf_gpa"`
+	//SSHKex is only set if the victim was triggered via ssh. It contains the ephemeral public values of the key exchange
+	SSHKex *trigger.SSHSignatureMessage `json:"ssh_kex,omitempty"`
+	//TLSHandshake is only set if the victim was triggered via tls. Its server key share allows to check recovered scalars
+	TLSHandshake *trigger.TLSHandshakeRecord `json:"tls_handshake,omitempty"`
 }
 
 type OSSHAttackConfigEdDSA struct {
@@ -18,3 +22,16 @@ type OSSHAttackConfigEdDSA struct {
 	StackBufAlignment   int                         `json:"stack_buf_alignment"`
 	StackBufBytes       int                         `json:"stack_buf_bytes"`
 }
+
+//OSSHCaptureEdDSA is a single capture of pfOSSHAttackEdDSA, i.e. the paths of an attack trace and its config
+type OSSHCaptureEdDSA struct {
+	Trace  string `json:"trace"`
+	Config string `json:"config"`
+	//Attempts is the number of victim executions needed for this capture
+	Attempts int `json:"attempts"`
+}
+
+//OSSHCapturesEdDSA lists all captures of a pfOSSHAttackEdDSA run. Paths are relative to the directory of the list
+type OSSHCapturesEdDSA struct {
+	Captures []OSSHCaptureEdDSA `json:"captures"`
+}
@@ -0,0 +1,100 @@
+//Verifies that a trace is complete before it is used by the analysis and recovery tools. Checks the ID continuity
+//and timestamps of the events, the Start/Stop balance, the markers of rolling batch tracking, the retired
+//instructions and, if an attack config is given, the memory snapshots the recovery needs. Writes a json report
+//next to the trace, that pfOSSLRecoverECDHKey and pfOSSHRecoverEdDSAKey consult with "-integrity". Exits with an
+//error if a check failed, e.g.
+//checkTrace -in attack-trace.txt -eddsaConfig attack-config.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"pfFingerprint"
+	"pfFingerprint/integrity"
+)
+
+func main() {
+	in := flag.String("in", "", "Path to the trace file. Requires the json format")
+	out := flag.String("out", "", "Path for the json report. Defaults to the trace path with the suffix \".integrity.json\"")
+	eddsaConfig := flag.String("eddsaConfig", "", "Attack config of pfOSSHAttackEdDSA. Checks the stack buffer snapshots and allows skipped IDs")
+	ecdhConfig := flag.String("ecdhConfig", "", "Attack config of pfOSSLAttackECDH. Checks the x2 snapshots and allows skipped IDs")
+	def := integrity.DefaultConfig()
+	allowIDSkips := flag.Bool("allowIDSkips", false, "Report skipped IDs as warnings. Implied by the attack configs, as the attack tools only write the emitted faults")
+	maxRetiredInstructions := flag.Uint64("maxRetiredInstructions", def.MaxRetiredInstructions, "Largest plausible retired instruction delta")
+	maxIssues := flag.Int("maxIssues", def.MaxIssues, "Number of issues listed in the report")
+
+	flag.Parse()
+
+	if *in == "" {
+		log.Printf("Please set \"-in\"")
+		flag.PrintDefaults()
+		return
+	}
+	if *eddsaConfig != "" && *ecdhConfig != "" {
+		log.Printf("Please set at most one of \"-eddsaConfig\" and \"-ecdhConfig\"")
+		return
+	}
+	if *out == "" {
+		*out = integrity.ReportPath(*in)
+	}
+
+	config := integrity.Config{
+		AllowIDSkips:           *allowIDSkips,
+		MaxRetiredInstructions: *maxRetiredInstructions,
+		MaxIssues:              *maxIssues,
+	}
+	if *eddsaConfig != "" {
+		attackConfig := pfFingerprint.OSSHAttackConfigEdDSA{}
+		if err := readConfig(*eddsaConfig, &attackConfig); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		config.AllowIDSkips = true
+		config.Snapshots = append(config.Snapshots, integrity.ExpectEdDSA(attackConfig))
+	}
+	if *ecdhConfig != "" {
+		attackConfig := pfFingerprint.OSSLAttackConfigECDH{}
+		if err := readConfig(*ecdhConfig, &attackConfig); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		config.AllowIDSkips = true
+		config.Snapshots = append(config.Snapshots, integrity.ExpectECDH(attackConfig))
+	}
+
+	report, err := integrity.CheckFile(*in, config)
+	if err != nil {
+		log.Printf("Failed to check trace : %v", err)
+		return
+	}
+	if err := report.Save(*out); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	log.Printf("Checked %v events in %v runs, %v chunks and %v gaps\n", report.Events, report.Runs, report.Chunks, report.Gaps)
+	for _, v := range report.Checks {
+		log.Printf("%-20v passed=%v errors=%v warnings=%v\n", v.Name, v.Passed, v.Errors, v.Warnings)
+	}
+	for _, v := range report.Issues {
+		log.Printf("%v\n", v)
+	}
+	if !report.OK {
+		log.Fatalf("Trace failed the integrity checks, see %v", *out)
+	}
+}
+
+//readConfig parses the json attack config at path into v
+func readConfig(path string, v interface{}) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read attack config : %v", err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("failed to parse attack config : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+//Labels the GPAs of guest kernel text and data and writes them as deny list for the trace generators and
+//buildAllowList. Takes json traces of the trace generators as arguments, each file is one source. Faults with RIP
+//info, e.g. from a debug VM, label their pages directly and calibrate the retired instruction signal. All other
+//pages are labeled without RIP, by the user bit of the error code, the retired instructions and by being present
+//in the runs of all sources. Use traces of unrelated victims as sources, e.g.
+//classifyKernelPages -out kernel-pages.txt ecdh-trace.txt ssh-trace.txt idle-trace.txt
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"pfFingerprint/allowlist"
+	"pfFingerprint/kernelpages"
+)
+
+func main() {
+	out := flag.String("out", "kernel-pages.txt", "Path for the deny list with the kernel pages")
+	reportOut := flag.String("report", "", "If set, write the evidence and label of every page as json to this path")
+	def := kernelpages.DefaultConfig()
+	minSupervisor := flag.Float64("minSupervisor", def.MinSupervisor*100, "Percentage of faults without the user bit, above which a page is voted kernel")
+	minPresence := flag.Float64("minPresence", def.MinPresence*100, "Percentage of the runs of a source a page has to be present in to count as stable. Pages stable in all sources are voted kernel")
+	minVotes := flag.Int("minVotes", def.MinVotes, "Number of RIP free signals that have to vote kernel. Pages with fewer available signals need all of them")
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Printf("Please pass at least one trace file")
+		flag.PrintDefaults()
+		return
+	}
+	config := kernelpages.Config{
+		MinSupervisor: *minSupervisor / 100,
+		MinPresence:   *minPresence / 100,
+		MinVotes:      *minVotes,
+	}
+	if err := config.Validate(); err != nil {
+		log.Printf("Invalid flags : %v", err)
+		flag.PrintDefaults()
+		return
+	}
+
+	classifier := kernelpages.NewClassifier(config)
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Failed to open trace : %v", err)
+			return
+		}
+		eventsByRun, err := allowlist.ParseRuns(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to parse %v : %v", path, err)
+			return
+		}
+		if len(eventsByRun) == 0 {
+			log.Printf("No runs in %v, the trace generators have to use \"-format json\"", path)
+			return
+		}
+		for _, events := range eventsByRun {
+			classifier.AddRun(path, events)
+		}
+		log.Printf("Parsed %v runs from %v\n", len(eventsByRun), path)
+	}
+
+	pages := classifier.Classify()
+	kernel := kernelpages.Kernel(pages)
+	bySignal := make(map[string]int)
+	for _, v := range pages {
+		if v.Kernel {
+			for _, signal := range v.Signals {
+				bySignal[signal]++
+			}
+		}
+	}
+	log.Printf("Labeled %v of %v pages as kernel, votes by signal %v\n", len(kernel), len(pages), bySignal)
+
+	outFile, err := os.Create(*out)
+	if err != nil {
+		log.Printf("Failed to create out file : %v", err)
+		return
+	}
+	defer outFile.Close()
+	if err := allowlist.Write(outFile, kernel); err != nil {
+		log.Printf("Failed to write deny list : %v", err)
+		return
+	}
+
+	if *reportOut != "" {
+		report, err := json.MarshalIndent(pages, "", "  ")
+		if err != nil {
+			log.Printf("Failed to marshal report : %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(*reportOut, report, 0644); err != nil {
+			log.Printf("Failed to write report : %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+//Decrypts a recorded SSH connection using the recovered ephemeral X25519 scalar of the server.
+//The connection must use curve25519-sha256 for the key exchange. Both directions of the connection
+//are expected as raw TCP streams, starting with the version line, e.g. as exported by wireshark via "Follow TCP Stream"
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//msgChannelData is the SSH message number of SSH_MSG_CHANNEL_DATA (RFC 4254, section 5.2)
+const msgChannelData = 94
+
+//writePackets decrypts all packets from in with readPacket and writes them to out. Payloads of channel
+//data messages are written in hex, for all other messages only type and length are written
+func writePackets(out io.Writer, direction string, in io.Reader, readPacket func(io.Reader) ([]byte, error)) error {
+	for idx := 0; ; idx++ {
+		packet, err := readPacket(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt packet %v : %v", idx, err)
+		}
+
+		line := fmt.Sprintf("%v packet %v type %v len %v", direction, idx, packet[0], len(packet))
+		//channel data : byte type, uint32 channel, string data
+		if packet[0] == msgChannelData && len(packet) >= 9 {
+			channel := binary.BigEndian.Uint32(packet[1:5])
+			line += fmt.Sprintf(" channel %v data %x", channel, packet[9:])
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return fmt.Errorf("failed to write output : %v", err)
+		}
+	}
+}
+
+func main() {
+	c2sPath := flag.String("c2s", "", "Path to the raw client to server stream")
+	s2cPath := flag.String("s2c", "", "Path to the raw server to client stream")
+	scalarHex := flag.String("scalar", "", "Recovered ephemeral X25519 scalar of the server as 32 byte hex string")
+	kexParamsPath := flag.String("kexParams", "", "Optional. If set, the parsed key exchange parameters are written to this file as json")
+	out := flag.String("out", "", "Optional. Write the decrypted packets to this file instead of stdout")
+
+	flag.Parse()
+
+	if *c2sPath == "" || *s2cPath == "" || *scalarHex == "" {
+		log.Printf("Specify \"-c2s\", \"-s2c\" and \"-scalar\"")
+		flag.PrintDefaults()
+		return
+	}
+
+	serverScalar, err := hex.DecodeString(strings.TrimPrefix(*scalarHex, "0x"))
+	if err != nil {
+		log.Printf("Failed to decode scalar : %v", err)
+		return
+	}
+
+	c2sFile, err := os.Open(*c2sPath)
+	if err != nil {
+		log.Printf("Failed to open %v : %v", *c2sPath, err)
+		return
+	}
+	defer c2sFile.Close()
+	c2sReader := bufio.NewReader(c2sFile)
+
+	s2cFile, err := os.Open(*s2cPath)
+	if err != nil {
+		log.Printf("Failed to open %v : %v", *s2cPath, err)
+		return
+	}
+	defer s2cFile.Close()
+	s2cReader := bufio.NewReader(s2cFile)
+
+	kexParams, err := ssh.ParseHandshake(c2sReader, s2cReader)
+	if err != nil {
+		log.Printf("Failed to parse handshake : %v", err)
+		return
+	}
+	log.Printf("Key exchange %v, client %q, server %q\n", kexParams.Algorithm, kexParams.ClientVersion, kexParams.ServerVersion)
+
+	if *kexParamsPath != "" {
+		rawParams, err := json.MarshalIndent(kexParams, "", "\t")
+		if err != nil {
+			log.Printf("Failed to marshal kex params : %v", err)
+			return
+		}
+		if err := ioutil.WriteFile(*kexParamsPath, rawParams, 0644); err != nil {
+			log.Printf("Failed to write kex params : %v", err)
+			return
+		}
+	}
+
+	decrypter, err := ssh.NewSessionDecrypter(kexParams, serverScalar)
+	if err != nil {
+		log.Printf("Failed to derive session keys : %v", err)
+		return
+	}
+	c2sCipher, s2cCipher := decrypter.Ciphers()
+	log.Printf("Shared secret %x\n", decrypter.SharedSecret())
+	log.Printf("Exchange hash %x\n", decrypter.ExchangeHash())
+	log.Printf("Ciphers: client to server %v, server to client %v\n", c2sCipher, s2cCipher)
+
+	var outWriter io.Writer = os.Stdout
+	if *out != "" {
+		outFile, err := os.Create(*out)
+		if err != nil {
+			log.Printf("Failed to create outfile %v : %v", *out, err)
+			return
+		}
+		defer outFile.Close()
+		bufOut := bufio.NewWriter(outFile)
+		defer bufOut.Flush()
+		outWriter = bufOut
+	}
+
+	if err := writePackets(outWriter, "c2s", c2sReader, decrypter.ReadClientPacket); err != nil {
+		log.Printf("Client to server : %v", err)
+	}
+	if err := writePackets(outWriter, "s2c", s2cReader, decrypter.ReadServerPacket); err != nil {
+		log.Printf("Server to client : %v", err)
+	}
+}
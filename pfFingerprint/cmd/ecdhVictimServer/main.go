@@ -0,0 +1,39 @@
+//Serves the Go stand-in for the ECDH dummy server. Each request performs X25519 and the reply contains the
+//private key in the "secretFromOpenSSL AA:BB:..." format expected by pfOSSLRecoverECDHKey
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"net/http"
+	"pfFingerprint/ecdhVictim"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "Listen address")
+	keyHex := flag.String("key", "", "Hex encoded X25519 private key. If empty, a new key is generated for each request")
+	swapLog := flag.Bool("swapLog", false, "Add a \"swap = x\" line for each ladder iteration to the reply")
+
+	flag.Parse()
+
+	var key []byte
+	if *keyHex != "" {
+		var err error
+		key, err = hex.DecodeString(*keyHex)
+		if err != nil {
+			log.Printf("Failed to decode key : %v", err)
+			return
+		}
+	}
+	server, err := ecdhVictim.NewServer(key, *swapLog)
+	if err != nil {
+		log.Printf("Failed to create server : %v", err)
+		return
+	}
+
+	log.Printf("Listening on %v\n", *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		log.Printf("Server failed : %v", err)
+	}
+}
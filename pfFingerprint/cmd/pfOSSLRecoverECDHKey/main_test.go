@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"io"
+	"net/http/httptest"
+	"pfFingerprint/ecdhVictim"
+	"pfFingerprint/trigger"
 	"reflect"
 	"strings"
 	"testing"
@@ -89,3 +94,59 @@ func Test_Swaphistory_To_Secret(t *testing.T) {
 	}
 
 }
+
+func Test_scalarBitsToBytes(t *testing.T) {
+	const rawSecret = "F8:FF:2D:BF:0D:D0:DB:08:50:2F:87:99:6C:4B:00:FE:57:57:9F:EB:79:B2:B0:C2:77:E9:8B:13:56:FB:F7:4C"
+	secretBits, err := parseSecretFromOpensslLog2(strings.NewReader("secretFromOpenSSL " + rawSecret))
+	if err != nil {
+		t.Fatalf("Failed to parse openssl secret : %v", err)
+	}
+	want, err := hex.DecodeString(strings.ReplaceAll(rawSecret, ":", ""))
+	if err != nil {
+		t.Fatalf("Failed to decode secret : %v", err)
+	}
+	if got := scalarBitsToBytes(secretBits); !reflect.DeepEqual(got, want) {
+		t.Errorf("scalarBitsToBytes() got = %x, want %x", got, want)
+	}
+}
+
+//Test_GroundTruthFromStandInServer triggers the stand-in ECDH server via http and checks that the scalar
+//recovered from the swap log matches the secret in the reply
+func Test_GroundTruthFromStandInServer(t *testing.T) {
+	server, err := ecdhVictim.NewServer(nil, true)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	victimTrigger, err := trigger.NewTriggerFromURI(httpServer.URL)
+	if err != nil {
+		t.Fatalf("NewTriggerFromURI() error = %v", err)
+	}
+	reply, err := victimTrigger.Execute()
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+
+	swapSequence, err := parseSecretFromOpensslLog(bytes.NewReader(reply), ecdhVictim.SwapSequenceLength)
+	if err != nil {
+		t.Fatalf("Failed to parse swap log : %v", err)
+	}
+	recoveredScalar, err := recoverScalarFromX25519Swaps(swapSequence)
+	if err != nil {
+		t.Fatalf("Failed to recover scalar from swaps : %v", err)
+	}
+
+	correctSecret, err := parseSecretFromOpensslLog2(bytes.NewReader(reply))
+	if err != nil {
+		t.Fatalf("Failed to parse secret : %v", err)
+	}
+	correctScalar, err := x25519KeyToScalar(correctSecret)
+	if err != nil {
+		t.Fatalf("Failed to convert secret to scalar : %v", err)
+	}
+	if !reflect.DeepEqual(recoveredScalar, correctScalar) {
+		t.Errorf("recovered scalar %x, want %x", scalarBitsToBytes(recoveredScalar), scalarBitsToBytes(correctScalar))
+	}
+}
@@ -0,0 +1,88 @@
+//Runs the stages of an attack pipeline, e.g. exec trace, attack and key recovery, in a work dir. Completed stages
+//are recorded with checksums of their inputs and outputs in the manifest of the work dir and skipped on a rerun,
+//so that a failed pipeline continues at the failed stage
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"pfFingerprint"
+	"pfFingerprint/pipeline"
+	"time"
+)
+
+func main() {
+	specPath := flag.String("pipeline", "openssh-eddsa", "Path of a pipeline spec or name of a builtin pipeline")
+	list := flag.Bool("list", false, "Print the builtin pipelines with their stages")
+	workDir := flag.String("workDir", ".", "Directory for all files of the pipeline and the manifest")
+	sudo := flag.String("sudo", "sudo", "Command prepended to privileged stages. Set to empty string if already running as root")
+	retries := flag.Int("retries", 0, "Additional attempts for a failed stage")
+	retryDelay := flag.Duration("retryDelay", 5*time.Second, "Pause between the attempts of a stage")
+	from := flag.String("from", "", "Run this stage and all following ones, even if they are up to date")
+	vars := pfFingerprint.KeyValueFlag{}
+	flag.Var(vars, "var", "Set a variable of the pipeline, e.g. -var cpu=2 -var triggerURI=ssh://user@localhost:2223. Repeatable")
+
+	flag.Parse()
+
+	if *list {
+		for _, name := range pipeline.BuiltinNames() {
+			spec, err := pipeline.Builtin(name)
+			if err != nil {
+				log.Printf("Invalid builtin pipeline %v : %v", name, err)
+				continue
+			}
+			fmt.Printf("%v: %v\n", spec.Name, spec.Description)
+			for _, v := range spec.Stages {
+				fmt.Printf("\t%v: %v\n", v.Name, v.Description)
+			}
+		}
+		return
+	}
+
+	spec, err := pipeline.LoadSpec(*specPath)
+	if err != nil {
+		log.Printf("Failed to load pipeline : %v", err)
+		os.Exit(1)
+	}
+
+	//privileged stages run the tools via sudo in the work dir, thus the default tools dir has to be absolute
+	if _, ok := vars["tools"]; !ok {
+		if _, declared := spec.Vars["tools"]; declared {
+			executable, err := os.Executable()
+			if err != nil {
+				log.Printf("Failed to get tools dir, set it with -var tools=path : %v", err)
+				os.Exit(1)
+			}
+			vars["tools"] = filepath.Dir(executable)
+		}
+	}
+
+	absWorkDir, err := filepath.Abs(*workDir)
+	if err != nil {
+		log.Printf("Invalid work dir : %v", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	runner := &pipeline.Runner{
+		WorkDir:    absWorkDir,
+		Vars:       vars,
+		Sudo:       *sudo,
+		Retries:    *retries,
+		RetryDelay: *retryDelay,
+		From:       *from,
+	}
+	start := time.Now()
+	if err := runner.Run(ctx, spec); err != nil {
+		log.Printf("Pipeline %v failed : %v. Rerun to continue at the failed stage", spec.Name, err)
+		os.Exit(1)
+	}
+	log.Printf("Pipeline %v done after %v\n", spec.Name, time.Since(start))
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"pfFingerprint"
+	"pfFingerprint/session"
 
 	"github.com/UzL-ITS/sev-step/sevStep"
 )
@@ -16,14 +17,22 @@ import (
 func main() {
 	gpa1 := flag.Uint64("gpa1", 0, "first gpa for toggle tracking")
 	gpa2 := flag.Uint64("gpa2", 0, "second gpa for toggle tracking")
-	trackingTypeParam := flag.String("tracking", "execute", "values: {access,execute}. Determines tracking type")
+	trackingTypeParam := flag.String("tracking", "execute", "values: "+session.TrackModeNames+". Determines tracking type")
 	writeTrackInbetween := flag.Bool("writeTrackInbetween", false, "Write track all pages between exec track toggle")
 	out := flag.String("out", "pf-log.txt", "output file")
 	ignoreCycles := flag.Int("ignoreCycles", 3, "Amount of cycles at start to ignore for write addr finding")
 	getRIP := flag.Bool("getRIP", true, "Try to get RIP for page fault events. Works only for plain VMs and debug SEV-ES VMs")
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	pollConfig, err := pollFlags.Config()
+	if err != nil {
+		log.Printf("%v", err)
+		flag.PrintDefaults()
+		return
+	}
+
 	if *gpa1 == 0 || *gpa2 == 0 {
 		log.Printf("Please set gpa1 and gpa2")
 		return
@@ -42,26 +51,28 @@ func main() {
 	outWriter := bufio.NewWriter(outFile)
 	defer outWriter.Flush()
 
-	var trackingType sevStep.PageTrackMode
-	if *trackingTypeParam == "access" {
-		trackingType = sevStep.PageTrackAccess
-	} else if *trackingTypeParam == "execute" {
-		trackingType = sevStep.PageTrackExec
-	} else {
-		log.Printf("Please set valid value for \"tracking\" param\n")
+	trackingType, err := session.ParseTrackMode(*trackingTypeParam)
+	if err != nil {
+		log.Printf("Please set valid value for \"tracking\" param : %v\n", err)
 		flag.PrintDefaults()
 		return
 	}
 
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", *getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Printf("Failed to open tracking session : %v", err)
+		return
 	}
-	defer ioctlAPI.Close()
+	defer ioctlAPI.Cleanup()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	eventSource := pfFingerprint.NewEventSource(ioctlAPI, pollConfig)
+	defer func() {
+		log.Printf("Event polling : %v\n", eventSource.Stats())
+	}()
+
 	log.Printf("Tracking start page 0x%016x\n", *gpa1)
 	if err := ioctlAPI.CmdTrackPage(*gpa1, trackingType); err != nil {
 		log.Printf("failed to track %x : %v", *gpa1, err)
@@ -72,9 +83,9 @@ func main() {
 	inCycle := false
 	cycleLog := make([]uint64, 0)
 	for {
-		ev, err := pfFingerprint.WaitForEventBlocking(ctx, ioctlAPI)
+		ev, err := eventSource.Next(ctx)
 		if err != nil {
-			log.Printf("WaitForEventBlocking failed : %v", err)
+			log.Printf("Waiting for event failed : %v", err)
 			return
 		}
 
@@ -8,9 +8,9 @@ import (
 	"flag"
 	"fmt"
 	"math"
+	"pfFingerprint/metrics"
+	"pfFingerprint/session"
 	"pfFingerprint/trigger"
-	"strconv"
-	"strings"
 
 	"github.com/UzL-ITS/sev-step/sevStep"
 
@@ -22,51 +22,25 @@ import (
 	"time"
 )
 
-//initTracking if allowList != nil only the gpas in the list are tracked, otherwise all pages are tracked
-func initTracking(ioctlAPI *sevStep.IoctlAPI, allowList []uint64, trackType sevStep.PageTrackMode, findWrite bool) error {
-	if allowList == nil {
-		if findWrite {
-			log.Printf("Doing additional write track")
-			if err := ioctlAPI.CmdTrackAllPages(sevStep.PageTrackWrite); err != nil {
-				return fmt.Errorf("CmdTrackAllPages write failed : %v", err)
-			}
-		}
-
-		log.Printf("Tracking all pages\n")
-		if err := ioctlAPI.CmdTrackAllPages(trackType); err != nil {
-			return fmt.Errorf("CmdTrackAllPages failed : %v", err)
-		}
-
-		return nil
-	}
-
-	log.Printf("tracking the %v pages from allowList\n", len(allowList))
-	for _, gpa := range allowList {
-		if err := ioctlAPI.CmdTrackPage(gpa, trackType); err != nil {
-			return fmt.Errorf("CmdTrackPage failed : %v", err)
-		}
-	}
-
-	return nil
-}
-
-func isWriteErr(code uint32) bool {
-	return code == 0x7
-}
-
 func main() {
 
-	triggerURI := flag.String("triggerURI", "http://localhost:8080", "Either http://someAddress:port or ssh://someHost:port")
+	triggerURI := flag.String("triggerURI", "http://localhost:8080", "One of http://someAddress:port, ssh://user@someHost:port?hostKeyAlgo=ssh-ed25519, tls://someHost:port, tcp://someHost:port?payload=data or exec:/path/to/victim?arg=value. Run listTriggers for all schemes and options")
 	out := flag.String("out", "pf-log.txt", "path to write page fault events to")
-	trackingTypeParam := flag.String("tracking", "access", "values: {access,execute}. Determines tracking type")
+	trackingTypeParam := flag.String("tracking", "access", "values: "+session.TrackModeNames+". Determines tracking type")
 	format := flag.String("format", "plain", "{plain,json}, format event output")
 	retrack := flag.Bool("retrack", true, "re-track pages")
 	allowListPath := flag.String("allowList", "", "only track pages from this list")
+	denyListPath := flag.String("denyList", "", "Never track or re-track the pages from this list, e.g. the kernel pages found by classifyKernelPages. Works without RIP info")
 	iterations := flag.Uint("iterations", 0, "Iterations for tracking If set to 0 iterations are starting by pressing enter")
 	findWrite := flag.Bool("findWrite", false, "also do write tracking to find buffer location")
-	simExcludeKernelSpace := flag.Bool("simExcludeKernelSpace", false, "Simulate Kernel space exclusion by filtering based on RIP")
+	simExcludeKernelSpace := flag.Bool("simExcludeKernelSpace", false, "Simulate Kernel space exclusion by filtering based on RIP. Same as adding kernelRIP to retrackPolicy")
+	retrackPolicy := flag.String("retrackPolicy", "", "Comma separated list of "+session.RetrackPolicyNames+". Pages are only re-tracked if all policies agree. Defaults to always with getRIP and instr otherwise")
 	cpu := flag.Int("cpu", -1, "Test parameter for perf readings. If set, guest must be pinned to this virtual cpu")
 	getRIP := flag.Bool("getRIP", true, "Try to get RIP for page fault events. Works only for plain VMs and debug SEV-ES VMs")
+	triggerTimeout := flag.Duration("triggerTimeout", 0, "Abort the victim trigger after this duration. 0 means no timeout")
+	prepareFlags := trigger.RegisterPrepareFlags(flag.CommandLine)
+	pollFlags := pfFingerprint.RegisterPollFlags(flag.CommandLine)
+	metricsFlags := metrics.RegisterFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -75,42 +49,61 @@ func main() {
 		log.Printf("Failed to parse triggerURI :%v", err)
 		return
 	}
+	prepareOpts, err := prepareFlags.Options(*triggerURI)
+	if err != nil {
+		log.Printf("Invalid trigger preparation flags : %v", err)
+		return
+	}
+	ctxTrigger, err := trigger.NewPreparedTrigger(trigger.AsContextTriggerer(victimTrigger), prepareOpts)
+	if err != nil {
+		log.Printf("Invalid trigger preparation flags : %v", err)
+		return
+	}
 
-	var allowList []uint64 = nil
-	if *allowListPath != "" {
-		allowListFile, err := os.Open(*allowListPath)
-		if err != nil {
-			log.Fatalf("Failed to open allow list file : %v\n", err)
-		}
-		defer allowListFile.Close()
-		sc := bufio.NewScanner(allowListFile)
-		sc.Split(bufio.ScanLines)
-		allowList = make([]uint64, 0)
-		for sc.Scan() {
-			line := sc.Text()
-			line = strings.Trim(line, " \n")
-
-			gpa, err := strconv.ParseUint(line, 0, 64)
-			if err != nil {
-				log.Fatalf("Failed to parse allow list entry %v : %v\n", line, err)
-			}
-			allowList = append(allowList, gpa)
-		}
-		if err := sc.Err(); err != nil {
-			log.Fatalf("allowList scanner error : %v", err)
+	allowList, err := session.LoadAllowList(*allowListPath)
+	if err != nil {
+		log.Printf("Failed to load allow list : %v", err)
+		return
+	}
+	denyList, err := session.LoadAllowList(*denyListPath)
+	if err != nil {
+		log.Printf("Failed to load deny list : %v", err)
+		return
+	}
+	allowList = session.FilterDenied(allowList, denyList)
+
+	trackType, err := session.ParseTrackMode(*trackingTypeParam)
+	if err != nil {
+		log.Printf("Please set valid value for \"tracking\" param : %v\n", err)
+		flag.PrintDefaults()
+		return
+	}
+
+	if *retrackPolicy == "" {
+		*retrackPolicy = "instr"
+		if *getRIP {
+			*retrackPolicy = "always"
 		}
 	}
+	if *simExcludeKernelSpace {
+		*retrackPolicy += ",kernelRIP"
+	}
+	retrackPolicies, err := session.ParseRetrackPolicies(*retrackPolicy)
+	if err != nil {
+		log.Printf("Please set valid value for \"retrackPolicy\" param : %v\n", err)
+		flag.PrintDefaults()
+		return
+	}
+	if denyList != nil {
+		//with tracking all pages, the denied pages fault once but are never re-tracked
+		retrackPolicies = append(retrackPolicies, session.NewKernelGPAPolicy(denyList))
+		log.Printf("Denying %v pages\n", len(denyList))
+	}
+	log.Printf("Retrack policies %v\n", *retrackPolicy)
 
-	var trackType sevStep.PageTrackMode
-	switch *trackingTypeParam {
-	case "access":
-		trackType = sevStep.PageTrackAccess
-	case "execute":
-		trackType = sevStep.PageTrackExec
-	case "write":
-		trackType = sevStep.PageTrackWrite
-	default:
-		log.Printf("Please set valid value for \"tracking\" param\n")
+	pollConfig, err := pollFlags.Config()
+	if err != nil {
+		log.Printf("%v", err)
 		flag.PrintDefaults()
 		return
 	}
@@ -134,12 +127,23 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	registry := metrics.NewRegistry()
+	runMetrics := pfFingerprint.NewRunMetrics(registry)
+	runMetrics.WatchWriter(outWriter, &outWriterLock)
+	if err := metricsFlags.Serve(ctx, registry); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
 	log.Printf("getRIP? %v\n", *getRIP)
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", *getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Printf("Failed to open tracking session : %v", err)
+		return
 	}
-	defer ioctlAPI.Close()
+	defer ioctlAPI.Cleanup()
+	ioctlAPI.CloseOnDone(ctx)
+	ioctlAPI.RegisterMetrics(registry)
 
 	if *cpu != -1 {
 		if err := ioctlAPI.CmdSetupRetInstrPerf(*cpu); err != nil {
@@ -148,16 +152,19 @@ func main() {
 		}
 	}
 
-	eventChan := pfFingerprint.OpenEventChannel(ctx, ioctlAPI)
+	eventSource := pfFingerprint.NewEventSource(ioctlAPI, pollConfig)
+	eventChan := eventSource.Events(ctx)
 	wg := sync.WaitGroup{}
 
-	retrackBacklog := make([]*sevStep.Event, 0)
+	retrackBacklog := session.NewRetrackBacklog(trackType, *findWrite, retrackPolicies...)
+	retrackBacklog.RegisterMetrics(registry)
 
 	//print events
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer cancel()
+		defer ioctlAPI.CloseOnPanic()
 		eventCounter := 0
 		defer func() {
 			log.Printf("Processed %v events\n", eventCounter)
@@ -223,50 +230,18 @@ func main() {
 					return
 				}
 				outWriterLock.Unlock()
+				runMetrics.EventsWritten.Inc()
 
-				//re-track logic
-
-				//hack: to exclude kernel space in test filter out
-				// e.RIP < 0xffff800000000000
-
-				if *retrack && (!(*simExcludeKernelSpace) || e.RIP < 0xffff800000000000) {
-					outWriterLock.Lock()
-					if len(retrackBacklog) > 0 {
-
-						var progressSinceLastFault bool
-						if !(*getRIP) {
-
-							progressSinceLastFault = retiredInstrSinceLastFault > 2
-							//log.Printf("Retired instructions since last fault : %v", retiredInstrSinceLastFaul)
-						} else {
-							//lastElem := retrackBacklog[len(retrackBacklog)-1]
-							progressSinceLastFault = true //lastElem.RIP != e.RIP
-						}
-
-						//if true, re-track elements and clear backlog, RIP chain broken
-						if progressSinceLastFault {
-							//log.Printf("Retracking %v elems in total\n", len(retrackBacklog))
-							for _, v := range retrackBacklog {
-								//log.Printf("Retracking %v\n",v)
-
-								//retrack write faults as write, everything else as default trackType
-								retrackType := trackType
-								if *findWrite && isWriteErr(v.ErrorCode) {
-									log.Printf("Retracking 0x%x as write\n", v.FaultedGPA)
-									retrackType = sevStep.PageTrackWrite
-								}
-								if err := ioctlAPI.CmdTrackPage(v.FaultedGPA, retrackType); err != nil {
-									log.Printf("Failed to retrack %x :%vn", v, err)
-									outWriterLock.Unlock()
-									return
-								}
-							}
-							retrackBacklog = retrackBacklog[:0]
-						}
+				if *retrack {
+					fault := session.Fault{
+						Event:          e,
+						InstrDelta:     uint64(retiredInstrSinceLastFault),
+						HaveInstrDelta: *cpu != -1,
+					}
+					if err := retrackBacklog.PushFault(ioctlAPI, fault); err != nil {
+						log.Printf("Retracking failed : %v\n", err)
+						return
 					}
-					retrackBacklog = append(retrackBacklog, e)
-					outWriterLock.Unlock()
-
 				}
 
 				if err := ioctlAPI.CmdAckEvent(e.ID); err != nil {
@@ -283,6 +258,7 @@ func main() {
 	go func() {
 		defer wg.Done()
 		defer cancel()
+		defer ioctlAPI.CloseOnPanic()
 		var haveNextRound func() bool
 		abort := false
 
@@ -315,6 +291,12 @@ func main() {
 			default:
 			}
 
+			//wait for victim, warm-up and pacing must happen before tracking starts
+			if err := ctxTrigger.Prepare(ctx); err != nil {
+				log.Printf("Failed to prepare victim trigger : %v", err)
+				return
+			}
+
 			//write measurement start header to log file
 			outWriterLock.Lock()
 			if _, err := outWriter.WriteString(fmt.Sprintf("Start %v\n", time.Now().Format(time.StampNano))); err != nil {
@@ -324,25 +306,30 @@ func main() {
 			}
 			outWriterLock.Unlock()
 
-			outWriterLock.Lock()
-			retrackBacklog = retrackBacklog[:0]
-			outWriterLock.Unlock()
+			retrackBacklog.Reset()
 
 			log.Printf("Initialize tracking\n")
-			if err := initTracking(ioctlAPI, allowList, trackType, *findWrite); err != nil {
+			if err := ioctlAPI.InitTracking(allowList, trackType, *findWrite); err != nil {
 				log.Printf("initTracking failed : %v", err)
 				return
 			}
 
 			log.Printf("Triggering Victim")
-			if _, err := victimTrigger.Execute(); err != nil {
+			triggerResult, err := trigger.ExecuteWithTimeout(ctx, ctxTrigger, *triggerTimeout)
+			if err != nil {
 				log.Printf("Failed to execute victim trigger : %v", err)
 				return
 			}
-			log.Printf("Victim done\n")
+			log.Printf("Victim done after %v\n", triggerResult.Latency())
+			runMetrics.TriggerDuration.ObserveDuration(triggerResult.Latency())
 
-			//write measurement done trailer to log file
+			//write trigger timing and measurement done trailer to log file
 			outWriterLock.Lock()
+			if _, err := outWriter.WriteString(triggerResult.TimingLine()); err != nil {
+				log.Printf("Failed to write trigger timing : %v", err)
+				outWriterLock.Unlock()
+				return
+			}
 			if _, err := outWriter.WriteString(fmt.Sprintf("Stop %v\n", time.Now().Format(time.StampNano))); err != nil {
 				log.Printf("Failed to write start of ecdh event : %v", err)
 				outWriterLock.Unlock()
@@ -365,5 +352,11 @@ func main() {
 	}()
 
 	wg.Wait()
+	log.Printf("Event polling : %v\n", eventSource.Stats())
+	if *retrack {
+		for _, v := range retrackBacklog.Stats() {
+			log.Printf("Retrack policy %v\n", v)
+		}
+	}
 
 }
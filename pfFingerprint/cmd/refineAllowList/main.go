@@ -0,0 +1,172 @@
+//Builds a stable allow list by repeatedly tracing the victim with the current list and keeping only the pages
+//that are present in (most of) the new runs. Automates the manual loop of pfBatchTraceGenerator and
+//buildAllowList. All arguments after "--" are passed to the tracer, e.g.
+//refineAllowList -runs 10 -- -triggerURI tcp://localhost:8080 -cpu 1
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"pfFingerprint/allowlist"
+	"pfFingerprint/session"
+)
+
+//writeList writes list to path, using a temporary file so that an abort does not leave a truncated list
+func writeList(path string, list map[uint64]bool) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %v : %v", tmpPath, err)
+	}
+	if err := allowlist.Write(f, list); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close %v : %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace %v : %v", path, err)
+	}
+	return nil
+}
+
+//trace runs the tracer for one round and returns the page sets of its runs. The tracer exits successfully on most
+//errors, so a round only succeeds if the tracer wrote a new trace
+func trace(ctx context.Context, tracer string, tracerArgs []string, runs uint, listPath, tracePath string, excludeKernel bool) ([]map[uint64]bool, error) {
+	//our flags come last, so that they override values in tracerArgs
+	args := append([]string{}, tracerArgs...)
+	args = append(args, "-iterations", fmt.Sprintf("%v", runs), "-format", "json", "-out", tracePath)
+	if listPath != "" {
+		args = append(args, "-allowList", listPath)
+	}
+	//a trace of an earlier invocation in the same work dir must not pass as the result of this round
+	if err := os.Remove(tracePath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old trace : %v", err)
+	}
+	log.Printf("Running %v %v\n", tracer, args)
+	cmd := exec.CommandContext(ctx, tracer, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("tracer failed : %v", err)
+	}
+
+	traceFile, err := os.Open(tracePath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("tracer did not write a trace, see its log")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace : %v", err)
+	}
+	defer traceFile.Close()
+	eventsByRun, err := allowlist.ParseRuns(traceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse trace : %v", err)
+	}
+	//the tracer creates the trace before it starts tracking
+	if len(eventsByRun) == 0 {
+		return nil, fmt.Errorf("trace contains no runs, see the log of the tracer")
+	}
+	if uint(len(eventsByRun)) != runs {
+		log.Printf("Requested %v runs but trace contains %v\n", runs, len(eventsByRun))
+	}
+	return allowlist.RunSets(eventsByRun, excludeKernel), nil
+}
+
+func main() {
+	tracer := flag.String("tracer", "./pfBatchTraceGenerator", "Trace generator to run in each round. Must support the -iterations, -format, -out and -allowList flags")
+	initialListPath := flag.String("allowList", "", "Allow list for the first round. If not set, the first round tracks all pages")
+	out := flag.String("out", "allow-list.txt", "path for the final allow list. Updated after every round")
+	statsOut := flag.String("statsOut", "allow-list-stats.txt", "path for the per page presence statistics")
+	workDir := flag.String("workDir", "refine-rounds", "directory for the traces and allow lists of each round")
+	runs := flag.Uint("runs", 10, "Victim executions per round")
+	maxRounds := flag.Int("maxRounds", 10, "Stop after this many rounds, even if the list is not stable")
+	stableRounds := flag.Int("stableRounds", 2, "Stop once the list did not shrink for this many consecutive rounds")
+	minPresence := flag.Float64("minPresence", 100, "Keep pages that are present in at least this percentage of the runs of a round. 100 is the strict intersection")
+	excludeKernel := flag.Bool("excludeKernel", false, "Exclude kernel space rips")
+
+	flag.Parse()
+
+	if *runs == 0 {
+		log.Printf("Please set valid value for \"runs\" param\n")
+		flag.PrintDefaults()
+		return
+	}
+
+	initialList, err := session.LoadAllowList(*initialListPath)
+	if err != nil {
+		log.Printf("Failed to load allow list : %v", err)
+		return
+	}
+	refiner, err := allowlist.NewRefiner(initialList, *minPresence/100, *stableRounds)
+	if err != nil {
+		log.Printf("Invalid refinement flags : %v", err)
+		flag.PrintDefaults()
+		return
+	}
+
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		log.Printf("Failed to create work dir : %v", err)
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	done := false
+	for round := 0; round < *maxRounds && !done; round++ {
+		listPath := ""
+		if refiner.List() != nil {
+			listPath = filepath.Join(*workDir, fmt.Sprintf("round-%v-allow-list.txt", round))
+			if err := writeList(listPath, refiner.List()); err != nil {
+				log.Printf("Failed to write allow list of round %v : %v", round, err)
+				return
+			}
+		}
+		tracePath := filepath.Join(*workDir, fmt.Sprintf("round-%v-trace.txt", round))
+
+		log.Printf("Round %v\n", round)
+		runSets, err := trace(ctx, *tracer, flag.Args(), *runs, listPath, tracePath, *excludeKernel)
+		if err != nil {
+			log.Printf("Round %v failed : %v", round, err)
+			return
+		}
+		var reason string
+		done, reason, err = refiner.Round(runSets)
+		if err != nil {
+			log.Printf("Round %v failed : %v", round, err)
+			return
+		}
+		log.Printf("Round %v: allow list has %v pages\n", round, len(refiner.List()))
+
+		if err := writeList(*out, refiner.List()); err != nil {
+			log.Printf("Failed to write allow list : %v", err)
+			return
+		}
+		if done {
+			log.Printf("Done after %v rounds : %v\n", refiner.Rounds(), reason)
+		}
+	}
+	if !done {
+		log.Printf("Allow list not stable after %v rounds\n", refiner.Rounds())
+	}
+
+	statsFile, err := os.Create(*statsOut)
+	if err != nil {
+		log.Printf("Failed to create stats file : %v", err)
+		return
+	}
+	defer statsFile.Close()
+	if err := refiner.WriteStats(statsFile); err != nil {
+		log.Printf("Failed to write stats : %v", err)
+		return
+	}
+	log.Printf("Final allow list with %v pages written to %v\n", len(refiner.List()), *out)
+}
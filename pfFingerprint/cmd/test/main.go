@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"pfFingerprint/session"
 	"time"
-
-	"github.com/UzL-ITS/sev-step/sevStep"
 )
 
 func main() {
@@ -18,18 +20,21 @@ func main() {
 		log.Fatalf("Set cpu")
 	}
 
-	ioctlAPI, err := sevStep.NewIoctlAPI("/dev/kvm", *getRIP)
+	ioctlAPI, err := session.Open("/dev/kvm", *getRIP)
 	if err != nil {
-		log.Fatalf("Failed to init ioctl API : %v", err)
+		log.Fatalf("Failed to open tracking session : %v", err)
 	}
-	defer ioctlAPI.Close()
+	defer ioctlAPI.Cleanup()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ioctlAPI.CloseOnDone(ctx)
 
 	if err := ioctlAPI.CmdSetupRetInstrPerf(*cpu); err != nil {
 		log.Printf("Failed to setup perf : %v", err)
 		return
 	}
 
-	for i := 0; i < 5; i++ {
+	for i := 0; i < 5 && ctx.Err() == nil; i++ {
 		time.Sleep(2 * time.Second)
 		reading, err := ioctlAPI.CmdReadRetInstrPerf(*cpu)
 		if err != nil {
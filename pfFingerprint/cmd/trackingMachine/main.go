@@ -0,0 +1,122 @@
+//Validates tracking state machine specs, renders them as Graphviz graphs and replays recorded page fault traces
+//through them without a VM
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"pfFingerprint"
+	"pfFingerprint/trackingMachine"
+	"strconv"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+func main() {
+	specPath := flag.String("spec", "", "Path of the spec or name of a builtin spec")
+	list := flag.Bool("list", false, "Print the names of the builtin specs")
+	dotOut := flag.String("dot", "", "Write the spec as Graphviz graph to this path")
+	dryRun := flag.String("dryRun", "", "Replay this page fault trace through the machine and print the transitions")
+	pages := pfFingerprint.KeyValueFlag{}
+	flag.Var(pages, "page", "Bind an input page for \"-dryRun\", e.g. -page fe64=0x1234000. Repeatable")
+	values := pfFingerprint.KeyValueFlag{}
+	flag.Var(values, "value", "Override a value of the spec for \"-dryRun\", e.g. -value ignoreCycles=2. Repeatable")
+
+	flag.Parse()
+
+	if *list {
+		for _, v := range trackingMachine.BuiltinNames() {
+			fmt.Println(v)
+		}
+		return
+	}
+	if *specPath == "" {
+		log.Printf("Please set \"-spec\"")
+		flag.PrintDefaults()
+		return
+	}
+
+	spec, err := trackingMachine.LoadSpec(*specPath)
+	if err != nil {
+		log.Printf("Failed to load spec : %v", err)
+		os.Exit(1)
+	}
+	log.Printf("Spec %v is valid", spec.Name)
+
+	if *dotOut != "" {
+		if err := writeDot(*dotOut, spec); err != nil {
+			log.Printf("Failed to write graph : %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if *dryRun != "" {
+		opts := trackingMachine.Options{
+			Pages:  make(map[string]uint64),
+			Values: make(map[string]int),
+		}
+		for name, v := range pages {
+			gpa, err := strconv.ParseUint(v, 0, 64)
+			if err != nil {
+				log.Printf("Failed to parse page %v : %v", name, err)
+				os.Exit(1)
+			}
+			opts.Pages[name] = gpa
+		}
+		for name, v := range values {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				log.Printf("Failed to parse value %v : %v", name, err)
+				os.Exit(1)
+			}
+			opts.Values[name] = i
+		}
+		if err := replay(*dryRun, spec, opts, os.Stdout); err != nil {
+			log.Printf("Dry run failed : %v", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func writeDot(path string, spec *trackingMachine.Spec) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := trackingMachine.WriteDot(f, spec); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//replay runs the dry run with the events from the trace file and prints a summary
+func replay(tracePath string, spec *trackingMachine.Spec, opts trackingMachine.Options, w io.Writer) error {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return fmt.Errorf("failed to open trace : %v", err)
+	}
+	defer f.Close()
+	events, err := sevStep.ParseInputFile(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("failed to parse trace : %v", err)
+	}
+
+	m, err := trackingMachine.DryRun(spec, opts, events, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "final state %v, emitted %v of %v events\n", m.State(), len(m.Events()), len(events))
+	for _, v := range spec.Pages {
+		if gpa, ok := m.Page(v.Name); ok {
+			fmt.Fprintf(w, "page %v = %x\n", v.Name, gpa)
+		} else {
+			fmt.Fprintf(w, "page %v not bound\n", v.Name)
+		}
+	}
+	return nil
+}
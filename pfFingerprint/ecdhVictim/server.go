@@ -0,0 +1,139 @@
+//Package ecdhVictim is a stand-in for the ECDH dummy server that runs inside the VM. It performs X25519 and replies
+//in the same format, so that pfOSSLAttackECDH and pfOSSLRecoverECDHKey can be exercised without a VM
+package ecdhVictim
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+//SecretMarker starts the reply line with the private key, see FormatSecret
+const SecretMarker = "secretFromOpenSSL"
+
+//SwapSequenceLength is the number of iterations of the montgomery ladder in OpenSSL's x25519_scalar_mult
+const SwapSequenceLength = 255
+
+//Server answers each HTTP request by performing X25519 with its private key and a fresh peer key
+type Server struct {
+	//Key is the private key. If nil, a new key is generated for each request
+	Key []byte
+	//SwapLog adds the cswap condition of each ladder iteration to the reply, as printed by a debug build of OpenSSL
+	SwapLog bool
+	//Rand is the source for generated keys. If nil, crypto/rand is used
+	Rand io.Reader
+}
+
+//NewServer creates a server with the fixed private key. If key is nil, a new key is generated for each request
+func NewServer(key []byte, swapLog bool) (*Server, error) {
+	if key != nil && len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("key must have length %v, got %v", curve25519.ScalarSize, len(key))
+	}
+	return &Server{
+		Key:     key,
+		SwapLog: swapLog,
+	}, nil
+}
+
+//GenerateKey generates a private key and clamps it, like OpenSSL does on key generation
+func GenerateKey(random io.Reader) ([]byte, error) {
+	key := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(random, key); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes : %v", err)
+	}
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+	return key, nil
+}
+
+//FormatSecret formats key like the OpenSSL debug output, i.e. as colon separated upper case hex bytes
+func FormatSecret(key []byte) string {
+	tokens := make([]string, len(key))
+	for i, v := range key {
+		tokens[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(tokens, ":")
+}
+
+//SwapSequence returns the cswap condition of each iteration of the montgomery ladder for the clamped key.
+//Entry i belongs to bit i of the scalar and is the xor of the bits i and i+1. The ladder starts at bit 254,
+//so the log contains the entries in descending order
+func SwapSequence(key []byte) []byte {
+	scalar := make([]byte, len(key))
+	copy(scalar, key)
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+
+	bit := func(pos int) byte {
+		return (scalar[pos/8] >> (pos % 8)) & 1
+	}
+	swaps := make([]byte, SwapSequenceLength)
+	//bit 255 is always zero
+	prev := byte(0)
+	for pos := SwapSequenceLength - 1; pos >= 0; pos-- {
+		b := bit(pos)
+		swaps[pos] = prev ^ b
+		prev = b
+	}
+	return swaps
+}
+
+func (s *Server) random() io.Reader {
+	if s.Rand != nil {
+		return s.Rand
+	}
+	return rand.Reader
+}
+
+//Exchange performs X25519 between the private key of the server and a fresh peer key. Returns the private key
+//that was used and the reply
+func (s *Server) Exchange() ([]byte, string, error) {
+	key := s.Key
+	if key == nil {
+		var err error
+		if key, err = GenerateKey(s.random()); err != nil {
+			return nil, "", fmt.Errorf("failed to generate key : %v", err)
+		}
+	}
+	peerKey, err := GenerateKey(s.random())
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate peer key : %v", err)
+	}
+	peerPublic, err := curve25519.X25519(peerKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compute peer public key : %v", err)
+	}
+	//this is the victim operation
+	if _, err := curve25519.X25519(key, peerPublic); err != nil {
+		return nil, "", fmt.Errorf("failed to compute shared secret : %v", err)
+	}
+
+	reply := &strings.Builder{}
+	if s.SwapLog {
+		swaps := SwapSequence(key)
+		for pos := SwapSequenceLength - 1; pos >= 0; pos-- {
+			fmt.Fprintf(reply, "swap = %v\n", swaps[pos])
+		}
+	}
+	fmt.Fprintf(reply, "%s %s\n", SecretMarker, FormatSecret(key))
+	return key, reply.String(), nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, reply, err := s.Exchange()
+	if err != nil {
+		log.Printf("ECDH failed : %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.WriteString(w, reply); err != nil {
+		log.Printf("Failed to write reply : %v", err)
+	}
+}
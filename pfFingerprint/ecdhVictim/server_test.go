@@ -0,0 +1,99 @@
+package ecdhVictim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSwapSequence(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		key, err := GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey() error = %v", err)
+		}
+		swaps := SwapSequence(key)
+		if len(swaps) != SwapSequenceLength {
+			t.Fatalf("got %v swaps, want %v", len(swaps), SwapSequenceLength)
+		}
+		//undo the xor chain, starting at the always zero bit 255
+		recovered := make([]byte, len(key))
+		prev := byte(0)
+		for pos := SwapSequenceLength - 1; pos >= 0; pos-- {
+			b := prev ^ swaps[pos]
+			recovered[pos/8] |= b << (pos % 8)
+			prev = b
+		}
+		if !bytes.Equal(recovered, key) {
+			t.Errorf("recovered %x from swaps, want %x", recovered, key)
+		}
+	}
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	key, err := hex.DecodeString("f8ff2dbf0dd0db08502f87996c4b00fe57579feb79b2b0c277e98b1356fbf74c")
+	if err != nil {
+		t.Fatalf("failed to decode key : %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		key       []byte
+		swapLog   bool
+		wantLines int
+	}{
+		{"fixed key", key, false, 1},
+		{"fixed key with swap log", key, true, SwapSequenceLength + 1},
+		{"random key", nil, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewServer(tt.key, tt.swapLog)
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+
+			replies := make([]string, 2)
+			for i := range replies {
+				resp, err := http.Get(httpServer.URL)
+				if err != nil {
+					t.Fatalf("request failed : %v", err)
+				}
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("failed to read reply : %v", err)
+				}
+				replies[i] = string(body)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(replies[0], "\n"), "\n")
+			if len(lines) != tt.wantLines {
+				t.Fatalf("got %v lines, want %v", len(lines), tt.wantLines)
+			}
+			if tt.swapLog && lines[0] != "swap = 1" {
+				t.Errorf("got first swap line %q, want %q", lines[0], "swap = 1")
+			}
+			secretLine := lines[len(lines)-1]
+			if tt.key != nil && secretLine != "secretFromOpenSSL F8:FF:2D:BF:0D:D0:DB:08:50:2F:87:99:6C:4B:00:FE:57:57:9F:EB:79:B2:B0:C2:77:E9:8B:13:56:FB:F7:4C" {
+				t.Errorf("got secret line %q", secretLine)
+			}
+			if sameKey := replies[0] == replies[1]; sameKey != (tt.key != nil) {
+				t.Errorf("replies of two requests equal? %v, want %v", sameKey, tt.key != nil)
+			}
+		})
+	}
+}
+
+func TestNewServer_InvalidKey(t *testing.T) {
+	if _, err := NewServer([]byte{1, 2, 3}, false); err == nil {
+		t.Errorf("NewServer() accepted short key")
+	}
+}
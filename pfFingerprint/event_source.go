@@ -0,0 +1,319 @@
+package pfFingerprint
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//PollConfig tunes the adaptive polling of an EventSource. While waiting for an event, the source first polls
+//SpinPolls times without pause, then YieldPolls times while yielding the processor in between and afterwards
+//sleeps between polls, starting with MinSleep and doubling up to MaxSleep. Spinning gives the lowest latency
+//but keeps a host core busy, which hurts if it shares the core with the pinned vCPU
+type PollConfig struct {
+	//SpinPolls < 0 spins forever, like the old busy polling
+	SpinPolls  int
+	YieldPolls int
+	MinSleep   time.Duration
+	MaxSleep   time.Duration
+	//BatchSize is the maximal number of events delivered at once by EventSource.Batches
+	BatchSize int
+}
+
+//DefaultPollConfig spins for a few microseconds, which covers the fault rate of toggle tracking, and
+//backs off to sub millisecond sleeps for idle phases
+func DefaultPollConfig() PollConfig {
+	return PollConfig{
+		SpinPolls:  10000,
+		YieldPolls: 1000,
+		MinSleep:   5 * time.Microsecond,
+		MaxSleep:   500 * time.Microsecond,
+		BatchSize:  64,
+	}
+}
+
+//BusyPollConfig never yields or sleeps
+func BusyPollConfig() PollConfig {
+	return PollConfig{SpinPolls: -1, BatchSize: 64}
+}
+
+//Validate checks for consistent thresholds
+func (c PollConfig) Validate() error {
+	if c.YieldPolls < 0 {
+		return fmt.Errorf("negative yield polls %v", c.YieldPolls)
+	}
+	if c.SpinPolls >= 0 && c.MinSleep <= 0 {
+		return fmt.Errorf("min sleep has to be positive, if the source does not spin forever")
+	}
+	if c.MaxSleep < c.MinSleep {
+		return fmt.Errorf("max sleep %v is smaller than min sleep %v", c.MaxSleep, c.MinSleep)
+	}
+	if c.BatchSize < 1 {
+		return fmt.Errorf("batch size has to be at least 1, got %v", c.BatchSize)
+	}
+	return nil
+}
+
+//PollFlags holds the flags defined by RegisterPollFlags
+type PollFlags struct {
+	busy       *bool
+	spinPolls  *int
+	yieldPolls *int
+	minSleep   *time.Duration
+	maxSleep   *time.Duration
+}
+
+//RegisterPollFlags defines the flags to tune the event polling on fs
+func RegisterPollFlags(fs *flag.FlagSet) *PollFlags {
+	def := DefaultPollConfig()
+	return &PollFlags{
+		busy:       fs.Bool("pollBusy", false, "Busy poll for events without ever yielding the cpu. Lowest latency, but keeps a host core at 100%"),
+		spinPolls:  fs.Int("pollSpin", def.SpinPolls, "Number of event polls without pause before yielding the cpu"),
+		yieldPolls: fs.Int("pollYield", def.YieldPolls, "Number of event polls with yielding the cpu before sleeping"),
+		minSleep:   fs.Duration("pollMinSleep", def.MinSleep, "First sleep between event polls after spinning and yielding"),
+		maxSleep:   fs.Duration("pollMaxSleep", def.MaxSleep, "Upper limit for the exponentially growing sleep between event polls"),
+	}
+}
+
+//Config converts the flag values to a PollConfig
+func (f *PollFlags) Config() (PollConfig, error) {
+	if *f.busy {
+		return BusyPollConfig(), nil
+	}
+	c := DefaultPollConfig()
+	c.SpinPolls = *f.spinPolls
+	c.YieldPolls = *f.yieldPolls
+	c.MinSleep = *f.minSleep
+	c.MaxSleep = *f.maxSleep
+	if err := c.Validate(); err != nil {
+		return PollConfig{}, fmt.Errorf("invalid poll flags : %v", err)
+	}
+	return c, nil
+}
+
+//PollStats are the counters of an EventSource
+type PollStats struct {
+	Polls      uint64
+	EmptyPolls uint64
+	Events     uint64
+	Yields     uint64
+	Sleeps     uint64
+	SleepTime  time.Duration
+	//WaitTime is the summed time from starting to wait until receiving an event, MaxWait the longest of these
+	WaitTime time.Duration
+	MaxWait  time.Duration
+	//Elapsed is the time since the source has been created. CPUTime is the user and system time
+	//of the whole process in this period
+	Elapsed time.Duration
+	CPUTime time.Duration
+}
+
+//MeanWait returns the average time to receive an event
+func (p PollStats) MeanWait() time.Duration {
+	if p.Events == 0 {
+		return 0
+	}
+	return p.WaitTime / time.Duration(p.Events)
+}
+
+//CPUUsage returns the used cpu time relative to the elapsed time. 1 means one fully used core
+func (p PollStats) CPUUsage() float64 {
+	if p.Elapsed == 0 {
+		return 0
+	}
+	return float64(p.CPUTime) / float64(p.Elapsed)
+}
+
+func (p PollStats) String() string {
+	return fmt.Sprintf("%v events, %v polls (%v empty), %v yields, %v sleeps (%v), mean wait %v, max wait %v, cpu usage %.1f%% over %v",
+		p.Events, p.Polls, p.EmptyPolls, p.Yields, p.Sleeps, p.SleepTime, p.MeanWait(), p.MaxWait, 100*p.CPUUsage(), p.Elapsed)
+}
+
+//processCPUTime returns the user and system time of this process
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+//EventSource delivers the events of an EventPoller using adaptive polling, see PollConfig
+type EventSource struct {
+	api      EventPoller
+	cfg      PollConfig
+	start    time.Time
+	startCPU time.Duration
+	mutex    sync.Mutex
+	stats    PollStats
+	err      error
+}
+
+//NewEventSource creates a source polling api. cfg has to be valid, see PollConfig.Validate
+func NewEventSource(api EventPoller, cfg PollConfig) *EventSource {
+	return &EventSource{
+		api:      api,
+		cfg:      cfg,
+		start:    time.Now(),
+		startCPU: processCPUTime(),
+	}
+}
+
+//merge adds the counters of a single wait to the stats of s
+func (s *EventSource) merge(local *PollStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Polls += local.Polls
+	s.stats.EmptyPolls += local.EmptyPolls
+	s.stats.Events += local.Events
+	s.stats.Yields += local.Yields
+	s.stats.Sleeps += local.Sleeps
+	s.stats.SleepTime += local.SleepTime
+	s.stats.WaitTime += local.WaitTime
+	if local.MaxWait > s.stats.MaxWait {
+		s.stats.MaxWait = local.MaxWait
+	}
+}
+
+//Stats returns a snapshot of the counters
+func (s *EventSource) Stats() PollStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Elapsed = time.Since(s.start)
+	stats.CPUTime = processCPUTime() - s.startCPU
+	return stats
+}
+
+//Err returns the error that stopped the channel of Events or Batches. Cancelling the context is no error
+func (s *EventSource) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+func (s *EventSource) setErr(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+//Next blocks until the next event is received or ctx is cancelled. Returns ErrCtxCancelled in the latter case
+func (s *EventSource) Next(ctx context.Context) (*sevStep.Event, error) {
+	var local PollStats
+	defer s.merge(&local)
+
+	begin := time.Now()
+	sleep := s.cfg.MinSleep
+	for i := 0; ; i++ {
+		if ctx.Err() != nil {
+			return nil, ErrCtxCancelled
+		}
+		e, ok, err := s.api.CmdPollEvent()
+		local.Polls++
+		if err != nil {
+			return nil, fmt.Errorf("CmdPollEvent failed : %v", err)
+		}
+		if ok {
+			wait := time.Since(begin)
+			local.Events++
+			local.WaitTime += wait
+			local.MaxWait = wait
+			return e, nil
+		}
+		local.EmptyPolls++
+
+		switch {
+		case s.cfg.SpinPolls < 0 || i < s.cfg.SpinPolls:
+		case i < s.cfg.SpinPolls+s.cfg.YieldPolls:
+			runtime.Gosched()
+			local.Yields++
+		default:
+			time.Sleep(sleep)
+			local.Sleeps++
+			local.SleepTime += sleep
+			if sleep *= 2; sleep > s.cfg.MaxSleep {
+				sleep = s.cfg.MaxSleep
+			}
+		}
+	}
+}
+
+//Events delivers single events until ctx is cancelled or polling fails, see Err. The channel is closed
+//afterwards. Consumers that stop reading have to cancel ctx, so that the goroutine can exit
+func (s *EventSource) Events(ctx context.Context) <-chan *sevStep.Event {
+	out := make(chan *sevStep.Event)
+	go func() {
+		defer close(out)
+		for {
+			e, err := s.Next(ctx)
+			if err != nil {
+				if !errors.Is(err, ErrCtxCancelled) {
+					log.Printf("Polling error %v", err)
+					s.setErr(err)
+				}
+				return
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+//Batches is like Events but delivers all events that are available at once, up to PollConfig.BatchSize. With the
+//blocking tracking API of the kernel module a batch usually has one event, as the next fault requires an ack
+func (s *EventSource) Batches(ctx context.Context) <-chan []*sevStep.Event {
+	out := make(chan []*sevStep.Event)
+	go func() {
+		defer close(out)
+		for {
+			e, err := s.Next(ctx)
+			if err != nil {
+				if !errors.Is(err, ErrCtxCancelled) {
+					log.Printf("Polling error %v", err)
+					s.setErr(err)
+				}
+				return
+			}
+			batch := []*sevStep.Event{e}
+			var local PollStats
+			for len(batch) < s.cfg.BatchSize {
+				e, ok, err := s.api.CmdPollEvent()
+				local.Polls++
+				if err != nil {
+					log.Printf("Polling error %v", err)
+					s.setErr(fmt.Errorf("CmdPollEvent failed : %v", err))
+					break
+				}
+				if !ok {
+					local.EmptyPolls++
+					break
+				}
+				local.Events++
+				batch = append(batch, e)
+			}
+			s.merge(&local)
+			select {
+			case out <- batch:
+			case <-ctx.Done():
+				return
+			}
+			if s.Err() != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
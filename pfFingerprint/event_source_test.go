@@ -0,0 +1,135 @@
+package pfFingerprint
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//scriptedPoller returns nil for the given number of polls before each event. Afterwards it returns err or nothing
+type scriptedPoller struct {
+	mutex      sync.Mutex
+	emptyPolls []int
+	next       int
+	err        error
+}
+
+func (s *scriptedPoller) CmdPollEvent() (*sevStep.Event, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.next >= len(s.emptyPolls) {
+		return nil, false, s.err
+	}
+	if s.emptyPolls[s.next] > 0 {
+		s.emptyPolls[s.next]--
+		return nil, false, nil
+	}
+	s.next++
+	return &sevStep.Event{ID: uint64(s.next - 1)}, true, nil
+}
+
+func TestPollConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     PollConfig
+		wantErr bool
+	}{
+		{name: "Default", cfg: DefaultPollConfig()},
+		{name: "Busy", cfg: BusyPollConfig()},
+		{name: "No sleep", cfg: PollConfig{SpinPolls: 10, BatchSize: 1}, wantErr: true},
+		{name: "Max below min", cfg: PollConfig{MinSleep: time.Millisecond, MaxSleep: time.Microsecond, BatchSize: 1}, wantErr: true},
+		{name: "No batch", cfg: PollConfig{MinSleep: 1, MaxSleep: 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEventSource_Next(t *testing.T) {
+	cfg := PollConfig{SpinPolls: 2, YieldPolls: 3, MinSleep: time.Microsecond, MaxSleep: 4 * time.Microsecond, BatchSize: 1}
+	poller := &scriptedPoller{emptyPolls: []int{0, 9}}
+	source := NewEventSource(poller, cfg)
+
+	for i := 0; i < 2; i++ {
+		e, err := source.Next(context.Background())
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if e.ID != uint64(i) {
+			t.Errorf("Next() got event %v, want %v", e.ID, i)
+		}
+	}
+	stats := source.Stats()
+	//second wait: 2 spins, 3 yields and sleeps of 1,2,4,4 us
+	want := PollStats{Polls: 11, EmptyPolls: 9, Events: 2, Yields: 3, Sleeps: 4, SleepTime: 11 * time.Microsecond}
+	if stats.Polls != want.Polls || stats.EmptyPolls != want.EmptyPolls || stats.Events != want.Events ||
+		stats.Yields != want.Yields || stats.Sleeps != want.Sleeps || stats.SleepTime != want.SleepTime {
+		t.Errorf("Stats() = %v, want %v", stats, want)
+	}
+	if stats.MaxWait < stats.SleepTime || stats.MeanWait() == 0 {
+		t.Errorf("wait times %v, %v are inconsistent with sleep time %v", stats.MeanWait(), stats.MaxWait, stats.SleepTime)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := source.Next(ctx); !errors.Is(err, ErrCtxCancelled) {
+		t.Errorf("Next() error = %v, want %v", err, ErrCtxCancelled)
+	}
+}
+
+func TestEventSource_Events_Shutdown(t *testing.T) {
+	//the consumer stops reading after the first event, cancelling must end the delivering goroutine
+	poller := &scriptedPoller{emptyPolls: []int{0, 0, 0}}
+	source := NewEventSource(poller, DefaultPollConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	events := source.Events(ctx)
+	if e := <-events; e == nil || e.ID != 0 {
+		t.Fatalf("got event %v, want 0", e)
+	}
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if err := source.Err(); err != nil {
+					t.Errorf("Err() = %v after cancel", err)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("channel not closed after cancel")
+		}
+	}
+}
+
+func TestEventSource_Batches(t *testing.T) {
+	pollErr := errors.New("device gone")
+	poller := &scriptedPoller{emptyPolls: []int{5, 0, 0, 3, 0}, err: pollErr}
+	cfg := DefaultPollConfig()
+	cfg.BatchSize = 2
+	source := NewEventSource(poller, cfg)
+
+	var sizes []int
+	for batch := range source.Batches(context.Background()) {
+		sizes = append(sizes, len(batch))
+	}
+	//the last batch is cut short by the poll error
+	if want := []int{2, 1, 2}; len(sizes) != len(want) || sizes[0] != want[0] || sizes[1] != want[1] || sizes[2] != want[2] {
+		t.Errorf("batch sizes %v, want %v", sizes, want)
+	}
+	if err := source.Err(); err == nil {
+		t.Errorf("Err() = nil, want poll error")
+	}
+	if got := source.Stats().Events; got != 5 {
+		t.Errorf("Stats().Events = %v, want 5", got)
+	}
+}
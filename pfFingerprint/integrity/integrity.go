@@ -0,0 +1,575 @@
+//Package integrity verifies that a trace is complete and ordered before analyses trust it. It checks the ID
+//continuity and the timestamps of the events, the balance of the Start and Stop lines, the chunk, gap and loss
+//markers of rolling batch tracking, the retired instructions and the memory snapshots an attack config expects.
+//The result is a json report, that the recovery tools consult before using a trace
+package integrity
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"pfFingerprint"
+	"pfFingerprint/pipeline"
+	"pfFingerprint/session"
+	"pfFingerprint/snapshot"
+	"strings"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//Names of the checks in Report.Checks
+const (
+	CheckIDs                 = "ids"
+	CheckTimestamps          = "timestamps"
+	CheckRuns                = "runs"
+	CheckChunks              = "chunks"
+	CheckRetiredInstructions = "retiredInstructions"
+	CheckSnapshots           = "snapshots"
+)
+
+var checkNames = []string{CheckIDs, CheckTimestamps, CheckRuns, CheckChunks, CheckRetiredInstructions, CheckSnapshots}
+
+//Severities of an Issue. Only errors fail a check
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+//minZeroInstrEvents is the number of events a run needs before only zero retired instructions are reported
+const minZeroInstrEvents = 10
+
+//SnapshotExpectation describes the snapshots of a page that an analysis needs
+type SnapshotExpectation struct {
+	Name string
+	GPA  uint64
+	//MinCount is the minimal number of events with a snapshot of the page
+	MinCount int
+	//Continuous requires a snapshot in every event after the first one with a snapshot of the page
+	Continuous bool
+}
+
+//ExpectEdDSA requires a snapshot of the stack buffer for each memory access of the main loop, like the capture
+//check of pfOSSHAttackEdDSA
+func ExpectEdDSA(config pfFingerprint.OSSHAttackConfigEdDSA) SnapshotExpectation {
+	return SnapshotExpectation{
+		Name:     "stackBuf",
+		GPA:      config.StackBufGPA,
+		MinCount: config.MainLoopCycles * config.MemAccessesPerCycle,
+	}
+}
+
+//ExpectECDH requires a snapshot of the x2 buffer in every event once it has been found
+func ExpectECDH(config pfFingerprint.OSSLAttackConfigECDH) SnapshotExpectation {
+	return SnapshotExpectation{
+		Name:       "x2",
+		GPA:        config.StackBufGPA,
+		MinCount:   1,
+		Continuous: true,
+	}
+}
+
+//Config selects the checks and their thresholds
+type Config struct {
+	//AllowIDSkips reports skipped IDs as warnings, e.g. for attack traces, which only contain the emitted faults
+	AllowIDSkips bool
+	//MaxRetiredInstructions is the largest plausible retired instruction delta. Larger values are left by a
+	//reset or an overflow of the perf counter
+	MaxRetiredInstructions uint64
+	Snapshots              []SnapshotExpectation
+	//MaxIssues is the number of issues kept in the report. The counts of the checks include all issues
+	MaxIssues int
+}
+
+//DefaultConfig requires continuous IDs and expects no snapshots
+func DefaultConfig() Config {
+	return Config{
+		MaxRetiredInstructions: 1 << 48,
+		MaxIssues:              100,
+	}
+}
+
+//Issue is a single finding. Line is the line in the trace, Run the index of the Start line, starting at 1. Run is
+//0 for traces without Start lines
+type Issue struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Line     int    `json:"line,omitempty"`
+	Run      int    `json:"run,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%v %v at line %v : %v", i.Check, i.Severity, i.Line, i.Message)
+}
+
+//CheckResult sums up the issues of a check
+type CheckResult struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Errors   int    `json:"errors"`
+	Warnings int    `json:"warnings"`
+}
+
+//Report is the machine readable result of Check
+type Report struct {
+	Trace string `json:"trace,omitempty"`
+	//SHA256 is the hex encoded checksum of the checked trace, like pipeline.Checksum
+	SHA256 string `json:"sha256"`
+	//OK is set if no check reported an error
+	OK     bool          `json:"ok"`
+	Lines  int           `json:"lines"`
+	Events int           `json:"events"`
+	Runs   int           `json:"runs"`
+	Chunks int           `json:"chunks"`
+	Gaps   int           `json:"gaps"`
+	Checks []CheckResult `json:"checks"`
+	Issues []Issue       `json:"issues,omitempty"`
+	//OmittedIssues is the number of issues beyond Config.MaxIssues
+	OmittedIssues int `json:"omittedIssues,omitempty"`
+}
+
+//ReportPath returns the default path of the report for the trace at tracePath
+func ReportPath(tracePath string) string {
+	return tracePath + ".integrity.json"
+}
+
+//Failed returns the names of the checks with errors
+func (r *Report) Failed() []string {
+	failed := make([]string, 0)
+	for _, v := range r.Checks {
+		if !v.Passed {
+			failed = append(failed, v.Name)
+		}
+	}
+	return failed
+}
+
+//Trust returns an error if the report does not vouch for the trace at tracePath, i.e. if a check failed or if the
+//trace changed since it has been checked
+func (r *Report) Trust(tracePath string) error {
+	sum, err := pipeline.Checksum(tracePath)
+	if err != nil {
+		return fmt.Errorf("failed to checksum trace : %v", err)
+	}
+	if sum != r.SHA256 {
+		return fmt.Errorf("the report belongs to another trace, checksum %v, want %v", r.SHA256, sum)
+	}
+	if !r.OK {
+		return fmt.Errorf("the trace failed the checks %v", strings.Join(r.Failed(), ","))
+	}
+	return nil
+}
+
+//Save writes the report as indented json to path
+func (r *Report) Save(path string) error {
+	encoded, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report : %v", err)
+	}
+	if err := ioutil.WriteFile(path, encoded, 0644); err != nil {
+		return fmt.Errorf("failed to write report : %v", err)
+	}
+	return nil
+}
+
+//LoadReport parses the report at path
+func LoadReport(path string) (*Report, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report : %v", err)
+	}
+	r := &Report{}
+	if err := json.Unmarshal(raw, r); err != nil {
+		return nil, fmt.Errorf("failed to parse report : %v", err)
+	}
+	return r, nil
+}
+
+//TrustTrace loads the report next to the trace at tracePath, see ReportPath, and calls Trust
+func TrustTrace(tracePath string) error {
+	r, err := LoadReport(ReportPath(tracePath))
+	if err != nil {
+		return err
+	}
+	return r.Trust(tracePath)
+}
+
+//segment is a sequence of events with continuous IDs, i.e. a run, a chunk or the faults of a gap
+type segment struct {
+	kind string
+	line int
+	//want is the number of events announced by the marker, -1 if unknown
+	want   int
+	events int
+	lastID uint64
+	haveID bool
+	//lastTime is only used for late gap events, which are older than the preceding chunk
+	lastTime time.Time
+}
+
+//run holds the state between a Start and a Stop line
+type run struct {
+	index     int
+	line      int
+	nextChunk uint64
+	lastChunk uint64
+	lastTime  time.Time
+	withInstr int
+	zeroInstr int
+	noInstr   int
+}
+
+//checker processes a trace line by line
+type checker struct {
+	config    Config
+	report    *Report
+	counts    map[string]*CheckResult
+	line      int
+	run       *run
+	implicit  bool
+	seg       *segment
+	snapshots []snapshotState
+}
+
+type snapshotState struct {
+	count       int
+	started     bool
+	missing     int
+	firstMissed int
+}
+
+//Check reads the trace from r and checks it according to config
+func Check(r io.Reader, config Config) (*Report, error) {
+	c := &checker{
+		config:    config,
+		report:    &Report{Issues: make([]Issue, 0)},
+		counts:    make(map[string]*CheckResult),
+		snapshots: make([]snapshotState, len(config.Snapshots)),
+	}
+	for _, name := range checkNames {
+		c.counts[name] = &CheckResult{Name: name}
+	}
+
+	h := sha256.New()
+	sc := bufio.NewScanner(io.TeeReader(r, h))
+	//events with many regions are way larger than the default token size
+	sc.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	for sc.Scan() {
+		c.line++
+		if err := c.processLine(sc.Text()); err != nil {
+			return nil, fmt.Errorf("line %v : %v", c.line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("scanner error : %v", err)
+	}
+	c.finish()
+	c.report.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return c.report, nil
+}
+
+//CheckFile checks the trace at path
+func CheckFile(path string, config Config) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace : %v", err)
+	}
+	defer f.Close()
+	report, err := Check(f, config)
+	if err != nil {
+		return nil, err
+	}
+	report.Trace = path
+	return report, nil
+}
+
+//issue records a finding at the current line
+func (c *checker) issue(check, severity string, format string, args ...interface{}) {
+	c.issueAt(c.line, check, severity, format, args...)
+}
+
+func (c *checker) issueAt(line int, check, severity string, format string, args ...interface{}) {
+	if severity == SeverityError {
+		c.counts[check].Errors++
+	} else {
+		c.counts[check].Warnings++
+	}
+	if len(c.report.Issues) >= c.config.MaxIssues {
+		c.report.OmittedIssues++
+		return
+	}
+	runIndex := 0
+	if c.run != nil {
+		runIndex = c.run.index
+	}
+	c.report.Issues = append(c.report.Issues, Issue{Check: check, Severity: severity, Line: line, Run: runIndex, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) processLine(line string) error {
+	c.report.Lines++
+	switch {
+	case strings.HasPrefix(line, "{"):
+		return c.event(line)
+	case strings.HasPrefix(line, "Start"):
+		c.start()
+	case strings.HasPrefix(line, "Stop"):
+		c.stop()
+	case strings.HasPrefix(line, "Chunk "):
+		c.chunk(line)
+	case strings.HasPrefix(line, "Gap "):
+		c.gap(line)
+	case strings.HasPrefix(line, "Loss "):
+		c.loss(line)
+	}
+	//other lines, e.g. the trigger timing, are not checked
+	return nil
+}
+
+func (c *checker) start() {
+	if c.run != nil {
+		c.endRun()
+		//lines after a Stop have already been reported by ensureRun
+		if !c.implicit {
+			c.issue(CheckRuns, SeverityError, "Start without Stop of the previous run")
+		} else if c.report.Runs == 0 {
+			c.issue(CheckRuns, SeverityError, "events before the first Start line")
+		}
+	}
+	c.report.Runs++
+	c.implicit = false
+	c.run = &run{index: c.report.Runs, line: c.line}
+	c.seg = &segment{kind: "run", line: c.line, want: -1}
+}
+
+func (c *checker) stop() {
+	if c.run == nil || c.implicit {
+		c.issue(CheckRuns, SeverityError, "Stop without Start")
+		return
+	}
+	c.endRun()
+	c.run = nil
+}
+
+func (c *checker) chunk(line string) {
+	var seq, dropped, counted, stopped uint64
+	var events int
+	if _, err := fmt.Sscanf(line, "Chunk %d events %d dropped %d counted %d stopped %d", &seq, &events, &dropped, &counted, &stopped); err != nil {
+		c.issue(CheckChunks, SeverityError, "malformed chunk marker : %v", err)
+		return
+	}
+	c.ensureRun()
+	c.endSegment()
+	c.report.Chunks++
+	if seq != c.run.nextChunk && c.run.nextChunk == 0 {
+		c.issue(CheckChunks, SeverityError, "the run starts with chunk %v, the chunks before are missing", seq)
+	} else if seq != c.run.nextChunk {
+		c.issue(CheckChunks, SeverityError, "chunk %v follows chunk %v, the chunks in between are missing", seq, c.run.lastChunk)
+	}
+	c.run.nextChunk = seq + 1
+	c.run.lastChunk = seq
+	if dropped > 0 {
+		c.issue(CheckChunks, SeverityError, "chunk %v dropped %v events on a full buffer", seq, dropped)
+	}
+	c.seg = &segment{kind: "chunk", line: c.line, want: events}
+}
+
+func (c *checker) gap(line string) {
+	var seq, from, to uint64
+	var events int
+	kind := "gap"
+	var err error
+	if strings.Contains(line, " late ") {
+		kind = "late"
+		_, err = fmt.Sscanf(line, "Gap %d late events %d", &seq, &events)
+	} else {
+		_, err = fmt.Sscanf(line, "Gap %d from %d to %d events %d", &seq, &from, &to, &events)
+	}
+	if err != nil {
+		c.issue(CheckChunks, SeverityError, "malformed gap marker : %v", err)
+		return
+	}
+	c.ensureRun()
+	c.endSegment()
+	if kind == "gap" {
+		c.report.Gaps++
+		if c.run.nextChunk == 0 || seq != c.run.lastChunk {
+			c.issue(CheckChunks, SeverityError, "gap %v does not follow its chunk", seq)
+		}
+	} else {
+		c.issue(CheckChunks, SeverityWarning, "%v faults of gap %v were reported late, they are older than the preceding chunk", events, seq)
+	}
+	c.seg = &segment{kind: kind, line: c.line, want: events}
+}
+
+func (c *checker) loss(line string) {
+	var seq, from, to uint64
+	var reason string
+	if _, err := fmt.Sscanf(line, "Loss %d reason %s from %d to %d", &seq, &reason, &from, &to); err != nil {
+		c.issue(CheckChunks, SeverityError, "malformed loss marker : %v", err)
+		return
+	}
+	c.ensureRun()
+	severity := SeverityWarning
+	if reason == session.LossOverflow {
+		severity = SeverityError
+	}
+	c.issue(CheckChunks, severity, "events may be missing after chunk %v for %v, reason %v", seq, time.Duration(int64(to)-int64(from)), reason)
+}
+
+//ensureRun opens an implicit run for traces without Start lines, e.g. the attack traces
+func (c *checker) ensureRun() {
+	if c.run != nil {
+		return
+	}
+	if c.report.Runs > 0 {
+		c.issue(CheckRuns, SeverityError, "line outside of a run")
+	}
+	c.implicit = true
+	c.run = &run{line: c.line}
+	c.seg = &segment{kind: "run", line: c.line, want: -1}
+}
+
+//endSegment compares the events of the current segment with the number announced by its marker
+func (c *checker) endSegment() {
+	if c.seg == nil {
+		return
+	}
+	if c.seg.want >= 0 && c.seg.events != c.seg.want {
+		c.issueAt(c.seg.line, CheckChunks, SeverityError, "%v marker announces %v events, got %v", c.seg.kind, c.seg.want, c.seg.events)
+	}
+	c.seg = nil
+}
+
+func (c *checker) endRun() {
+	c.endSegment()
+	r := c.run
+	if r.withInstr >= minZeroInstrEvents && r.zeroInstr == r.withInstr {
+		c.issueAt(r.line, CheckRetiredInstructions, SeverityWarning, "all %v retired instruction deltas are 0, the perf counter is probably not running", r.withInstr)
+	}
+	if r.withInstr > 0 && r.noInstr > 0 {
+		c.issueAt(r.line, CheckRetiredInstructions, SeverityWarning, "%v of %v events have no retired instructions", r.noInstr, r.noInstr+r.withInstr)
+	}
+}
+
+func (c *checker) event(line string) error {
+	e := &snapshot.Event{Event: &sevStep.Event{}}
+	if err := json.Unmarshal([]byte(line), e); err != nil {
+		return fmt.Errorf("failed to parse event : %v", err)
+	}
+	c.ensureRun()
+	if c.seg == nil {
+		c.seg = &segment{kind: "run", line: c.line, want: -1}
+	}
+	c.report.Events++
+	c.seg.events++
+	c.checkID(e.Event)
+	c.checkTime(e.Event)
+	c.checkInstr(e.Event)
+	for i, v := range c.config.Snapshots {
+		state := &c.snapshots[i]
+		if _, ok := e.Region(v.GPA); ok {
+			state.count++
+			state.started = true
+		} else if state.started && v.Continuous {
+			if state.missing == 0 {
+				state.firstMissed = c.line
+			}
+			state.missing++
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkID(e *sevStep.Event) {
+	s := c.seg
+	defer func() {
+		s.lastID = e.ID
+		s.haveID = true
+	}()
+	if !s.haveID {
+		//batch IDs restart at 0 in every chunk
+		if s.kind == "chunk" && e.ID != 0 {
+			c.issue(CheckIDs, SeverityError, "chunk starts at ID %v, the first %v events are missing", e.ID, e.ID)
+		}
+		return
+	}
+	switch {
+	case e.ID <= s.lastID:
+		c.issue(CheckIDs, SeverityError, "ID %v follows ID %v", e.ID, s.lastID)
+	case e.ID > s.lastID+1:
+		severity := SeverityError
+		if c.config.AllowIDSkips {
+			severity = SeverityWarning
+		}
+		c.issue(CheckIDs, severity, "%v events between ID %v and %v are missing", e.ID-s.lastID-1, s.lastID, e.ID)
+	}
+}
+
+func (c *checker) checkTime(e *sevStep.Event) {
+	if e.Timestamp.IsZero() {
+		return
+	}
+	last := &c.run.lastTime
+	if c.seg.kind == "late" {
+		last = &c.seg.lastTime
+	}
+	if !last.IsZero() && e.Timestamp.Before(*last) {
+		c.issue(CheckTimestamps, SeverityError, "timestamp of ID %v goes back by %v", e.ID, last.Sub(e.Timestamp))
+	}
+	if e.Timestamp.After(*last) {
+		*last = e.Timestamp
+	}
+}
+
+func (c *checker) checkInstr(e *sevStep.Event) {
+	if !e.HaveRetiredInstructions {
+		c.run.noInstr++
+		return
+	}
+	//the first event of a batch has no valid delta
+	if e.ID == 0 {
+		return
+	}
+	c.run.withInstr++
+	if e.RetiredInstructions == 0 {
+		c.run.zeroInstr++
+	}
+	if e.RetiredInstructions > c.config.MaxRetiredInstructions {
+		c.issue(CheckRetiredInstructions, SeverityError, "retired instruction delta %v of ID %v is implausible, the perf counter was reset or overflowed", e.RetiredInstructions, e.ID)
+	}
+}
+
+func (c *checker) finish() {
+	if c.run != nil {
+		if !c.implicit {
+			c.issue(CheckRuns, SeverityError, "run %v has no Stop line, the trace is truncated", c.run.index)
+		}
+		c.endRun()
+	}
+	if c.report.Events == 0 {
+		c.issue(CheckRuns, SeverityError, "no json events, the checks require the json format")
+	}
+	for i, v := range c.config.Snapshots {
+		state := c.snapshots[i]
+		if state.count < v.MinCount {
+			c.issue(CheckSnapshots, SeverityError, "%v events have a snapshot of %v at 0x%x, want at least %v", state.count, v.Name, v.GPA, v.MinCount)
+		}
+		if state.missing > 0 {
+			c.issueAt(state.firstMissed, CheckSnapshots, SeverityError, "%v events after the first snapshot of %v have none", state.missing, v.Name)
+		}
+	}
+
+	c.report.OK = true
+	for _, name := range checkNames {
+		result := c.counts[name]
+		result.Passed = result.Errors == 0
+		c.report.OK = c.report.OK && result.Passed
+		c.report.Checks = append(c.report.Checks, *result)
+	}
+}
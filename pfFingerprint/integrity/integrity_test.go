@@ -0,0 +1,219 @@
+package integrity
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"pfFingerprint"
+	"pfFingerprint/snapshot"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//event returns the json line of an event with the given ID, timestamp in microseconds and retired instructions
+func event(id uint64, us int64, instr uint64) string {
+	e := &sevStep.Event{ID: id, FaultedGPA: 0x1000, Timestamp: time.Unix(0, us*1000), RetiredInstructions: instr, HaveRetiredInstructions: instr != 0}
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return string(encoded)
+}
+
+//snapshotEvent returns the json line of an event with a snapshot of gpa
+func snapshotEvent(id uint64, gpa uint64) string {
+	e := &snapshot.Event{Event: &sevStep.Event{ID: id, FaultedGPA: 0x1000}, Regions: []snapshot.Region{{GPA: gpa, Length: 1, Content: []byte{1}}}}
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return string(encoded)
+}
+
+func lines(l ...string) string {
+	return strings.Join(l, "\n") + "\n"
+}
+
+//issues returns the severities of the issues by check
+func issues(r *Report) map[string][]string {
+	got := make(map[string][]string)
+	for _, v := range r.Issues {
+		got[v.Check] = append(got[v.Check], v.Severity)
+	}
+	return got
+}
+
+func TestCheck(t *testing.T) {
+	allowSkips := DefaultConfig()
+	allowSkips.AllowIDSkips = true
+	eddsa := DefaultConfig()
+	eddsa.AllowIDSkips = true
+	eddsa.Snapshots = []SnapshotExpectation{ExpectEdDSA(pfFingerprint.OSSHAttackConfigEdDSA{StackBufGPA: 0x5000, MainLoopCycles: 1, MemAccessesPerCycle: 3})}
+	ecdh := DefaultConfig()
+	ecdh.Snapshots = []SnapshotExpectation{ExpectECDH(pfFingerprint.OSSLAttackConfigECDH{StackBufGPA: 0x5000})}
+
+	tests := []struct {
+		name   string
+		trace  string
+		config Config
+		want   map[string][]string
+		wantOK bool
+	}{
+		{
+			name:   "Complete poll trace",
+			trace:  lines("Start a", event(1, 1, 0), event(2, 2, 0), "Trigger start 1 end 2 latency 1ns", "Stop b", "Start c", event(7, 3, 0), "Stop d"),
+			want:   map[string][]string{},
+			wantOK: true,
+		},
+		{
+			name:  "Skipped and repeated IDs",
+			trace: lines("Start a", event(1, 1, 0), event(4, 2, 0), event(4, 3, 0), "Stop b"),
+			want:  map[string][]string{CheckIDs: {SeverityError, SeverityError}},
+		},
+		{
+			name:   "Skipped IDs allowed",
+			trace:  lines("Start a", event(1, 1, 0), event(4, 2, 0), "Stop b"),
+			config: allowSkips,
+			want:   map[string][]string{CheckIDs: {SeverityWarning}},
+			wantOK: true,
+		},
+		{
+			name:  "Timestamp goes back",
+			trace: lines("Start a", event(1, 5, 0), event(2, 4, 0), "Stop b"),
+			want:  map[string][]string{CheckTimestamps: {SeverityError}},
+		},
+		{
+			name:  "Unbalanced runs",
+			trace: lines("Stop a", "Start b", event(1, 1, 0), "Start c", event(2, 2, 0)),
+			want:  map[string][]string{CheckRuns: {SeverityError, SeverityError, SeverityError}},
+		},
+		{
+			name:  "Event after Stop",
+			trace: lines("Start a", event(1, 1, 0), "Stop b", event(2, 2, 0), "Start c", event(3, 3, 0), "Stop d"),
+			want:  map[string][]string{CheckRuns: {SeverityError}},
+		},
+		{
+			name:  "No json events",
+			trace: lines("Start a", "0x1000 plain event", "Stop b"),
+			want:  map[string][]string{CheckRuns: {SeverityError}},
+		},
+		{
+			name: "Rolling batch trace",
+			trace: lines("Start a",
+				"Chunk 0 events 2 dropped 0 counted 10000 stopped 11000", event(0, 1, 5), event(1, 2, 100),
+				"Loss 0 reason unfetched from 10000 to 11000",
+				"Gap 0 from 11000 to 12000 events 1", event(8, 11, 0),
+				"Gap 0 late events 1", event(9, 11, 0),
+				"Chunk 1 events 1 dropped 0 counted 20000 stopped 21000", event(0, 13, 5),
+				"Loss 1 reason unfetched from 20000 to 21000",
+				"Stop b"),
+			want:   map[string][]string{CheckChunks: {SeverityWarning, SeverityWarning, SeverityWarning}, CheckRetiredInstructions: {SeverityWarning}},
+			wantOK: true,
+		},
+		{
+			name: "Writer failed in chunk",
+			trace: lines("Start a",
+				"Chunk 0 events 3 dropped 0 counted 1 stopped 2", event(0, 1, 5), event(1, 2, 5),
+				"Chunk 2 events 1 dropped 4 counted 1 stopped 2", event(3, 3, 5),
+				"Loss 2 reason overflow from 1 to 2",
+				"Stop b"),
+			want: map[string][]string{CheckChunks: {SeverityError, SeverityError, SeverityError, SeverityError}, CheckIDs: {SeverityError}},
+		},
+		{
+			name:  "Implausible retired instructions",
+			trace: lines("Start a", event(1, 1, 1<<50), "Stop b"),
+			want:  map[string][]string{CheckRetiredInstructions: {SeverityError}},
+		},
+		{
+			name:   "EdDSA snapshots",
+			trace:  lines(event(1, 0, 0), snapshotEvent(2, 0x5000), snapshotEvent(5, 0x5000), snapshotEvent(6, 0x5abc)),
+			config: eddsa,
+			want:   map[string][]string{CheckIDs: {SeverityWarning}},
+			wantOK: true,
+		},
+		{
+			name:   "Too few EdDSA snapshots",
+			trace:  lines(snapshotEvent(1, 0x5000), snapshotEvent(2, 0x6000)),
+			config: eddsa,
+			want:   map[string][]string{CheckSnapshots: {SeverityError}},
+		},
+		{
+			name:   "ECDH snapshot missing",
+			trace:  lines(event(1, 0, 0), snapshotEvent(2, 0x5000), event(3, 0, 0), snapshotEvent(4, 0x5000)),
+			config: ecdh,
+			want:   map[string][]string{CheckSnapshots: {SeverityError}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config.MaxIssues == 0 {
+				config = DefaultConfig()
+			}
+			got, err := Check(strings.NewReader(tt.trace), config)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if !reflect.DeepEqual(issues(got), tt.want) || got.OK != tt.wantOK {
+				t.Errorf("Check() ok = %v, issues %v, want ok = %v, issues %v", got.OK, got.Issues, tt.wantOK, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck_MaxIssues(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxIssues = 1
+	got, err := Check(strings.NewReader(lines("Stop a", "Stop b", "Stop c", event(1, 0, 0))), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Issues) != 1 || got.OmittedIssues != 2 || got.Checks[2].Errors != 3 {
+		t.Errorf("Check() issues %v, omitted %v, checks %v", got.Issues, got.OmittedIssues, got.Checks)
+	}
+}
+
+func TestTrustTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tracePath := filepath.Join(dir, "trace.txt")
+	write := func(trace string) {
+		if err := ioutil.WriteFile(tracePath, []byte(trace), 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := CheckFile(tracePath, DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := report.Save(ReportPath(tracePath)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := TrustTrace(tracePath); err == nil {
+		t.Errorf("TrustTrace() without report succeeded")
+	}
+	write(lines("Start a", event(1, 1, 0), "Stop b"))
+	if err := TrustTrace(tracePath); err != nil {
+		t.Errorf("TrustTrace() error = %v", err)
+	}
+	//changed after the check
+	if err := ioutil.WriteFile(tracePath, []byte(lines("Start a", event(1, 1, 0), event(2, 2, 0), "Stop b")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := TrustTrace(tracePath); err == nil || !strings.Contains(err.Error(), "another trace") {
+		t.Errorf("TrustTrace() of changed trace error = %v", err)
+	}
+	write(lines("Start a", event(1, 1, 0)))
+	if err := TrustTrace(tracePath); err == nil || !strings.Contains(err.Error(), CheckRuns) {
+		t.Errorf("TrustTrace() of truncated trace error = %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+//Package kernelpages labels the GPAs of guest kernel text and data, so that they can be excluded from tracking
+//on guests without RIP info, e.g. production SEV-SNP VMs. Faults with RIP info, recorded on debug VMs, label their
+//page directly. All other pages are labeled by signals that do not need the RIP: the user bit of the error code,
+//the retired instructions since the last fault and the presence of the page in the runs of unrelated victims
+package kernelpages
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//KernelSpaceStart is the lowest RIP of the guest kernel
+const KernelSpaceStart = 0xffff800000000000
+
+//Names of the signals in Page.Signals
+const (
+	SignalRIP      = "rip"
+	SignalUserBit  = "userBit"
+	SignalInstr    = "instr"
+	SignalPresence = "presence"
+)
+
+//Config holds the thresholds of the RIP free signals
+type Config struct {
+	//MinSupervisor is the fraction of faults without the user bit, above which a page is voted kernel
+	MinSupervisor float64
+	//MinPresence is the fraction of the runs of a source a page has to be present in to count as stable for
+	//this source. A page that is stable in all sources without RIP info is voted kernel. Requires at least two
+	//such sources. Sources with RIP info usually come from a debug VM with another memory layout
+	MinPresence float64
+	//MinVotes is the number of RIP free signals that have to vote kernel. A page for which only fewer signals
+	//are available is labeled kernel if all of them vote kernel
+	MinVotes int
+}
+
+//DefaultConfig requires two signals to agree
+func DefaultConfig() Config {
+	return Config{
+		MinSupervisor: 0.9,
+		MinPresence:   0.9,
+		MinVotes:      2,
+	}
+}
+
+//Validate checks the ranges of the thresholds
+func (c Config) Validate() error {
+	if c.MinSupervisor <= 0 || c.MinSupervisor > 1 {
+		return fmt.Errorf("min supervisor fraction has to be in (0,1], got %v", c.MinSupervisor)
+	}
+	if c.MinPresence <= 0 || c.MinPresence > 1 {
+		return fmt.Errorf("min presence has to be in (0,1], got %v", c.MinPresence)
+	}
+	if c.MinVotes < 1 {
+		return fmt.Errorf("min votes has to be at least 1, got %v", c.MinVotes)
+	}
+	return nil
+}
+
+//instrHistogram counts retired instruction deltas by their bit length, i.e. in logarithmic buckets
+type instrHistogram [65]uint64
+
+func (h *instrHistogram) add(delta uint64) {
+	h[bits.Len64(delta)]++
+}
+
+//median returns the bucket of the median delta and false if the histogram is empty
+func (h *instrHistogram) median() (int, bool) {
+	total := uint64(0)
+	for _, v := range h {
+		total += v
+	}
+	if total == 0 {
+		return 0, false
+	}
+	seen := uint64(0)
+	for i, v := range h {
+		seen += v
+		if 2*seen >= total {
+			return i, true
+		}
+	}
+	return len(h) - 1, true
+}
+
+//Page is the evidence for a single page and its label
+type Page struct {
+	GPA    uint64 `json:"gpa"`
+	Faults uint64 `json:"faults"`
+	//KernelRIP and UserRIP count the faults with RIP info
+	KernelRIP uint64 `json:"kernelRIP"`
+	UserRIP   uint64 `json:"userRIP"`
+	//Supervisor counts the faults without the user bit in the error code
+	Supervisor uint64 `json:"supervisor"`
+	//StableSources is the number of sources without RIP info in which the page is present in at least MinPresence
+	//of the runs
+	StableSources int  `json:"stableSources"`
+	Kernel        bool `json:"kernel"`
+	//Signals lists the signals that voted kernel. Only SignalRIP if the page has been labeled by RIP
+	Signals []string `json:"signals,omitempty"`
+	//Available is the number of RIP free signals that could be evaluated for the page
+	Available int `json:"available"`
+
+	instr instrHistogram
+	runs  map[string]int
+}
+
+func (p *Page) String() string {
+	return fmt.Sprintf("0x%x kernel=%v signals=[%v] faults=%v", p.GPA, p.Kernel, strings.Join(p.Signals, ","), p.Faults)
+}
+
+//Classifier collects the evidence of traces from several sources. A source is a set of runs of the same victim,
+//e.g. a trace file. Sources should use unrelated victims, so that only kernel pages are present in all of them
+type Classifier struct {
+	config  Config
+	pages   map[uint64]*Page
+	sources map[string]int
+	//ripSources holds the sources with RIP info, they are not used for the presence signal
+	ripSources map[string]bool
+	//kernelInstr and userInstr are learned from the faults with RIP info
+	kernelInstr instrHistogram
+	userInstr   instrHistogram
+}
+
+//NewClassifier creates an empty classifier
+func NewClassifier(config Config) *Classifier {
+	return &Classifier{
+		config:     config,
+		pages:      make(map[uint64]*Page),
+		sources:    make(map[string]int),
+		ripSources: make(map[string]bool),
+	}
+}
+
+//AddRun adds the events of a single run of source
+func (c *Classifier) AddRun(source string, events []*sevStep.Event) {
+	c.sources[source]++
+	present := make(map[uint64]bool)
+	for _, e := range events {
+		gpa := e.FaultedGPA &^ 0xfff
+		p, ok := c.pages[gpa]
+		if !ok {
+			p = &Page{GPA: gpa, runs: make(map[string]int)}
+			c.pages[gpa] = p
+		}
+		p.Faults++
+		if !sevStep.ArePfErrorsSet(e.ErrorCode, sevStep.PfErrorUser) {
+			p.Supervisor++
+		}
+		if e.HaveRetiredInstructions {
+			p.instr.add(e.RetiredInstructions)
+		}
+		if e.HaveRipInfo {
+			c.ripSources[source] = true
+			if e.RIP >= KernelSpaceStart {
+				p.KernelRIP++
+				if e.HaveRetiredInstructions {
+					c.kernelInstr.add(e.RetiredInstructions)
+				}
+			} else {
+				p.UserRIP++
+				if e.HaveRetiredInstructions {
+					c.userInstr.add(e.RetiredInstructions)
+				}
+			}
+		}
+		if !present[gpa] {
+			present[gpa] = true
+			p.runs[source]++
+		}
+	}
+}
+
+//Classify labels all pages and returns them sorted by GPA. Pages with RIP info are labeled by the majority of
+//their faults. The other pages are labeled by the RIP free signals, see Config
+func (c *Classifier) Classify() []*Page {
+	kernelMedian, haveKernel := c.kernelInstr.median()
+	userMedian, haveUser := c.userInstr.median()
+
+	ripFreeSources := len(c.sources) - len(c.ripSources)
+
+	pages := make([]*Page, 0, len(c.pages))
+	for _, p := range c.pages {
+		p.Signals = nil
+		p.Available = 0
+		p.StableSources = 0
+		for source, runs := range c.sources {
+			if c.ripSources[source] {
+				continue
+			}
+			if float64(p.runs[source]) >= c.config.MinPresence*float64(runs)-1e-9 {
+				p.StableSources++
+			}
+		}
+
+		if p.KernelRIP+p.UserRIP > 0 {
+			p.Kernel = p.KernelRIP > p.UserRIP
+			if p.Kernel {
+				p.Signals = []string{SignalRIP}
+			}
+			pages = append(pages, p)
+			continue
+		}
+
+		votes := 0
+		vote := func(signal string, kernel bool) {
+			p.Available++
+			if kernel {
+				votes++
+				p.Signals = append(p.Signals, signal)
+			}
+		}
+		vote(SignalUserBit, float64(p.Supervisor) >= c.config.MinSupervisor*float64(p.Faults))
+		if median, ok := p.instr.median(); ok && haveKernel && haveUser && kernelMedian != userMedian {
+			vote(SignalInstr, abs(median-kernelMedian) < abs(median-userMedian))
+		}
+		if ripFreeSources >= 2 {
+			vote(SignalPresence, p.StableSources == ripFreeSources)
+		}
+		p.Kernel = votes >= c.config.MinVotes || (votes > 0 && votes == p.Available)
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].GPA < pages[j].GPA })
+	return pages
+}
+
+//Kernel returns the GPAs of the pages labeled kernel, e.g. to write them as deny list with allowlist.Write
+func Kernel(pages []*Page) map[uint64]bool {
+	set := make(map[uint64]bool)
+	for _, v := range pages {
+		if v.Kernel {
+			set[v.GPA] = true
+		}
+	}
+	return set
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+package kernelpages
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+const (
+	kernelRIP = KernelSpaceStart + 0x1000
+	userRIP   = 0x400000
+)
+
+func ripFault(gpa, rip, instr uint64) *sevStep.Event {
+	return &sevStep.Event{FaultedGPA: gpa, RIP: rip, HaveRipInfo: true, RetiredInstructions: instr, HaveRetiredInstructions: true}
+}
+
+func fault(gpa uint64, errorCode uint32, instr uint64) *sevStep.Event {
+	return &sevStep.Event{FaultedGPA: gpa, ErrorCode: errorCode, RetiredInstructions: instr, HaveRetiredInstructions: true}
+}
+
+func labels(pages []*Page) map[uint64][]string {
+	got := make(map[uint64][]string)
+	for _, v := range pages {
+		if v.Kernel {
+			got[v.GPA] = v.Signals
+		}
+	}
+	return got
+}
+
+func TestClassifier_Classify(t *testing.T) {
+	c := NewClassifier(DefaultConfig())
+	for run := 0; run < 2; run++ {
+		//debug VM with RIP, kernel faults after few instructions, user faults after many
+		c.AddRun("debug", []*sevStep.Event{
+			ripFault(0x1000, kernelRIP, 10),
+			ripFault(0x2000, userRIP, 100000),
+			ripFault(0x3000, kernelRIP, 12),
+			ripFault(0x3000, userRIP, 90000),
+			ripFault(0x3000, kernelRIP, 8),
+		})
+		//victims without RIP. 0x5000 is a kernel page present in both, 0x6000 and 0x7000 belong to the victims
+		c.AddRun("ecdh", []*sevStep.Event{
+			fault(0x5000, 0x1, 9),
+			fault(0x6000, 0x5, 80000),
+			fault(0x8123, 0x0, 100000),
+		})
+		c.AddRun("ssh", []*sevStep.Event{
+			fault(0x5000, 0x1, 11),
+			fault(0x7000, 0x4, 11),
+			fault(0x8000, 0x0, 100000),
+		})
+	}
+	//0x9000 faults from user mode and is missing in the first runs
+	c.AddRun("ssh", []*sevStep.Event{fault(0x5000, 0x1, 11), fault(0x9000, 0x4, 10), fault(0x8000, 0x0, 100000)})
+	c.AddRun("ecdh", []*sevStep.Event{fault(0x5000, 0x1, 11), fault(0x9000, 0x4, 10), fault(0x8000, 0x0, 100000)})
+
+	pages := c.Classify()
+	want := map[uint64][]string{
+		0x1000: {SignalRIP},
+		0x3000: {SignalRIP},
+		0x5000: {SignalUserBit, SignalInstr, SignalPresence},
+		//supervisor faults and stable, but with the retired instructions of user faults
+		0x8000: {SignalUserBit, SignalPresence},
+	}
+	if got := labels(pages); !reflect.DeepEqual(got, want) {
+		t.Errorf("Classify() kernel pages = %v, want %v", got, want)
+	}
+	if got := Kernel(pages); len(got) != len(want) || !got[0x5000] {
+		t.Errorf("Kernel() = %v", got)
+	}
+
+	//a single signal is enough if it is the only one available
+	single := NewClassifier(DefaultConfig())
+	single.AddRun("idle", []*sevStep.Event{{FaultedGPA: 0x1000}, {FaultedGPA: 0x2000, ErrorCode: 0x4}})
+	if got, want := labels(single.Classify()), map[uint64][]string{0x1000: {SignalUserBit}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Classify() kernel pages = %v, want %v", got, want)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "Default", config: DefaultConfig()},
+		{name: "Supervisor above 1", config: Config{MinSupervisor: 1.5, MinPresence: 1, MinVotes: 1}, wantErr: true},
+		{name: "Zero presence", config: Config{MinSupervisor: 1, MinPresence: 0, MinVotes: 1}, wantErr: true},
+		{name: "No votes", config: Config{MinSupervisor: 1, MinPresence: 1, MinVotes: 0}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
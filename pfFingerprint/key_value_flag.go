@@ -0,0 +1,27 @@
+package pfFingerprint
+
+import (
+	"fmt"
+	"strings"
+)
+
+//KeyValueFlag collects repeated "name=value" command line flags, register it with flag.Var
+type KeyValueFlag map[string]string
+
+func (k KeyValueFlag) String() string {
+	tokens := make([]string, 0, len(k))
+	for name, v := range k {
+		tokens = append(tokens, name+"="+v)
+	}
+	return strings.Join(tokens, ",")
+}
+
+//Set adds a single "name=value" pair. Later values overwrite earlier ones with the same name
+func (k KeyValueFlag) Set(v string) error {
+	tokens := strings.SplitN(v, "=", 2)
+	if len(tokens) != 2 || tokens[0] == "" {
+		return fmt.Errorf("%q is not in the format name=value", v)
+	}
+	k[tokens[0]] = tokens[1]
+	return nil
+}
@@ -0,0 +1,39 @@
+package pfFingerprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyValueFlag_Set(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    KeyValueFlag
+		wantErr bool
+	}{
+		{name: "Repeated", args: []string{"cpu=2", "uri=ssh://user@localhost:2223"}, want: KeyValueFlag{"cpu": "2", "uri": "ssh://user@localhost:2223"}},
+		{name: "Value with separator", args: []string{"filter=a=b"}, want: KeyValueFlag{"filter": "a=b"}},
+		{name: "Empty value", args: []string{"cpu="}, want: KeyValueFlag{"cpu": ""}},
+		{name: "Overwrite", args: []string{"cpu=2", "cpu=3"}, want: KeyValueFlag{"cpu": "3"}},
+		{name: "Missing separator", args: []string{"cpu"}, want: KeyValueFlag{}, wantErr: true},
+		{name: "Empty name", args: []string{"=2"}, want: KeyValueFlag{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := KeyValueFlag{}
+			var err error
+			for _, v := range tt.args {
+				if err = got.Set(v); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Set() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+//Flags holds the flags defined by RegisterFlags
+type Flags struct {
+	addr *string
+}
+
+//RegisterFlags defines the flags to export metrics on fs
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		addr: fs.String("metricsAddr", "", "Serve Prometheus metrics at http://<addr>/metrics, e.g. localhost:9101. Disabled if empty"),
+	}
+}
+
+//Enabled reports whether an address has been set
+func (f *Flags) Enabled() bool {
+	return *f.addr != ""
+}
+
+//Serve exports r at the address of the flags until ctx is done. Does nothing if no address has been set.
+//Listening happens before Serve returns, so that a used port is reported right away
+func (f *Flags) Serve(ctx context.Context, r *Registry) error {
+	if !f.Enabled() {
+		return nil
+	}
+	listener, err := net.Listen("tcp", *f.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %v : %v", *f.addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			log.Printf("Failed to close metrics server : %v", err)
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server failed : %v", err)
+		}
+	}()
+	log.Printf("Serving metrics at http://%v/metrics\n", listener.Addr())
+	return nil
+}
@@ -0,0 +1,406 @@
+//Package metrics exports counters, gauges and histograms in the Prometheus text format, so that long tracking
+//runs can be watched with standard tooling. All metric types are safe for concurrent use and their methods are
+//no-ops on nil pointers, so that code can record metrics unconditionally and only the commands decide whether
+//they are exported
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Metric kinds as used in the "# TYPE" line
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+//Counter is a monotonically increasing value
+type Counter struct {
+	value uint64
+}
+
+//Add increases the counter by n
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.value, n)
+}
+
+//Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+//Value returns the current count
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.value)
+}
+
+//Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+//Set replaces the value of the gauge
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+//Add adds delta to the value of the gauge
+func (g *Gauge) Add(delta float64) {
+	if g == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, updated) {
+			return
+		}
+	}
+}
+
+//Value returns the current value
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+//Histogram counts observations in buckets with fixed upper bounds
+type Histogram struct {
+	mutex sync.Mutex
+	//bounds are the sorted upper bounds, counts has one more entry for the observations above the last bound
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//ExponentialBuckets returns count upper bounds, starting at start and growing by factor
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+//LatencyBuckets covers durations in seconds from one microsecond to about a minute
+var LatencyBuckets = ExponentialBuckets(1e-6, 4, 14)
+
+func newHistogram(buckets []float64) *Histogram {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+//Observe adds v to the histogram
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+//ObserveDuration adds d in seconds to the histogram
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+//Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+//write prints the cumulative buckets, the sum and the count of h
+func (h *Histogram) write(w io.Writer, name, labels string) error {
+	h.mutex.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mutex.Unlock()
+
+	bounds := make([]float64, len(h.bounds)+1)
+	copy(bounds, h.bounds)
+	bounds[len(h.bounds)] = math.Inf(1)
+	cumulative := uint64(0)
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		le := joinLabels(labels, "le=\""+formatFloat(bound)+"\"")
+		if _, err := fmt.Fprintf(w, "%v_bucket{%v} %v\n", name, le, cumulative); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%v_sum%v %v\n", name, braces(labels), formatFloat(sum)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%v_count%v %v\n", name, braces(labels), count)
+	return err
+}
+
+//series is one label combination of a metric. Exactly one of the value sources is set
+type series struct {
+	labels    string
+	counter   *Counter
+	gauge     *Gauge
+	histogram *Histogram
+	fn        func() float64
+}
+
+func (s *series) value() float64 {
+	switch {
+	case s.counter != nil:
+		return float64(s.counter.Value())
+	case s.gauge != nil:
+		return s.gauge.Value()
+	default:
+		return s.fn()
+	}
+}
+
+//family groups all series of a metric name
+type family struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*series
+}
+
+//Registry holds all metrics of a process and serves them via ServeHTTP
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+//NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+//get returns the series of name with labels. Creates the family and the series if necessary. Registering a name
+//with another kind is a programming error and panics, as does an odd number of label tokens
+func (r *Registry) get(name, help, kind string, labels []string) *series {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metric %v : labels have to be name value pairs, got %v", name, labels))
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", labels[i], escapeLabel(labels[i+1])))
+	}
+	key := strings.Join(pairs, ",")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		panic(fmt.Sprintf("metric %v registered as %v and %v", name, f.kind, kind))
+	}
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+//Counter returns the counter of name with the given label name value pairs. Registering the same name and
+//labels again returns the same counter
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	s := r.get(name, help, kindCounter, labels)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s.counter == nil {
+		s.counter, s.fn = &Counter{}, nil
+	}
+	return s.counter
+}
+
+//CounterFunc exports the result of fn as counter. Registering the same name and labels again replaces fn
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	s := r.get(name, help, kindCounter, labels)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s.counter, s.fn = nil, fn
+}
+
+//Gauge returns the gauge of name with the given label name value pairs. Registering the same name and
+//labels again returns the same gauge
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	s := r.get(name, help, kindGauge, labels)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s.gauge == nil {
+		s.gauge, s.fn = &Gauge{}, nil
+	}
+	return s.gauge
+}
+
+//GaugeFunc exports the result of fn as gauge. Registering the same name and labels again replaces fn, e.g.
+//to export the state of a new session
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	s := r.get(name, help, kindGauge, labels)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s.gauge, s.fn = nil, fn
+}
+
+//Histogram returns the histogram of name with the given label name value pairs. Registering the same name and
+//labels again returns the same histogram and ignores buckets
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	s := r.get(name, help, kindHistogram, labels)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s.histogram == nil {
+		s.histogram = newHistogram(buckets)
+	}
+	return s.histogram
+}
+
+//Rate exports the per second increase of fn as gauge, e.g. of a counter value. The rate is updated when the
+//gauge is read and at least window has passed since the last update, so that frequent scrapes do not give
+//noisy values. Registering the same name and labels again replaces fn
+func (r *Registry) Rate(name, help string, fn func() float64, window time.Duration, labels ...string) {
+	rt := &rate{fn: fn, window: window, now: time.Now}
+	rt.start, rt.startValue = rt.now(), fn()
+	r.GaugeFunc(name, help, rt.value, labels...)
+}
+
+//rate computes the per second increase of fn over windows of at least window
+type rate struct {
+	mutex      sync.Mutex
+	fn         func() float64
+	window     time.Duration
+	now        func() time.Time
+	start      time.Time
+	startValue float64
+	last       float64
+}
+
+func (r *rate) value() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.now()
+	if elapsed := now.Sub(r.start); elapsed >= r.window && elapsed > 0 {
+		v := r.fn()
+		r.last = (v - r.startValue) / elapsed.Seconds()
+		r.start, r.startValue = now, v
+	}
+	return r.last
+}
+
+//WriteText writes all metrics in the Prometheus text format, sorted by name and labels
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	//copy the series, the value functions may take locks that are held while registering
+	seriesOf := make(map[string][]series, len(families))
+	for _, f := range families {
+		list := make([]series, 0, len(f.series))
+		for _, s := range f.series {
+			list = append(list, *s)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].labels < list[j].labels })
+		seriesOf[f.name] = list
+	}
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", f.name, escapeHelp(f.help), f.name, f.kind); err != nil {
+			return err
+		}
+		for _, s := range seriesOf[f.name] {
+			if s.histogram != nil {
+				if err := s.histogram.write(w, f.name, s.labels); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%v%v %v\n", f.name, braces(s.labels), formatFloat(s.value())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//ServeHTTP writes all metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("events_total", "All events").Add(3)
+	r.Counter("events_total", "All events").Inc()
+	r.Gauge("pages", "Tracked pages", "mode", "write").Set(2)
+	r.Gauge("pages", "Tracked pages", "mode", "access").Add(1.5)
+	r.GaugeFunc("backlog", "Pending pages", func() float64 { return 7 })
+	r.GaugeFunc("backlog", "Pending pages", func() float64 { return 8 })
+	h := r.Histogram("latency_seconds", "Latency", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.ObserveDuration(2 * time.Second)
+	r.Counter("escaped_total", "Escaped \"labels\"", "path", "a\"b\\c")
+
+	buf := &strings.Builder{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP backlog Pending pages
+# TYPE backlog gauge
+backlog 8
+# HELP escaped_total Escaped "labels"
+# TYPE escaped_total counter
+escaped_total{path="a\"b\\c"} 0
+# HELP events_total All events
+# TYPE events_total counter
+events_total 4
+# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP pages Tracked pages
+# TYPE pages gauge
+pages{mode="access"} 1.5
+pages{mode="write"} 2
+`
+	if buf.String() != want {
+		t.Errorf("WriteText() =\n%v\nwant\n%v", buf.String(), want)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	c.Inc()
+	g.Set(1)
+	g.Add(1)
+	h.ObserveDuration(time.Second)
+	if c.Value() != 0 || g.Value() != 0 || h.Count() != 0 {
+		t.Errorf("nil metrics recorded values")
+	}
+}
+
+func TestRegistry_KindMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("events_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering a counter as gauge did not panic")
+		}
+	}()
+	r.Gauge("events_total", "")
+}
+
+func TestRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	value := 0.0
+	rt := &rate{fn: func() float64 { return value }, window: 10 * time.Second, now: func() time.Time { return now }}
+	rt.start, rt.startValue = now, 0
+
+	tests := []struct {
+		advance time.Duration
+		value   float64
+		want    float64
+	}{
+		{advance: 5 * time.Second, value: 50, want: 0},
+		//first full window
+		{advance: 5 * time.Second, value: 100, want: 10},
+		//too early, keeps the last rate
+		{advance: time.Second, value: 200, want: 10},
+		{advance: 19 * time.Second, value: 300, want: 10},
+		{advance: 10 * time.Second, value: 300, want: 0},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		value = tt.value
+		if got := rt.value(); got != tt.want {
+			t.Errorf("step %v: rate = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestFlags_Serve(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := NewRegistry()
+	r.Counter("events_total", "").Inc()
+	//disabled by default
+	if err := flags.Serve(ctx, r); err != nil || flags.Enabled() {
+		t.Fatalf("Serve() without address = %v, enabled %v", err, flags.Enabled())
+	}
+
+	//get a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	if err := fs.Parse([]string{"-metricsAddr", addr}); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Serve(ctx, r); err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET metrics : %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "events_total 1\n") || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("GET metrics = %q, %v", body, resp.Header)
+	}
+}
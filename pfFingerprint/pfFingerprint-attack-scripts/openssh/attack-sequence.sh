@@ -47,18 +47,6 @@ fi
 echo "GET_RIP        = ${GET_RIP}"
 echo "CPU            = ${CPU}"
 
-sudo qemu-affinity $(pidof qemu-system-x86_64 ) -k $CPU
-printf "###\nPinned vcpu thread to CPU $CPU\n###\n"
-
-
-#Switch between different trace generator backends
-TRACE_GENERATOR="${TOOLS_BASE}/pfBatchTraceGenerator"
-#TRACE_GENERATOR="${TOOLS_BASE}/pfTraceGenerator"
-printf "###\nBuild Allow Set\n###\n"
-sudo ${TRACE_GENERATOR} -retrack=false -tracking execute -iterations 1 -format json -cpu ${CPU} -getRIP=${GET_RIP}  -triggerURI ${TRIGGER_URI}
-
-printf "###\nGenerating Attack Trace\n###\n"
-sudo ${TOOLS_BASE}/pfOSSHAttackEdDSA -triggerURI ${TRIGGER_URI} #-debugLog
-
-printf "###\nKey Recovery\n###\n"
-${TOOLS_BASE}/pfOSSHRecoverEdDSAKey -debugLog=false
+#pins the vcpu, records the exec trace, runs the attack and the key recovery. Completed stages are skipped on
+#a rerun, see pipeline-manifest.json. Use "-from <stage>" of pfPipeline to force a stage
+${TOOLS_BASE}/pfPipeline -pipeline openssh-eddsa -var tools=$(realpath ${TOOLS_BASE}) -var cpu=${CPU} -var getRIP=${GET_RIP} -var triggerURI=${TRIGGER_URI} "$@"
@@ -0,0 +1,38 @@
+package pipeline
+
+//Pipelines shipped with pfPipeline, see "-list"
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed pipelines/*.json
+var builtinFS embed.FS
+
+//Builtin returns the builtin pipeline with the given name, e.g. "openssl-ecdh"
+func Builtin(name string) (*Spec, error) {
+	f, err := builtinFS.Open(path.Join("pipelines", name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no builtin pipeline %v, builtin pipelines are %v", name, strings.Join(BuiltinNames(), ","))
+	}
+	defer f.Close()
+	return ParseSpec(f)
+}
+
+//BuiltinNames lists the builtin pipelines, sorted by name
+func BuiltinNames() []string {
+	entries, err := builtinFS.ReadDir("pipelines")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, v := range entries {
+		names = append(names, strings.TrimSuffix(v.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+)
+
+//Stage states in the manifest
+const (
+	StatusDone   = "done"
+	StatusFailed = "failed"
+)
+
+//Manifest records the result of every stage of a pipeline in a work dir
+type Manifest struct {
+	Pipeline string                  `json:"pipeline"`
+	Stages   map[string]*StageRecord `json:"stages"`
+}
+
+//StageRecord describes the last run of a stage
+type StageRecord struct {
+	Status string `json:"status"`
+	//Command is the resolved command line, a changed variable invalidates the stage
+	Command []string `json:"command"`
+	//Inputs and Outputs map the paths to their sha256 checksum
+	Inputs   map[string]string `json:"inputs,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Attempts int               `json:"attempts"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Error    string            `json:"error,omitempty"`
+}
+
+//NewManifest creates an empty manifest for the pipeline
+func NewManifest(pipeline string) *Manifest {
+	return &Manifest{
+		Pipeline: pipeline,
+		Stages:   make(map[string]*StageRecord),
+	}
+}
+
+//LoadManifest parses the manifest at path. Returns an empty manifest if the file does not exist
+func LoadManifest(path string, pipeline string) (*Manifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewManifest(pipeline), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest : %v", err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest : %v", err)
+	}
+	if m.Pipeline != pipeline {
+		return nil, fmt.Errorf("manifest belongs to pipeline %v, not %v. Use another work dir", m.Pipeline, pipeline)
+	}
+	if m.Stages == nil {
+		m.Stages = make(map[string]*StageRecord)
+	}
+	return m, nil
+}
+
+//Save writes the manifest to path. A temporary file is used, so that an abort does not leave a truncated manifest
+func (m *Manifest) Save(path string) error {
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest : %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest : %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace manifest : %v", err)
+	}
+	return nil
+}
+
+//Checksum returns the hex encoded sha256 of the file at path
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %v : %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//checksums returns the checksums of all paths
+func checksums(paths []string, resolve func(string) string) (map[string]string, error) {
+	sums := make(map[string]string, len(paths))
+	for _, v := range paths {
+		sum, err := Checksum(resolve(v))
+		if err != nil {
+			return nil, err
+		}
+		sums[v] = sum
+	}
+	return sums, nil
+}
+
+//upToDate reports whether the recorded run of a stage with the given command, inputs and outputs is still
+//valid, i.e. nothing changed since it completed. Returns the reason otherwise
+func (r *StageRecord) upToDate(command []string, inputs, outputs []string, resolve func(string) string) (bool, string) {
+	if r == nil {
+		return false, "never run"
+	}
+	if r.Status != StatusDone {
+		return false, "last run " + r.Status
+	}
+	if len(outputs) == 0 {
+		return false, "stage has no outputs"
+	}
+	if !reflect.DeepEqual(r.Command, command) {
+		return false, "command changed"
+	}
+	current, err := checksums(inputs, resolve)
+	if err != nil {
+		return false, fmt.Sprintf("input unavailable : %v", err)
+	}
+	if !sameSums(current, r.Inputs) {
+		return false, "inputs changed"
+	}
+	current, err = checksums(outputs, resolve)
+	if err != nil {
+		return false, fmt.Sprintf("output missing : %v", err)
+	}
+	if !sameSums(current, r.Outputs) {
+		return false, "outputs changed"
+	}
+	return true, ""
+}
+
+//sameSums compares checksum maps, nil and empty maps are equal
+func sameSums(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+//ManifestName is the file name of the manifest in the work dir
+const ManifestName = "pipeline-manifest.json"
+
+//ExecFunc runs the command line argv in dir and writes its standard output to stdout
+type ExecFunc func(ctx context.Context, dir string, argv []string, stdout io.Writer) error
+
+//execCommand is the default ExecFunc. Stderr is forwarded
+func execCommand(ctx context.Context, dir string, argv []string, stdout io.Writer) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+//Runner executes the stages of a Spec in WorkDir
+type Runner struct {
+	WorkDir string
+	//Vars override the default values of the spec variables
+	Vars map[string]string
+	//Sudo is prepended to the command of privileged stages. Empty to run them without
+	Sudo string
+	//Retries is the number of additional attempts for a failed stage, RetryDelay the pause in between
+	Retries    int
+	RetryDelay time.Duration
+	//From forces this stage and all following stages to run, even if they are up to date
+	From string
+	//Exec runs the commands. Defaults to os/exec
+	Exec ExecFunc
+}
+
+//resolve returns path relative to the work dir
+func (r *Runner) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(r.WorkDir, path)
+}
+
+//vars returns the spec defaults merged with the overrides of the runner
+func (r *Runner) vars(spec *Spec) (map[string]string, error) {
+	vars := make(map[string]string, len(spec.Vars))
+	for k, v := range spec.Vars {
+		vars[k] = v
+	}
+	for k, v := range r.Vars {
+		if _, ok := spec.Vars[k]; !ok {
+			return nil, fmt.Errorf("pipeline %v has no variable %v", spec.Name, k)
+		}
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+//command returns the resolved command line of stage
+func (r *Runner) command(stage *StageSpec, vars map[string]string) []string {
+	argv := make([]string, 0, len(stage.Args)+2)
+	if stage.Privileged && r.Sudo != "" {
+		argv = append(argv, r.Sudo)
+	}
+	argv = append(argv, expand(stage.Command, vars))
+	for _, v := range stage.Args {
+		argv = append(argv, expand(v, vars))
+	}
+	return argv
+}
+
+//Run executes all stages that are not up to date according to the manifest in the work dir. The manifest is
+//saved after every stage, so that a rerun continues at the first stage that failed
+func (r *Runner) Run(ctx context.Context, spec *Spec) error {
+	if r.From != "" {
+		if _, ok := spec.Stage(r.From); !ok {
+			return fmt.Errorf("pipeline %v has no stage %v", spec.Name, r.From)
+		}
+	}
+	vars, err := r.vars(spec)
+	if err != nil {
+		return err
+	}
+	if r.Exec == nil {
+		r.Exec = execCommand
+	}
+	if err := os.MkdirAll(r.WorkDir, 0755); err != nil {
+		return fmt.Errorf("failed to create work dir : %v", err)
+	}
+	manifestPath := filepath.Join(r.WorkDir, ManifestName)
+	manifest, err := LoadManifest(manifestPath, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range spec.Inputs {
+		if _, err := os.Stat(r.resolve(expand(v, vars))); err != nil {
+			return fmt.Errorf("pipeline input missing : %v", err)
+		}
+	}
+
+	resolveVars := func(paths []string) []string {
+		resolved := make([]string, len(paths))
+		for i, v := range paths {
+			resolved[i] = expand(v, vars)
+		}
+		return resolved
+	}
+	//stages without outputs, like pinning the vCPU, are set up steps. They run if any later stage runs
+	setupNeeded := make([]bool, len(spec.Stages))
+	laterRuns := false
+	for i := len(spec.Stages) - 1; i >= 0; i-- {
+		setupNeeded[i] = laterRuns
+		stage := spec.Stages[i]
+		outputs := resolveVars(stage.outputs())
+		if len(outputs) == 0 {
+			continue
+		}
+		ok, _ := manifest.Stages[stage.Name].upToDate(r.command(stage, vars), resolveVars(stage.Inputs), outputs, r.resolve)
+		laterRuns = laterRuns || !ok || r.forced(spec, i)
+	}
+
+	for i, stage := range spec.Stages {
+		argv := r.command(stage, vars)
+		inputs := resolveVars(stage.Inputs)
+		outputs := resolveVars(stage.outputs())
+
+		if len(outputs) == 0 && !setupNeeded[i] {
+			log.Printf("Stage %v is not needed by any later stage, skipping\n", stage.Name)
+			continue
+		}
+		if len(outputs) > 0 && !r.forced(spec, i) {
+			//checked again, as an earlier stage might have changed the inputs
+			ok, reason := manifest.Stages[stage.Name].upToDate(argv, inputs, outputs, r.resolve)
+			if ok {
+				log.Printf("Stage %v is up to date, skipping\n", stage.Name)
+				continue
+			}
+			log.Printf("Stage %v needs to run : %v\n", stage.Name, reason)
+		}
+
+		record, err := r.runStage(ctx, stage, argv, inputs, outputs, vars)
+		manifest.Stages[stage.Name] = record
+		if saveErr := manifest.Save(manifestPath); saveErr != nil {
+			return saveErr
+		}
+		if err != nil {
+			return fmt.Errorf("stage %v failed after %v attempts : %v", stage.Name, record.Attempts, err)
+		}
+	}
+	return nil
+}
+
+//forced reports whether stage i is at or after the From stage
+func (r *Runner) forced(spec *Spec, i int) bool {
+	if r.From == "" {
+		return false
+	}
+	for _, v := range spec.Stages[:i+1] {
+		if v.Name == r.From {
+			return true
+		}
+	}
+	return false
+}
+
+//runStage runs stage with retries and returns the record for the manifest
+func (r *Runner) runStage(ctx context.Context, stage *StageSpec, argv, inputs, outputs []string, vars map[string]string) (*StageRecord, error) {
+	record := &StageRecord{
+		Command: argv,
+		Started: time.Now(),
+	}
+	var err error
+	for record.Attempts = 1; ; record.Attempts++ {
+		err = r.attempt(ctx, stage, argv, inputs, outputs, vars, record)
+		if err == nil || ctx.Err() != nil || record.Attempts > r.Retries {
+			break
+		}
+		log.Printf("Stage %v attempt %v failed : %v. Retrying in %v\n", stage.Name, record.Attempts, err, r.RetryDelay)
+		select {
+		case <-time.After(r.RetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	record.Finished = time.Now()
+	if err != nil {
+		record.Status = StatusFailed
+		record.Error = err.Error()
+		return record, err
+	}
+	record.Status = StatusDone
+	log.Printf("Stage %v done after %v\n", stage.Name, record.Finished.Sub(record.Started))
+	return record, nil
+}
+
+//attempt runs the command of stage once and checksums its inputs and outputs into record
+func (r *Runner) attempt(ctx context.Context, stage *StageSpec, argv, inputs, outputs []string, vars map[string]string, record *StageRecord) error {
+	var err error
+	//checksum inputs before the run, a stage must not change its inputs unnoticed
+	record.Inputs, err = checksums(inputs, r.resolve)
+	if err != nil {
+		return fmt.Errorf("input unavailable : %v", err)
+	}
+	//remove old outputs, so that a stage that exits without writing them is detected
+	for _, v := range outputs {
+		if err := os.Remove(r.resolve(v)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old output : %v", err)
+		}
+	}
+
+	var stdout io.Writer = os.Stdout
+	if stage.Stdout != "" {
+		f, err := os.Create(r.resolve(expand(stage.Stdout, vars)))
+		if err != nil {
+			return fmt.Errorf("failed to create stdout file : %v", err)
+		}
+		defer f.Close()
+		stdout = f
+	}
+	log.Printf("Stage %v : %v\n", stage.Name, argv)
+	if err := r.Exec(ctx, r.WorkDir, argv, stdout); err != nil {
+		return fmt.Errorf("command failed : %v", err)
+	}
+
+	record.Outputs, err = checksums(outputs, r.resolve)
+	if err != nil {
+		return fmt.Errorf("output missing : %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//fakeTools records the executed commands. Each tool writes the value of its "-out" arg to the path given by "-out"
+type fakeTools struct {
+	calls []string
+	//fail makes the next n runs of the tool fail
+	fail map[string]int
+}
+
+func (f *fakeTools) exec(ctx context.Context, dir string, argv []string, stdout io.Writer) error {
+	tool := argv[0]
+	if tool == "sudo" {
+		tool = argv[1]
+	}
+	f.calls = append(f.calls, tool)
+	if f.fail[tool] > 0 {
+		f.fail[tool]--
+		return errors.New("exit status 1")
+	}
+	for i, v := range argv {
+		if v == "-out" {
+			if err := ioutil.WriteFile(filepath.Join(dir, argv[i+1]), []byte(strings.Join(argv, " ")), 0644); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(stdout, "%v done\n", tool)
+	return err
+}
+
+func testSpec() *Spec {
+	return &Spec{
+		Name: "test",
+		Vars: map[string]string{"cpu": "1"},
+		Stages: []*StageSpec{
+			{Name: "pin", Command: "pin", Args: []string{"${cpu}"}, Privileged: true},
+			{Name: "trace", Command: "trace", Args: []string{"-cpu", "${cpu}", "-out", "trace.txt"}, Privileged: true, Outputs: []string{"trace.txt"}},
+			{Name: "attack", Command: "attack", Args: []string{"-out", "attack.txt"}, Inputs: []string{"trace.txt"}, Outputs: []string{"attack.txt"}},
+			{Name: "recover", Command: "recover", Inputs: []string{"attack.txt"}, Stdout: "key.txt"},
+		},
+	}
+}
+
+func TestSpec_Validate(t *testing.T) {
+	for _, name := range BuiltinNames() {
+		if _, err := Builtin(name); err != nil {
+			t.Errorf("builtin pipeline %v : %v", name, err)
+		}
+	}
+	if len(BuiltinNames()) != 2 {
+		t.Errorf("BuiltinNames() = %v, want the eddsa and ecdh pipelines", BuiltinNames())
+	}
+
+	spec := testSpec()
+	spec.Stages[2].Inputs = []string{"missing.txt"}
+	spec.Stages[3].Args = []string{"${unknown}"}
+	err := spec.Validate()
+	if err == nil || !strings.Contains(err.Error(), "missing.txt") || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Validate() error = %v, want missing input and undeclared variable", err)
+	}
+}
+
+func TestRunner_Run(t *testing.T) {
+	dir := t.TempDir()
+	tools := &fakeTools{fail: map[string]int{"attack": 1}}
+	runner := &Runner{WorkDir: dir, Sudo: "sudo", Exec: tools.exec}
+	spec := testSpec()
+
+	//attack fails, the pipeline stops
+	if err := runner.Run(context.Background(), spec); err == nil {
+		t.Fatalf("Run() succeeded despite failing stage")
+	}
+	manifest, err := LoadManifest(filepath.Join(dir, ManifestName), "test")
+	if err != nil {
+		t.Fatalf("LoadManifest() error = %v", err)
+	}
+	if got := manifest.Stages["attack"]; got.Status != StatusFailed || got.Attempts != 1 {
+		t.Errorf("attack record = %+v, want one failed attempt", got)
+	}
+	if got := manifest.Stages["trace"]; got.Status != StatusDone || got.Outputs["trace.txt"] == "" || got.Command[0] != "sudo" {
+		t.Errorf("trace record = %+v, want done with checksum", got)
+	}
+
+	//rerun continues at the failed stage
+	tools.calls = nil
+	if err := runner.Run(context.Background(), spec); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, want := tools.calls, []string{"pin", "attack", "recover"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(dir, "key.txt"))
+	if err != nil || string(key) != "recover done\n" {
+		t.Errorf("stdout file = %q, %v", key, err)
+	}
+
+	//everything is up to date
+	tools.calls = nil
+	if err := runner.Run(context.Background(), spec); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(tools.calls) != 0 {
+		t.Errorf("calls = %v, want none", tools.calls)
+	}
+
+	//a changed variable invalidates the stage using it and its changed output the next stage. The output of
+	//attack does not change, so recover stays up to date
+	tools.calls = nil
+	runner.Vars = map[string]string{"cpu": "2"}
+	if err := runner.Run(context.Background(), spec); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, want := tools.calls, []string{"pin", "trace", "attack"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+
+	//a modified output is detected
+	tools.calls = nil
+	if err := ioutil.WriteFile(filepath.Join(dir, "attack.txt"), []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Run(context.Background(), spec); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, want := tools.calls, []string{"pin", "attack"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+
+	//from forces the stage and all following ones
+	tools.calls = nil
+	runner.From = "attack"
+	if err := runner.Run(context.Background(), spec); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, want := tools.calls, []string{"pin", "attack", "recover"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestRunner_Retries(t *testing.T) {
+	dir := t.TempDir()
+	tools := &fakeTools{fail: map[string]int{"trace": 2}}
+	runner := &Runner{WorkDir: dir, Retries: 2, Exec: tools.exec}
+	if err := runner.Run(context.Background(), testSpec()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	manifest, err := LoadManifest(filepath.Join(dir, ManifestName), "test")
+	if err != nil {
+		t.Fatalf("LoadManifest() error = %v", err)
+	}
+	if got := manifest.Stages["trace"]; got.Status != StatusDone || got.Attempts != 3 {
+		t.Errorf("trace record = %+v, want done after 3 attempts", got)
+	}
+
+	if _, err := LoadManifest(filepath.Join(dir, ManifestName), "other"); err == nil {
+		t.Errorf("LoadManifest() accepted manifest of other pipeline")
+	}
+	runner.Vars = map[string]string{"foo": "bar"}
+	if err := runner.Run(context.Background(), testSpec()); err == nil {
+		t.Errorf("Run() accepted undeclared variable")
+	}
+}
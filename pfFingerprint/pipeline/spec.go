@@ -0,0 +1,170 @@
+//Package pipeline runs the tools of an attack as a sequence of stages with explicit input and output files.
+//The outputs of completed stages are checksummed in a manifest, so that a rerun skips all stages whose
+//inputs, command and outputs did not change and continues at the first failed stage
+package pipeline
+
+//Description of a pipeline and its validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+//Spec describes a pipeline. It is usually loaded from a JSON file, see ParseSpec
+type Spec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//Vars are the variables with their default values, that can be used as ${name} in commands, args and files
+	Vars map[string]string `json:"vars,omitempty"`
+	//Inputs are files that have to exist before the pipeline starts, i.e. that are produced by no stage
+	Inputs []string     `json:"inputs,omitempty"`
+	Stages []*StageSpec `json:"stages"`
+}
+
+//StageSpec runs Command with Args in the work dir. All paths are relative to the work dir
+type StageSpec struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args,omitempty"`
+	//Privileged stages are run with the sudo command of the Runner
+	Privileged bool `json:"privileged,omitempty"`
+	//Inputs have to be produced by an earlier stage or be listed in Spec.Inputs
+	Inputs []string `json:"inputs,omitempty"`
+	//Outputs are checksummed after the stage succeeded. Stages without outputs are never skipped
+	Outputs []string `json:"outputs,omitempty"`
+	//Stdout is the file the standard output is written to. It counts as output. If empty, stdout is forwarded
+	Stdout string `json:"stdout,omitempty"`
+}
+
+//outputs returns the Outputs including Stdout
+func (s *StageSpec) outputs() []string {
+	if s.Stdout == "" {
+		return s.Outputs
+	}
+	return append(append([]string{}, s.Outputs...), s.Stdout)
+}
+
+//ParseSpec decodes and validates a JSON spec
+func ParseSpec(r io.Reader) (*Spec, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	spec := &Spec{}
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("failed to decode spec : %v", err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+//LoadSpec parses the pipeline spec at path. A path that does not exist is looked up as the name of a
+//builtin pipeline, so "-pipeline openssh-eddsa" works without a spec file
+func LoadSpec(path string) (*Spec, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if spec, builtinErr := Builtin(path); builtinErr == nil {
+			return spec, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pipeline spec : %v", err)
+	}
+	defer f.Close()
+	return ParseSpec(f)
+}
+
+//Stage returns the stage with the given name
+func (s *Spec) Stage(name string) (*StageSpec, bool) {
+	for _, v := range s.Stages {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+//Validate checks that stage names are unique, that every input is available when its stage runs and that
+//only declared variables are used. All problems are reported in one error
+func (s *Spec) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkVars := func(where, v string) {
+		for _, name := range usedVars(v) {
+			if _, ok := s.Vars[name]; !ok {
+				report("%v: undeclared variable %v", where, name)
+			}
+		}
+	}
+
+	if s.Name == "" {
+		report("spec has no name")
+	}
+	if len(s.Stages) == 0 {
+		report("spec has no stages")
+	}
+
+	available := make(map[string]bool)
+	for _, v := range s.Inputs {
+		checkVars("inputs", v)
+		available[v] = true
+	}
+	stages := make(map[string]bool)
+	for i, stage := range s.Stages {
+		where := fmt.Sprintf("stage %v (%v)", i, stage.Name)
+		if stage.Name == "" {
+			report("stage %v has no name", i)
+		}
+		if stages[stage.Name] {
+			report("stage %v declared twice", stage.Name)
+		}
+		stages[stage.Name] = true
+		if stage.Command == "" {
+			report("%v: command missing", where)
+		}
+		checkVars(where, stage.Command)
+		for _, v := range stage.Args {
+			checkVars(where, v)
+		}
+		for _, v := range stage.Inputs {
+			checkVars(where, v)
+			if !available[v] {
+				report("%v: input %v is produced by no earlier stage and not listed in the pipeline inputs", where, v)
+			}
+		}
+		for _, v := range stage.outputs() {
+			checkVars(where, v)
+			available[v] = true
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid spec %v : %v", s.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+var varPattern = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+//usedVars returns the names of all ${name} references in v
+func usedVars(v string) []string {
+	names := make([]string, 0)
+	for _, m := range varPattern.FindAllStringSubmatch(v, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+//expand replaces all ${name} references in v with the value from vars
+func expand(v string, vars map[string]string) string {
+	return varPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		return vars[varPattern.FindStringSubmatch(ref)[1]]
+	})
+}
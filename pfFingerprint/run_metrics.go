@@ -0,0 +1,41 @@
+package pfFingerprint
+
+import (
+	"bufio"
+	"pfFingerprint/metrics"
+	"sync"
+)
+
+//RunMetrics are the metrics of a tracking run that the commands record themselves. The session and the retrack
+//backlog register their own metrics. All fields are nil safe
+type RunMetrics struct {
+	//EventsWritten counts the events saved to the output file
+	EventsWritten *metrics.Counter
+	//TriggerDuration observes the time from triggering the victim until it is done
+	TriggerDuration *metrics.Histogram
+	registry        *metrics.Registry
+}
+
+//NewRunMetrics registers the run metrics in r
+func NewRunMetrics(r *metrics.Registry) *RunMetrics {
+	return &RunMetrics{
+		EventsWritten:   r.Counter("pf_events_written_total", "Events saved to the output file"),
+		TriggerDuration: r.Histogram("pf_trigger_duration_seconds", "Duration of the victim triggers", metrics.LatencyBuckets),
+		registry:        r,
+	}
+}
+
+//WatchWriter exports the bytes buffered in w and its buffer size. lock has to guard all uses of w, as the
+//metrics are read concurrently
+func (m *RunMetrics) WatchWriter(w *bufio.Writer, lock sync.Locker) {
+	m.registry.GaugeFunc("pf_writer_buffered_bytes", "Bytes in the output buffer that have not been written to the file", func() float64 {
+		lock.Lock()
+		defer lock.Unlock()
+		return float64(w.Buffered())
+	})
+	m.registry.GaugeFunc("pf_writer_buffer_size_bytes", "Size of the output buffer", func() float64 {
+		lock.Lock()
+		defer lock.Unlock()
+		return float64(w.Size())
+	})
+}
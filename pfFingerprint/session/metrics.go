@@ -0,0 +1,66 @@
+package session
+
+import (
+	"pfFingerprint/metrics"
+	"strings"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//sessionMetrics are recorded by the commands of a Session. All fields are nil without RegisterMetrics, which
+//makes recording a no-op
+type sessionMetrics struct {
+	received       *metrics.Counter
+	acked          *metrics.Counter
+	memReadErrors  *metrics.Counter
+	memReadLatency *metrics.Histogram
+}
+
+//RegisterMetrics records the events received and acked, the guest memory reads and the tracked pages of the
+//session in r. Calling it for a new session continues the counters of the previous one, e.g. for one session
+//per attack attempt
+func (s *Session) RegisterMetrics(r *metrics.Registry) {
+	m := sessionMetrics{
+		received:       r.Counter("pf_events_received_total", "Page fault events received from the kernel, by polling or batch tracking"),
+		acked:          r.Counter("pf_events_acked_total", "Page fault events acknowledged to the kernel"),
+		memReadErrors:  r.Counter("pf_guest_memory_read_errors_total", "Failed reads of guest memory"),
+		memReadLatency: r.Histogram("pf_guest_memory_read_seconds", "Latency of guest memory reads", metrics.LatencyBuckets),
+	}
+	r.Rate("pf_events_per_second", "Page fault events received per second, averaged over at least 10 seconds",
+		func() float64 { return float64(m.received.Value()) }, 10*time.Second)
+
+	for _, name := range strings.Split(strings.Trim(TrackModeNames, "{}"), ",") {
+		mode, err := ParseTrackMode(name)
+		if err != nil {
+			continue
+		}
+		r.GaugeFunc("pf_tracked_pages", "Pages tracked individually since the last untrack all, by tracking mode",
+			func() float64 { return float64(s.TrackedPages(mode)) }, "mode", name)
+		r.GaugeFunc("pf_tracking_all_pages", "1 if all pages are tracked in the mode, e.g. by batch tracking with re-tracking",
+			func() float64 { return s.trackingAll(mode) }, "mode", name)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics = m
+}
+
+//trackingAll returns 1 if all pages are tracked in mode and 0 otherwise
+func (s *Session) trackingAll(mode sevStep.PageTrackMode) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.allTracked[mode] {
+		return 1
+	}
+	return 0
+}
+
+//addBatchEvents adds the events of the current batch run beyond batchSeen to the received events. The caller
+//must hold the lock
+func (s *Session) addBatchEvents(count uint64) {
+	if count > s.batchSeen {
+		s.metrics.received.Add(count - s.batchSeen)
+		s.batchSeen = count
+	}
+}
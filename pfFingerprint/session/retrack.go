@@ -0,0 +1,197 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//Fault is a page fault as seen by a RetrackPolicy
+type Fault struct {
+	Event *sevStep.Event
+	//Seq numbers the faults since the last RetrackBacklog.Reset, starting at 1. Set by RetrackBacklog.PushFault
+	Seq uint64
+	//InstrDelta is the number of instructions the guest retired since the previous fault.
+	//Only valid if HaveInstrDelta is set, i.e. if the perf counter is available
+	InstrDelta     uint64
+	HaveInstrDelta bool
+}
+
+//RetrackPolicy decides which faulted pages are re-tracked and when. Re-tracking a page before the faulting
+//instruction has been retired leads to an endless fault loop, e.g. for instructions that access several pages
+type RetrackPolicy interface {
+	//Name identifies the policy in the RetrackStats
+	Name() string
+	//Admit reports whether the page of f enters the backlog. Pages that are not admitted stay untracked until
+	//the tracking is initialized again
+	Admit(f Fault) bool
+	//Release reports whether the pending fault may be re-tracked at the current fault. It is called before
+	//current enters the backlog
+	Release(pending, current Fault) bool
+}
+
+//AlwaysPolicy re-tracks the backlog at every fault. This assumes that each fault means progress
+type AlwaysPolicy struct{}
+
+func (AlwaysPolicy) Name() string                        { return "always" }
+func (AlwaysPolicy) Admit(f Fault) bool                  { return true }
+func (AlwaysPolicy) Release(pending, current Fault) bool { return true }
+
+//RetiredInstrPolicy re-tracks the backlog once the guest retired more than Threshold instructions between two
+//faults. Holds all pages if the perf counter is not available
+type RetiredInstrPolicy struct {
+	Threshold uint64
+}
+
+func (RetiredInstrPolicy) Name() string       { return "instr" }
+func (RetiredInstrPolicy) Admit(f Fault) bool { return true }
+func (p RetiredInstrPolicy) Release(pending, current Fault) bool {
+	return current.HaveInstrDelta && current.InstrDelta > p.Threshold
+}
+
+//RIPChangePolicy re-tracks a page once a fault happens at a different RIP than the fault of the page, i.e. once
+//the instruction that accessed the page is done. Faults without RIP info count as progress
+type RIPChangePolicy struct{}
+
+func (RIPChangePolicy) Name() string       { return "rip" }
+func (RIPChangePolicy) Admit(f Fault) bool { return true }
+func (RIPChangePolicy) Release(pending, current Fault) bool {
+	if !pending.Event.HaveRipInfo || !current.Event.HaveRipInfo {
+		return true
+	}
+	return pending.Event.RIP != current.Event.RIP
+}
+
+//KernelGPAPolicy never re-tracks the pages in its set, e.g. the kernel pages found by classifyKernelPages.
+//In contrast to KernelRIPPolicy this works without RIP info
+type KernelGPAPolicy struct {
+	pages map[uint64]bool
+}
+
+//NewKernelGPAPolicy excludes the pages of gpas
+func NewKernelGPAPolicy(gpas []uint64) *KernelGPAPolicy {
+	pages := make(map[uint64]bool, len(gpas))
+	for _, v := range gpas {
+		pages[v&^0xfff] = true
+	}
+	return &KernelGPAPolicy{pages: pages}
+}
+
+func (p *KernelGPAPolicy) Name() string                        { return "kernelGPA" }
+func (p *KernelGPAPolicy) Admit(f Fault) bool                  { return !p.pages[f.Event.FaultedGPA&^0xfff] }
+func (p *KernelGPAPolicy) Release(pending, current Fault) bool { return true }
+
+//KernelRIPPolicy ignores faults from kernel space, based on the RIP. Their pages are never re-tracked and they do
+//not release the backlog either, like the kernel space exclusion it simulates. Requires RIP info
+type KernelRIPPolicy struct{}
+
+func (KernelRIPPolicy) Name() string                        { return "kernelRIP" }
+func (KernelRIPPolicy) Admit(f Fault) bool                  { return f.Event.RIP < 0xffff800000000000 }
+func (KernelRIPPolicy) Release(pending, current Fault) bool { return current.Event.RIP < 0xffff800000000000 }
+
+//WindowPolicy re-tracks the whole backlog at every Size-th fault
+type WindowPolicy struct {
+	Size uint64
+}
+
+func (WindowPolicy) Name() string       { return "window" }
+func (WindowPolicy) Admit(f Fault) bool { return true }
+func (p WindowPolicy) Release(pending, current Fault) bool {
+	return current.Seq%p.Size == 0
+}
+
+//HoldLastPolicy never re-tracks the pages of the last N faults, including the current one. With N = 2 a page is
+//re-tracked at the second fault after its own
+type HoldLastPolicy struct {
+	N uint64
+}
+
+func (HoldLastPolicy) Name() string       { return "lastN" }
+func (HoldLastPolicy) Admit(f Fault) bool { return true }
+func (p HoldLastPolicy) Release(pending, current Fault) bool {
+	return current.Seq-pending.Seq >= p.N
+}
+
+//RetrackPolicyNames lists the values accepted by ParseRetrackPolicies, for flag descriptions
+const RetrackPolicyNames = "{always,instr[:threshold],rip,kernelGPA:path,kernelRIP,window[:size],lastN[:n]}"
+
+//ParseRetrackPolicies parses a comma separated list of policies with optional arguments, e.g. "rip,kernelGPA:kernel.txt".
+//The argument of kernelGPA is a file in the format of ParseAllowList
+func ParseRetrackPolicies(spec string) ([]RetrackPolicy, error) {
+	policies := make([]RetrackPolicy, 0)
+	for _, v := range strings.Split(spec, ",") {
+		name, arg := v, ""
+		if i := strings.Index(v, ":"); i != -1 {
+			name, arg = v[:i], v[i+1:]
+		}
+		//numeric argument with default value
+		number := func(def uint64) (uint64, error) {
+			if arg == "" {
+				return def, nil
+			}
+			n, err := strconv.ParseUint(arg, 0, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid argument for retrack policy %v : %v", name, err)
+			}
+			return n, nil
+		}
+
+		switch name {
+		case "always":
+			policies = append(policies, AlwaysPolicy{})
+		case "instr":
+			threshold, err := number(2)
+			if err != nil {
+				return nil, err
+			}
+			policies = append(policies, RetiredInstrPolicy{Threshold: threshold})
+		case "rip":
+			policies = append(policies, RIPChangePolicy{})
+		case "kernelGPA":
+			if arg == "" {
+				return nil, fmt.Errorf("retrack policy kernelGPA requires a file, e.g. kernelGPA:kernel.txt")
+			}
+			gpas, err := LoadAllowList(arg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load kernel gpas : %v", err)
+			}
+			policies = append(policies, NewKernelGPAPolicy(gpas))
+		case "kernelRIP":
+			policies = append(policies, KernelRIPPolicy{})
+		case "window":
+			size, err := number(8)
+			if err != nil {
+				return nil, err
+			}
+			if size == 0 {
+				return nil, fmt.Errorf("window size has to be positive")
+			}
+			policies = append(policies, WindowPolicy{Size: size})
+		case "lastN":
+			n, err := number(2)
+			if err != nil {
+				return nil, err
+			}
+			policies = append(policies, HoldLastPolicy{N: n})
+		default:
+			return nil, fmt.Errorf("unknown retrack policy %q, valid values are %v", name, RetrackPolicyNames)
+		}
+	}
+	return policies, nil
+}
+
+//RetrackStats counts the decisions of a single policy. Admitted and Excluded count faults, Released and Held
+//count the checks of pending pages, i.e. a page that waits for three faults is held up to three times
+type RetrackStats struct {
+	Policy   string
+	Admitted uint64
+	Excluded uint64
+	Released uint64
+	Held     uint64
+}
+
+func (r RetrackStats) String() string {
+	return fmt.Sprintf("%v: admitted %v, excluded %v, released %v, held %v", r.Policy, r.Admitted, r.Excluded, r.Released, r.Held)
+}
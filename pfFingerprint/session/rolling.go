@@ -0,0 +1,294 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pfFingerprint"
+	"pfFingerprint/metrics"
+	"sort"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//kernelRetrackBacklogSize is the size of the re-track backlog of the kernel, see uspt_batch_tracking_handle_retrack
+const kernelRetrackBacklogSize = 10
+
+//kernelAckTimeout is the time after which the kernel stops waiting for the ack of a polled event. Later faults
+//fail until the event has been acked
+const kernelAckTimeout = time.Second
+
+//Reasons of a LossWindow
+const (
+	//LossOverflow means the kernel buffer was full. Chunk.Dropped events are missing
+	LossOverflow = "overflow"
+	//LossUnfetched covers the events recorded between reading the event count and stopping the batch. The kernel
+	//frees them on stop
+	LossUnfetched = "unfetched"
+	//LossGap means the restart took longer than the ack timeout of the kernel. Faults in the gap may have failed
+	LossGap = "gap"
+)
+
+//RollingConfig holds the batch tracking parameters used for every chunk
+type RollingConfig struct {
+	TrackType sevStep.PageTrackMode
+	//ChunkSize is the capacity of the kernel buffer of each chunk. The kernel allocates and clears the buffer on
+	//every restart, large values prolong the gaps between the chunks
+	ChunkSize uint64
+	PerfCPU   int
+	Retrack   bool
+	//GapSettle is how long to keep polling for faults of the gap after the restart
+	GapSettle time.Duration
+	//Poll configures the polling during GapSettle. The zero value uses pfFingerprint.DefaultPollConfig
+	Poll pfFingerprint.PollConfig
+}
+
+//LossWindow is a time range in which events may be missing from the trace
+type LossWindow struct {
+	Reason string
+	From   time.Time
+	To     time.Time
+}
+
+//Chunk holds the events of one batch and the faults of the gap after it
+type Chunk struct {
+	Seq uint64
+	//Late are faults of the gap before this chunk that were reported after the restart had settled
+	Late []*sevStep.Event
+	//Events are the batch events. Their IDs restart at 0 in every chunk and the retired instructions of the first
+	//event are not valid
+	Events []*sevStep.Event
+	//Dropped is the number of events that did not fit into the kernel buffer
+	Dropped uint64
+	Counted time.Time
+	Stopped time.Time
+	//Resumed is the restart of batch tracking, zero for the final chunk. GapEvents are the faults reported by
+	//polling between Stopped and Resumed
+	Resumed   time.Time
+	GapEvents []*sevStep.Event
+	//Losses are sorted by From
+	Losses []LossWindow
+}
+
+//LateLine formats the marker preceding Late as a line for trace files. Only valid if Late is not empty
+func (c *Chunk) LateLine() string {
+	return fmt.Sprintf("Gap %v late events %v\n", c.Seq-1, len(c.Late))
+}
+
+//HeaderLine formats the marker preceding Events as a line for trace files. Times are given in unix nanoseconds,
+//like the timestamps of the events. Like all markers, the line neither starts with "Start" nor with "Stop"
+func (c *Chunk) HeaderLine() string {
+	return fmt.Sprintf("Chunk %v events %v dropped %v counted %v stopped %v\n", c.Seq, len(c.Events), c.Dropped, c.Counted.UnixNano(), c.Stopped.UnixNano())
+}
+
+//LossLines formats a marker for each entry of Losses
+func (c *Chunk) LossLines() []string {
+	lines := make([]string, 0, len(c.Losses))
+	for _, v := range c.Losses {
+		lines = append(lines, fmt.Sprintf("Loss %v reason %v from %v to %v\n", c.Seq, v.Reason, v.From.UnixNano(), v.To.UnixNano()))
+	}
+	return lines
+}
+
+//GapLine formats the marker preceding GapEvents. Only valid if the chunk has been restarted
+func (c *Chunk) GapLine() string {
+	return fmt.Sprintf("Gap %v from %v to %v events %v\n", c.Seq, c.Stopped.UnixNano(), c.Resumed.UnixNano(), len(c.GapEvents))
+}
+
+//rollingMetrics are nil without RegisterMetrics, which makes recording a no-op
+type rollingMetrics struct {
+	chunks    *metrics.Counter
+	gapEvents *metrics.Counter
+	dropped   *metrics.Counter
+	losses    map[string]*metrics.Counter
+	gap       *metrics.Histogram
+}
+
+//RollingBatch drains batch tracking in chunks while the guest runs. Each drain stops batch tracking, fetches the
+//events and restarts it. In between, the kernel reports faults by polling and blocks the vCPU until they are
+//acked. RollingBatch acks them and, with re-tracking, tracks their pages and the pages the kernel dropped from its
+//re-track backlog again. It is not safe for concurrent use
+type RollingBatch struct {
+	s       *Session
+	config  RollingConfig
+	seq     uint64
+	started time.Time
+	metrics rollingMetrics
+	now     func() time.Time
+	source  *pfFingerprint.EventSource
+}
+
+//NewRollingBatch creates a rolling batch on s. Call Start to start the first chunk
+func NewRollingBatch(s *Session, config RollingConfig) *RollingBatch {
+	if config.Poll == (pfFingerprint.PollConfig{}) {
+		config.Poll = pfFingerprint.DefaultPollConfig()
+	}
+	return &RollingBatch{
+		s:      s,
+		config: config,
+		now:    time.Now,
+		source: pfFingerprint.NewEventSource(s, config.Poll),
+	}
+}
+
+//RegisterMetrics exports the chunks, the faults of the gaps and the loss windows in reg
+func (r *RollingBatch) RegisterMetrics(reg *metrics.Registry) {
+	r.metrics = rollingMetrics{
+		chunks:    reg.Counter("pf_batch_chunks_total", "Chunks drained by rolling batch tracking"),
+		gapEvents: reg.Counter("pf_batch_gap_events_total", "Faults reported by polling between two chunks"),
+		dropped:   reg.Counter("pf_batch_dropped_events_total", "Events that did not fit into the kernel buffer of a chunk"),
+		losses:    make(map[string]*metrics.Counter),
+		gap:       reg.Histogram("pf_batch_gap_seconds", "Time between stopping a chunk and starting the next one", metrics.LatencyBuckets),
+	}
+	for _, reason := range []string{LossOverflow, LossUnfetched, LossGap} {
+		r.metrics.losses[reason] = reg.Counter("pf_batch_loss_windows_total", "Time ranges in which events may be missing, by reason", "reason", reason)
+	}
+}
+
+//Start starts batch tracking for the first chunk
+func (r *RollingBatch) Start() error {
+	if err := r.start(); err != nil {
+		return err
+	}
+	r.seq = 0
+	return nil
+}
+
+func (r *RollingBatch) start() error {
+	if err := r.s.CmdBatchTrackingStart(r.config.TrackType, r.config.ChunkSize, r.config.PerfCPU, r.config.Retrack); err != nil {
+		return fmt.Errorf("failed to start batch tracking : %v", err)
+	}
+	r.started = r.now()
+	return nil
+}
+
+//Drain stops the current chunk and returns its events. If restart is set, batch tracking is started again and the
+//faults of the gap are collected. Otherwise batch tracking stays stopped, e.g. once the victim is done
+func (r *RollingBatch) Drain(restart bool) (*Chunk, error) {
+	c := &Chunk{Seq: r.seq}
+	late, err := r.pollGap(0)
+	if err != nil {
+		return nil, err
+	}
+	c.Late = late
+
+	count, err := r.s.CmdBatchTrackingEventCount()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get event count : %v", err)
+	}
+	c.Counted = r.now()
+	//the kernel keeps counting on a full buffer, but fetching more than its size is not checked
+	if count > r.config.ChunkSize {
+		c.Dropped = count - r.config.ChunkSize
+		count = r.config.ChunkSize
+	}
+	events, errDuringBatch, err := r.s.CmdBatchTrackingStopAndGet(count)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stop batch tracking : %v", err)
+	}
+	c.Stopped = r.now()
+	c.Events = events
+	if errDuringBatch || c.Dropped > 0 {
+		from := r.started
+		if len(events) > 0 {
+			from = events[len(events)-1].Timestamp
+		}
+		c.Losses = append(c.Losses, LossWindow{Reason: LossOverflow, From: from, To: c.Counted})
+	}
+	c.Losses = append(c.Losses, LossWindow{Reason: LossUnfetched, From: c.Counted, To: c.Stopped})
+
+	if restart {
+		if err := r.start(); err != nil {
+			return nil, err
+		}
+		c.Resumed = r.started
+		if c.Resumed.Sub(c.Stopped) > kernelAckTimeout {
+			c.Losses = append(c.Losses, LossWindow{Reason: LossGap, From: c.Stopped, To: c.Resumed})
+		}
+		if c.GapEvents, err = r.pollGap(r.config.GapSettle); err != nil {
+			return nil, err
+		}
+		if r.config.Retrack {
+			if err := r.retrack(pendingRetrack(events), c.GapEvents); err != nil {
+				return nil, err
+			}
+		}
+		r.metrics.gap.ObserveDuration(c.Resumed.Sub(c.Stopped))
+		r.seq++
+	}
+
+	sort.SliceStable(c.Losses, func(i, j int) bool { return c.Losses[i].From.Before(c.Losses[j].From) })
+	r.metrics.chunks.Inc()
+	r.metrics.gapEvents.Add(uint64(len(c.Late) + len(c.GapEvents)))
+	r.metrics.dropped.Add(c.Dropped)
+	for _, v := range c.Losses {
+		r.metrics.losses[v.Reason].Inc()
+	}
+	return c, nil
+}
+
+//pollGap acks all faults reported by polling. Keeps polling until there has been no fault for settle, with the
+//backoff of RollingConfig.Poll, so that the core next to the vCPU is not kept busy
+func (r *RollingBatch) pollGap(settle time.Duration) ([]*sevStep.Event, error) {
+	events := make([]*sevStep.Event, 0)
+	for {
+		e, ok, err := r.s.CmdPollEvent()
+		if err != nil {
+			return nil, fmt.Errorf("failed to poll event : %v", err)
+		}
+		if !ok {
+			if settle <= 0 {
+				return events, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), settle)
+			e, err = r.source.Next(ctx)
+			cancel()
+			if errors.Is(err, pfFingerprint.ErrCtxCancelled) {
+				return events, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to poll event : %v", err)
+			}
+		}
+		if err := r.s.CmdAckEvent(e.ID); err != nil {
+			return nil, fmt.Errorf("failed to ack event : %v", err)
+		}
+		events = append(events, e)
+	}
+}
+
+//retrack tracks the pages of pending and of the faults in the gap again. Both have been untracked by their fault
+//and the kernel only re-tracks pages while batch tracking is active
+func (r *RollingBatch) retrack(pending []uint64, gapEvents []*sevStep.Event) error {
+	done := make(map[uint64]bool)
+	for _, v := range gapEvents {
+		pending = append(pending, v.FaultedGPA&^0xfff)
+	}
+	for _, gpa := range pending {
+		if done[gpa] {
+			continue
+		}
+		done[gpa] = true
+		if err := r.s.CmdTrackPage(gpa, r.config.TrackType); err != nil {
+			return fmt.Errorf("failed to re-track 0x%x : %v", gpa, err)
+		}
+	}
+	return nil
+}
+
+//pendingRetrack returns the pages that are in the re-track backlog of the kernel after events. The kernel drops
+//the backlog on stop. Mirrors uspt_batch_tracking_handle_retrack
+func pendingRetrack(events []*sevStep.Event) []uint64 {
+	pending := make([]uint64, 0, kernelRetrackBacklogSize)
+	for i, e := range events {
+		progress := i == 0 || !e.HaveRetiredInstructions || e.RetiredInstructions >= 2
+		if progress {
+			pending = pending[:0]
+		} else if len(pending) >= kernelRetrackBacklogSize {
+			continue
+		}
+		pending = append(pending, e.FaultedGPA&^0xfff)
+	}
+	return pending
+}
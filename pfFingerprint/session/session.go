@@ -0,0 +1,318 @@
+//Package session wraps the sevStep ioctl API and remembers all tracking state that it sets up, so that it
+//can be undone when the command exits. Close untracks all pages in every mode that has been used, stops batch
+//tracking and resets the kernel side, which also stops the perf counters
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//IoctlAPI is implemented by sevStep.IoctlAPI. Allows to replace the API in tests
+type IoctlAPI interface {
+	CmdTrackPage(gpa uint64, trackMode sevStep.PageTrackMode) error
+	CmdTrackAllPages(trackMode sevStep.PageTrackMode) error
+	CmdUnTrackAllPages(trackMode sevStep.PageTrackMode) error
+	CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error)
+	CmdPollEvent() (*sevStep.Event, bool, error)
+	CmdAckEvent(id uint64) error
+	CmdSetupRetInstrPerf(cpu int) error
+	CmdReadRetInstrPerf(cpu int) (uint64, error)
+	CmdBatchTrackingStart(trackingType sevStep.PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error
+	CmdBatchTrackingEventCount() (uint64, error)
+	CmdBatchTrackingStopAndGet(eventCount uint64) ([]*sevStep.Event, bool, error)
+	Close() error
+}
+
+//ErrClosed is returned by all commands after the session has been closed
+var ErrClosed = errors.New("session closed")
+
+//Session forwards commands to the ioctl API and records the tracking state. It is safe for concurrent use.
+//All commands fail with ErrClosed once Close has been called
+type Session struct {
+	api   IoctlAPI
+	mutex sync.Mutex
+	//tracked holds the pages tracked with CmdTrackPage for each mode. Pages that faulted are not removed, as
+	//the kernel might have re-tracked them
+	tracked map[sevStep.PageTrackMode]map[uint64]bool
+	//allTracked holds the modes used with CmdTrackAllPages or CmdBatchTrackingStart
+	allTracked  map[sevStep.PageTrackMode]bool
+	batchActive bool
+	perfCPUs    map[int]bool
+	closed      bool
+	closeErr    error
+	//metrics are set by RegisterMetrics. batchSeen is the batch event count that has already been added to them
+	metrics   sessionMetrics
+	batchSeen uint64
+}
+
+//New creates a session for api. The session owns api and closes it in Close
+func New(api IoctlAPI) *Session {
+	return &Session{
+		api:        api,
+		tracked:    make(map[sevStep.PageTrackMode]map[uint64]bool),
+		allTracked: make(map[sevStep.PageTrackMode]bool),
+		perfCPUs:   make(map[int]bool),
+	}
+}
+
+//Open opens the ioctl API at kvmDevicePath and creates a session for it. See sevStep.NewIoctlAPI for getRIP
+func Open(kvmDevicePath string, getRIP bool) (*Session, error) {
+	api, err := sevStep.NewIoctlAPI(kvmDevicePath, getRIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init ioctl API : %v", err)
+	}
+	return New(api), nil
+}
+
+//CloseOnDone closes the session once ctx is done. Use with signal.NotifyContext to clean up on SIGINT, even if
+//the command is blocked elsewhere
+func (s *Session) CloseOnDone(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.Cleanup()
+	}()
+}
+
+//Cleanup calls Close and logs the error. Meant to be deferred
+func (s *Session) Cleanup() {
+	if err := s.Close(); err != nil {
+		log.Printf("Failed to clean up tracking session : %v", err)
+	}
+}
+
+//CloseOnPanic closes the session if the goroutine panics and re-panics afterwards. Has to be deferred directly,
+//in every goroutine that uses the session. A panic in a goroutine ends the process without running the deferred
+//calls of main
+func (s *Session) CloseOnPanic() {
+	if r := recover(); r != nil {
+		s.Cleanup()
+		panic(r)
+	}
+}
+
+//Close undoes all tracking done via the session and closes the ioctl API. Calling Close more than once
+//returns the result of the first call
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return s.closeErr
+	}
+	s.closed = true
+
+	var errs []string
+	if s.batchActive {
+		log.Printf("Stopping batch tracking")
+		count, err := s.api.CmdBatchTrackingEventCount()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to get batch event count : %v", err))
+		} else if _, _, err := s.api.CmdBatchTrackingStopAndGet(count); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to stop batch tracking : %v", err))
+		}
+		s.batchActive = false
+	}
+	for _, mode := range s.usedModes() {
+		log.Printf("Untracking all pages in mode %v (%v pages tracked individually)", mode, len(s.tracked[mode]))
+		if err := s.api.CmdUnTrackAllPages(mode); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to untrack mode %v : %v", mode, err))
+		}
+	}
+	if len(s.perfCPUs) > 0 {
+		log.Printf("Resetting perf counters on cpus %v", s.perfCPUList())
+	}
+	//closing the API resets the kernel side, this also disables the perf counters
+	if err := s.api.Close(); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to close ioctl API : %v", err))
+	}
+
+	if len(errs) > 0 {
+		s.closeErr = fmt.Errorf("cleanup failed : %v", errs)
+	}
+	return s.closeErr
+}
+
+//usedModes returns all modes with tracked pages, sorted for reproducible cleanup
+func (s *Session) usedModes() []sevStep.PageTrackMode {
+	modes := make([]sevStep.PageTrackMode, 0)
+	for mode, pages := range s.tracked {
+		if len(pages) > 0 && !s.allTracked[mode] {
+			modes = append(modes, mode)
+		}
+	}
+	for mode, ok := range s.allTracked {
+		if ok {
+			modes = append(modes, mode)
+		}
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	return modes
+}
+
+func (s *Session) perfCPUList() []int {
+	cpus := make([]int, 0, len(s.perfCPUs))
+	for cpu := range s.perfCPUs {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus
+}
+
+//TrackedPages returns the number of pages tracked with CmdTrackPage in mode since the last CmdUnTrackAllPages
+func (s *Session) TrackedPages(mode sevStep.PageTrackMode) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.tracked[mode])
+}
+
+func (s *Session) CmdTrackPage(gpa uint64, trackMode sevStep.PageTrackMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.tracked[trackMode] == nil {
+		s.tracked[trackMode] = make(map[uint64]bool)
+	}
+	//record before the call, the page might be tracked even if the call reports an error
+	s.tracked[trackMode][gpa] = true
+	return s.api.CmdTrackPage(gpa, trackMode)
+}
+
+func (s *Session) CmdTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.allTracked[trackMode] = true
+	return s.api.CmdTrackAllPages(trackMode)
+}
+
+func (s *Session) CmdUnTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.api.CmdUnTrackAllPages(trackMode); err != nil {
+		return err
+	}
+	delete(s.tracked, trackMode)
+	delete(s.allTracked, trackMode)
+	return nil
+}
+
+func (s *Session) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	start := time.Now()
+	mem, err := s.api.CmdReadGuestMemory(gpa, size, hostDecryption, wbinvdCPU)
+	s.metrics.memReadLatency.ObserveDuration(time.Since(start))
+	if err != nil {
+		s.metrics.memReadErrors.Inc()
+	}
+	return mem, err
+}
+
+func (s *Session) CmdPollEvent() (*sevStep.Event, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, false, ErrClosed
+	}
+	e, ok, err := s.api.CmdPollEvent()
+	if err == nil && ok {
+		s.metrics.received.Inc()
+	}
+	return e, ok, err
+}
+
+func (s *Session) CmdAckEvent(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.api.CmdAckEvent(id); err != nil {
+		return err
+	}
+	s.metrics.acked.Inc()
+	return nil
+}
+
+func (s *Session) CmdSetupRetInstrPerf(cpu int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.perfCPUs[cpu] = true
+	return s.api.CmdSetupRetInstrPerf(cpu)
+}
+
+func (s *Session) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	return s.api.CmdReadRetInstrPerf(cpu)
+}
+
+func (s *Session) CmdBatchTrackingStart(trackingType sevStep.PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.api.CmdBatchTrackingStart(trackingType, expectedEvents, perfCPU, retrack); err != nil {
+		return err
+	}
+	s.batchActive = true
+	s.batchSeen = 0
+	//with re-tracking, the kernel tracks faulted pages in this mode on its own
+	if retrack {
+		s.allTracked[trackingType] = true
+	}
+	return nil
+}
+
+func (s *Session) CmdBatchTrackingEventCount() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	count, err := s.api.CmdBatchTrackingEventCount()
+	if err == nil && s.batchActive {
+		s.addBatchEvents(count)
+	}
+	return count, err
+}
+
+func (s *Session) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*sevStep.Event, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, false, ErrClosed
+	}
+	events, errDuringBatch, err := s.api.CmdBatchTrackingStopAndGet(eventCount)
+	if err != nil {
+		return nil, false, err
+	}
+	s.batchActive = false
+	s.addBatchEvents(uint64(len(events)))
+	s.batchSeen = 0
+	return events, errDuringBatch, nil
+}
@@ -0,0 +1,619 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pfFingerprint"
+	"pfFingerprint/metrics"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//fakeAPI records all commands as strings
+type fakeAPI struct {
+	calls      []string
+	batchCount uint64
+	//batchEvents are returned by CmdBatchTrackingStopAndGet if set, polled by CmdPollEvent
+	batchEvents    []*sevStep.Event
+	errDuringBatch bool
+	polled         []*sevStep.Event
+	polls          int
+	acked          []uint64
+	//failTrack makes CmdTrackPage fail for these pages
+	failTrack map[uint64]bool
+	//gapEvents are moved to polled by the next CmdBatchTrackingStart, i.e. they faulted before the restart
+	gapEvents []*sevStep.Event
+}
+
+func (f *fakeAPI) record(format string, args ...interface{}) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeAPI) CmdTrackPage(gpa uint64, trackMode sevStep.PageTrackMode) error {
+	f.record("track %x %v", gpa, trackMode)
+	if f.failTrack[gpa] {
+		return fmt.Errorf("track %x failed", gpa)
+	}
+	return nil
+}
+
+func (f *fakeAPI) CmdTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	f.record("trackAll %v", trackMode)
+	return nil
+}
+
+func (f *fakeAPI) CmdUnTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	f.record("untrackAll %v", trackMode)
+	return nil
+}
+
+func (f *fakeAPI) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+func (f *fakeAPI) CmdPollEvent() (*sevStep.Event, bool, error) {
+	f.polls++
+	if len(f.polled) == 0 {
+		return nil, false, nil
+	}
+	e := f.polled[0]
+	f.polled = f.polled[1:]
+	return e, true, nil
+}
+
+func (f *fakeAPI) CmdAckEvent(id uint64) error {
+	f.acked = append(f.acked, id)
+	return nil
+}
+
+func (f *fakeAPI) CmdSetupRetInstrPerf(cpu int) error {
+	f.record("perf %v", cpu)
+	return nil
+}
+
+func (f *fakeAPI) CmdReadRetInstrPerf(cpu int) (uint64, error) {
+	return 0, nil
+}
+
+func (f *fakeAPI) CmdBatchTrackingStart(trackingType sevStep.PageTrackMode, expectedEvents uint64, perfCPU int, retrack bool) error {
+	f.record("batchStart %v %v", trackingType, retrack)
+	f.polled = append(f.polled, f.gapEvents...)
+	f.gapEvents = nil
+	return nil
+}
+
+func (f *fakeAPI) CmdBatchTrackingEventCount() (uint64, error) {
+	return f.batchCount, nil
+}
+
+func (f *fakeAPI) CmdBatchTrackingStopAndGet(eventCount uint64) ([]*sevStep.Event, bool, error) {
+	f.record("batchStop %v", eventCount)
+	if f.batchEvents != nil {
+		return f.batchEvents[:eventCount], f.errDuringBatch, nil
+	}
+	return make([]*sevStep.Event, eventCount), f.errDuringBatch, nil
+}
+
+func (f *fakeAPI) Close() error {
+	f.record("close")
+	return nil
+}
+
+func TestSession_Close(t *testing.T) {
+	tests := []struct {
+		name string
+		//setup issues commands on the session before Close
+		setup     func(s *Session) error
+		wantCalls []string
+	}{
+		{
+			name:      "Nothing tracked",
+			setup:     func(s *Session) error { return nil },
+			wantCalls: []string{"close"},
+		},
+		{
+			name: "Single pages in two modes",
+			setup: func(s *Session) error {
+				if err := s.CmdTrackPage(0x1000, sevStep.PageTrackExec); err != nil {
+					return err
+				}
+				if err := s.CmdTrackPage(0x2000, sevStep.PageTrackWrite); err != nil {
+					return err
+				}
+				return s.CmdSetupRetInstrPerf(2)
+			},
+			wantCalls: []string{"track 1000 3", "track 2000 0", "perf 2", "untrackAll 0", "untrackAll 3", "close"},
+		},
+		{
+			name: "Mode already untracked",
+			setup: func(s *Session) error {
+				if err := s.CmdTrackAllPages(sevStep.PageTrackAccess); err != nil {
+					return err
+				}
+				if err := s.CmdTrackPage(0x1000, sevStep.PageTrackWrite); err != nil {
+					return err
+				}
+				return s.CmdUnTrackAllPages(sevStep.PageTrackAccess)
+			},
+			wantCalls: []string{"trackAll 1", "track 1000 0", "untrackAll 1", "untrackAll 0", "close"},
+		},
+		{
+			name: "Active batch",
+			setup: func(s *Session) error {
+				if err := s.CmdBatchTrackingStart(sevStep.PageTrackAccess, 10, 0, true); err != nil {
+					return err
+				}
+				return s.InitTracking([]uint64{0x1000}, sevStep.PageTrackAccess, false)
+			},
+			wantCalls: []string{"batchStart 1 true", "track 1000 1", "batchStop 5", "untrackAll 1", "close"},
+		},
+		{
+			name: "Stopped batch",
+			setup: func(s *Session) error {
+				if err := s.CmdBatchTrackingStart(sevStep.PageTrackAccess, 10, 0, false); err != nil {
+					return err
+				}
+				_, _, err := s.CmdBatchTrackingStopAndGet(1)
+				return err
+			},
+			wantCalls: []string{"batchStart 1 false", "batchStop 1", "close"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPI{batchCount: 5}
+			s := New(api)
+			if err := tt.setup(s); err != nil {
+				t.Fatalf("setup failed : %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if !reflect.DeepEqual(api.calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", api.calls, tt.wantCalls)
+			}
+
+			//second close must not issue commands
+			if err := s.Close(); err != nil {
+				t.Errorf("second Close() error = %v", err)
+			}
+			if err := s.CmdTrackPage(0x1000, sevStep.PageTrackAccess); !errors.Is(err, ErrClosed) {
+				t.Errorf("CmdTrackPage() after Close error = %v, want %v", err, ErrClosed)
+			}
+			if len(api.calls) != len(tt.wantCalls) {
+				t.Errorf("commands issued after Close : %v", api.calls[len(tt.wantCalls):])
+			}
+		})
+	}
+}
+
+func TestSession_CloseOnDone(t *testing.T) {
+	api := &fakeAPI{}
+	s := New(api)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.CloseOnDone(ctx)
+	if err := s.CmdTrackAllPages(sevStep.PageTrackExec); err != nil {
+		t.Fatalf("CmdTrackAllPages() error = %v", err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for s.CmdAckEvent(0) != ErrClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("session not closed after ctx cancel")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := strings.Join(api.calls, ","), "trackAll 3,untrackAll 3,close"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestSession_CloseOnPanic(t *testing.T) {
+	api := &fakeAPI{}
+	s := New(api)
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("panic was swallowed")
+			}
+		}()
+		defer s.CloseOnPanic()
+		if err := s.CmdTrackPage(0x1000, sevStep.PageTrackExec); err != nil {
+			t.Fatalf("CmdTrackPage() error = %v", err)
+		}
+		panic("test")
+	}()
+	if got, want := strings.Join(api.calls, ","), "track 1000 3,untrackAll 3,close"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "Hex and decimal", input: "0x1000\n 4096 \n\n0x2000\n", want: []uint64{0x1000, 4096, 0x2000}},
+		{name: "Empty", input: "", want: []uint64{}},
+		{name: "Invalid entry", input: "0x1000\nfoo\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAllowList(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAllowList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAllowList() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrackPolicies(t *testing.T) {
+	fault := func(seq uint64, gpa, rip uint64, instr uint64) Fault {
+		return Fault{
+			Event:          &sevStep.Event{FaultedGPA: gpa, RIP: rip, HaveRipInfo: rip != 0},
+			Seq:            seq,
+			InstrDelta:     instr,
+			HaveInstrDelta: instr != 0,
+		}
+	}
+	tests := []struct {
+		name        string
+		policy      RetrackPolicy
+		pending     Fault
+		current     Fault
+		wantAdmit   bool
+		wantRelease bool
+	}{
+		{name: "Instr above threshold", policy: RetiredInstrPolicy{Threshold: 2}, pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2000, 0, 3), wantAdmit: true, wantRelease: true},
+		{name: "Instr at threshold", policy: RetiredInstrPolicy{Threshold: 2}, pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2000, 0, 2), wantAdmit: true},
+		{name: "Instr without perf", policy: RetiredInstrPolicy{}, pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2000, 0, 0), wantAdmit: true},
+		{name: "Same RIP", policy: RIPChangePolicy{}, pending: fault(1, 0x1000, 0x400, 0), current: fault(2, 0x2000, 0x400, 0), wantAdmit: true},
+		{name: "Changed RIP", policy: RIPChangePolicy{}, pending: fault(1, 0x1000, 0x400, 0), current: fault(2, 0x2000, 0x404, 0), wantAdmit: true, wantRelease: true},
+		{name: "Kernel GPA", policy: NewKernelGPAPolicy([]uint64{0x2000}), pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2abc, 0, 0), wantRelease: true},
+		{name: "Kernel RIP", policy: KernelRIPPolicy{}, pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2000, 0xffffffff81000000, 0)},
+		{name: "User RIP", policy: KernelRIPPolicy{}, pending: fault(1, 0x1000, 0, 0), current: fault(2, 0x2000, 0x400, 0), wantAdmit: true, wantRelease: true},
+		{name: "Window end", policy: WindowPolicy{Size: 4}, pending: fault(1, 0x1000, 0, 0), current: fault(4, 0x2000, 0, 0), wantAdmit: true, wantRelease: true},
+		{name: "Window middle", policy: WindowPolicy{Size: 4}, pending: fault(1, 0x1000, 0, 0), current: fault(3, 0x2000, 0, 0), wantAdmit: true},
+		{name: "Hold last", policy: HoldLastPolicy{N: 3}, pending: fault(2, 0x1000, 0, 0), current: fault(4, 0x2000, 0, 0), wantAdmit: true},
+		{name: "Release after last", policy: HoldLastPolicy{N: 3}, pending: fault(1, 0x1000, 0, 0), current: fault(4, 0x2000, 0, 0), wantAdmit: true, wantRelease: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Admit(tt.current); got != tt.wantAdmit {
+				t.Errorf("Admit() = %v, want %v", got, tt.wantAdmit)
+			}
+			if got := tt.policy.Release(tt.pending, tt.current); got != tt.wantRelease {
+				t.Errorf("Release() = %v, want %v", got, tt.wantRelease)
+			}
+		})
+	}
+}
+
+func TestParseRetrackPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []RetrackPolicy
+		wantErr bool
+	}{
+		{name: "Defaults", spec: "instr,window,lastN", want: []RetrackPolicy{RetiredInstrPolicy{Threshold: 2}, WindowPolicy{Size: 8}, HoldLastPolicy{N: 2}}},
+		{name: "Arguments", spec: "rip,instr:10,lastN:0x4", want: []RetrackPolicy{RIPChangePolicy{}, RetiredInstrPolicy{Threshold: 10}, HoldLastPolicy{N: 4}}},
+		{name: "Unknown", spec: "rip,foo", wantErr: true},
+		{name: "Bad argument", spec: "window:x", wantErr: true},
+		{name: "Empty window", spec: "window:0", wantErr: true},
+		{name: "Kernel GPA without file", spec: "kernelGPA", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRetrackPolicies(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRetrackPolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRetrackPolicies() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetrackBacklog_PushFault(t *testing.T) {
+	api := &fakeAPI{}
+	s := New(api)
+	r := NewRetrackBacklog(sevStep.PageTrackAccess, false, RIPChangePolicy{}, NewKernelGPAPolicy([]uint64{0x9000}))
+	//0x1000 and 0x2000 are accessed by the same instruction, 0x9000 is a kernel page
+	steps := []*sevStep.Event{
+		{FaultedGPA: 0x1000, RIP: 0x400, HaveRipInfo: true},
+		{FaultedGPA: 0x2000, RIP: 0x400, HaveRipInfo: true},
+		{FaultedGPA: 0x9000, RIP: 0x404, HaveRipInfo: true},
+		{FaultedGPA: 0x3000, RIP: 0x408, HaveRipInfo: true},
+	}
+	for _, v := range steps {
+		if err := r.PushFault(s, Fault{Event: v}); err != nil {
+			t.Fatalf("PushFault() error = %v", err)
+		}
+	}
+	if got, want := strings.Join(api.calls, ","), "track 1000 1,track 2000 1"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if got := r.Len(); got != 1 {
+		t.Errorf("Len() = %v, want 1", got)
+	}
+	want := []RetrackStats{
+		{Policy: "rip", Admitted: 4, Released: 2, Held: 1},
+		{Policy: "kernelGPA", Admitted: 3, Excluded: 1, Released: 3},
+	}
+	if got := r.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+	r.Reset()
+	if got := r.Len(); got != 0 {
+		t.Errorf("Len() after Reset = %v, want 0", got)
+	}
+}
+
+func TestRetrackBacklog_PushFault_TrackError(t *testing.T) {
+	api := &fakeAPI{failTrack: map[uint64]bool{0x2000: true}}
+	s := New(api)
+	r := NewRetrackBacklog(sevStep.PageTrackAccess, false, RIPChangePolicy{})
+	for _, v := range []uint64{0x1000, 0x2000, 0x3000} {
+		if err := r.PushFault(s, Fault{Event: &sevStep.Event{FaultedGPA: v, RIP: 0x400, HaveRipInfo: true}}); err != nil {
+			t.Fatalf("PushFault() error = %v", err)
+		}
+	}
+	if err := r.PushFault(s, Fault{Event: &sevStep.Event{FaultedGPA: 0x4000, RIP: 0x404, HaveRipInfo: true}}); err == nil {
+		t.Fatalf("PushFault() with failing track succeeded")
+	}
+	//the page whose re-track failed and the ones after it stay pending
+	if got, want := r.Len(), 2; got != want {
+		t.Errorf("Len() = %v, want %v", got, want)
+	}
+	api.failTrack = nil
+	api.calls = nil
+	if err := r.PushFault(s, Fault{Event: &sevStep.Event{FaultedGPA: 0x5000, RIP: 0x408, HaveRipInfo: true}}); err != nil {
+		t.Fatalf("PushFault() error = %v", err)
+	}
+	if got, want := strings.Join(api.calls, ","), "track 2000 1,track 3000 1"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestRetrackBacklog_KernelRIP(t *testing.T) {
+	api := &fakeAPI{}
+	s := New(api)
+	r := NewRetrackBacklog(sevStep.PageTrackAccess, false, KernelRIPPolicy{})
+	steps := []*sevStep.Event{
+		{FaultedGPA: 0x1000, RIP: 0x400, HaveRipInfo: true},
+		//kernel faults neither release nor enter the backlog
+		{FaultedGPA: 0x9000, RIP: 0xffffffff81000000, HaveRipInfo: true},
+	}
+	for _, v := range steps {
+		if err := r.PushFault(s, Fault{Event: v}); err != nil {
+			t.Fatalf("PushFault() error = %v", err)
+		}
+	}
+	if len(api.calls) != 0 || r.Len() != 1 {
+		t.Errorf("calls = %v, Len() = %v, want no calls and 1 pending page", api.calls, r.Len())
+	}
+	if err := r.PushFault(s, Fault{Event: &sevStep.Event{FaultedGPA: 0x2000, RIP: 0x404, HaveRipInfo: true}}); err != nil {
+		t.Fatalf("PushFault() error = %v", err)
+	}
+	if got, want := strings.Join(api.calls, ","), "track 1000 1"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestSession_RegisterMetrics(t *testing.T) {
+	api := &fakeAPI{}
+	s := New(api)
+	registry := metrics.NewRegistry()
+	s.RegisterMetrics(registry)
+	backlog := NewRetrackBacklog(sevStep.PageTrackAccess, false, AlwaysPolicy{})
+	backlog.RegisterMetrics(registry)
+
+	if err := s.CmdTrackPage(0x1000, sevStep.PageTrackAccess); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CmdReadGuestMemory(0x1000, 16, true, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CmdAckEvent(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := backlog.PushFault(s, Fault{Event: &sevStep.Event{FaultedGPA: 0x2000}}); err != nil {
+		t.Fatal(err)
+	}
+
+	//the batch events are counted while the batch is running and not counted again when they are fetched
+	if err := s.CmdBatchTrackingStart(sevStep.PageTrackAccess, 100, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	api.batchCount = 3
+	if _, err := s.CmdBatchTrackingEventCount(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.CmdBatchTrackingStopAndGet(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CmdBatchTrackingEventCount(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &strings.Builder{}
+	if err := registry.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"pf_events_received_total 5\n",
+		"pf_events_acked_total 1\n",
+		"pf_guest_memory_read_seconds_count 1\n",
+		"pf_tracked_pages{mode=\"access\"} 1\n",
+		"pf_tracking_all_pages{mode=\"access\"} 1\n",
+		"pf_retrack_backlog_pages 1\n",
+		"pf_retrack_decisions_total{policy=\"always\",decision=\"admitted\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%v", want, buf.String())
+		}
+	}
+}
+
+func TestFilterDenied(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowList []uint64
+		denyList  []uint64
+		want      []uint64
+	}{
+		{name: "Track all", allowList: nil, denyList: []uint64{0x1000}, want: nil},
+		{name: "No deny list", allowList: []uint64{0x1000}, denyList: nil, want: []uint64{0x1000}},
+		{name: "Filtered by page", allowList: []uint64{0x1000, 0x2000, 0x3000}, denyList: []uint64{0x2abc}, want: []uint64{0x1000, 0x3000}},
+		{name: "All denied", allowList: []uint64{0x1000}, denyList: []uint64{0x1000}, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FilterDenied(tt.allowList, tt.denyList); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilterDenied() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingRetrack(t *testing.T) {
+	fault := func(gpa, instr uint64) *sevStep.Event {
+		return &sevStep.Event{FaultedGPA: gpa, RetiredInstructions: instr, HaveRetiredInstructions: true}
+	}
+	many := []*sevStep.Event{fault(0x1000, 5)}
+	for i := uint64(0); i < 12; i++ {
+		many = append(many, fault(0x2000+i*0x1000, 0))
+	}
+	tests := []struct {
+		name   string
+		events []*sevStep.Event
+		want   []uint64
+	}{
+		{name: "Empty", events: nil, want: []uint64{}},
+		{name: "First event is progress", events: []*sevStep.Event{fault(0x1abc, 0)}, want: []uint64{0x1000}},
+		{name: "Since last progress", events: []*sevStep.Event{fault(0x1000, 0), fault(0x2000, 100), fault(0x3000, 1), fault(0x4000, 0)}, want: []uint64{0x2000, 0x3000, 0x4000}},
+		{name: "Backlog full", events: many, want: []uint64{0x1000, 0x2000, 0x3000, 0x4000, 0x5000, 0x6000, 0x7000, 0x8000, 0x9000, 0xa000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pendingRetrack(tt.events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pendingRetrack() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollingBatch_Drain(t *testing.T) {
+	base := time.Unix(100, 0)
+	event := func(id, gpa, instr uint64) *sevStep.Event {
+		return &sevStep.Event{ID: id, FaultedGPA: gpa, Timestamp: base.Add(time.Duration(id) * time.Microsecond), RetiredInstructions: instr, HaveRetiredInstructions: true}
+	}
+	api := &fakeAPI{}
+	s := New(api)
+	r := NewRollingBatch(s, RollingConfig{TrackType: sevStep.PageTrackAccess, ChunkSize: 4, PerfCPU: 1, Retrack: true})
+	now := base
+	r.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	registry := metrics.NewRegistry()
+	r.RegisterMetrics(registry)
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	//two events more than fit into the buffer and a fault on 0x5000 before the restart
+	api.batchEvents = []*sevStep.Event{event(0, 0x1000, 0), event(1, 0x2000, 100), event(2, 0x3000, 1), event(3, 0x4abc, 0)}
+	api.batchCount = 6
+	api.errDuringBatch = true
+	api.gapEvents = []*sevStep.Event{event(9, 0x5000, 0), event(10, 0x2000, 0)}
+	c, err := r.Drain(true)
+	if err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if c.Seq != 0 || len(c.Events) != 4 || c.Dropped != 2 || len(c.GapEvents) != 2 || len(c.Late) != 0 {
+		t.Errorf("Drain() = seq %v, %v events, %v dropped, %v gap events, %v late", c.Seq, len(c.Events), c.Dropped, len(c.GapEvents), len(c.Late))
+	}
+	if got, want := strings.Join(c.LossLines(), ""), fmt.Sprintf("Loss 0 reason overflow from %v to %v\nLoss 0 reason unfetched from %v to %v\n",
+		base.Add(3*time.Microsecond).UnixNano(), c.Counted.UnixNano(), c.Counted.UnixNano(), c.Stopped.UnixNano()); got != want {
+		t.Errorf("LossLines() = %q, want %q", got, want)
+	}
+	if got, want := c.GapLine(), fmt.Sprintf("Gap 0 from %v to %v events 2\n", c.Stopped.UnixNano(), c.Resumed.UnixNano()); got != want {
+		t.Errorf("GapLine() = %q, want %q", got, want)
+	}
+	//the pages of the kernel backlog and of the gap are tracked again after the restart
+	if got, want := strings.Join(api.calls, ","), "batchStart 1 true,batchStop 4,batchStart 1 true,track 2000 1,track 3000 1,track 4000 1,track 5000 1"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+	if want := []uint64{9, 10}; !reflect.DeepEqual(api.acked, want) {
+		t.Errorf("acked = %v, want %v", api.acked, want)
+	}
+
+	//a late fault of the first gap and the final chunk without restart
+	api.calls = nil
+	api.batchEvents = []*sevStep.Event{event(0, 0x6000, 0)}
+	api.batchCount = 1
+	api.errDuringBatch = false
+	api.polled = []*sevStep.Event{event(11, 0x7000, 0)}
+	c, err = r.Drain(false)
+	if err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if got, want := c.LateLine()+c.HeaderLine(), fmt.Sprintf("Gap 0 late events 1\nChunk 1 events 1 dropped 0 counted %v stopped %v\n", c.Counted.UnixNano(), c.Stopped.UnixNano()); got != want {
+		t.Errorf("LateLine()+HeaderLine() = %q, want %q", got, want)
+	}
+	if len(c.Losses) != 1 || c.Losses[0].Reason != LossUnfetched || !c.Resumed.IsZero() {
+		t.Errorf("final chunk losses %v, resumed %v", c.Losses, c.Resumed)
+	}
+	if got, want := strings.Join(api.calls, ","), "batchStop 1"; got != want {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+
+	buf := &strings.Builder{}
+	if err := registry.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"pf_batch_chunks_total 2\n",
+		"pf_batch_gap_events_total 3\n",
+		"pf_batch_dropped_events_total 2\n",
+		"pf_batch_loss_windows_total{reason=\"unfetched\"} 2\n",
+		"pf_batch_gap_seconds_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%v", want, buf.String())
+		}
+	}
+}
+
+func TestRollingBatch_GapSettle(t *testing.T) {
+	api := &fakeAPI{}
+	poll := pfFingerprint.PollConfig{MinSleep: time.Millisecond, MaxSleep: time.Millisecond, BatchSize: 1}
+	r := NewRollingBatch(New(api), RollingConfig{GapSettle: 20 * time.Millisecond, Poll: poll})
+	api.polled = []*sevStep.Event{{ID: 1}, {ID: 2}}
+	begin := time.Now()
+	events, err := r.pollGap(r.config.GapSettle)
+	if err != nil {
+		t.Fatalf("pollGap() error = %v", err)
+	}
+	if len(events) != 2 || time.Since(begin) < r.config.GapSettle {
+		t.Errorf("pollGap() returned %v events after %v", len(events), time.Since(begin))
+	}
+	//sleeping between the polls, not spinning until the deadline
+	if api.polls > 100 {
+		t.Errorf("pollGap() polled %v times during %v", api.polls, r.config.GapSettle)
+	}
+}
@@ -0,0 +1,258 @@
+package session
+
+//Helpers shared by the trace generators
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"pfFingerprint/metrics"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//TrackModeNames lists the values accepted by ParseTrackMode, for flag descriptions
+const TrackModeNames = "{access,execute,write}"
+
+//ParseTrackMode parses the value of a "-tracking" flag
+func ParseTrackMode(name string) (sevStep.PageTrackMode, error) {
+	switch name {
+	case "access":
+		return sevStep.PageTrackAccess, nil
+	case "execute":
+		return sevStep.PageTrackExec, nil
+	case "write":
+		return sevStep.PageTrackWrite, nil
+	default:
+		return 0, fmt.Errorf("unknown tracking mode %q, valid values are %v", name, TrackModeNames)
+	}
+}
+
+//ParseAllowList parses one GPA per line. Accepts all formats of strconv.ParseUint with base 0. Empty lines are skipped
+func ParseAllowList(r io.Reader) ([]uint64, error) {
+	sc := bufio.NewScanner(r)
+	sc.Split(bufio.ScanLines)
+	allowList := make([]uint64, 0)
+	for sc.Scan() {
+		line := strings.Trim(sc.Text(), " \n\r\t")
+		if line == "" {
+			continue
+		}
+		gpa, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allow list entry %v : %v", line, err)
+		}
+		allowList = append(allowList, gpa)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("allowList scanner error : %v", err)
+	}
+	return allowList, nil
+}
+
+//LoadAllowList parses the allow list at path. Returns nil if path is empty, i.e. all pages should be tracked
+func LoadAllowList(path string) ([]uint64, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allow list file : %v", err)
+	}
+	defer f.Close()
+	return ParseAllowList(f)
+}
+
+//FilterDenied returns the pages of allowList that are not on denyList, e.g. the kernel pages found by
+//classifyKernelPages. A nil allowList stays nil, tracking all pages cannot exclude single pages. Use
+//NewKernelGPAPolicy to never re-track the denied pages in that case
+func FilterDenied(allowList, denyList []uint64) []uint64 {
+	if allowList == nil || len(denyList) == 0 {
+		return allowList
+	}
+	denied := make(map[uint64]bool, len(denyList))
+	for _, v := range denyList {
+		denied[v&^0xfff] = true
+	}
+	filtered := make([]uint64, 0, len(allowList))
+	for _, v := range allowList {
+		if !denied[v&^0xfff] {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+//InitTracking if allowList != nil only the gpas in the list are tracked, otherwise all pages are tracked.
+//If findWrite is set, all pages are additionally write tracked when tracking all pages
+func (s *Session) InitTracking(allowList []uint64, trackType sevStep.PageTrackMode, findWrite bool) error {
+	if allowList == nil {
+		if findWrite {
+			log.Printf("Doing additional write track")
+			if err := s.CmdTrackAllPages(sevStep.PageTrackWrite); err != nil {
+				return fmt.Errorf("CmdTrackAllPages write failed : %v", err)
+			}
+		}
+
+		log.Printf("Tracking all pages\n")
+		if err := s.CmdTrackAllPages(trackType); err != nil {
+			return fmt.Errorf("CmdTrackAllPages failed : %v", err)
+		}
+
+		return nil
+	}
+
+	log.Printf("tracking the %v pages from allowList\n", len(allowList))
+	for _, gpa := range allowList {
+		if err := s.CmdTrackPage(gpa, trackType); err != nil {
+			return fmt.Errorf("CmdTrackPage failed : %v", err)
+		}
+	}
+
+	return nil
+}
+
+//isWriteErr checks for a present, write, user fault
+func isWriteErr(code uint32) bool {
+	return code == 0x7
+}
+
+//RetrackBacklog re-tracks faulted pages once the guest made progress. Re-tracking a page directly after its fault
+//would lead to an endless fault loop on the same instruction. It is safe for concurrent use
+type RetrackBacklog struct {
+	mutex   sync.Mutex
+	pending []Fault
+	seq     uint64
+	//policies decide in PushFault which pages are re-tracked and when, stats has one entry per policy
+	policies []RetrackPolicy
+	stats    []RetrackStats
+	//TrackType is used to re-track the pages
+	TrackType sevStep.PageTrackMode
+	//FindWrite re-tracks write faults in write mode
+	FindWrite bool
+}
+
+//NewRetrackBacklog creates an empty backlog. The policies are used by PushFault, a page is only admitted or
+//released if all of them agree
+func NewRetrackBacklog(trackType sevStep.PageTrackMode, findWrite bool, policies ...RetrackPolicy) *RetrackBacklog {
+	stats := make([]RetrackStats, len(policies))
+	for i, v := range policies {
+		stats[i].Policy = v.Name()
+	}
+	return &RetrackBacklog{
+		pending:   make([]Fault, 0),
+		stats:     stats,
+		TrackType: trackType,
+		FindWrite: findWrite,
+		policies:  policies,
+	}
+}
+
+//Reset drops all pending pages, e.g. before the tracking is initialized again. The stats are kept
+func (r *RetrackBacklog) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending = r.pending[:0]
+	r.seq = 0
+}
+
+//Len returns the number of pages waiting to be re-tracked
+func (r *RetrackBacklog) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pending)
+}
+
+//Stats returns the decisions of each policy since the backlog has been created
+func (r *RetrackBacklog) Stats() []RetrackStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]RetrackStats(nil), r.stats...)
+}
+
+//RegisterMetrics exports the number of pending pages and the decisions of each policy in r
+func (r *RetrackBacklog) RegisterMetrics(reg *metrics.Registry) {
+	reg.GaugeFunc("pf_retrack_backlog_pages", "Faulted pages waiting to be re-tracked", func() float64 { return float64(r.Len()) })
+	for i, v := range r.Stats() {
+		i := i
+		decisions := map[string]func(RetrackStats) uint64{
+			"admitted": func(s RetrackStats) uint64 { return s.Admitted },
+			"excluded": func(s RetrackStats) uint64 { return s.Excluded },
+			"released": func(s RetrackStats) uint64 { return s.Released },
+			"held":     func(s RetrackStats) uint64 { return s.Held },
+		}
+		for decision, get := range decisions {
+			get := get
+			reg.CounterFunc("pf_retrack_decisions_total", "Decisions of each re-tracking policy", func() float64 {
+				r.mutex.Lock()
+				defer r.mutex.Unlock()
+				return float64(get(r.stats[i]))
+			}, "policy", v.Policy, "decision", decision)
+		}
+	}
+}
+
+//retrack tracks the page of f again, caller must hold the lock
+func (r *RetrackBacklog) retrack(s *Session, f Fault) error {
+	//retrack write faults as write, everything else as default trackType
+	retrackType := r.TrackType
+	if r.FindWrite && isWriteErr(f.Event.ErrorCode) {
+		log.Printf("Retracking 0x%x as write\n", f.Event.FaultedGPA)
+		retrackType = sevStep.PageTrackWrite
+	}
+	if err := s.CmdTrackPage(f.Event.FaultedGPA, retrackType); err != nil {
+		return fmt.Errorf("failed to retrack %x : %v", f.Event.FaultedGPA, err)
+	}
+	return nil
+}
+
+//PushFault re-tracks the pending pages that all policies release at f and afterwards adds the page of f
+//to the backlog, if all policies admit it. Every policy is asked, so that the stats show the effect of each one
+func (r *RetrackBacklog) PushFault(s *Session, f Fault) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.seq++
+	f.Seq = r.seq
+
+	kept := r.pending[:0]
+	for i, v := range r.pending {
+		release := true
+		for j, p := range r.policies {
+			if p.Release(v, f) {
+				r.stats[j].Released++
+			} else {
+				r.stats[j].Held++
+				release = false
+			}
+		}
+		if !release {
+			kept = append(kept, v)
+			continue
+		}
+		if err := r.retrack(s, v); err != nil {
+			//keep the pages that have not been re-tracked
+			r.pending = append(append(kept, v), r.pending[i+1:]...)
+			return err
+		}
+	}
+	r.pending = kept
+
+	admit := true
+	for j, p := range r.policies {
+		if p.Admit(f) {
+			r.stats[j].Admitted++
+		} else {
+			r.stats[j].Excluded++
+			admit = false
+		}
+	}
+	if admit {
+		r.pending = append(r.pending, f)
+	}
+	return nil
+}
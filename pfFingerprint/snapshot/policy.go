@@ -0,0 +1,91 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//MemoryReader is implemented by sevStep.IoctlAPI
+type MemoryReader interface {
+	CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error)
+}
+
+//Policy decides which candidate pages are read at each save point, in addition to the page that the attack
+//selected. The zero value reads no candidates
+type Policy struct {
+	//Candidates enables snapshots of the candidate pages
+	Candidates bool
+	//MaxCandidates keeps only the last MaxCandidates pages, as the buffers we are looking for are usually written
+	//right before the selection. 0 means no limit
+	MaxCandidates int
+	//Offset and Length restrict the snapshot to a part of each page. Length 0 means until the end of the page
+	Offset uint64
+	Length uint64
+}
+
+//Validate checks that the region described by Offset and Length is inside a page
+func (p Policy) Validate() error {
+	if p.Offset >= PageSize {
+		return fmt.Errorf("offset %v is outside of the page", p.Offset)
+	}
+	if p.Offset+p.Length > PageSize {
+		return fmt.Errorf("offset %v + length %v exceeds the page", p.Offset, p.Length)
+	}
+	if p.MaxCandidates < 0 {
+		return fmt.Errorf("negative candidate limit %v", p.MaxCandidates)
+	}
+	return nil
+}
+
+//CandidatePages returns the distinct pages of the write faults in events, in the order of their last write fault.
+//Read and fetch faults of an access track all phase are skipped, as they would push the written buffers out of
+//the MaxCandidates window
+func (p Policy) CandidatePages(events []*sevStep.Event) []uint64 {
+	if !p.Candidates {
+		return nil
+	}
+	//walk backwards to order by last fault and to apply the limit
+	seen := make(map[uint64]bool)
+	reversed := make([]uint64, 0)
+	for i := len(events) - 1; i >= 0; i-- {
+		if p.MaxCandidates > 0 && len(reversed) >= p.MaxCandidates {
+			break
+		}
+		if !sevStep.ArePfErrorsSet(events[i].ErrorCode, sevStep.PfErrorWrite) {
+			continue
+		}
+		gpa := events[i].FaultedGPA &^ (PageSize - 1)
+		if seen[gpa] {
+			continue
+		}
+		seen[gpa] = true
+		reversed = append(reversed, gpa)
+	}
+	pages := make([]uint64, len(reversed))
+	for i, v := range reversed {
+		pages[len(reversed)-1-i] = v
+	}
+	return pages
+}
+
+//Read takes a snapshot of each page. Pages on the same page as skip are omitted, as they are already
+//contained in the event
+func (p Policy) Read(api MemoryReader, pages []uint64, skip uint64, wbinvdCPU int) ([]Region, error) {
+	length := p.Length
+	if length == 0 {
+		length = PageSize - p.Offset
+	}
+	regions := make([]Region, 0, len(pages))
+	for _, gpa := range pages {
+		if skip != 0 && sevStep.OnSamePage(gpa, skip) {
+			continue
+		}
+		mem, err := api.CmdReadGuestMemory(gpa+p.Offset, length, true, wbinvdCPU)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read candidate %x : %v", gpa, err)
+		}
+		regions = append(regions, Region{GPA: gpa, Offset: p.Offset, Length: length, Content: mem})
+	}
+	return regions, nil
+}
@@ -0,0 +1,177 @@
+//Package snapshot extends sevStep.Event with any number of memory regions that were read at the time of the
+//event. This allows to capture several candidate buffers during the attack and to decide in the recovery tools
+//which of them is the right one, instead of committing to a single GPA during capture
+package snapshot
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//PageSize is the size of a guest page
+const PageSize = 4096
+
+//HexBytes is encoded as hex string in json, like the content of sevStep.Event
+type HexBytes []byte
+
+func (h HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *HexBytes) UnmarshalJSON(b []byte) error {
+	//input might have a 0x prefix
+	s := strings.TrimPrefix(strings.Trim(string(b), `"`), "0x")
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal HexBytes : %v", err)
+	}
+	*h = buf
+	return nil
+}
+
+//Region is a memory snapshot of Length bytes, starting at Offset in the page at GPA
+type Region struct {
+	GPA     uint64   `json:"gpa"`
+	Offset  uint64   `json:"offset"`
+	Length  uint64   `json:"length"`
+	Content HexBytes `json:"content"`
+}
+
+//UnmarshalJSON rejects regions that do not fit into a page, as traces are not trusted
+func (r *Region) UnmarshalJSON(b []byte) error {
+	//the alias has no UnmarshalJSON method
+	type region Region
+	var v region
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Offset > PageSize || uint64(len(v.Content)) > PageSize-v.Offset {
+		return fmt.Errorf("region of %v bytes at offset %v exceeds the page", len(v.Content), v.Offset)
+	}
+	*r = Region(v)
+	return nil
+}
+
+//Page returns the region placed into a zeroed page, so that offsets in the page can be used as is
+func (r Region) Page() []byte {
+	if r.Offset == 0 && len(r.Content) == PageSize {
+		return r.Content
+	}
+	page := make([]byte, PageSize)
+	copy(page[r.Offset:], r.Content)
+	return page
+}
+
+//Event is a sevStep.Event with additional memory regions. The json encoding is a superset of the one of
+//sevStep.Event, i.e. sevStep.ParseInputFile can still parse files of Events and ParseEvents can parse
+//files of sevStep.Events
+type Event struct {
+	*sevStep.Event
+	Regions []Region `json:"regions,omitempty"`
+}
+
+//Region returns the region of the page at gpa. The MonitorGPA/Content snapshot of the embedded event counts as region
+func (e *Event) Region(gpa uint64) (Region, bool) {
+	if e.MonitorGPA != 0 && sevStep.OnSamePage(e.MonitorGPA, gpa) {
+		return Region{GPA: e.MonitorGPA, Length: uint64(len(e.Content)), Content: HexBytes(e.Content)}, true
+	}
+	for _, v := range e.Regions {
+		if sevStep.OnSamePage(v.GPA, gpa) {
+			return v, true
+		}
+	}
+	return Region{}, false
+}
+
+//Wrap converts events without additional regions
+func Wrap(events []*sevStep.Event) []*Event {
+	wrapped := make([]*Event, len(events))
+	for i, v := range events {
+		wrapped[i] = &Event{Event: v}
+	}
+	return wrapped
+}
+
+//Unwrap returns the embedded events, i.e. drops the additional regions
+func Unwrap(events []*Event) []*sevStep.Event {
+	unwrapped := make([]*sevStep.Event, len(events))
+	for i, v := range events {
+		unwrapped[i] = v.Event
+	}
+	return unwrapped
+}
+
+//ParseEvents parses json lines of Events. Like sevStep.ParseInputFile, other lines are skipped
+func ParseEvents(r io.Reader) ([]*Event, error) {
+	sc := bufio.NewScanner(r)
+	//events with many regions are way larger than the default token size
+	sc.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	sc.Split(bufio.ScanLines)
+
+	events := make([]*Event, 0)
+	printedWarningNonJSON := false
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "{") {
+			if !printedWarningNonJSON {
+				log.Printf("omiting non json lines")
+			}
+			printedWarningNonJSON = true
+			continue
+		}
+		v := &Event{Event: &sevStep.Event{}}
+		if err := json.Unmarshal([]byte(line), v); err != nil {
+			return nil, fmt.Errorf("failed to parse event %s : %v", line, err)
+		}
+		events = append(events, v)
+	}
+	if sc.Err() != nil {
+		return nil, fmt.Errorf("scanner error : %v", sc.Err())
+	}
+	return events, nil
+}
+
+//RegionGPAs returns the pages that have been snapshotted in any event, in the order of their first occurrence.
+//The MonitorGPA of an event comes before its regions
+func RegionGPAs(events []*Event) []uint64 {
+	seen := make(map[uint64]bool)
+	gpas := make([]uint64, 0)
+	add := func(gpa uint64) {
+		if gpa != 0 && !seen[gpa] {
+			seen[gpa] = true
+			gpas = append(gpas, gpa)
+		}
+	}
+	for _, e := range events {
+		add(e.MonitorGPA)
+		for _, v := range e.Regions {
+			add(v.GPA)
+		}
+	}
+	return gpas
+}
+
+//Project returns copies of events, whose MonitorGPA and Content are taken from the region of the page at gpa.
+//Events without this region get no content. This allows to run the analyses, that only know about
+//MonitorGPA and Content, on each captured region
+func Project(events []*Event, gpa uint64) []*sevStep.Event {
+	projected := make([]*sevStep.Event, len(events))
+	for i, e := range events {
+		ev := *e.Event
+		ev.MonitorGPA = 0
+		ev.Content = nil
+		if r, ok := e.Region(gpa); ok {
+			ev.MonitorGPA = r.GPA
+			ev.Content = r.Page()
+		}
+		projected[i] = &ev
+	}
+	return projected
+}
@@ -0,0 +1,164 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//fakeReader returns pages filled with the second lowest byte of the gpa
+type fakeReader struct {
+	reads []uint64
+}
+
+func (f *fakeReader) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	f.reads = append(f.reads, gpa)
+	return bytes.Repeat([]byte{byte(gpa >> 8)}, int(size)), nil
+}
+
+func TestParseEvents_Compatibility(t *testing.T) {
+	events := []*Event{
+		{Event: &sevStep.Event{ID: 1, FaultedGPA: 0x1000, MonitorGPA: 0x3000, Content: make([]byte, PageSize)}},
+		{
+			Event:   &sevStep.Event{ID: 2, FaultedGPA: 0x2000},
+			Regions: []Region{{GPA: 0x4000, Offset: 16, Length: 4, Content: []byte{1, 2, 3, 4}}},
+		},
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("Start\n")
+	for _, v := range events {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		buf.Write(append(encoded, '\n'))
+	}
+
+	got, err := ParseEvents(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseEvents() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("ParseEvents() got = %v, want %v", got, events)
+	}
+
+	//old tools still parse the embedded event
+	plain, err := sevStep.ParseInputFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ParseInputFile() error = %v", err)
+	}
+	if len(plain) != 2 || plain[0].MonitorGPA != 0x3000 || plain[1].FaultedGPA != 0x2000 {
+		t.Errorf("ParseInputFile() got = %v", plain)
+	}
+}
+
+func TestParseEvents_InvalidRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{name: "End of page", line: `{"regions": [{"gpa": 4096, "offset": 4095, "length": 1, "content": "01"}]}`},
+		{name: "Offset outside of page", line: `{"regions": [{"gpa": 4096, "offset": 8192, "length": 1, "content": "01"}]}`, wantErr: true},
+		{name: "Content crosses page", line: `{"regions": [{"gpa": 4096, "offset": 4095, "length": 1, "content": "0102"}]}`, wantErr: true},
+		{name: "Offset overflows", line: `{"regions": [{"gpa": 4096, "offset": 18446744073709551615, "length": 1, "content": "01"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseEvents(bytes.NewReader([]byte(tt.line))); (err != nil) != tt.wantErr {
+				t.Errorf("ParseEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProject(t *testing.T) {
+	events := []*Event{
+		{Event: &sevStep.Event{ID: 0}},
+		{
+			Event:   &sevStep.Event{ID: 1, MonitorGPA: 0x3000, Content: bytes.Repeat([]byte{3}, PageSize)},
+			Regions: []Region{{GPA: 0x4000, Offset: 16, Length: 2, Content: []byte{4, 4}}},
+		},
+		{
+			Event:   &sevStep.Event{ID: 2, MonitorGPA: 0x3000, Content: bytes.Repeat([]byte{3}, PageSize)},
+			Regions: []Region{{GPA: 0x5000, Length: 1, Content: []byte{5}}},
+		},
+	}
+
+	if got, want := RegionGPAs(events), []uint64{0x3000, 0x4000, 0x5000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RegionGPAs() got = %x, want %x", got, want)
+	}
+
+	projected := Project(events, 0x4000)
+	if len(projected) != len(events) {
+		t.Fatalf("Project() returned %v events, want %v", len(projected), len(events))
+	}
+	if projected[0].MonitorGPA != 0 || projected[2].MonitorGPA != 0 || projected[2].Content != nil {
+		t.Errorf("events without region must have no content")
+	}
+	if got := projected[1]; got.MonitorGPA != 0x4000 || len(got.Content) != PageSize || got.Content[16] != 4 || got.Content[17] != 4 || got.Content[18] != 0 {
+		t.Errorf("region not placed at its offset in the page")
+	}
+	//the original events are not modified
+	if events[1].MonitorGPA != 0x3000 {
+		t.Errorf("Project() modified the input")
+	}
+
+	projected = Project(events, 0x3000)
+	if projected[1].Content[0] != 3 || projected[2].Content[0] != 3 {
+		t.Errorf("MonitorGPA snapshot not used as region")
+	}
+}
+
+func TestPolicy_CandidatePages(t *testing.T) {
+	write := uint32(sevStep.PfErrorWrite | sevStep.PfErrorUser)
+	events := Unwrap(Wrap([]*sevStep.Event{
+		{FaultedGPA: 0x1000, ErrorCode: write}, {FaultedGPA: 0x2123, ErrorCode: write}, {FaultedGPA: 0x1000, ErrorCode: write},
+		{FaultedGPA: 0x3000, ErrorCode: write}, {FaultedGPA: 0x4000, ErrorCode: uint32(sevStep.PfErrorUser)},
+	}))
+	tests := []struct {
+		name   string
+		policy Policy
+		want   []uint64
+	}{
+		{name: "Disabled", policy: Policy{}, want: nil},
+		{name: "All", policy: Policy{Candidates: true}, want: []uint64{0x2000, 0x1000, 0x3000}},
+		{name: "Limited", policy: Policy{Candidates: true, MaxCandidates: 2}, want: []uint64{0x1000, 0x3000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.CandidatePages(events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CandidatePages() got = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_Read(t *testing.T) {
+	policy := Policy{Candidates: true, Offset: 0x100, Length: 8}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	api := &fakeReader{}
+	regions, err := policy.Read(api, []uint64{0x1000, 0x2000, 0x3000}, 0x2000, 0)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got, want := api.reads, []uint64{0x1100, 0x3100}; !reflect.DeepEqual(got, want) {
+		t.Errorf("read gpas %x, want %x", got, want)
+	}
+	want := []Region{
+		{GPA: 0x1000, Offset: 0x100, Length: 8, Content: bytes.Repeat([]byte{0x11}, 8)},
+		{GPA: 0x3000, Offset: 0x100, Length: 8, Content: bytes.Repeat([]byte{0x31}, 8)},
+	}
+	if !reflect.DeepEqual(regions, want) {
+		t.Errorf("Read() got = %v, want %v", regions, want)
+	}
+
+	if err := (Policy{Offset: 0xff0, Length: 0x20}).Validate(); err == nil {
+		t.Errorf("Validate() accepted region crossing the page")
+	}
+}
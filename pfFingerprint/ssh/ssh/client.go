@@ -14,13 +14,6 @@ import (
 	"time"
 )
 
-//LastSignature is a hacky global variable to export the signature send in the last ssh connection. LastMessage
-//contains the message for this signature
-var LastSignature *Signature
-
-//LastMessage is a hacky global variable to export the message signed by LastSignature
-var LastMessage []byte
-
 // Client implements a traditional SSH client that supports shells,
 // subprocesses, TCP port/streamlocal forwarding and tunneled dialing.
 type Client struct {
@@ -122,14 +115,17 @@ func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) e
 
 // verifyHostKeySignature verifies the host key obtained in the key
 // exchange.
-func verifyHostKeySignature(hostKey PublicKey, result *kexResult) error {
+func verifyHostKeySignature(hostKey PublicKey, algo string, result *kexResult) error {
 	sig, rest, ok := parseSignatureBody(result.Signature)
 	if len(rest) > 0 || !ok {
 		return errors.New("ssh: signature parse error")
 	}
 
-	LastSignature = sig
-	LastMessage = result.H
+	// For rsa-sha2-256 and rsa-sha2-512, the host key type is ssh-rsa,
+	// so the signature format has to be checked explicitly.
+	if (algo == SigAlgoRSASHA2256 || algo == SigAlgoRSASHA2512) && sig.Format != algo {
+		return fmt.Errorf("ssh: invalid signature algorithm %q, expected %q", sig.Format, algo)
+	}
 
 	return hostKey.Verify(result.H, sig)
 }
@@ -202,6 +198,48 @@ type HostKeyCallback func(hostname string, remote net.Addr, key PublicKey) error
 // the server. A BannerCallback receives the message sent by the remote server.
 type BannerCallback func(message string) error
 
+// HandshakeRecord contains the values exchanged and derived in one key
+// exchange of a client connection. All byte slices are owned by the record.
+type HandshakeRecord struct {
+	// ClientVersion and ServerVersion are the version lines without
+	// the terminating CR LF.
+	ClientVersion []byte
+	ServerVersion []byte
+
+	// ClientKexInit and ServerKexInit are the payloads of the
+	// msgKexInit packets.
+	ClientKexInit []byte
+	ServerKexInit []byte
+
+	// KexAlgorithm and HostKeyAlgorithm are the negotiated algorithms.
+	KexAlgorithm     string
+	HostKeyAlgorithm string
+
+	// HostKey is the server host key in SSH wire format.
+	HostKey []byte
+
+	// ClientEphemeral and ServerEphemeral are the ephemeral public
+	// values of the key exchange, as hashed into ExchangeHash.
+	ClientEphemeral []byte
+	ServerEphemeral []byte
+
+	// SharedSecret is the shared secret K, encoded as mpint.
+	SharedSecret []byte
+
+	// ExchangeHash is the exchange hash H, which is the message signed
+	// by the server host key.
+	ExchangeHash []byte
+
+	// Signature is the server's signature of ExchangeHash.
+	Signature *Signature
+}
+
+// HandshakeObserver is the function type used to observe the key
+// exchanges of a client connection. It is called once per key exchange,
+// after the signature of the server has been verified and before the
+// HostKeyCallback is called.
+type HandshakeObserver func(record *HandshakeRecord)
+
 // A ClientConfig structure is used to configure a Client. It must not be
 // modified after having been passed to an SSH function.
 type ClientConfig struct {
@@ -241,6 +279,10 @@ type ClientConfig struct {
 	// any of the CertAlgoXxxx and KeyAlgoXxxx constants.
 	HostKeyAlgorithms []string
 
+	// HandshakeObserver, if not nil, is called with the details of
+	// every key exchange of the connection.
+	HandshakeObserver HandshakeObserver
+
 	// Timeout is the maximum amount of time for the TCP connection to establish.
 	//
 	// A Timeout of zero means no timeout.
@@ -5,6 +5,7 @@
 package ssh
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -213,3 +214,103 @@ func TestNewClientConn(t *testing.T) {
 		})
 	}
 }
+
+func TestHandshakeObserver(t *testing.T) {
+	for _, kexAlgo := range []string{kexAlgoCurve25519SHA256, kexAlgoECDH256, kexAlgoDH14SHA1, kexAlgoDH14SHA256} {
+		t.Run(kexAlgo, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			serverConf := &ServerConfig{NoClientAuth: true}
+			serverConf.KeyExchanges = []string{kexAlgo}
+			serverConf.AddHostKey(testSigners["ed25519"])
+			go NewServerConn(c1, serverConf)
+
+			var records []*HandshakeRecord
+			clientConf := &ClientConfig{
+				HostKeyCallback: InsecureIgnoreHostKey(),
+				HandshakeObserver: func(record *HandshakeRecord) {
+					records = append(records, record)
+				},
+			}
+			clientConn, _, _, err := NewClientConn(c2, "", clientConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+
+			if len(records) != 1 {
+				t.Fatalf("got %d records, want 1", len(records))
+			}
+			record := records[0]
+			if record.KexAlgorithm != kexAlgo {
+				t.Errorf("got kex algorithm %q, want %q", record.KexAlgorithm, kexAlgo)
+			}
+			if record.HostKeyAlgorithm != KeyAlgoED25519 {
+				t.Errorf("got host key algorithm %q, want %q", record.HostKeyAlgorithm, KeyAlgoED25519)
+			}
+			if string(record.ClientVersion) != packageVersion {
+				t.Errorf("got client version %q, want %q", record.ClientVersion, packageVersion)
+			}
+			if !bytes.Equal(record.ExchangeHash, clientConn.SessionID()) {
+				t.Errorf("exchange hash does not match session ID")
+			}
+			if len(record.ClientEphemeral) == 0 || len(record.ServerEphemeral) == 0 || len(record.SharedSecret) == 0 {
+				t.Errorf("ephemeral values or shared secret missing")
+			}
+
+			hostKey, err := ParsePublicKey(record.HostKey)
+			if err != nil {
+				t.Fatalf("ParsePublicKey: %v", err)
+			}
+			if !bytes.Equal(hostKey.Marshal(), testSigners["ed25519"].PublicKey().Marshal()) {
+				t.Errorf("host key does not match")
+			}
+			if err := hostKey.Verify(record.ExchangeHash, record.Signature); err != nil {
+				t.Errorf("signature does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestClientRSASHA2HostKey(t *testing.T) {
+	for _, algo := range []string{SigAlgoRSASHA2256, SigAlgoRSASHA2512} {
+		t.Run(algo, func(t *testing.T) {
+			c1, c2, err := netPipe()
+			if err != nil {
+				t.Fatalf("netPipe: %v", err)
+			}
+			defer c1.Close()
+			defer c2.Close()
+
+			serverConf := &ServerConfig{NoClientAuth: true}
+			serverConf.AddHostKey(testSigners["rsa"])
+			go NewServerConn(c1, serverConf)
+
+			var record *HandshakeRecord
+			clientConf := &ClientConfig{
+				HostKeyCallback:   InsecureIgnoreHostKey(),
+				HostKeyAlgorithms: []string{algo},
+				HandshakeObserver: func(r *HandshakeRecord) {
+					record = r
+				},
+			}
+			clientConn, _, _, err := NewClientConn(c2, "", clientConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+
+			if record.HostKeyAlgorithm != algo {
+				t.Errorf("got host key algorithm %q, want %q", record.HostKeyAlgorithm, algo)
+			}
+			if record.Signature.Format != algo {
+				t.Errorf("got signature format %q, want %q", record.Signature.Format, algo)
+			}
+		})
+	}
+}
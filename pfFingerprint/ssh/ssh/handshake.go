@@ -83,6 +83,10 @@ type handshakeTransport struct {
 	// dance to handle a custom server's message.
 	bannerCallback BannerCallback
 
+	// handshakeObserver is non-nil if we are the client and it has been set
+	// in ClientConfig. It is called after every client side key exchange.
+	handshakeObserver HandshakeObserver
+
 	// Algorithms agreed in the last key exchange.
 	algorithms *algorithms
 
@@ -126,6 +130,7 @@ func newClientTransport(conn keyingTransport, clientVersion, serverVersion []byt
 	t.remoteAddr = addr
 	t.hostKeyCallback = config.HostKeyCallback
 	t.bannerCallback = config.BannerCallback
+	t.handshakeObserver = config.HandshakeObserver
 	if config.HostKeyAlgorithms != nil {
 		t.hostKeyAlgorithms = config.HostKeyAlgorithms
 	} else {
@@ -457,6 +462,12 @@ func (t *handshakeTransport) sendKexInit() error {
 
 	if len(t.hostKeys) > 0 {
 		for _, k := range t.hostKeys {
+			// RSA keys that can sign with SHA-2 are also offered as
+			// rsa-sha2-256 and rsa-sha2-512 (RFC 8332).
+			if _, ok := k.(AlgorithmSigner); ok && k.PublicKey().Type() == KeyAlgoRSA {
+				msg.ServerHostKeyAlgos = append(
+					msg.ServerHostKeyAlgos, SigAlgoRSASHA2512, SigAlgoRSASHA2256)
+			}
 			msg.ServerHostKeyAlgos = append(
 				msg.ServerHostKeyAlgos, k.PublicKey().Type())
 		}
@@ -617,12 +628,32 @@ func (t *handshakeTransport) server(kex kexAlgorithm, algs *algorithms, magics *
 		if algs.hostKey == k.PublicKey().Type() {
 			hostKey = k
 		}
+		if algs.hostKey == SigAlgoRSASHA2256 || algs.hostKey == SigAlgoRSASHA2512 {
+			if algSigner, ok := k.(AlgorithmSigner); ok && k.PublicKey().Type() == KeyAlgoRSA {
+				hostKey = &fixedAlgorithmSigner{algSigner, algs.hostKey}
+			}
+		}
 	}
 
 	r, err := kex.Server(t.conn, t.config.Rand, magics, hostKey)
 	return r, err
 }
 
+// fixedAlgorithmSigner is a Signer that always signs with the given
+// algorithm.
+type fixedAlgorithmSigner struct {
+	AlgorithmSigner
+	algorithm string
+}
+
+func (s *fixedAlgorithmSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, s.algorithm)
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
 func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *handshakeMagics) (*kexResult, error) {
 	result, err := kex.Client(t.conn, t.config.Rand, magics)
 	if err != nil {
@@ -634,10 +665,28 @@ func (t *handshakeTransport) client(kex kexAlgorithm, algs *algorithms, magics *
 		return nil, err
 	}
 
-	if err := verifyHostKeySignature(hostKey, result); err != nil {
+	if err := verifyHostKeySignature(hostKey, algs.hostKey, result); err != nil {
 		return nil, err
 	}
 
+	if t.handshakeObserver != nil {
+		sig, _, _ := parseSignatureBody(copyBytes(result.Signature))
+		t.handshakeObserver(&HandshakeRecord{
+			ClientVersion:    copyBytes(magics.clientVersion),
+			ServerVersion:    copyBytes(magics.serverVersion),
+			ClientKexInit:    copyBytes(magics.clientKexInit),
+			ServerKexInit:    copyBytes(magics.serverKexInit),
+			KexAlgorithm:     algs.kex,
+			HostKeyAlgorithm: algs.hostKey,
+			HostKey:          copyBytes(result.HostKey),
+			ClientEphemeral:  copyBytes(result.ClientPubKey),
+			ServerEphemeral:  copyBytes(result.ServerPubKey),
+			SharedSecret:     copyBytes(result.K),
+			ExchangeHash:     copyBytes(result.H),
+			Signature:        sig,
+		})
+	}
+
 	err = t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey)
 	if err != nil {
 		return nil, err
@@ -20,12 +20,14 @@ import (
 )
 
 const (
-	kexAlgoDH1SHA1          = "diffie-hellman-group1-sha1"
-	kexAlgoDH14SHA1         = "diffie-hellman-group14-sha1"
-	kexAlgoECDH256          = "ecdh-sha2-nistp256"
-	kexAlgoECDH384          = "ecdh-sha2-nistp384"
-	kexAlgoECDH521          = "ecdh-sha2-nistp521"
-	kexAlgoCurve25519SHA256 = "curve25519-sha256@libssh.org"
+	kexAlgoDH1SHA1                = "diffie-hellman-group1-sha1"
+	kexAlgoDH14SHA1               = "diffie-hellman-group14-sha1"
+	kexAlgoDH14SHA256             = "diffie-hellman-group14-sha256"
+	kexAlgoECDH256                = "ecdh-sha2-nistp256"
+	kexAlgoECDH384                = "ecdh-sha2-nistp384"
+	kexAlgoECDH521                = "ecdh-sha2-nistp521"
+	kexAlgoCurve25519SHA256LibSSH = "curve25519-sha256@libssh.org"
+	kexAlgoCurve25519SHA256       = "curve25519-sha256"
 
 	// For the following kex only the client half contains a production
 	// ready implementation. The server half only consists of a minimal
@@ -48,6 +50,11 @@ type kexResult struct {
 	// Signature of H.
 	Signature []byte
 
+	// Ephemeral public values of the client and the server, as
+	// hashed into H. For finite field Diffie-Hellman, these are the
+	// big-endian encodings of e and f.
+	ClientPubKey, ServerPubKey []byte
+
 	// A cryptographic hash function that matches the security
 	// level of the key exchange algorithm. It is used for
 	// calculating H, and for deriving keys from H and K.
@@ -86,6 +93,7 @@ type kexAlgorithm interface {
 // dhGroup is a multiplicative group suitable for implementing Diffie-Hellman key agreement.
 type dhGroup struct {
 	g, p, pMinus1 *big.Int
+	hashFunc      crypto.Hash
 }
 
 func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int, error) {
@@ -96,7 +104,7 @@ func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int,
 }
 
 func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
-	hashFunc := crypto.SHA1
+	hashFunc := group.hashFunc
 
 	var x *big.Int
 	for {
@@ -142,16 +150,18 @@ func (group *dhGroup) Client(c packetConn, randSource io.Reader, magics *handsha
 	h.Write(K)
 
 	return &kexResult{
-		H:         h.Sum(nil),
-		K:         K,
-		HostKey:   kexDHReply.HostKey,
-		Signature: kexDHReply.Signature,
-		Hash:      crypto.SHA1,
+		H:            h.Sum(nil),
+		K:            K,
+		HostKey:      kexDHReply.HostKey,
+		Signature:    kexDHReply.Signature,
+		Hash:         hashFunc,
+		ClientPubKey: X.Bytes(),
+		ServerPubKey: kexDHReply.Y.Bytes(),
 	}, nil
 }
 
 func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
-	hashFunc := crypto.SHA1
+	hashFunc := group.hashFunc
 	packet, err := c.readPacket()
 	if err != nil {
 		return
@@ -207,11 +217,13 @@ func (group *dhGroup) Server(c packetConn, randSource io.Reader, magics *handsha
 
 	err = c.writePacket(packet)
 	return &kexResult{
-		H:         H,
-		K:         K,
-		HostKey:   hostKeyBytes,
-		Signature: sig,
-		Hash:      crypto.SHA1,
+		H:            H,
+		K:            K,
+		HostKey:      hostKeyBytes,
+		Signature:    sig,
+		Hash:         hashFunc,
+		ClientPubKey: kexDHInit.X.Bytes(),
+		ServerPubKey: Y.Bytes(),
 	}, err
 }
 
@@ -264,11 +276,13 @@ func (kex *ecdh) Client(c packetConn, rand io.Reader, magics *handshakeMagics) (
 	h.Write(K)
 
 	return &kexResult{
-		H:         h.Sum(nil),
-		K:         K,
-		HostKey:   reply.HostKey,
-		Signature: reply.Signature,
-		Hash:      ecHash(kex.curve),
+		H:            h.Sum(nil),
+		K:            K,
+		HostKey:      reply.HostKey,
+		Signature:    reply.Signature,
+		Hash:         ecHash(kex.curve),
+		ClientPubKey: kexInit.ClientPubKey,
+		ServerPubKey: reply.EphemeralPubKey,
 	}, nil
 }
 
@@ -376,11 +390,13 @@ func (kex *ecdh) Server(c packetConn, rand io.Reader, magics *handshakeMagics, p
 	}
 
 	return &kexResult{
-		H:         H,
-		K:         K,
-		HostKey:   reply.HostKey,
-		Signature: sig,
-		Hash:      ecHash(kex.curve),
+		H:            H,
+		K:            K,
+		HostKey:      reply.HostKey,
+		Signature:    sig,
+		Hash:         ecHash(kex.curve),
+		ClientPubKey: kexECDHInit.ClientPubKey,
+		ServerPubKey: serializedEphKey,
 	}, nil
 }
 
@@ -391,9 +407,10 @@ func init() {
 	// 4253 and Oakley Group 2 in RFC 2409.
 	p, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
 	kexAlgoMap[kexAlgoDH1SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA1,
 	}
 
 	// This is the group called diffie-hellman-group14-sha1 in RFC
@@ -401,22 +418,32 @@ func init() {
 	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
 
 	kexAlgoMap[kexAlgoDH14SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA1,
+	}
+
+	// The same group with SHA-256, see RFC 8268.
+	kexAlgoMap[kexAlgoDH14SHA256] = &dhGroup{
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA256,
 	}
 
 	kexAlgoMap[kexAlgoECDH521] = &ecdh{elliptic.P521()}
 	kexAlgoMap[kexAlgoECDH384] = &ecdh{elliptic.P384()}
 	kexAlgoMap[kexAlgoECDH256] = &ecdh{elliptic.P256()}
 	kexAlgoMap[kexAlgoCurve25519SHA256] = &curve25519sha256{}
+	kexAlgoMap[kexAlgoCurve25519SHA256LibSSH] = &curve25519sha256{}
 	kexAlgoMap[kexAlgoDHGEXSHA1] = &dhGEXSHA{hashFunc: crypto.SHA1}
 	kexAlgoMap[kexAlgoDHGEXSHA256] = &dhGEXSHA{hashFunc: crypto.SHA256}
 }
 
-// curve25519sha256 implements the curve25519-sha256@libssh.org key
-// agreement protocol, as described in
-// https://git.libssh.org/projects/libssh.git/tree/doc/curve25519-sha256@libssh.org.txt
+// curve25519sha256 implements the curve25519-sha256 (formerly known as
+// curve25519-sha256@libssh.org) key agreement protocol, as described in
+// RFC 8731.
 type curve25519sha256 struct{}
 
 type curve25519KeyPair struct {
@@ -478,11 +505,13 @@ func (kex *curve25519sha256) Client(c packetConn, rand io.Reader, magics *handsh
 	h.Write(K)
 
 	return &kexResult{
-		H:         h.Sum(nil),
-		K:         K,
-		HostKey:   reply.HostKey,
-		Signature: reply.Signature,
-		Hash:      crypto.SHA256,
+		H:            h.Sum(nil),
+		K:            K,
+		HostKey:      reply.HostKey,
+		Signature:    reply.Signature,
+		Hash:         crypto.SHA256,
+		ClientPubKey: kp.pub[:],
+		ServerPubKey: reply.EphemeralPubKey,
 	}, nil
 }
 
@@ -541,11 +570,13 @@ func (kex *curve25519sha256) Server(c packetConn, rand io.Reader, magics *handsh
 		return nil, err
 	}
 	return &kexResult{
-		H:         H,
-		K:         K,
-		HostKey:   hostKeyBytes,
-		Signature: sig,
-		Hash:      crypto.SHA256,
+		H:            H,
+		K:            K,
+		HostKey:      hostKeyBytes,
+		Signature:    sig,
+		Hash:         crypto.SHA256,
+		ClientPubKey: kexInit.ClientPubKey,
+		ServerPubKey: kp.pub[:],
 	}, nil
 }
 
@@ -659,11 +690,13 @@ func (gex dhGEXSHA) Client(c packetConn, randSource io.Reader, magics *handshake
 	h.Write(K)
 
 	return &kexResult{
-		H:         h.Sum(nil),
-		K:         K,
-		HostKey:   kexDHGexReply.HostKey,
-		Signature: kexDHGexReply.Signature,
-		Hash:      gex.hashFunc,
+		H:            h.Sum(nil),
+		K:            K,
+		HostKey:      kexDHGexReply.HostKey,
+		Signature:    kexDHGexReply.Signature,
+		Hash:         gex.hashFunc,
+		ClientPubKey: X.Bytes(),
+		ServerPubKey: kexDHGexReply.Y.Bytes(),
 	}, nil
 }
 
@@ -773,10 +806,12 @@ func (gex dhGEXSHA) Server(c packetConn, randSource io.Reader, magics *handshake
 	err = c.writePacket(packet)
 
 	return &kexResult{
-		H:         H,
-		K:         K,
-		HostKey:   hostKeyBytes,
-		Signature: sig,
-		Hash:      gex.hashFunc,
+		H:            H,
+		K:            K,
+		HostKey:      hostKeyBytes,
+		Signature:    sig,
+		Hash:         gex.hashFunc,
+		ClientPubKey: kexDHGexInit.X.Bytes(),
+		ServerPubKey: Y.Bytes(),
 	}, err
 }
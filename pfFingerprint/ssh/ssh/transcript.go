@@ -0,0 +1,287 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// The strict key exchange markers from OpenSSH 9.6. If both sides send them,
+// the sequence numbers are reset to zero after each msgNewKeys.
+const (
+	kexStrictClient = "kex-strict-c-v00@openssh.com"
+	kexStrictServer = "kex-strict-s-v00@openssh.com"
+)
+
+// KexParameters contains the public values of a curve25519-sha256 key
+// exchange, as they are hashed into the exchange hash H (RFC 8731, section
+// 3), together with the sequence numbers of the first encrypted packet in
+// each direction. Together with the ephemeral scalar of either side, they
+// are sufficient to derive the session keys of a recorded connection.
+type KexParameters struct {
+	// Algorithm is the negotiated key exchange algorithm.
+	Algorithm string
+
+	// ClientVersion and ServerVersion are the version lines without
+	// the terminating CR LF.
+	ClientVersion []byte
+	ServerVersion []byte
+
+	// ClientKexInit and ServerKexInit are the payloads of the
+	// msgKexInit packets.
+	ClientKexInit []byte
+	ServerKexInit []byte
+
+	// HostKey is the server host key in SSH wire format.
+	HostKey []byte
+
+	// ClientEphemeral and ServerEphemeral are the curve25519 public
+	// values Q_C and Q_S.
+	ClientEphemeral []byte
+	ServerEphemeral []byte
+
+	// ClientToServerSeq and ServerToClientSeq are the sequence numbers of
+	// the first packet after msgNewKeys in the respective direction.
+	ClientToServerSeq uint32
+	ServerToClientSeq uint32
+}
+
+// ParseHandshake reads the version exchange and the unencrypted key
+// exchange packets from both directions of a recorded connection. The
+// readers must start at the first byte of the connection. On success, they
+// are positioned at the first encrypted packet.
+func ParseHandshake(clientToServer, serverToClient io.Reader) (*KexParameters, error) {
+	params := &KexParameters{}
+	var err error
+
+	if params.ClientVersion, err = readVersion(clientToServer); err != nil {
+		return nil, fmt.Errorf("ssh: failed to read client version: %v", err)
+	}
+	if params.ServerVersion, err = readVersion(serverToClient); err != nil {
+		return nil, fmt.Errorf("ssh: failed to read server version: %v", err)
+	}
+
+	var clientECDHInit kexECDHInitMsg
+	params.ClientKexInit, params.ClientToServerSeq, err = readPlainKex(clientToServer, msgKexECDHInit, &clientECDHInit)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: client to server: %v", err)
+	}
+	params.ClientEphemeral = clientECDHInit.ClientPubKey
+
+	var serverECDHReply kexECDHReplyMsg
+	params.ServerKexInit, params.ServerToClientSeq, err = readPlainKex(serverToClient, msgKexECDHReply, &serverECDHReply)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: server to client: %v", err)
+	}
+	params.ServerEphemeral = serverECDHReply.EphemeralPubKey
+	params.HostKey = serverECDHReply.HostKey
+
+	var clientInit, serverInit kexInitMsg
+	if err := Unmarshal(params.ClientKexInit, &clientInit); err != nil {
+		return nil, err
+	}
+	if err := Unmarshal(params.ServerKexInit, &serverInit); err != nil {
+		return nil, err
+	}
+	algs, err := findAgreedAlgorithms(true, &clientInit, &serverInit)
+	if err != nil {
+		return nil, err
+	}
+	params.Algorithm = algs.kex
+
+	if contains(clientInit.KexAlgos, kexStrictClient) && contains(serverInit.KexAlgos, kexStrictServer) {
+		params.ClientToServerSeq = 0
+		params.ServerToClientSeq = 0
+	}
+
+	return params, nil
+}
+
+// readPlainKex reads the unencrypted packets of the initial key exchange
+// from one direction up to and including msgNewKeys. The ECDH message of
+// type ecdhType is unmarshaled into ecdhMsg. It returns the msgKexInit
+// payload and the sequence number of the packet following msgNewKeys.
+func readPlainKex(r io.Reader, ecdhType byte, ecdhMsg interface{}) (kexInit []byte, seqNum uint32, err error) {
+	plain := &streamPacketCipher{cipher: noneCipher{}}
+	haveECDH := false
+	for {
+		packet, err := plain.readCipherPacket(seqNum, r)
+		if err != nil {
+			return nil, 0, err
+		}
+		// The packet buffer is reused by the next read, and unmarshaled
+		// messages refer to it.
+		packet = append([]byte(nil), packet...)
+		seqNum++
+		if len(packet) == 0 {
+			return nil, 0, errors.New("zero length packet")
+		}
+
+		switch packet[0] {
+		case msgIgnore, msgDebug:
+		case msgKexInit:
+			if kexInit != nil {
+				return nil, 0, errors.New("duplicate msgKexInit")
+			}
+			kexInit = packet
+		case ecdhType:
+			if err := Unmarshal(packet, ecdhMsg); err != nil {
+				return nil, 0, err
+			}
+			haveECDH = true
+		case msgNewKeys:
+			if kexInit == nil || !haveECDH {
+				return nil, 0, errors.New("msgNewKeys before key exchange finished")
+			}
+			return kexInit, seqNum, nil
+		default:
+			return nil, 0, fmt.Errorf("unexpected message type %d during key exchange", packet[0])
+		}
+	}
+}
+
+// SessionDecrypter decrypts both directions of a recorded connection using
+// session keys that are derived from a curve25519-sha256 key exchange and the
+// ephemeral scalar of the server. Re-keying is not supported.
+type SessionDecrypter struct {
+	result         *kexResult
+	algs           *algorithms
+	clientToServer connectionState
+	serverToClient connectionState
+}
+
+// NewSessionDecrypter recomputes the shared secret and the exchange hash
+// from params and the server's ephemeral curve25519 scalar, and derives the
+// session keys for both directions. It returns an error if serverScalar does
+// not belong to params.ServerEphemeral.
+func NewSessionDecrypter(params *KexParameters, serverScalar []byte) (*SessionDecrypter, error) {
+	if params.Algorithm != kexAlgoCurve25519SHA256 && params.Algorithm != kexAlgoCurve25519SHA256LibSSH {
+		return nil, fmt.Errorf("ssh: unsupported key exchange algorithm %q", params.Algorithm)
+	}
+	if len(serverScalar) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("ssh: server scalar has length %d, want %d", len(serverScalar), curve25519.ScalarSize)
+	}
+
+	serverPub, err := curve25519.X25519(serverScalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(serverPub, params.ServerEphemeral) {
+		return nil, errors.New("ssh: server scalar does not match the server's ephemeral public value")
+	}
+	secret, err := curve25519.X25519(serverScalar, params.ClientEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	h := crypto.SHA256.New()
+	magics := handshakeMagics{
+		clientVersion: params.ClientVersion,
+		serverVersion: params.ServerVersion,
+		clientKexInit: params.ClientKexInit,
+		serverKexInit: params.ServerKexInit,
+	}
+	magics.write(h)
+	writeString(h, params.HostKey)
+	writeString(h, params.ClientEphemeral)
+	writeString(h, params.ServerEphemeral)
+
+	ki := new(big.Int).SetBytes(secret)
+	K := make([]byte, intLength(ki))
+	marshalInt(K, ki)
+	h.Write(K)
+	H := h.Sum(nil)
+
+	result := &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   params.HostKey,
+		Hash:      crypto.SHA256,
+		SessionID: H,
+	}
+
+	var clientInit, serverInit kexInitMsg
+	if err := Unmarshal(params.ClientKexInit, &clientInit); err != nil {
+		return nil, err
+	}
+	if err := Unmarshal(params.ServerKexInit, &serverInit); err != nil {
+		return nil, err
+	}
+	// From the client's point of view, w is client to server and r is
+	// server to client.
+	algs, err := findAgreedAlgorithms(true, &clientInit, &serverInit)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &SessionDecrypter{
+		result: result,
+		algs:   algs,
+	}
+	d.clientToServer.seqNum = params.ClientToServerSeq
+	d.clientToServer.dir = clientKeys
+	if d.clientToServer.packetCipher, err = newPacketCipher(clientKeys, algs.w, result); err != nil {
+		return nil, err
+	}
+	d.serverToClient.seqNum = params.ServerToClientSeq
+	d.serverToClient.dir = serverKeys
+	if d.serverToClient.packetCipher, err = newPacketCipher(serverKeys, algs.r, result); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// SharedSecret returns the shared secret K, encoded as mpint.
+func (d *SessionDecrypter) SharedSecret() []byte {
+	return d.result.K
+}
+
+// ExchangeHash returns the exchange hash H, which is also the session ID.
+func (d *SessionDecrypter) ExchangeHash() []byte {
+	return d.result.H
+}
+
+// Ciphers returns the negotiated ciphers for both directions.
+func (d *SessionDecrypter) Ciphers() (clientToServer, serverToClient string) {
+	return d.algs.w.Cipher, d.algs.r.Cipher
+}
+
+// ReadClientPacket reads and decrypts the next packet sent by the client.
+// The returned payload is not reused by later calls.
+func (d *SessionDecrypter) ReadClientPacket(r io.Reader) ([]byte, error) {
+	return d.readPacket(&d.clientToServer, r)
+}
+
+// ReadServerPacket reads and decrypts the next packet sent by the server.
+// The returned payload is not reused by later calls.
+func (d *SessionDecrypter) ReadServerPacket(r io.Reader) ([]byte, error) {
+	return d.readPacket(&d.serverToClient, r)
+}
+
+func (d *SessionDecrypter) readPacket(s *connectionState, r io.Reader) ([]byte, error) {
+	if s.packetCipher == nil {
+		return nil, errors.New("ssh: key was re-exchanged, the following packets use unknown keys")
+	}
+	packet, err := s.packetCipher.readCipherPacket(s.seqNum, r)
+	if err != nil {
+		return nil, err
+	}
+	s.seqNum++
+	if len(packet) == 0 {
+		return nil, errors.New("ssh: zero length packet")
+	}
+	if packet[0] == msgNewKeys {
+		s.packetCipher = nil
+	}
+	return append([]byte(nil), packet...), nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// fixedScalarReader returns scalar for every read of a curve25519 scalar
+// and random bytes otherwise.
+type fixedScalarReader struct {
+	scalar []byte
+}
+
+func (r *fixedScalarReader) Read(p []byte) (int, error) {
+	if len(p) == len(r.scalar) {
+		return copy(p, r.scalar), nil
+	}
+	return rand.Read(p)
+}
+
+// recordingConn records all bytes written to and read from the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+	read    bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Write(b[:n])
+	return n, err
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Write(b[:n])
+	return n, err
+}
+
+// recordSession runs a connection between a client and a server whose
+// ephemeral curve25519 scalar is serverScalar. The client sends ping and the
+// server answers with pong on a channel. It returns the recorded client to
+// server and server to client streams.
+func recordSession(t *testing.T, kexAlgo string, serverScalar, ping, pong []byte) (c2s, s2c []byte) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConf := &ServerConfig{NoClientAuth: true}
+	serverConf.Rand = &fixedScalarReader{scalar: serverScalar}
+	serverConf.KeyExchanges = []string{kexAlgo}
+	serverConf.AddHostKey(testSigners["ed25519"])
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c2, serverConf)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		go DiscardRequests(reqs)
+		newCh := <-chans
+		if newCh == nil {
+			serverErr <- io.EOF
+			return
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		go DiscardRequests(chReqs)
+		buf := make([]byte, len(ping))
+		if _, err := io.ReadFull(ch, buf); err != nil {
+			serverErr <- err
+			return
+		}
+		_, err = ch.Write(pong)
+		serverErr <- err
+	}()
+
+	rec := &recordingConn{Conn: c1}
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	conn, chans, reqs, err := NewClientConn(rec, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(conn, chans, reqs)
+	defer client.Close()
+
+	ch, chReqs, err := client.OpenChannel("transcript-test", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(chReqs)
+	if _, err := ch.Write(ping); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, len(pong))
+	if _, err := io.ReadFull(ch, buf); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+
+	return append([]byte(nil), rec.written.Bytes()...), append([]byte(nil), rec.read.Bytes()...)
+}
+
+// readAllPackets decrypts packets until the stream ends. The last packet of
+// the server stream may be truncated, as the client does not need to have
+// read it completely.
+func readAllPackets(r io.Reader, read func(io.Reader) ([]byte, error)) [][]byte {
+	var packets [][]byte
+	for {
+		p, err := read(r)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, p)
+	}
+}
+
+func containsChannelData(packets [][]byte, data []byte) bool {
+	for _, p := range packets {
+		if p[0] == msgChannelData && bytes.Contains(p, data) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSessionDecrypter(t *testing.T) {
+	serverScalar := bytes.Repeat([]byte{0x42}, 32)
+	ping := []byte("ping from the client")
+	pong := []byte("pong from the server")
+
+	for _, kexAlgo := range []string{kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH} {
+		t.Run(kexAlgo, func(t *testing.T) {
+			c2s, s2c := recordSession(t, kexAlgo, serverScalar, ping, pong)
+
+			c2sReader := bytes.NewReader(c2s)
+			s2cReader := bytes.NewReader(s2c)
+			params, err := ParseHandshake(c2sReader, s2cReader)
+			if err != nil {
+				t.Fatalf("ParseHandshake: %v", err)
+			}
+			if params.Algorithm != kexAlgo {
+				t.Errorf("got algorithm %q, want %q", params.Algorithm, kexAlgo)
+			}
+			if !bytes.Equal(params.HostKey, testSigners["ed25519"].PublicKey().Marshal()) {
+				t.Errorf("host key does not match")
+			}
+
+			d, err := NewSessionDecrypter(params, serverScalar)
+			if err != nil {
+				t.Fatalf("NewSessionDecrypter: %v", err)
+			}
+
+			clientPackets := readAllPackets(c2sReader, d.ReadClientPacket)
+			if !containsChannelData(clientPackets, ping) {
+				t.Errorf("did not find client channel data in %d decrypted packets", len(clientPackets))
+			}
+			serverPackets := readAllPackets(s2cReader, d.ReadServerPacket)
+			if !containsChannelData(serverPackets, pong) {
+				t.Errorf("did not find server channel data in %d decrypted packets", len(serverPackets))
+			}
+		})
+	}
+}
+
+func TestSessionDecrypterWrongScalar(t *testing.T) {
+	serverScalar := bytes.Repeat([]byte{0x42}, 32)
+	c2s, s2c := recordSession(t, kexAlgoCurve25519SHA256, serverScalar, []byte("ping"), []byte("pong"))
+
+	params, err := ParseHandshake(bytes.NewReader(c2s), bytes.NewReader(s2c))
+	if err != nil {
+		t.Fatalf("ParseHandshake: %v", err)
+	}
+	wrongScalar := bytes.Repeat([]byte{0x43}, 32)
+	if _, err := NewSessionDecrypter(params, wrongScalar); err == nil {
+		t.Fatalf("NewSessionDecrypter succeeded with wrong scalar")
+	}
+}
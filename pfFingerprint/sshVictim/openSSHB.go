@@ -0,0 +1,86 @@
+package sshVictim
+
+//Recompute the digit vector "b" that OpenSSH derives from the signed message. Its digits decide the
+//swaps during the scalar multiplication, which is what the page fault side channel observes
+
+import (
+	"crypto/sha512"
+	"pfFingerprint/edwards25519"
+	"strconv"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//MessageDigestReduced computes messageDigestReduced as in the edDSA signature
+func MessageDigestReduced(privateKey ed25519.PrivateKey, message []byte) []byte {
+	if l := len(privateKey); l != ed25519.PrivateKeySize {
+		panic("ed25519: bad private key length: " + strconv.Itoa(l))
+	}
+
+	h := sha512.New()
+	h.Write(privateKey[:32])
+
+	var digest1, messageDigest [64]byte
+	var expandedSecretKey [32]byte
+	h.Sum(digest1[:0])
+	copy(expandedSecretKey[:], digest1[:])
+	expandedSecretKey[0] &= 248
+	expandedSecretKey[31] &= 63
+	expandedSecretKey[31] |= 64
+
+	h.Reset()
+	h.Write(digest1[32:])
+	h.Write(message)
+	h.Sum(messageDigest[:0])
+
+	var messageDigestReduced [32]byte
+	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
+
+	return messageDigestReduced[:]
+}
+
+//sc25519Window3 is a port of the OpenSSH function sc25519_window3. It calculates the value of "b" given
+//the output the reduced message digest (MessageDigestReduced)
+func sc25519Window3(reducedMessageDigest []byte) []int8 {
+	var carry int8
+	r := make([]int8, 85)
+	i := 0
+	for ; i < 10; i++ {
+		r[8*i+0] = int8(reducedMessageDigest[3*i+0] & 7)
+		r[8*i+1] = int8((reducedMessageDigest[3*i+0] >> 3) & 7)
+		r[8*i+2] = int8((reducedMessageDigest[3*i+0] >> 6) & 7)
+		r[8*i+2] ^= int8((reducedMessageDigest[3*i+1] << 2) & 7)
+		r[8*i+3] = int8((reducedMessageDigest[3*i+1] >> 1) & 7)
+		r[8*i+4] = int8((reducedMessageDigest[3*i+1] >> 4) & 7)
+		r[8*i+5] = int8((reducedMessageDigest[3*i+1] >> 7) & 7)
+		r[8*i+5] ^= int8((reducedMessageDigest[3*i+2] << 1) & 7)
+		r[8*i+6] = int8((reducedMessageDigest[3*i+2] >> 2) & 7)
+		r[8*i+7] = int8((reducedMessageDigest[3*i+2] >> 5) & 7)
+	}
+	r[8*i+0] = int8(reducedMessageDigest[3*i+0] & 7)
+	r[8*i+1] = int8((reducedMessageDigest[3*i+0] >> 3) & 7)
+	r[8*i+2] = int8((reducedMessageDigest[3*i+0] >> 6) & 7)
+	r[8*i+2] ^= int8((reducedMessageDigest[3*i+1] << 2) & 7)
+	r[8*i+3] = int8((reducedMessageDigest[3*i+1] >> 1) & 7)
+	r[8*i+4] = int8((reducedMessageDigest[3*i+1] >> 4) & 7)
+
+	/* Making it signed */
+	carry = 0
+	for i = 0; i < 84; i++ {
+		r[i] += carry
+		r[i+1] += r[i] >> 3
+		r[i] &= 7
+		carry = r[i] >> 2
+		r[i] -= carry << 3
+	}
+	r[84] += carry
+
+	return r
+}
+
+//CalcOpenSSHB calculates the "b" array from the OpenSSh code that is used to make the
+//swap decisions. This can be used for debugging the key recovery
+func CalcOpenSSHB(privateKey ed25519.PrivateKey, message []byte) []int8 {
+	reducedMsgDig := MessageDigestReduced(privateKey, message)
+	return sc25519Window3(reducedMsgDig)
+}
@@ -0,0 +1,197 @@
+//Package sshVictim is an in-process stand-in for the victim sshd. It signs the key exchange with an ed25519 host
+//key and reports the ground truth of every signature, so that pfOSSHAttackEdDSA and pfOSSHRecoverEdDSAKey can be
+//exercised without a VM
+package sshVictim
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+//GroundTruth contains the secret dependent values of one host key signature
+type GroundTruth struct {
+	//Message is the signed exchange hash H
+	Message []byte
+	//Signature is the raw ed25519 signature of Message
+	Signature []byte
+	//B is the signed digit vector computed by CalcOpenSSHB, whose digits decide the swaps that the attack observes
+	B []int8
+}
+
+//GroundTruthObserver is called with the ground truth of every host key signature
+type GroundTruthObserver func(gt *GroundTruth)
+
+//Server accepts ssh connections and rejects all authentication attempts. This is enough to get the signature of
+//the key exchange, e.g. with the ssh trigger
+type Server struct {
+	hostKey ed25519.PrivateKey
+	config  *ssh.ServerConfig
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]bool
+	closed    bool
+}
+
+//LoadHostKey reads an ed25519 host key in the OpenSSH private key format, e.g.
+//openssh-target/victim-sshd-config/ssh_host_ed25519_key
+func LoadHostKey(path string) (ed25519.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key : %v", err)
+	}
+	key, err := ssh.ParseRawPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key : %v", err)
+	}
+	edKey, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("host key has type %T, expected ed25519", key)
+	}
+	return *edKey, nil
+}
+
+//groundTruthSigner wraps the host key signer and reports the ground truth of each signature
+type groundTruthSigner struct {
+	ssh.Signer
+	hostKey  ed25519.PrivateKey
+	observer GroundTruthObserver
+}
+
+//Sign signs data, which is the exchange hash H for the host key signature of the key exchange
+func (g *groundTruthSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	sig, err := g.Signer.Sign(rand, data)
+	if err != nil {
+		return nil, err
+	}
+	if g.observer != nil {
+		g.observer(&GroundTruth{
+			Message:   append([]byte(nil), data...),
+			Signature: append([]byte(nil), sig.Blob...),
+			B:         CalcOpenSSHB(g.hostKey, data),
+		})
+	}
+	return sig, nil
+}
+
+//NewServer creates a server with hostKey. observer may be nil. It is called from the connection handling
+//goroutines and thus has to be safe for concurrent use
+func NewServer(hostKey ed25519.PrivateKey, observer GroundTruthObserver) (*Server, error) {
+	if l := len(hostKey); l != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("host key must have %v bytes, got %v", ed25519.PrivateKeySize, l)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host key signer : %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("password rejected for %v", conn.User())
+		},
+	}
+	config.AddHostKey(&groundTruthSigner{
+		Signer:   signer,
+		hostKey:  hostKey,
+		observer: observer,
+	})
+
+	return &Server{
+		hostKey:   hostKey,
+		config:    config,
+		listeners: make(map[net.Listener]bool),
+	}, nil
+}
+
+//PublicKey returns the public host key
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.hostKey.Public().(ed25519.PublicKey)
+}
+
+//ServeConn runs the handshake on conn until the client gives up authenticating and closes conn
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return err
+	}
+	//all authentication attempts are rejected, so we should never get here
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		newChan.Reject(ssh.Prohibited, "no channels")
+	}
+	return sshConn.Close()
+}
+
+//Serve accepts connections on l and serves each one in its own goroutine. Returns once l has been closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return fmt.Errorf("server closed")
+	}
+	s.listeners[l] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection : %v", err)
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				log.Printf("Connection from %v ended : %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+//Close closes all listeners passed to Serve
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	var firstErr error
+	for l := range s.listeners {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//ListenAndServe listens on addr and serves the connections in the background. The returned address is useful
+//if addr has port 0. Stop the server with Close
+func (s *Server) ListenAndServe(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen : %v", err)
+	}
+	//register the listener before returning, so that Close always sees it
+	s.mutex.Lock()
+	s.listeners[l] = true
+	s.mutex.Unlock()
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Printf("sshVictim server stopped : %v", err)
+		}
+	}()
+	return l.Addr(), nil
+}
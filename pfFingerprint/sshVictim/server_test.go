@@ -0,0 +1,98 @@
+package sshVictim
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"pfFingerprint/edwards25519"
+	"pfFingerprint/trigger"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const victimHostKeyPath = "../../openssh-target/victim-sshd-config/ssh_host_ed25519_key"
+
+//startServer starts a server with the victim host key on a random port. The ground truth of each signature
+//is sent to the returned channel
+func startServer(t *testing.T) (*Server, string, chan *GroundTruth) {
+	hostKey, err := LoadHostKey(victimHostKeyPath)
+	if err != nil {
+		t.Fatalf("LoadHostKey() error = %v", err)
+	}
+	groundTruths := make(chan *GroundTruth, 10)
+	server, err := NewServer(hostKey, func(gt *GroundTruth) {
+		groundTruths <- gt
+	})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	addr, err := server.ListenAndServe("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenAndServe() error = %v", err)
+	}
+	return server, addr.String(), groundTruths
+}
+
+func TestServer_GroundTruthMatchesTrigger(t *testing.T) {
+	server, addr, groundTruths := startServer(t)
+	defer server.Close()
+
+	victimTrigger, err := trigger.NewTriggerFromURI(fmt.Sprintf("ssh://victim@%v?hostKeyAlgo=ssh-ed25519", addr))
+	if err != nil {
+		t.Fatalf("NewTriggerFromURI() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		payload, err := victimTrigger.Execute()
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		var sigMsg trigger.SSHSignatureMessage
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&sigMsg); err != nil {
+			t.Fatalf("Failed to decode signature message : %v", err)
+		}
+		if err := sigMsg.Verify(); err != nil {
+			t.Errorf("Verify() error = %v", err)
+		}
+		if !bytes.Equal(sigMsg.PublicKeySSH, server.PublicKey()) {
+			t.Errorf("public key %x, want %x", sigMsg.PublicKeySSH, []byte(server.PublicKey()))
+		}
+
+		var gt *GroundTruth
+		select {
+		case gt = <-groundTruths:
+		default:
+			t.Fatalf("Server did not report ground truth")
+		}
+		if !bytes.Equal(sigMsg.Message, gt.Message) {
+			t.Errorf("signed message %x, ground truth %x", sigMsg.Message, gt.Message)
+		}
+		if !bytes.Equal(sigMsg.Signature, gt.Signature) {
+			t.Errorf("signature %x, ground truth %x", sigMsg.Signature, gt.Signature)
+		}
+		if got, want := len(gt.B), 85; got != want {
+			t.Errorf("b has %v digits, want %v", got, want)
+		}
+	}
+}
+
+func TestMessageDigestReduced(t *testing.T) {
+	hostKey, err := LoadHostKey(victimHostKeyPath)
+	if err != nil {
+		t.Fatalf("LoadHostKey() error = %v", err)
+	}
+
+	//R of the signature is the base point multiplied with the reduced message digest
+	message := []byte("exchange hash")
+	sig := ed25519.Sign(hostKey, message)
+	var r [32]byte
+	copy(r[:], MessageDigestReduced(hostKey, message))
+	var R edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&R, &r)
+	var encodedR [32]byte
+	R.ToBytes(&encodedR)
+	if !bytes.Equal(encodedR[:], sig[:32]) {
+		t.Errorf("R = %x, want %x", encodedR, sig[:32])
+	}
+}
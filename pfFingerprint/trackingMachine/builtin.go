@@ -0,0 +1,38 @@
+package trackingMachine
+
+//Specs shipped with the binaries
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed machines/*.json
+var builtinFS embed.FS
+
+//Builtin returns the builtin spec with the given name, e.g. "openssh-eddsa"
+func Builtin(name string) (*Spec, error) {
+	f, err := builtinFS.Open(path.Join("machines", name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no builtin spec %v, builtin specs are %v", name, strings.Join(BuiltinNames(), ","))
+	}
+	defer f.Close()
+	return ParseSpec(f)
+}
+
+//BuiltinNames returns the names of all builtin specs in alphabetical order
+func BuiltinNames() []string {
+	entries, err := builtinFS.ReadDir("machines")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, v := range entries {
+		names = append(names, strings.TrimSuffix(v.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
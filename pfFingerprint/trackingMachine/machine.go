@@ -0,0 +1,366 @@
+//Package trackingMachine runs page tracking state machines described by a Spec. This replaces the hand coded
+//toggle tracking loops of the attacks, which are now shipped as builtin specs, see Builtin
+package trackingMachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"pfFingerprint"
+	"pfFingerprint/snapshot"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//IoctlAPI is the part of sevStep.IoctlAPI used by the machine
+type IoctlAPI interface {
+	CmdTrackPage(gpa uint64, trackMode sevStep.PageTrackMode) error
+	CmdTrackAllPages(trackMode sevStep.PageTrackMode) error
+	CmdUnTrackAllPages(trackMode sevStep.PageTrackMode) error
+	CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error)
+	CmdPollEvent() (*sevStep.Event, bool, error)
+	CmdAckEvent(id uint64) error
+}
+
+//pageSize is the amount of memory read by "readMemory" actions
+const pageSize = 4096
+
+//Options configure a Machine
+type Options struct {
+	//Pages binds the input pages of the spec
+	Pages map[string]uint64
+	//Values overrides the default values of the spec
+	Values map[string]int
+	//InputTrackMode overrides the mode of every tracking of an input page, one of the modes of TrackSpec. If
+	//empty, the modes of the spec are used
+	InputTrackMode string
+	//WbinvdCPU is passed to CmdReadGuestMemory
+	WbinvdCPU int
+	//OnEmit is called for each emitted event. If nil, the events are kept and returned by Events
+	OnEmit func(ev *snapshot.Event) error
+	//Snapshot configures the candidate pages that are read by "readMemory" actions in addition to the page of
+	//the action. The candidates are the pages collected during the track all phase that ended with "selectPage"
+	Snapshot snapshot.Policy
+	//OnTransition is called after each fired transition, before the actions are executed. Used for tracing
+	OnTransition func(ev *sevStep.Event, from *StateSpec, t *TransitionSpec)
+	//DebugLog receives verbose output. If nil, the output is discarded
+	DebugLog *log.Logger
+	//Poll configures the event polling of Run. The zero value uses pfFingerprint.DefaultPollConfig
+	Poll pfFingerprint.PollConfig
+}
+
+//Machine executes a Spec
+type Machine struct {
+	spec     *Spec
+	api      IoctlAPI
+	opts     Options
+	state    *StateSpec
+	pages    map[string]uint64
+	inputs   map[string]bool
+	counters map[string]int
+	//collecting is true during a track all phase. The collected events are the input for selectors
+	collecting bool
+	collected  []*sevStep.Event
+	candidates []uint64
+	emitted    []*snapshot.Event
+	finished   bool
+	handled    int
+	source     *pfFingerprint.EventSource
+}
+
+//ErrUnexpectedEvent is returned for events that match no transition in a state with "unexpected": "error"
+var ErrUnexpectedEvent = errors.New("unexpected event")
+
+//New creates a machine for spec that uses api. All input pages of spec have to be bound in opts.Pages
+func New(spec *Spec, api IoctlAPI, opts Options) (*Machine, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.Snapshot.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid snapshot policy : %v", err)
+	}
+	if opts.Poll == (pfFingerprint.PollConfig{}) {
+		opts.Poll = pfFingerprint.DefaultPollConfig()
+	}
+	if err := opts.Poll.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid poll config : %v", err)
+	}
+	m := &Machine{
+		spec:     spec,
+		api:      api,
+		opts:     opts,
+		pages:    make(map[string]uint64),
+		inputs:   make(map[string]bool),
+		counters: make(map[string]int),
+	}
+	if m.opts.DebugLog == nil {
+		m.opts.DebugLog = log.New(ioutil.Discard, "", 0)
+	}
+	if _, ok := trackModes[opts.InputTrackMode]; opts.InputTrackMode != "" && !ok {
+		return nil, fmt.Errorf("invalid input tracking mode %q", opts.InputTrackMode)
+	}
+	for name := range opts.Values {
+		if _, ok := spec.Values[name]; !ok {
+			return nil, fmt.Errorf("spec %v has no value %v", spec.Name, name)
+		}
+	}
+	declared := make(map[string]bool)
+	for _, v := range spec.Pages {
+		declared[v.Name] = true
+		if !v.Input {
+			continue
+		}
+		gpa, ok := opts.Pages[v.Name]
+		if !ok {
+			return nil, fmt.Errorf("input page %v of spec %v is not bound", v.Name, spec.Name)
+		}
+		m.pages[v.Name] = gpa
+		m.inputs[v.Name] = true
+	}
+	for name := range opts.Pages {
+		if !declared[name] {
+			return nil, fmt.Errorf("spec %v has no page %v", spec.Name, name)
+		}
+	}
+	return m, nil
+}
+
+//Start enters the initial state
+func (m *Machine) Start() error {
+	initial, _ := m.spec.State(m.spec.Initial)
+	return m.enter(initial)
+}
+
+//enter makes s the current state and tracks its pages
+func (m *Machine) enter(s *StateSpec) error {
+	m.state = s
+	for _, v := range s.Track {
+		gpa, ok := m.pages[v.Page]
+		if !ok {
+			return fmt.Errorf("state %v tracks page %v, which is not bound yet", s.Name, v.Page)
+		}
+		if err := m.api.CmdTrackPage(gpa, m.trackMode(v.Page, v.Mode)); err != nil {
+			return fmt.Errorf("state %v failed to track %v at %x : %v", s.Name, v.Page, gpa, err)
+		}
+	}
+	return nil
+}
+
+//trackMode returns the tracking mode for page, which is Options.InputTrackMode for input pages if set
+func (m *Machine) trackMode(page, mode string) sevStep.PageTrackMode {
+	if m.opts.InputTrackMode != "" && m.inputs[page] {
+		return trackModes[m.opts.InputTrackMode]
+	}
+	return trackModes[mode]
+}
+
+//matches checks if t fires for ev in the current state
+func (m *Machine) matches(t *TransitionSpec, ev *sevStep.Event) (bool, error) {
+	if t.Fault != "" {
+		gpa, ok := m.pages[t.Fault]
+		if !ok || gpa != ev.FaultedGPA {
+			return false, nil
+		}
+	}
+	for _, v := range t.ErrorSet {
+		if !sevStep.ArePfErrorsSet(ev.ErrorCode, errorBits[v]) {
+			return false, nil
+		}
+	}
+	for _, v := range t.ErrorClear {
+		if sevStep.ArePfErrorsSet(ev.ErrorCode, errorBits[v]) {
+			return false, nil
+		}
+	}
+	for _, c := range t.If {
+		want, err := m.spec.resolveValue(c.Value, m.opts.Values)
+		if err != nil {
+			return false, err
+		}
+		if !comparisons[c.Op](m.counters[c.Counter], want+c.Offset) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//HandleEvent fires the first matching transition of the current state. Returns true once a "finish"
+//action has been executed. The event is not acknowledged
+func (m *Machine) HandleEvent(ev *sevStep.Event) (bool, error) {
+	if m.state == nil {
+		return false, fmt.Errorf("machine has not been started")
+	}
+	if m.finished {
+		return true, nil
+	}
+	m.handled++
+	rec := &snapshot.Event{Event: ev}
+
+	for _, t := range m.state.Transitions {
+		ok, err := m.matches(t, ev)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		if m.opts.OnTransition != nil {
+			m.opts.OnTransition(ev, m.state, t)
+		}
+		for _, a := range t.Actions {
+			if err := m.execute(a, rec); err != nil {
+				return false, fmt.Errorf("state %v, event %v : %v failed : %v", m.state.Name, ev.ID, a.Do, err)
+			}
+		}
+		if t.Target != "" {
+			target, _ := m.spec.State(t.Target)
+			if err := m.enter(target); err != nil {
+				return false, err
+			}
+		}
+		return m.finished, nil
+	}
+
+	if m.collecting {
+		m.collected = append(m.collected, ev)
+		return false, nil
+	}
+	switch m.state.Unexpected {
+	case "ignore":
+	case "error":
+		return false, fmt.Errorf("state %v, fault at %x : %w", m.state.Name, ev.FaultedGPA, ErrUnexpectedEvent)
+	default:
+		log.Printf("unexpected fault at %x in state %v\n", ev.FaultedGPA, m.state.Name)
+	}
+	return false, nil
+}
+
+//execute runs a single action for the event in rec
+func (m *Machine) execute(a ActionSpec, rec *snapshot.Event) error {
+	ev := rec.Event
+	switch a.Do {
+	case "emit":
+		if m.opts.OnEmit != nil {
+			return m.opts.OnEmit(rec)
+		}
+		m.emitted = append(m.emitted, rec)
+	case "readMemory":
+		gpa, ok := m.pages[a.Page]
+		if !ok {
+			return nil
+		}
+		m.opts.DebugLog.Printf("Reading %v %x at RIP %x\n", a.Page, gpa, ev.RIP)
+		mem, err := m.api.CmdReadGuestMemory(gpa, pageSize, true, m.opts.WbinvdCPU)
+		if err != nil {
+			return fmt.Errorf("failed to read guest memory : %v", err)
+		}
+		ev.Content = mem
+		ev.MonitorGPA = gpa
+		if len(m.candidates) > 0 {
+			regions, err := m.opts.Snapshot.Read(m.api, m.candidates, gpa, m.opts.WbinvdCPU)
+			if err != nil {
+				return err
+			}
+			rec.Regions = append(rec.Regions, regions...)
+		}
+	case "track":
+		gpa, ok := m.pages[a.Page]
+		if !ok {
+			return fmt.Errorf("page %v is not bound yet", a.Page)
+		}
+		return m.api.CmdTrackPage(gpa, m.trackMode(a.Page, a.Mode))
+	case "trackAll":
+		log.Printf("Starting %v track all\n", a.Mode)
+		if err := m.api.CmdTrackAllPages(trackModes[a.Mode]); err != nil {
+			return err
+		}
+		m.collecting = true
+		m.collected = m.collected[:0]
+	case "untrackAll":
+		m.collecting = false
+		return m.api.CmdUnTrackAllPages(trackModes[a.Mode])
+	case "selectPage":
+		m.collecting = false
+		selected, ok := selectors[a.Selector](m.collected)
+		if !ok {
+			return fmt.Errorf("selector %v found no page in %v collected events", a.Selector, len(m.collected))
+		}
+		m.pages[a.Page] = selected.FaultedGPA
+		log.Printf("Selected %v %x from %v events. Access was at RIP %x\n", a.Page, selected.FaultedGPA, len(m.collected), selected.RIP)
+		m.candidates = m.opts.Snapshot.CandidatePages(m.collected)
+		if len(m.candidates) > 0 {
+			log.Printf("Snapshotting %v candidate pages %x\n", len(m.candidates), m.candidates)
+		}
+		m.collected = m.collected[:0]
+	case "count":
+		m.counters[a.Counter]++
+	case "log":
+		m.opts.DebugLog.Printf("%v (state %v, event %v)\n", a.Message, m.state.Name, ev.ID)
+	case "finish":
+		m.finished = true
+	}
+	return nil
+}
+
+//Run handles events until ctx is done or the machine finishes. Each event is acknowledged after it has been
+//handled. Start has to be called before, usually before the victim is triggered
+func (m *Machine) Run(ctx context.Context) error {
+	m.source = pfFingerprint.NewEventSource(m.api, m.opts.Poll)
+	defer func() {
+		log.Printf("Processed %v events\n", m.handled)
+		log.Printf("Event polling : %v\n", m.source.Stats())
+	}()
+	for {
+		ev, err := m.source.Next(ctx)
+		if errors.Is(err, pfFingerprint.ErrCtxCancelled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		finished, err := m.HandleEvent(ev)
+		if err != nil {
+			return err
+		}
+		if err := m.api.CmdAckEvent(ev.ID); err != nil {
+			return fmt.Errorf("failed to ack event %v : %v", ev.ID, err)
+		}
+		if finished {
+			return nil
+		}
+	}
+}
+
+//PollStats returns the statistics of the event polling in Run
+func (m *Machine) PollStats() pfFingerprint.PollStats {
+	if m.source == nil {
+		return pfFingerprint.PollStats{}
+	}
+	return m.source.Stats()
+}
+
+//Events returns the emitted events, if Options.OnEmit is nil
+func (m *Machine) Events() []*snapshot.Event {
+	return m.emitted
+}
+
+//Page returns the GPA bound to the page name
+func (m *Machine) Page(name string) (uint64, bool) {
+	gpa, ok := m.pages[name]
+	return gpa, ok
+}
+
+//Counter returns the value of the counter
+func (m *Machine) Counter(name string) int {
+	return m.counters[name]
+}
+
+//State returns the name of the current state
+func (m *Machine) State() string {
+	if m.state == nil {
+		return ""
+	}
+	return m.state.Name
+}
@@ -0,0 +1,417 @@
+package trackingMachine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"pfFingerprint/snapshot"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//eventSequence creates events with increasing ids for the given gpas. All events are fetch faults
+func eventSequence(gpas ...uint64) []*sevStep.Event {
+	events := make([]*sevStep.Event, len(gpas))
+	for i, v := range gpas {
+		events[i] = &sevStep.Event{
+			FaultedGPA: v,
+			ErrorCode:  uint32(sevStep.PfErrorFetch | sevStep.PfErrorUser),
+		}
+	}
+	return events
+}
+
+//renumber assigns increasing ids to events
+func renumber(events []*sevStep.Event) []*sevStep.Event {
+	for i, v := range events {
+		v.ID = uint64(i)
+	}
+	return events
+}
+
+func TestBuiltin(t *testing.T) {
+	names := BuiltinNames()
+	if len(names) == 0 {
+		t.Fatalf("no builtin specs")
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			spec, err := Builtin(name)
+			if err != nil {
+				t.Fatalf("Builtin() error = %v", err)
+			}
+			if spec.Name != name {
+				t.Errorf("spec in file %v has name %v", name, spec.Name)
+			}
+			if err := WriteDot(ioutil.Discard, spec); err != nil {
+				t.Errorf("WriteDot() error = %v", err)
+			}
+		})
+	}
+	if _, err := Builtin("does-not-exist"); err == nil {
+		t.Errorf("Builtin() of unknown spec succeeded")
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	const validStates = `"states": [{"name": "a", "track": [{"page": "p", "mode": "exec"}], "transitions": [{"fault": "p", "actions": [{"do": "emit"}], "target": "a"}]}]`
+	tests := []struct {
+		name    string
+		spec    string
+		wantErr string
+	}{
+		{
+			name: "Valid",
+			spec: `{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "a", ` + validStates + `}`,
+		},
+		{
+			name:    "Unknown field",
+			spec:    `{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "a", "foo": 1, ` + validStates + `}`,
+			wantErr: "unknown field",
+		},
+		{
+			name:    "Missing initial state",
+			spec:    `{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "b", ` + validStates + `}`,
+			wantErr: `initial state "b" does not exist`,
+		},
+		{
+			name:    "Undeclared page",
+			spec:    `{"name": "t", "pages": [], "initial": "a", ` + validStates + `}`,
+			wantErr: "undeclared page p",
+		},
+		{
+			name: "Invalid mode and unknown target",
+			spec: `{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "a", "states": [{"name": "a", "track": [{"page": "p", "mode": "fetch"}],
+				"transitions": [{"fault": "p", "target": "b"}]}]}`,
+			wantErr: `invalid tracking mode "fetch"; state a transition 0: target state b does not exist`,
+		},
+		{
+			name: "Unknown selector",
+			spec: `{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "a", "states": [{"name": "a",
+				"transitions": [{"actions": [{"do": "selectPage", "page": "p", "select": "first"}]}]}]}`,
+			wantErr: `unknown selector "first"`,
+		},
+		{
+			name: "Unknown value",
+			spec: `{"name": "t", "pages": [], "initial": "a", "states": [{"name": "a",
+				"transitions": [{"if": [{"counter": "c", "op": "==", "value": "limit"}]}]}]}`,
+			wantErr: `"limit" is neither an integer nor a declared value`,
+		},
+		{
+			name: "Unknown action and error bit",
+			spec: `{"name": "t", "pages": [], "initial": "a", "states": [{"name": "a",
+				"transitions": [{"errorSet": ["exec"], "actions": [{"do": "jump"}]}]}]}`,
+			wantErr: `unknown error bit "exec"; state a transition 0 action 0 (jump): unknown action`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSpec(strings.NewReader(tt.spec))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ParseSpec() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseSpec() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNew_Binding(t *testing.T) {
+	spec, err := Builtin("openssl-x25519")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "Valid", opts: Options{Pages: map[string]uint64{"base": 1, "fe64": 2}}},
+		{name: "Missing input page", opts: Options{Pages: map[string]uint64{"base": 1}}, wantErr: true},
+		{name: "Unknown page", opts: Options{Pages: map[string]uint64{"base": 1, "fe64": 2, "foo": 3}}, wantErr: true},
+		{name: "Unknown value", opts: Options{Pages: map[string]uint64{"base": 1, "fe64": 2}, Values: map[string]int{"foo": 1}}, wantErr: true},
+		{name: "Invalid input tracking mode", opts: Options{Pages: map[string]uint64{"base": 1, "fe64": 2}, InputTrackMode: "execute"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(spec, NewSimulatedAPI(nil, nil), tt.opts); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDryRun_OpenSSLX25519(t *testing.T) {
+	const base, fe64 = 0x1000, 0x2000
+	spec, err := Builtin("openssl-x25519")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+
+	var events []*sevStep.Event
+	for cycle := 0; cycle < 6; cycle++ {
+		events = append(events, eventSequence(base)...)
+		if cycle == 2 {
+			//the access tracking starts one cycle later, these must be ignored
+			events = append(events, eventSequence(0x5000)...)
+		}
+		if cycle == 3 {
+			events = append(events, eventSequence(0x7000, 0x8000, 0x7000)...)
+		}
+		events = append(events, eventSequence(fe64)...)
+	}
+	renumber(events)
+
+	m, err := DryRun(spec, Options{
+		Pages:  map[string]uint64{"base": base, "fe64": fe64},
+		Values: map[string]int{"ignoreCycles": 3},
+	}, events, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+
+	if got, ok := m.Page("x2"); !ok || got != 0x8000 {
+		t.Errorf("x2 = %x, %v, want 8000", got, ok)
+	}
+	if got, want := len(m.Events()), 12; got != want {
+		t.Fatalf("emitted %v events, want %v", got, want)
+	}
+	for i, ev := range m.Events() {
+		//x2 is known after the base fault of cycle 4, i.e. the 9th event
+		wantContent := i > 8
+		if gotContent := ev.MonitorGPA == 0x8000 && len(ev.Content) == pageSize; gotContent != wantContent {
+			t.Errorf("event %v has content %v, want %v", i, gotContent, wantContent)
+		}
+	}
+	if got, want := m.Counter("cycle"), 6; got != want {
+		t.Errorf("cycle = %v, want %v", got, want)
+	}
+}
+
+func TestDryRun_InputTrackMode(t *testing.T) {
+	const base, fe64 = 0x1000, 0x2000
+	spec, err := Builtin("openssl-x25519")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+	var w strings.Builder
+	events := renumber(eventSequence(base, fe64, base, fe64, base, fe64, base, 0x5000, fe64))
+	if _, err := DryRun(spec, Options{
+		Pages:          map[string]uint64{"base": base, "fe64": fe64},
+		InputTrackMode: "access",
+	}, events, &w); err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	got := w.String()
+	//the labels of the transitions show the modes of the spec
+	if strings.Contains(got, "\ttrack 1000 exec") || strings.Contains(got, "\ttrack 2000 exec") || !strings.Contains(got, "track 1000 access") || !strings.Contains(got, "track 2000 access") {
+		t.Errorf("input pages not tracked with access mode:\n%v", got)
+	}
+	//the track all phase is not about input pages and keeps its mode
+	if !strings.Contains(got, "track all access") {
+		t.Errorf("track all missing:\n%v", got)
+	}
+}
+
+func TestDryRun_OpenSSHEdDSA(t *testing.T) {
+	const chooseT, fe64 = 0x1000, 0x2000
+	spec, err := Builtin("openssh-eddsa")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+
+	writeFault := func(gpa uint64) *sevStep.Event {
+		return &sevStep.Event{FaultedGPA: gpa, ErrorCode: uint32(sevStep.PfErrorWrite | sevStep.PfErrorUser)}
+	}
+	events := eventSequence(chooseT, fe64, chooseT, fe64)
+	for cycle := 0; cycle < 2; cycle++ {
+		for idx := 0; idx < 22; idx++ {
+			events = append(events, eventSequence([]uint64{chooseT, fe64}[idx%2])...)
+			if cycle == 0 && idx == 1 {
+				events = append(events, writeFault(0xa000), writeFault(0xb000), writeFault(0xc000))
+				events = append(events, eventSequence(0xd000)...)
+			}
+		}
+	}
+	renumber(events)
+
+	m, err := DryRun(spec, Options{Pages: map[string]uint64{"chooseT": chooseT, "fe64": fe64}}, events, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if got, ok := m.Page("stackBuf"); !ok || got != 0xd000 {
+		t.Errorf("stackBuf = %x, %v, want d000", got, ok)
+	}
+	emitted := m.Events()
+	if got, want := len(emitted), 4+2*22; got != want {
+		t.Fatalf("emitted %v events, want %v", got, want)
+	}
+	savePoints := map[int]bool{1: true, 3: true, 5: true, 7: true, 9: true, 11: true, 13: true, 15: true, 19: true, 20: true}
+	for i, ev := range emitted[4:] {
+		cycle, idx := i/22, i%22
+		//in the first cycle the stack buffer is read for the first time when it has been found
+		wantContent := (savePoints[idx] && !(cycle == 0 && idx == 1)) || (cycle == 0 && idx == 2)
+		if gotContent := ev.MonitorGPA == 0xd000; gotContent != wantContent {
+			t.Errorf("cycle %v idx %v has content %v, want %v", cycle, idx, gotContent, wantContent)
+		}
+	}
+	if got, want := m.Counter("cycle"), 2; got != want {
+		t.Errorf("cycle = %v, want %v", got, want)
+	}
+}
+
+//pollAPI delivers events like the kernel module and records the acknowledged ids
+type pollAPI struct {
+	*SimulatedAPI
+	acked []uint64
+}
+
+func (p *pollAPI) CmdAckEvent(id uint64) error {
+	p.acked = append(p.acked, id)
+	return nil
+}
+
+func TestMachine_Run(t *testing.T) {
+	spec, err := ParseSpec(strings.NewReader(`{"name": "t", "pages": [{"name": "p", "input": true}], "initial": "a", "states": [
+		{"name": "a", "track": [{"page": "p", "mode": "exec"}], "unexpected": "error", "transitions": [
+			{"fault": "p", "if": [{"counter": "n", "op": ">=", "value": "1"}], "actions": [{"do": "emit"}, {"do": "finish"}]},
+			{"fault": "p", "actions": [{"do": "emit"}, {"do": "count", "counter": "n"}], "target": "a"}
+		]}]}`))
+	if err != nil {
+		t.Fatalf("ParseSpec() error = %v", err)
+	}
+
+	api := &pollAPI{SimulatedAPI: NewSimulatedAPI(renumber(eventSequence(0x1000, 0x1000, 0x1000)), nil)}
+	m, err := New(spec, api, Options{Pages: map[string]uint64{"p": 0x1000}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got, want := len(m.Events()), 2; got != want {
+		t.Errorf("emitted %v events, want %v", got, want)
+	}
+	if got, want := len(api.acked), 2; got != want {
+		t.Errorf("acked %v events, want %v", got, want)
+	}
+
+	//untracked faults are unexpected in state a
+	if _, err := m.HandleEvent(&sevStep.Event{FaultedGPA: 0x2000}); err != nil {
+		t.Errorf("HandleEvent() after finish error = %v", err)
+	}
+	m, err = New(spec, api, Options{Pages: map[string]uint64{"p": 0x1000}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if _, err := m.HandleEvent(&sevStep.Event{FaultedGPA: 0x2000}); !errors.Is(err, ErrUnexpectedEvent) {
+		t.Errorf("HandleEvent() error = %v, want %v", err, ErrUnexpectedEvent)
+	}
+}
+
+func TestDryRun_OpenSSHEdDSA_StackPage(t *testing.T) {
+	const chooseT, fe64 = 0x1000, 0x2000
+	spec, err := Builtin("openssh-eddsa")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+
+	writeFault := func(gpa uint64) *sevStep.Event {
+		return &sevStep.Event{FaultedGPA: gpa, ErrorCode: uint32(sevStep.PfErrorWrite | sevStep.PfErrorUser)}
+	}
+	//an fe64 fault during the track all phase must not move the window of the stack page selector
+	phase := []*sevStep.Event{writeFault(0xa000), writeFault(0xb000), writeFault(0xc000)}
+	phase = append(phase, eventSequence(0xd000, 0x3000, 0x4000, fe64, 0x5000, 0x6000, 0x7000, 0x8000)...)
+	events := eventSequence(chooseT, fe64, chooseT, fe64, chooseT, fe64)
+	events = append(events, phase...)
+	for idx := 2; idx < 22; idx++ {
+		events = append(events, eventSequence([]uint64{chooseT, fe64}[idx%2])...)
+	}
+	renumber(events)
+
+	//the old attack loop collected all faults of the phase except those on chooseT and fe64
+	baselineEvents := make([]*sevStep.Event, 0)
+	for _, v := range phase {
+		if v.FaultedGPA != chooseT && v.FaultedGPA != fe64 {
+			baselineEvents = append(baselineEvents, v)
+		}
+	}
+	baseline, ok := SelectStackPage(baselineEvents)
+	if !ok {
+		t.Fatalf("baseline selected no stack page")
+	}
+
+	m, err := DryRun(spec, Options{Pages: map[string]uint64{"chooseT": chooseT, "fe64": fe64}}, events, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if got, ok := m.Page("stackBuf"); !ok || got != baseline.FaultedGPA {
+		t.Errorf("stackBuf = %x, %v, want %x", got, ok, baseline.FaultedGPA)
+	}
+	//like the old attack loop, the fe64 fault of the phase is part of the trace
+	emitted := false
+	for _, v := range m.Events() {
+		if v.ID == phase[6].ID {
+			emitted = true
+		}
+	}
+	if !emitted {
+		t.Errorf("fe64 fault of the track all phase not emitted")
+	}
+}
+
+func TestDryRun_SnapshotCandidates(t *testing.T) {
+	const chooseT, fe64 = 0x1000, 0x2000
+	spec, err := Builtin("openssh-eddsa")
+	if err != nil {
+		t.Fatalf("Builtin() error = %v", err)
+	}
+
+	writeFault := func(gpa uint64) *sevStep.Event {
+		return &sevStep.Event{FaultedGPA: gpa, ErrorCode: uint32(sevStep.PfErrorWrite | sevStep.PfErrorUser)}
+	}
+	events := eventSequence(chooseT, fe64, chooseT, fe64)
+	for idx := 0; idx < 22; idx++ {
+		events = append(events, eventSequence([]uint64{chooseT, fe64}[idx%2])...)
+		if idx == 1 {
+			events = append(events, writeFault(0xa000), writeFault(0xb000), writeFault(0xc000))
+			//the fetch fault of 0xe000 is no candidate
+			events = append(events, eventSequence(0xd000, 0xe000)...)
+		}
+	}
+	renumber(events)
+
+	m, err := DryRun(spec, Options{
+		Pages:    map[string]uint64{"chooseT": chooseT, "fe64": fe64},
+		Snapshot: snapshot.Policy{Candidates: true, MaxCandidates: 3},
+	}, events, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	for i, ev := range m.Events() {
+		if ev.MonitorGPA == 0 {
+			if len(ev.Regions) != 0 {
+				t.Errorf("event %v has regions without a snapshot of the stack page", i)
+			}
+			continue
+		}
+		//the selected page 0xd000 is the MonitorGPA, the written pages are additional regions
+		got := snapshot.RegionGPAs([]*snapshot.Event{ev})
+		if want := []uint64{0xd000, 0xa000, 0xb000, 0xc000}; !reflect.DeepEqual(got, want) {
+			t.Errorf("event %v has regions %x, want %x", i, got, want)
+		}
+	}
+}
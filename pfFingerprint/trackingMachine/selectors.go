@@ -0,0 +1,78 @@
+package trackingMachine
+
+//Selectors choose a page from the events collected during a track all phase
+
+import (
+	"sort"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//Selector returns the event whose GPA should be bound by a "selectPage" action, or false if there is none
+type Selector func(events []*sevStep.Event) (*sevStep.Event, bool)
+
+var selectors = map[string]Selector{
+	"lastFault": SelectLastFault,
+	"stackPage": SelectStackPage,
+}
+
+//SelectorNames returns the names of all selectors in alphabetical order
+func SelectorNames() []string {
+	names := make([]string, 0, len(selectors))
+	for k := range selectors {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//SelectLastFault selects the last event
+func SelectLastFault(events []*sevStep.Event) (*sevStep.Event, bool) {
+	if len(events) == 0 {
+		return nil, false
+	}
+	return events[len(events)-1], true
+}
+
+//SelectStackPage returns the event containing the memory access to the stack buffer that we want
+//to observe in OpenSSH's edDSA implementation
+func SelectStackPage(events []*sevStep.Event) (*sevStep.Event, bool) {
+	//look for sequence write,write,write,user with rips 0,0,0,0. Last fault (user) is the stack page
+	//If this picks the wrong page, capture with Options.Snapshot to record all candidate pages and let the
+	//recovery tools choose the right one
+
+	var state int
+	var stackBufEvent *sevStep.Event
+	const elemsFromBack = 10
+	offset := len(events) - elemsFromBack
+	if offset < 0 {
+		offset = 0
+	}
+	var v *sevStep.Event
+	for i := offset; i < len(events) && stackBufEvent == nil; i++ {
+		state = 0
+		for j := 0; j < elemsFromBack && i+j < len(events) && stackBufEvent == nil; j++ {
+			v = events[i+j]
+			switch state {
+			case 0:
+				fallthrough
+			case 1:
+				fallthrough
+			case 2:
+				if sevStep.ArePfErrorsSet(v.ErrorCode, sevStep.PfErrorWrite) && v.RetiredInstructions == 0 {
+					state++
+				} else {
+					state = 0
+				}
+			case 3:
+				if !sevStep.ArePfErrorsSet(v.ErrorCode, sevStep.PfErrorWrite) && v.RetiredInstructions == 0 {
+					stackBufEvent = v
+				} else {
+					state = 0
+				}
+			}
+
+		}
+	}
+	return stackBufEvent, stackBufEvent != nil
+}
@@ -0,0 +1,299 @@
+package trackingMachine
+
+//Description of a tracking state machine and its validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//Spec describes a tracking state machine. It is usually loaded from a JSON file, see ParseSpec
+type Spec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//Pages are the named GPAs used by the machine
+	Pages []PageSpec `json:"pages"`
+	//Values are named integers with their default value, that can be used in conditions
+	Values map[string]int `json:"values,omitempty"`
+	//Initial is the name of the state entered by Start
+	Initial string       `json:"initial"`
+	States  []*StateSpec `json:"states"`
+}
+
+//PageSpec declares a named GPA
+type PageSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//Input pages have to be bound when the machine is created. All other pages are bound by "selectPage" actions
+	Input bool `json:"input,omitempty"`
+}
+
+//StateSpec describes a state. On entering the state, all pages in Track are tracked
+type StateSpec struct {
+	Name  string      `json:"name"`
+	Track []TrackSpec `json:"track,omitempty"`
+	//Transitions are checked in order. The first matching transition fires
+	Transitions []*TransitionSpec `json:"transitions"`
+	//Unexpected decides what happens with events that match no transition while no track all phase collects events.
+	//One of "log" (default), "ignore" or "error"
+	Unexpected string `json:"unexpected,omitempty"`
+}
+
+//TrackSpec tracks Page with Mode, one of "access", "exec" or "write"
+type TrackSpec struct {
+	Page string `json:"page"`
+	Mode string `json:"mode"`
+}
+
+//TransitionSpec fires if the event matches all given predicates
+type TransitionSpec struct {
+	//Fault is the page that has to fault. If empty, all pages match
+	Fault string `json:"fault,omitempty"`
+	//ErrorSet and ErrorClear are names of page fault error code bits that have to be set or clear, see errorBits
+	ErrorSet   []string        `json:"errorSet,omitempty"`
+	ErrorClear []string        `json:"errorClear,omitempty"`
+	If         []ConditionSpec `json:"if,omitempty"`
+	Actions    []ActionSpec    `json:"actions,omitempty"`
+	//Target is the next state. If empty, the machine stays in the current state without entering it again
+	Target string `json:"target,omitempty"`
+}
+
+//ConditionSpec compares Counter with Value + Offset. Value is either an integer or the name of a value
+type ConditionSpec struct {
+	Counter string `json:"counter"`
+	//Op is one of "==", "!=", "<", "<=", ">", ">="
+	Op     string `json:"op"`
+	Value  string `json:"value"`
+	Offset int    `json:"offset,omitempty"`
+}
+
+//ActionSpec describes an action. Do selects the action, the other fields are its arguments
+//  emit                      add the event to the output of the machine
+//  readMemory   page         attach the content of the page to the event. Does nothing if the page is not bound yet
+//  track        page,mode    track the page
+//  trackAll     mode         track all pages and collect the events that match no transition
+//  untrackAll   mode         untrack all pages and stop collecting events
+//  selectPage   page,select  bind the page to the GPA chosen by the selector from the collected events.
+//                            Stops collecting events
+//  count        counter      increment the counter
+//  log          message      write message to the debug log
+//  finish                    stop the machine
+type ActionSpec struct {
+	Do       string `json:"do"`
+	Page     string `json:"page,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	Selector string `json:"select,omitempty"`
+	Counter  string `json:"counter,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+//trackModes maps the mode names used in specs to the sevStep tracking modes
+var trackModes = map[string]sevStep.PageTrackMode{
+	"access": sevStep.PageTrackAccess,
+	"exec":   sevStep.PageTrackExec,
+	"write":  sevStep.PageTrackWrite,
+}
+
+//errorBits maps the error bit names used in specs to the page fault error code bits
+var errorBits = map[string]sevStep.PfErrorBit{
+	"present": sevStep.PfErrorPresent,
+	"write":   sevStep.PfErrorWrite,
+	"user":    sevStep.PfErrorUser,
+	"rsvd":    sevStep.PfErrorRSVD,
+	"fetch":   sevStep.PfErrorFetch,
+	"pk":      sevStep.PfErrorPK,
+}
+
+//comparisons maps the condition operators to their implementation
+var comparisons = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+}
+
+//ParseSpec decodes and validates a JSON spec
+func ParseSpec(r io.Reader) (*Spec, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	spec := &Spec{}
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("failed to decode spec : %v", err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+//LoadSpec parses the spec at path. If no such file exists but path is the name of a builtin spec, the
+//builtin spec is returned
+func LoadSpec(path string) (*Spec, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if spec, builtinErr := Builtin(path); builtinErr == nil {
+			return spec, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spec : %v", err)
+	}
+	defer f.Close()
+	return ParseSpec(f)
+}
+
+//State returns the state with the given name
+func (s *Spec) State(name string) (*StateSpec, bool) {
+	for _, v := range s.States {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+//Validate checks that all names used in the spec are declared and all actions have their arguments. All
+//problems are reported in one error
+func (s *Spec) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if s.Name == "" {
+		report("spec has no name")
+	}
+	pages := make(map[string]bool)
+	for _, v := range s.Pages {
+		if v.Name == "" {
+			report("page without name")
+		}
+		if pages[v.Name] {
+			report("page %v declared twice", v.Name)
+		}
+		pages[v.Name] = true
+	}
+	checkPage := func(where, page string) {
+		if page == "" {
+			report("%v: page missing", where)
+		} else if !pages[page] {
+			report("%v: undeclared page %v", where, page)
+		}
+	}
+	checkMode := func(where, mode string) {
+		if _, ok := trackModes[mode]; !ok {
+			report("%v: invalid tracking mode %q", where, mode)
+		}
+	}
+
+	states := make(map[string]bool)
+	for _, v := range s.States {
+		if v.Name == "" {
+			report("state without name")
+		}
+		if states[v.Name] {
+			report("state %v declared twice", v.Name)
+		}
+		states[v.Name] = true
+	}
+	if len(s.States) == 0 {
+		report("spec has no states")
+	}
+	if !states[s.Initial] {
+		report("initial state %q does not exist", s.Initial)
+	}
+
+	for _, state := range s.States {
+		for i, v := range state.Track {
+			where := fmt.Sprintf("state %v track %v", state.Name, i)
+			checkPage(where, v.Page)
+			checkMode(where, v.Mode)
+		}
+		switch state.Unexpected {
+		case "", "log", "ignore", "error":
+		default:
+			report("state %v: invalid unexpected handling %q", state.Name, state.Unexpected)
+		}
+		for i, t := range state.Transitions {
+			where := fmt.Sprintf("state %v transition %v", state.Name, i)
+			if t.Fault != "" {
+				checkPage(where, t.Fault)
+			}
+			for _, bit := range append(append([]string{}, t.ErrorSet...), t.ErrorClear...) {
+				if _, ok := errorBits[bit]; !ok {
+					report("%v: unknown error bit %q", where, bit)
+				}
+			}
+			for _, c := range t.If {
+				if c.Counter == "" {
+					report("%v: condition without counter", where)
+				}
+				if _, ok := comparisons[c.Op]; !ok {
+					report("%v: invalid operator %q", where, c.Op)
+				}
+				if _, err := s.resolveValue(c.Value, nil); err != nil {
+					report("%v: %v", where, err)
+				}
+			}
+			if t.Target != "" && !states[t.Target] {
+				report("%v: target state %v does not exist", where, t.Target)
+			}
+			for j, a := range t.Actions {
+				actionWhere := fmt.Sprintf("%v action %v (%v)", where, j, a.Do)
+				switch a.Do {
+				case "emit", "finish":
+				case "readMemory":
+					checkPage(actionWhere, a.Page)
+				case "track":
+					checkPage(actionWhere, a.Page)
+					checkMode(actionWhere, a.Mode)
+				case "trackAll", "untrackAll":
+					checkMode(actionWhere, a.Mode)
+				case "selectPage":
+					checkPage(actionWhere, a.Page)
+					if _, ok := selectors[a.Selector]; !ok {
+						report("%v: unknown selector %q, supported selectors are %v", actionWhere, a.Selector, strings.Join(SelectorNames(), ","))
+					}
+				case "count":
+					if a.Counter == "" {
+						report("%v: counter missing", actionWhere)
+					}
+				case "log":
+					if a.Message == "" {
+						report("%v: message missing", actionWhere)
+					}
+				default:
+					report("%v: unknown action", actionWhere)
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid spec %v : %v", s.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+//resolveValue returns the integer literal v or the value named v. Values in overrides take precedence over
+//the defaults of the spec
+func (s *Spec) resolveValue(v string, overrides map[string]int) (int, error) {
+	if i, err := strconv.Atoi(v); err == nil {
+		return i, nil
+	}
+	if i, ok := overrides[v]; ok {
+		return i, nil
+	}
+	if i, ok := s.Values[v]; ok {
+		return i, nil
+	}
+	return 0, fmt.Errorf("%q is neither an integer nor a declared value", v)
+}
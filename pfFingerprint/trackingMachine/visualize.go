@@ -0,0 +1,192 @@
+package trackingMachine
+
+//Render specs as graphs and replay recorded traces without a VM
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/UzL-ITS/sev-step/sevStep"
+)
+
+//transitionLabel summarizes the predicates and actions of t
+func transitionLabel(t *TransitionSpec) string {
+	var predicates []string
+	if t.Fault != "" {
+		predicates = append(predicates, "fault "+t.Fault)
+	} else {
+		predicates = append(predicates, "any fault")
+	}
+	for _, v := range t.ErrorSet {
+		predicates = append(predicates, "+"+v)
+	}
+	for _, v := range t.ErrorClear {
+		predicates = append(predicates, "-"+v)
+	}
+	for _, c := range t.If {
+		cond := fmt.Sprintf("%v %v %v", c.Counter, c.Op, c.Value)
+		if c.Offset != 0 {
+			cond += fmt.Sprintf("%+d", c.Offset)
+		}
+		predicates = append(predicates, cond)
+	}
+	var actions []string
+	for _, a := range t.Actions {
+		action := a.Do
+		for _, arg := range []string{a.Page, a.Mode, a.Selector, a.Counter} {
+			if arg != "" {
+				action += " " + arg
+			}
+		}
+		actions = append(actions, action)
+	}
+	return strings.Join(predicates, ", ") + " / " + strings.Join(actions, "; ")
+}
+
+//WriteDot writes spec as a Graphviz digraph. Transitions without target are drawn as self loops
+func WriteDot(w io.Writer, spec *Spec) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %q {\n", spec.Name)
+	fmt.Fprintf(&b, "\t__start [shape=point];\n\t__start -> %q;\n", spec.Initial)
+	for _, s := range spec.States {
+		label := s.Name
+		for _, v := range s.Track {
+			label += fmt.Sprintf("\ntrack %v %v", v.Page, v.Mode)
+		}
+		fmt.Fprintf(&b, "\t%q [shape=box, label=%q];\n", s.Name, label)
+		for _, t := range s.Transitions {
+			target := t.Target
+			if target == "" {
+				target = s.Name
+			}
+			fmt.Fprintf(&b, "\t%q -> %q [label=%q];\n", s.Name, target, transitionLabel(t))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+//SimulatedAPI replays recorded events. Only faults on tracked pages are delivered. Like in the kernel module,
+//a page is untracked once it faulted. Events on untracked pages are skipped. Each command is written to Log
+type SimulatedAPI struct {
+	events  []*sevStep.Event
+	next    int
+	tracked map[uint64]bool
+	//allTracked is true during a track all phase. faultedSinceTrackAll holds the pages that already faulted
+	allTracked           bool
+	faultedSinceTrackAll map[uint64]bool
+	//Log receives one line per command. May be nil
+	Log io.Writer
+}
+
+//NewSimulatedAPI creates an api that replays events
+func NewSimulatedAPI(events []*sevStep.Event, log io.Writer) *SimulatedAPI {
+	return &SimulatedAPI{
+		events:               events,
+		tracked:              make(map[uint64]bool),
+		faultedSinceTrackAll: make(map[uint64]bool),
+		Log:                  log,
+	}
+}
+
+//modeName returns the spec name of mode
+func modeName(mode sevStep.PageTrackMode) string {
+	for name, v := range trackModes {
+		if v == mode {
+			return name
+		}
+	}
+	return fmt.Sprintf("mode %d", mode)
+}
+
+func (s *SimulatedAPI) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, format, args...)
+	}
+}
+
+func (s *SimulatedAPI) CmdTrackPage(gpa uint64, trackMode sevStep.PageTrackMode) error {
+	s.logf("\ttrack %x %v\n", gpa, modeName(trackMode))
+	s.tracked[gpa] = true
+	return nil
+}
+
+func (s *SimulatedAPI) CmdTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	s.logf("\ttrack all %v\n", modeName(trackMode))
+	s.allTracked = true
+	s.faultedSinceTrackAll = make(map[uint64]bool)
+	return nil
+}
+
+func (s *SimulatedAPI) CmdUnTrackAllPages(trackMode sevStep.PageTrackMode) error {
+	s.logf("\tuntrack all %v\n", modeName(trackMode))
+	s.allTracked = false
+	s.tracked = make(map[uint64]bool)
+	return nil
+}
+
+//CmdReadGuestMemory returns a zeroed buffer, as recorded traces do not contain the memory of all pages
+func (s *SimulatedAPI) CmdReadGuestMemory(gpa, size uint64, hostDecryption bool, wbinvdCPU int) ([]byte, error) {
+	s.logf("\tread memory %x\n", gpa)
+	return make([]byte, size), nil
+}
+
+//CmdPollEvent returns the next recorded event on a tracked page. Returns false once all events have been replayed
+func (s *SimulatedAPI) CmdPollEvent() (*sevStep.Event, bool, error) {
+	for ; s.next < len(s.events); s.next++ {
+		ev := s.events[s.next]
+		if s.tracked[ev.FaultedGPA] {
+			delete(s.tracked, ev.FaultedGPA)
+			s.next++
+			return ev, true, nil
+		}
+		if s.allTracked && !s.faultedSinceTrackAll[ev.FaultedGPA] {
+			s.faultedSinceTrackAll[ev.FaultedGPA] = true
+			s.next++
+			return ev, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *SimulatedAPI) CmdAckEvent(id uint64) error {
+	return nil
+}
+
+//DryRun replays events through a machine for spec and writes each transition and command to w.
+//Returns the machine, to inspect the bound pages and emitted events
+func DryRun(spec *Spec, opts Options, events []*sevStep.Event, w io.Writer) (*Machine, error) {
+	api := NewSimulatedAPI(events, w)
+	opts.OnTransition = func(ev *sevStep.Event, from *StateSpec, t *TransitionSpec) {
+		target := t.Target
+		if target == "" {
+			target = from.Name
+		}
+		fmt.Fprintf(w, "event %v fault %x: %v -> %v [%v]\n", ev.ID, ev.FaultedGPA, from.Name, target, transitionLabel(t))
+	}
+	m, err := New(spec, api, opts)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "start in %v\n", spec.Initial)
+	if err := m.Start(); err != nil {
+		return m, err
+	}
+	for {
+		ev, ok, _ := api.CmdPollEvent()
+		if !ok {
+			break
+		}
+		finished, err := m.HandleEvent(ev)
+		if err != nil {
+			return m, err
+		}
+		if finished {
+			fmt.Fprintf(w, "finished\n")
+			break
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,138 @@
+package trigger
+
+//Context aware triggers with structured results
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//ContextTriggerer is the cancellable version of Triggerer that returns a structured Result
+type ContextTriggerer interface {
+	//ExecuteContext triggers the victim behaviour. If ctx is done before the victim behaviour has finished,
+	//ctx.Err() is returned
+	ExecuteContext(ctx context.Context) (*Result, error)
+}
+
+//HTTPMetadata contains the response metadata of HTTP based triggers
+type HTTPMetadata struct {
+	StatusCode int
+	Header     http.Header
+}
+
+//ExecMetadata contains the outcome of a command that was run by a trigger
+type ExecMetadata struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+}
+
+//Result of a ContextTriggerer execution
+type Result struct {
+	//Payload contains the same data that Triggerer.Execute returns
+	Payload []byte
+	//HTTP is only set for HTTP based triggers
+	HTTP *HTTPMetadata
+	//SSH is only set for SSH based triggers. It contains the record of the first key exchange
+	SSH *ssh.HandshakeRecord
+	//Exec is only set for triggers that run a command
+	Exec *ExecMetadata
+	//TLS is only set for TLS based triggers
+	TLS *TLSHandshakeRecord
+	//Start and End are taken directly before and after the victim operation. Both contain monotonic
+	//clock readings, so End.Sub(Start) is not affected by wall clock changes
+	Start time.Time
+	End   time.Time
+}
+
+//Latency returns the duration of the victim operation
+func (r *Result) Latency() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+//TimingLine formats start, end and latency as a line for trace files. Start and end are given in
+//unix nanoseconds. The line neither starts with "Start" nor with "Stop", so run based parsers are not affected
+func (r *Result) TimingLine() string {
+	return fmt.Sprintf("Trigger start %v end %v latency %v\n", r.Start.UnixNano(), r.End.UnixNano(), r.Latency())
+}
+
+//contextTriggerAdapter wraps a Triggerer that does not support contexts
+type contextTriggerAdapter struct {
+	t Triggerer
+}
+
+func (c *contextTriggerAdapter) ExecuteContext(ctx context.Context) (*Result, error) {
+	type executeResult struct {
+		payload []byte
+		err     error
+	}
+	done := make(chan executeResult, 1)
+	start := time.Now()
+	go func() {
+		payload, err := c.t.Execute()
+		done <- executeResult{payload, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &Result{
+			Payload: r.payload,
+			Start:   start,
+			End:     time.Now(),
+		}, nil
+	}
+}
+
+//AsContextTriggerer returns t, if it implements ContextTriggerer. Otherwise, t is wrapped so that ExecuteContext
+//returns as soon as ctx is done. Note that the wrapped Execute call keeps running in the background in this case
+func AsContextTriggerer(t Triggerer) ContextTriggerer {
+	if ct, ok := t.(ContextTriggerer); ok {
+		return ct
+	}
+	return &contextTriggerAdapter{t: t}
+}
+
+//triggerAdapter wraps a ContextTriggerer to implement Triggerer
+type triggerAdapter struct {
+	t ContextTriggerer
+}
+
+func (a *triggerAdapter) Execute() ([]byte, error) {
+	result, err := a.t.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+func (a *triggerAdapter) ExecuteContext(ctx context.Context) (*Result, error) {
+	return a.t.ExecuteContext(ctx)
+}
+
+//AsTriggerer returns t, if it implements Triggerer. Otherwise, t is wrapped so that Execute returns the payload
+//of ExecuteContext without a deadline
+func AsTriggerer(t ContextTriggerer) Triggerer {
+	if tt, ok := t.(Triggerer); ok {
+		return tt
+	}
+	return &triggerAdapter{t: t}
+}
+
+//ExecuteWithTimeout runs t with a timeout derived from ctx. If timeout is zero, only ctx limits the execution
+func ExecuteWithTimeout(ctx context.Context, t ContextTriggerer, timeout time.Duration) (*Result, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return t.ExecuteContext(ctx)
+}
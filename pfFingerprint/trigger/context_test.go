@@ -0,0 +1,163 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//funcTrigger is a Triggerer that does not implement ContextTriggerer
+type funcTrigger func() ([]byte, error)
+
+func (f funcTrigger) Execute() ([]byte, error) {
+	return f()
+}
+
+func TestAsContextTriggerer(t *testing.T) {
+	fast := funcTrigger(func() ([]byte, error) {
+		return []byte("done"), nil
+	})
+	failing := funcTrigger(func() ([]byte, error) {
+		return nil, fmt.Errorf("victim crashed")
+	})
+	blockForever := make(chan struct{})
+	defer close(blockForever)
+	hanging := funcTrigger(func() ([]byte, error) {
+		<-blockForever
+		return nil, nil
+	})
+
+	tests := []struct {
+		name        string
+		trigger     Triggerer
+		wantPayload []byte
+		wantErr     error
+	}{
+		{"fast", fast, []byte("done"), nil},
+		{"failing", failing, nil, nil},
+		{"hanging", hanging, nil, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ExecuteWithTimeout(context.Background(), AsContextTriggerer(tt.trigger), 50*time.Millisecond)
+			if tt.wantPayload == nil {
+				if err == nil {
+					t.Fatalf("ExecuteContext() did not return an error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("ExecuteContext() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecuteContext() error = %v", err)
+			}
+			if !bytes.Equal(result.Payload, tt.wantPayload) {
+				t.Errorf("got payload %q, want %q", result.Payload, tt.wantPayload)
+			}
+			if result.Latency() < 0 {
+				t.Errorf("got negative latency %v", result.Latency())
+			}
+		})
+	}
+}
+
+func TestAsTriggerer(t *testing.T) {
+	ct := AsContextTriggerer(funcTrigger(func() ([]byte, error) {
+		return []byte("payload"), nil
+	}))
+	payload, err := AsTriggerer(ct).Execute()
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("got payload %q, want %q", payload, "payload")
+	}
+}
+
+func TestHTTPTrigger_ExecuteContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("X-Victim", "ecdh")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "secretFromOpenSSL 00")
+	}))
+	defer server.Close()
+
+	trigger := &HTTPTrigger{url: server.URL}
+	result, err := trigger.ExecuteContext(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteContext() error = %v", err)
+	}
+	if string(result.Payload) != "secretFromOpenSSL 00" {
+		t.Errorf("got payload %q", result.Payload)
+	}
+	if result.HTTP == nil || result.HTTP.StatusCode != http.StatusAccepted || result.HTTP.Header.Get("X-Victim") != "ecdh" {
+		t.Errorf("got http metadata %+v", result.HTTP)
+	}
+
+	slowTrigger := &HTTPTrigger{url: server.URL + "/slow"}
+	if _, err := ExecuteWithTimeout(context.Background(), slowTrigger, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSSHTrigger_ExecuteContext(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key : %v", err)
+	}
+	addr := startSSHServer(t, edKey)
+
+	trigger, err := NewSSHTrigger("user", addr, SSHOptions{})
+	if err != nil {
+		t.Fatalf("NewSSHTrigger() error = %v", err)
+	}
+	result, err := trigger.(ContextTriggerer).ExecuteContext(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteContext() error = %v", err)
+	}
+	if result.SSH == nil || !bytes.Equal(result.SSH.HostKey[len(result.SSH.HostKey)-ed25519.PublicKeySize:], edKey.Public().(ed25519.PublicKey)) {
+		t.Errorf("result does not contain the handshake record")
+	}
+
+	//server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	hangingTrigger, err := NewSSHTrigger("user", listener.Addr().String(), SSHOptions{})
+	if err != nil {
+		t.Fatalf("NewSSHTrigger() error = %v", err)
+	}
+	_, err = ExecuteWithTimeout(context.Background(), hangingTrigger.(ContextTriggerer), 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
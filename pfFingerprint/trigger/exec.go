@@ -0,0 +1,99 @@
+package trigger
+
+//Construct Triggerer for exec URIs, that run a local command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"time"
+)
+
+func init() {
+	mustRegister(Scheme{
+		Name:        "exec",
+		Description: "Runs a local command. Both exec:path and exec:///path are accepted, e.g. exec:/usr/bin/openssl?arg=pkeyutl&arg=-derive",
+		Options: []Option{
+			{Name: "arg", Description: "command line argument", Repeatable: true},
+			{Name: "dir", Description: "working directory, default is the working directory of the calling process"},
+		},
+		Factory: func(uri *url.URL, options url.Values) (Triggerer, error) {
+			path := uri.Opaque
+			if path == "" {
+				path = uri.Path
+			}
+			return NewExecTrigger(path, options["arg"], options.Get("dir"))
+		},
+	})
+}
+
+//ExecTrigger runs a local command. The victim operation ends once the command has exited
+type ExecTrigger struct {
+	path string
+	args []string
+	dir  string
+}
+
+func (e *ExecTrigger) Execute() ([]byte, error) {
+	result, err := e.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext runs the command and kills it if ctx is done. The payload of the result is stdout. A non-zero
+//exit status of the command is reported in the result and does not lead to an error
+func (e *ExecTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	cmd := exec.CommandContext(ctx, e.path, e.args...)
+	cmd.Dir = e.dir
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	end := time.Now()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	exitStatus := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("failed to run %v : %v", e.path, err)
+		}
+		exitStatus = exitErr.ExitCode()
+	}
+
+	return &Result{
+		Payload: stdout.Bytes(),
+		Exec: &ExecMetadata{
+			Stdout:     stdout.Bytes(),
+			Stderr:     stderr.Bytes(),
+			ExitStatus: exitStatus,
+		},
+		Start: start,
+		End:   end,
+	}, nil
+}
+
+//NewExecTrigger creates a Triggerer that runs path with args in the working directory dir. If dir is empty,
+//the working directory of the calling process is used
+func NewExecTrigger(path string, args []string, dir string) (Triggerer, error) {
+	if path == "" {
+		return nil, fmt.Errorf("command may not be empty")
+	}
+	if _, err := exec.LookPath(path); err != nil {
+		return nil, fmt.Errorf("failed to find command %v : %v", path, err)
+	}
+	return &ExecTrigger{
+		path: path,
+		args: args,
+		dir:  dir,
+	}, nil
+}
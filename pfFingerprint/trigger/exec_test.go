@@ -0,0 +1,78 @@
+package trigger
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecTrigger_ExecuteContext(t *testing.T) {
+	tests := []struct {
+		name           string
+		uri            string
+		wantStdout     string
+		wantStderr     string
+		wantExitStatus int
+	}{
+		{"success", "exec:/bin/sh?arg=-c&arg=echo%20victim", "victim\n", "", 0},
+		{"exit status and stderr", "exec:/bin/sh?arg=-c&arg=echo%20err%20%3E%262%3B%20exit%203", "", "err\n", 3},
+		{"working directory", "exec:///bin/pwd?dir=/tmp", "/tmp\n", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := NewTriggerFromURI(tt.uri)
+			if err != nil {
+				t.Fatalf("NewTriggerFromURI() error = %v", err)
+			}
+			result, err := trigger.(ContextTriggerer).ExecuteContext(context.Background())
+			if err != nil {
+				t.Fatalf("ExecuteContext() error = %v", err)
+			}
+			if string(result.Payload) != tt.wantStdout || string(result.Exec.Stdout) != tt.wantStdout {
+				t.Errorf("got stdout %q, want %q", result.Exec.Stdout, tt.wantStdout)
+			}
+			if string(result.Exec.Stderr) != tt.wantStderr {
+				t.Errorf("got stderr %q, want %q", result.Exec.Stderr, tt.wantStderr)
+			}
+			if result.Exec.ExitStatus != tt.wantExitStatus {
+				t.Errorf("got exit status %v, want %v", result.Exec.ExitStatus, tt.wantExitStatus)
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		trigger, err := NewExecTrigger("/bin/sleep", []string{"10"}, "")
+		if err != nil {
+			t.Fatalf("NewExecTrigger() error = %v", err)
+		}
+		_, err = ExecuteWithTimeout(context.Background(), trigger.(ContextTriggerer), 100*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestNewTriggerFromURI_Exec(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr string
+	}{
+		{"opaque path", "exec:/bin/sh?arg=-c&arg=true", ""},
+		{"missing command", "exec:?arg=-c", "command may not be empty"},
+		{"unknown command", "exec:/does/not/exist", "failed to find command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTriggerFromURI(tt.uri)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("NewTriggerFromURI() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("NewTriggerFromURI() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -4,17 +4,102 @@ package trigger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+func init() {
+	for name, port := range map[string]string{"http": "80", "https": "443"} {
+		mustRegister(Scheme{
+			Name: name,
+			Description: "Sends HTTP requests. Query parameters that are not listed as options are sent to the server, e.g. " +
+				name + "://host:8080/sign?method=POST&bodyFile=msg.bin&header=Content-Type:%20application/octet-stream&expectStatus=200",
+			Options: []Option{
+				{Name: "method", Description: "HTTP method, default GET"},
+				{Name: "bodyFile", Description: "path of a file that is sent as request body"},
+				{Name: "header", Description: "request header in the format \"Name: value\"", Repeatable: true},
+				{Name: "expectStatus", Description: "fail if the response has a different status code"},
+				{Name: "repetitions", Description: "number of requests per execution, default 1"},
+			},
+			ForwardUnknownOptions: true,
+			Factory:               newHTTPTriggerFromURI,
+			ReadinessProbe:        hostProbe(port, ""),
+		})
+	}
+}
+
 type HTTPTrigger struct {
-	url string
+	url  string
+	opts HTTPOptions
+}
+
+//HTTPOptions configure the requests of an HTTPTrigger
+type HTTPOptions struct {
+	//Method is the HTTP method. If empty, GET is used
+	Method string
+	//Body is sent with each request
+	Body   []byte
+	Header http.Header
+	//ExpectedStatus is the expected status code of the responses. If zero, all status codes are accepted
+	ExpectedStatus int
+	//Repetitions is the number of requests sent by one execution. If zero, one request is sent
+	Repetitions int
 }
 
 func (h *HTTPTrigger) Execute() ([]byte, error) {
-	resp, err := http.Get(h.url)
+	result, err := h.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext sends the configured number of requests. The payload and the http metadata of the result
+//belong to the last response
+func (h *HTTPTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	repetitions := h.opts.Repetitions
+	if repetitions == 0 {
+		repetitions = 1
+	}
+
+	start := time.Now()
+	var result *Result
+	for i := 0; i < repetitions; i++ {
+		var err error
+		result, err = h.request(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Start = start
+	return result, nil
+}
+
+//request sends a single request and checks the status code
+func (h *HTTPTrigger) request(ctx context.Context) (*Result, error) {
+	method := h.opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, h.url, bytes.NewReader(h.opts.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request : %v", err)
+	}
+	for k, v := range h.opts.Header {
+		req.Header[k] = v
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request failed : %v", err)
 
@@ -22,14 +107,29 @@ func (h *HTTPTrigger) Execute() ([]byte, error) {
 	//drain http body to wait until server is finished
 	body := &bytes.Buffer{}
 	if _, err := io.Copy(body, resp.Body); err != nil {
-		return nil, fmt.Errorf("Failed do train http response\n")
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Failed do train http response : %v\n", err)
 	}
+	end := time.Now()
 	if err := resp.Body.Close(); err != nil {
 		return nil, fmt.Errorf("Failed to close http response : %v\n", err)
 	}
+	if h.opts.ExpectedStatus != 0 && resp.StatusCode != h.opts.ExpectedStatus {
+		return nil, fmt.Errorf("unexpected HTTP status %v, expected %v", resp.StatusCode, h.opts.ExpectedStatus)
+	}
 
-	return body.Bytes(), nil
-
+	return &Result{
+		Payload: body.Bytes(),
+		HTTP: &HTTPMetadata{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+		},
+		Start: start,
+		End:   end,
+	}, nil
 }
 
 func NewHTTPTrigger(url string) Triggerer {
@@ -37,3 +137,52 @@ func NewHTTPTrigger(url string) Triggerer {
 		url: url,
 	}
 }
+
+//NewHTTPTriggerWithOptions creates a Triggerer that sends requests to url as configured by opts
+func NewHTTPTriggerWithOptions(url string, opts HTTPOptions) (Triggerer, error) {
+	if opts.Method != "" && strings.ToUpper(opts.Method) != opts.Method {
+		return nil, fmt.Errorf("HTTP method %v must be upper case", opts.Method)
+	}
+	if opts.ExpectedStatus != 0 && (opts.ExpectedStatus < 100 || opts.ExpectedStatus > 599) {
+		return nil, fmt.Errorf("invalid expected HTTP status %v", opts.ExpectedStatus)
+	}
+	if opts.Repetitions < 0 {
+		return nil, fmt.Errorf("repetitions may not be negative")
+	}
+	return &HTTPTrigger{
+		url:  url,
+		opts: opts,
+	}, nil
+}
+
+func newHTTPTriggerFromURI(uri *url.URL, options url.Values) (Triggerer, error) {
+	opts := HTTPOptions{
+		Method: options.Get("method"),
+		Header: make(http.Header),
+	}
+	if bodyFile := options.Get("bodyFile"); bodyFile != "" {
+		body, err := ioutil.ReadFile(bodyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body file : %v", err)
+		}
+		opts.Body = body
+	}
+	for _, v := range options["header"] {
+		tokens := strings.SplitN(v, ":", 2)
+		if len(tokens) != 2 || strings.TrimSpace(tokens[0]) == "" {
+			return nil, fmt.Errorf("header %q is not in the format \"Name: value\"", v)
+		}
+		opts.Header.Add(strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1]))
+	}
+	var err error
+	if opts.ExpectedStatus, err = intOption(options, "expectStatus", 0); err != nil {
+		return nil, err
+	}
+	if opts.Repetitions, err = intOption(options, "repetitions", 1); err != nil {
+		return nil, err
+	}
+	if opts.Repetitions == 0 {
+		return nil, fmt.Errorf("repetitions must be at least 1")
+	}
+	return NewHTTPTriggerWithOptions(uri.String(), opts)
+}
@@ -0,0 +1,70 @@
+package trigger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewTriggerFromURI_HTTP(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "%v %v %v %v %q %v", n, r.Method, r.URL.RawQuery, r.Header.Get("X-Victim"), body, r.Header.Values("X-Multi"))
+	}))
+	defer server.Close()
+
+	bodyFile := filepath.Join(t.TempDir(), "body")
+	if err := ioutil.WriteFile(bodyFile, []byte("message"), 0600); err != nil {
+		t.Fatalf("failed to write body file : %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr string
+	}{
+		{"plain get keeps query", "/?z=1&a=2", "1 GET z=1&a=2  \"\" []", ""},
+		{"post with body and headers", "/?method=POST&bodyFile=" + url.QueryEscape(bodyFile) + "&header=X-Victim:%20ecdh&header=X-Multi:a&header=X-Multi:b&server=1",
+			"1 POST server=1 ecdh \"message\" [a b]", ""},
+		{"repetitions return last response", "/?repetitions=3", "3 GET   \"\" []", ""},
+		{"expected status", "/?expectStatus=200", "1 GET   \"\" []", ""},
+		{"unexpected status", "/missing?expectStatus=200", "", "unexpected HTTP status 404, expected 200"},
+		{"bad header", "/?header=novalue", "", "not in the format"},
+		{"bad status", "/?expectStatus=42", "", "invalid expected HTTP status 42"},
+		{"zero repetitions", "/?repetitions=0", "", "repetitions must be at least 1"},
+		{"lower case method", "/?method=post", "", "must be upper case"},
+		{"method given twice", "/?method=GET&method=POST", "", "may only be given once"},
+		{"missing body file", "/?bodyFile=/does/not/exist", "", "failed to read body file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			trigger, err := NewTriggerFromURI(server.URL + tt.uri)
+			if err == nil {
+				var payload []byte
+				payload, err = trigger.Execute()
+				if err == nil && string(payload) != tt.want {
+					t.Errorf("got %q, want %q", payload, tt.want)
+				}
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package trigger
+
+//Wait for the victim to become ready, warm it up and pace the executions. All of this happens outside of the
+//tracked victim operation
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+//ReadinessProbe checks that the victim accepts connections and, if Banner is set, that it sends the banner
+type ReadinessProbe struct {
+	Addr string
+	//Banner is the expected start of the data sent by the victim after the connection has been accepted,
+	//e.g. "SSH-" for sshd. If empty, the probe succeeds once the connection has been accepted
+	Banner []byte
+	//Interval is the time between two probe attempts and the time limit for a single attempt
+	Interval time.Duration
+}
+
+//hostProbe returns a factory for readiness probes that connect to the host of the URI. If the URI has no port,
+//defaultPort is used. An empty defaultPort means that the URI must contain a port
+func hostProbe(defaultPort, banner string) func(uri *url.URL) (*ReadinessProbe, error) {
+	return func(uri *url.URL) (*ReadinessProbe, error) {
+		addr := uri.Host
+		if uri.Port() == "" {
+			if defaultPort == "" {
+				return nil, fmt.Errorf("URI %v has no port", uri)
+			}
+			addr = net.JoinHostPort(uri.Hostname(), defaultPort)
+		}
+		return &ReadinessProbe{
+			Addr:     addr,
+			Banner:   []byte(banner),
+			Interval: time.Second,
+		}, nil
+	}
+}
+
+//NewReadinessProbe creates a probe for the victim behind the trigger uri. Returns an error if the scheme
+//of the uri does not support probing, e.g. because it does not connect to a server
+func NewReadinessProbe(uri string) (*ReadinessProbe, error) {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URI : %v", err)
+	}
+	registryMutex.RLock()
+	scheme, ok := registry[parsedURI.Scheme]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %v", parsedURI.Scheme)
+	}
+	if scheme.ReadinessProbe == nil {
+		return nil, fmt.Errorf("scheme %v does not support readiness probes", scheme.Name)
+	}
+	return scheme.ReadinessProbe(parsedURI)
+}
+
+//probe performs a single attempt
+func (r *ReadinessProbe) probe(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: r.Interval}
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(r.Banner) == 0 {
+		return nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(r.Interval)); err != nil {
+		return err
+	}
+	banner := make([]byte, len(r.Banner))
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		return fmt.Errorf("failed to read banner : %v", err)
+	}
+	if !bytes.Equal(banner, r.Banner) {
+		return fmt.Errorf("got banner %q, expected %q", banner, r.Banner)
+	}
+	return nil
+}
+
+//Wait blocks until a probe attempt succeeds or ctx is done
+func (r *ReadinessProbe) Wait(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		err := r.probe(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Victim at %v not ready (attempt %v) : %v", r.Addr, attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+//PrepareOptions configure a PreparedTrigger
+type PrepareOptions struct {
+	//Probe is waited for before the first execution. If nil, the victim is assumed to be ready
+	Probe *ReadinessProbe
+	//ReadyTimeout limits the time waiting for Probe. If zero, there is no limit
+	ReadyTimeout time.Duration
+	//WarmUp is the number of executions done before the first tracked execution
+	WarmUp int
+	//Pacing is the minimal time between the end of an execution and the start of the next one
+	Pacing time.Duration
+	//Jitter is the maximal random deviation from Pacing, in both directions
+	Jitter time.Duration
+}
+
+//PreparedTrigger wraps a ContextTriggerer with readiness probing, warm-up executions and pacing. Prepare has
+//to be called before tracking is enabled for each execution, so that none of these show up in the trace
+type PreparedTrigger struct {
+	t        ContextTriggerer
+	opts     PrepareOptions
+	rand     *rand.Rand
+	prepared bool
+	lastEnd  time.Time
+}
+
+//NewPreparedTrigger wraps t as configured by opts
+func NewPreparedTrigger(t ContextTriggerer, opts PrepareOptions) (*PreparedTrigger, error) {
+	if opts.WarmUp < 0 || opts.Pacing < 0 || opts.Jitter < 0 || opts.ReadyTimeout < 0 {
+		return nil, fmt.Errorf("warm up count and durations may not be negative")
+	}
+	return &PreparedTrigger{
+		t:    t,
+		opts: opts,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+//Prepare waits for the victim and runs the warm-up executions on the first call. On later calls, it waits
+//until the pacing interval since the end of the last execution has passed
+func (p *PreparedTrigger) Prepare(ctx context.Context) error {
+	if !p.prepared {
+		if p.opts.Probe != nil {
+			log.Printf("Waiting for victim at %v", p.opts.Probe.Addr)
+			probeCtx := ctx
+			if p.opts.ReadyTimeout > 0 {
+				var cancel context.CancelFunc
+				probeCtx, cancel = context.WithTimeout(ctx, p.opts.ReadyTimeout)
+				defer cancel()
+			}
+			if err := p.opts.Probe.Wait(probeCtx); err != nil {
+				return fmt.Errorf("victim did not become ready : %v", err)
+			}
+		}
+		for i := 0; i < p.opts.WarmUp; i++ {
+			log.Printf("Warm up execution %v/%v", i+1, p.opts.WarmUp)
+			if err := p.waitPacing(ctx); err != nil {
+				return err
+			}
+			if _, err := p.ExecuteContext(ctx); err != nil {
+				return fmt.Errorf("warm up execution %v failed : %v", i+1, err)
+			}
+		}
+		p.prepared = true
+	}
+	return p.waitPacing(ctx)
+}
+
+//waitPacing sleeps until the pacing interval, including jitter, has passed since the last execution
+func (p *PreparedTrigger) waitPacing(ctx context.Context) error {
+	if p.lastEnd.IsZero() {
+		return nil
+	}
+	pause := p.opts.Pacing
+	if p.opts.Jitter > 0 {
+		pause += time.Duration(p.rand.Int63n(int64(2*p.opts.Jitter)+1)) - p.opts.Jitter
+	}
+	wait := time.Until(p.lastEnd.Add(pause))
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+//ExecuteContext executes the wrapped trigger and remembers the end of the execution for pacing
+func (p *PreparedTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	defer func() {
+		p.lastEnd = time.Now()
+	}()
+	return p.t.ExecuteContext(ctx)
+}
+
+//PrepareFlags holds the command line flags that configure a PreparedTrigger
+type PrepareFlags struct {
+	waitReady    *bool
+	readyBanner  *string
+	readyTimeout *time.Duration
+	warmUp       *int
+	pacing       *time.Duration
+	jitter       *time.Duration
+}
+
+//RegisterPrepareFlags defines the flags for readiness probing, warm-up and pacing on fs
+func RegisterPrepareFlags(fs *flag.FlagSet) *PrepareFlags {
+	return &PrepareFlags{
+		waitReady:    fs.Bool("waitReady", false, "Wait until the victim accepts connections before the first execution"),
+		readyBanner:  fs.String("readyBanner", "", "Banner the victim has to send for \"-waitReady\". Default depends on the trigger, e.g. \"SSH-\" for ssh"),
+		readyTimeout: fs.Duration("readyTimeout", 0, "Give up waiting for the victim after this duration. 0 means no timeout"),
+		warmUp:       fs.Int("warmUp", 0, "Number of victim executions without tracking before the first tracked execution"),
+		pacing:       fs.Duration("pacing", 0, "Minimal pause between the end of a victim execution and the start of the next one"),
+		jitter:       fs.Duration("pacingJitter", 0, "Maximal random deviation from \"-pacing\""),
+	}
+}
+
+//Options converts the flag values to PrepareOptions. triggerURI is used to create the readiness probe
+func (f *PrepareFlags) Options(triggerURI string) (PrepareOptions, error) {
+	opts := PrepareOptions{
+		ReadyTimeout: *f.readyTimeout,
+		WarmUp:       *f.warmUp,
+		Pacing:       *f.pacing,
+		Jitter:       *f.jitter,
+	}
+	if *f.waitReady {
+		probe, err := NewReadinessProbe(triggerURI)
+		if err != nil {
+			return PrepareOptions{}, fmt.Errorf("failed to create readiness probe : %v", err)
+		}
+		if *f.readyBanner != "" {
+			probe.Banner = []byte(*f.readyBanner)
+		}
+		opts.Probe = probe
+	}
+	return opts, nil
+}
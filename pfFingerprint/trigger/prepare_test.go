@@ -0,0 +1,135 @@
+package trigger
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		wantAddr   string
+		wantBanner string
+		wantErr    bool
+	}{
+		{"ssh default port", "ssh://user@victim", "victim:22", "SSH-", false},
+		{"sshexec", "sshexec://user@victim:2222/?cmd=ls", "victim:2222", "SSH-", false},
+		{"http default port", "http://victim/sign", "victim:80", "", false},
+		{"https", "https://victim:8443", "victim:8443", "", false},
+		{"tls default port", "tls://victim", "victim:443", "", false},
+		{"tcp", "tcp://victim:9000", "victim:9000", "", false},
+		{"tcp without port", "tcp://victim", "", "", true},
+		{"exec", "exec:/bin/true", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := NewReadinessProbe(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewReadinessProbe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if probe.Addr != tt.wantAddr || string(probe.Banner) != tt.wantBanner {
+				t.Errorf("got %v %q, want %v %q", probe.Addr, probe.Banner, tt.wantAddr, tt.wantBanner)
+			}
+		})
+	}
+}
+
+func TestReadinessProbe_Wait(t *testing.T) {
+	//reserve a port and start the victim on it after some failed attempts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { listener.Close() })
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-victim\r\n"))
+			conn.Close()
+		}
+	}()
+
+	probe := &ReadinessProbe{Addr: addr, Banner: []byte("SSH-"), Interval: 20 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := probe.Wait(ctx); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	wrongBanner := &ReadinessProbe{Addr: addr, Banner: []byte("HTTP"), Interval: 20 * time.Millisecond}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := wrongBanner.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPreparedTrigger(t *testing.T) {
+	executions := 0
+	counting := AsContextTriggerer(funcTrigger(func() ([]byte, error) {
+		executions++
+		return nil, nil
+	}))
+
+	const pacing = 100 * time.Millisecond
+	const jitter = 20 * time.Millisecond
+	prepared, err := NewPreparedTrigger(counting, PrepareOptions{WarmUp: 2, Pacing: pacing, Jitter: jitter})
+	if err != nil {
+		t.Fatalf("NewPreparedTrigger() error = %v", err)
+	}
+
+	if err := prepared.Prepare(context.Background()); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if executions != 2 {
+		t.Errorf("got %v warm up executions, want 2", executions)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := prepared.ExecuteContext(context.Background()); err != nil {
+			t.Fatalf("ExecuteContext() error = %v", err)
+		}
+		start := time.Now()
+		if err := prepared.Prepare(context.Background()); err != nil {
+			t.Fatalf("Prepare() error = %v", err)
+		}
+		if waited := time.Since(start); waited < pacing-jitter {
+			t.Errorf("Prepare() only waited %v, want at least %v", waited, pacing-jitter)
+		}
+	}
+	if executions != 4 {
+		t.Errorf("got %v executions, want 4", executions)
+	}
+
+	_, err = prepared.ExecuteContext(context.Background())
+	if err != nil {
+		t.Fatalf("ExecuteContext() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := prepared.Prepare(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Prepare() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := NewPreparedTrigger(counting, PrepareOptions{WarmUp: -1}); err == nil {
+		t.Errorf("NewPreparedTrigger() accepted negative warm up count")
+	}
+}
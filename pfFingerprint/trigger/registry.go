@@ -7,6 +7,11 @@ package trigger
 import (
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 //Triggerer abstracts various ways to trigger soome victim code behaviour
@@ -17,21 +22,176 @@ type Triggerer interface {
 	Execute() ([]byte, error)
 }
 
+//Factory creates a Triggerer from a parsed URI. options are the query parameters of the URI. They have already
+//been checked against the options declared for the scheme
+type Factory func(uri *url.URL, options url.Values) (Triggerer, error)
+
+//Option describes a query parameter that is understood by a scheme
+type Option struct {
+	Name        string
+	Description string
+	//Repeatable options may be given more than once
+	Repeatable bool
+}
+
+//Scheme describes how to construct a Triggerer for URIs with the scheme Name
+type Scheme struct {
+	Name string
+	//Description explains the URI format and should contain an example
+	Description string
+	Options     []Option
+	//ForwardUnknownOptions leaves query parameters that are not declared in Options in the URI instead of
+	//rejecting them. They are not passed to the Factory. This is required for schemes like http, where the
+	//query is part of the request
+	ForwardUnknownOptions bool
+	Factory               Factory
+	//ReadinessProbe creates a probe that checks whether the victim behind the URI is ready. Nil, if the
+	//scheme does not support probing
+	ReadinessProbe func(uri *url.URL) (*ReadinessProbe, error)
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Scheme)
+)
+
+//Register makes the scheme available to NewTriggerFromURI. Returns an error if the scheme is already registered
+func Register(scheme Scheme) error {
+	if scheme.Name == "" || scheme.Factory == nil {
+		return fmt.Errorf("scheme name and factory are required")
+	}
+	optionNames := make(map[string]bool)
+	for _, v := range scheme.Options {
+		if optionNames[v.Name] {
+			return fmt.Errorf("scheme %v declares option %v twice", scheme.Name, v.Name)
+		}
+		optionNames[v.Name] = true
+	}
+
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[scheme.Name]; ok {
+		return fmt.Errorf("scheme %v is already registered", scheme.Name)
+	}
+	registry[scheme.Name] = scheme
+	return nil
+}
+
+//mustRegister is used by the schemes of this package, which are registered in init functions
+func mustRegister(scheme Scheme) {
+	if err := Register(scheme); err != nil {
+		panic(err)
+	}
+}
+
+//RegisteredSchemes returns all registered schemes, sorted by name
+func RegisteredSchemes() []Scheme {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	schemes := make([]Scheme, 0, len(registry))
+	for _, v := range registry {
+		schemes = append(schemes, v)
+	}
+	sort.Slice(schemes, func(i, j int) bool {
+		return schemes[i].Name < schemes[j].Name
+	})
+	return schemes
+}
+
 //NewTriggerFromURI resolves the uri to a Triggerer. Returns an error
-//if no Triggerer is known for the given uri
+//if no Triggerer is known for the given uri or if the query parameters do not match the options of the scheme.
+//Use RegisteredSchemes to get the supported schemes and their options
 func NewTriggerFromURI(uri string) (Triggerer, error) {
 	parsedURI, err := url.Parse(uri)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URI : %v", err)
 	}
-	switch parsedURI.Scheme {
-	case "http":
-		fallthrough
-	case "https":
-		return NewHTTPTrigger(uri), nil
-	case "ssh":
-		return NewSSHTrigger(parsedURI.User.Username(), parsedURI.Host), nil
-	default:
+	registryMutex.RLock()
+	scheme, ok := registry[parsedURI.Scheme]
+	registryMutex.RUnlock()
+	if !ok {
 		return nil, fmt.Errorf("unsupported protocol %v", parsedURI.Scheme)
 	}
+
+	query := parsedURI.Query()
+	options := make(url.Values)
+	for _, v := range scheme.Options {
+		values, ok := query[v.Name]
+		if !ok {
+			continue
+		}
+		if len(values) > 1 && !v.Repeatable {
+			return nil, fmt.Errorf("option %v of scheme %v may only be given once", v.Name, scheme.Name)
+		}
+		options[v.Name] = values
+		delete(query, v.Name)
+	}
+	if len(query) > 0 && !scheme.ForwardUnknownOptions {
+		unknown := make([]string, 0, len(query))
+		for k := range query {
+			unknown = append(unknown, k)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown options %v for scheme %v, supported options are %v", strings.Join(unknown, ","),
+			scheme.Name, strings.Join(optionNames(scheme.Options), ","))
+	}
+	//only re-encode if needed, to keep the URI unchanged otherwise
+	if scheme.ForwardUnknownOptions && len(options) > 0 {
+		parsedURI.RawQuery = query.Encode()
+	}
+
+	return scheme.Factory(parsedURI, options)
+}
+
+func optionNames(options []Option) []string {
+	names := make([]string, 0, len(options))
+	for _, v := range options {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+//intOption parses the option name as non-negative integer. Returns defaultValue if the option is not set
+func intOption(options url.Values, name string, defaultValue int) (int, error) {
+	raw := options.Get(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %v : %v", name, err)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("%v may not be negative", name)
+	}
+	return v, nil
+}
+
+//durationOption parses the option name as time.Duration. Returns zero if the option is not set
+func durationOption(options url.Values, name string) (time.Duration, error) {
+	raw := options.Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %v : %v", name, err)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("%v may not be negative", name)
+	}
+	return v, nil
+}
+
+//boolOption parses the option name as bool. Returns false if the option is not set
+func boolOption(options url.Values, name string) (bool, error) {
+	raw := options.Get(name)
+	if raw == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %v : %v", name, err)
+	}
+	return v, nil
 }
@@ -4,60 +4,267 @@ package trigger
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
 
 	"golang.org/x/crypto/ssh"
 )
 
+//sshHostKeyTypes maps the host key algorithms that can be requested for an SSHTrigger to the type
+//of the host key that is used by the algorithm
+var sshHostKeyTypes = map[string]string{
+	ssh.KeyAlgoED25519:    ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256:   ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384:   ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521:   ssh.KeyAlgoECDSA521,
+	ssh.SigAlgoRSASHA2256: ssh.KeyAlgoRSA,
+	ssh.SigAlgoRSASHA2512: ssh.KeyAlgoRSA,
+}
+
+//sshKexAlgos are the key exchange algorithms that can be requested for an SSHTrigger
+var sshKexAlgos = map[string]bool{
+	"curve25519-sha256":             true,
+	"curve25519-sha256@libssh.org":  true,
+	"ecdh-sha2-nistp256":            true,
+	"ecdh-sha2-nistp384":            true,
+	"ecdh-sha2-nistp521":            true,
+	"diffie-hellman-group14-sha256": true,
+	"diffie-hellman-group14-sha1":   true,
+}
+
+func init() {
+	mustRegister(Scheme{
+		Name: "ssh",
+		Description: "Connects to an ssh server and attempts a password login, to get the signature of the key exchange, e.g. " +
+			"ssh://user@host:22?hostKeyAlgo=ecdsa-sha2-nistp256&kex=curve25519-sha256,ecdh-sha2-nistp256",
+		Options: []Option{
+			{Name: "user", Description: "user name, overrides the user of the URI"},
+			{Name: "password", Description: "password for the login attempt, overrides the password of the URI"},
+			{Name: "hostKeyAlgo", Description: "host key algorithm, default ssh-ed25519"},
+			{Name: "kex", Description: "comma separated key exchange algorithms in order of preference"},
+		},
+		Factory:        newSSHTriggerFromURI,
+		ReadinessProbe: hostProbe("22", sshBanner),
+	})
+}
+
+//sshUserAndPassword returns the user and password from the URI, overridden by the "user" and "password" options
+func sshUserAndPassword(uri *url.URL, options url.Values) (string, string) {
+	user := uri.User.Username()
+	password, _ := uri.User.Password()
+	if v := options.Get("user"); v != "" {
+		user = v
+	}
+	if v := options.Get("password"); v != "" {
+		password = v
+	}
+	return user, password
+}
+
+func newSSHTriggerFromURI(uri *url.URL, options url.Values) (Triggerer, error) {
+	user, password := sshUserAndPassword(uri, options)
+	opts := SSHOptions{
+		HostKeyAlgo: options.Get("hostKeyAlgo"),
+		Password:    password,
+	}
+	if kex := options.Get("kex"); kex != "" {
+		opts.KexAlgos = strings.Split(kex, ",")
+	}
+	return NewSSHTrigger(user, uri.Host, opts)
+}
+
+//sshBanner is the start of the identification string of ssh servers
+const sshBanner = "SSH-"
+
 type SSHTrigger struct {
-	config              *ssh.ClientConfig
-	addr                string
-	marshalledPublicKey []byte
+	config *ssh.ClientConfig
+	addr   string
 }
 
 type SSHSignatureMessage struct {
 	SignatureType string
 	Signature     []byte
 	Message       []byte
-	PublicKeySSH  []byte
+	//PublicKeySSH is the raw ed25519 public key. Only set for ssh-ed25519 host keys
+	PublicKeySSH []byte
+	//HostKeyAlgorithm is the negotiated host key algorithm
+	HostKeyAlgorithm string
+	//HostKey is the host key in SSH wire format. Use PublicKey to parse it
+	HostKey []byte
+	//KexAlgorithm is the negotiated key exchange algorithm
+	KexAlgorithm string
+	//ClientEphemeral and ServerEphemeral are the ephemeral public values of the key exchange.
+	//For curve25519-sha256 these are the 32 byte X25519 public keys, for ecdh the uncompressed points and
+	//for diffie-hellman the big endian encodings of e and f
+	ClientEphemeral []byte
+	ServerEphemeral []byte
 }
 
-func (s *SSHTrigger) Execute() ([]byte, error) {
-	client, err := ssh.Dial("tcp", s.addr, s.config)
+//PublicKey parses the host key
+func (s *SSHSignatureMessage) PublicKey() (ssh.PublicKey, error) {
+	return ssh.ParsePublicKey(s.HostKey)
+}
 
+//Verify checks that Signature is a valid signature for Message under the host key. Returns nil if the signature is valid
+func (s *SSHSignatureMessage) Verify() error {
+	hostKey, err := s.PublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to parse host key : %v", err)
+	}
+	sig := &ssh.Signature{
+		Format: s.SignatureType,
+		Blob:   s.Signature,
+	}
+	return hostKey.Verify(s.Message, sig)
+}
+
+//newSSHSignatureMessage extracts the host signature and the signed exchange hash from the handshake record
+func newSSHSignatureMessage(record *ssh.HandshakeRecord) (SSHSignatureMessage, error) {
 	sigMsg := SSHSignatureMessage{
-		ssh.LastSignature.Format,
-		ssh.LastSignature.Blob,
-		ssh.LastMessage,
-		s.marshalledPublicKey,
+		SignatureType:    record.Signature.Format,
+		Signature:        record.Signature.Blob,
+		Message:          record.ExchangeHash,
+		HostKeyAlgorithm: record.HostKeyAlgorithm,
+		HostKey:          record.HostKey,
+		KexAlgorithm:     record.KexAlgorithm,
+		ClientEphemeral:  record.ClientEphemeral,
+		ServerEphemeral:  record.ServerEphemeral,
+	}
+
+	hostKey, err := sigMsg.PublicKey()
+	if err != nil {
+		return SSHSignatureMessage{}, fmt.Errorf("failed to parse host key : %v", err)
+	}
+	if hostKey.Type() == ssh.KeyAlgoED25519 {
+		cryptPubKey, ok := hostKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return SSHSignatureMessage{}, fmt.Errorf("key did not implement ssh.CryptoPublicKey, cannot get raw key")
+		}
+		edPubKey, ok := cryptPubKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return SSHSignatureMessage{}, fmt.Errorf("failed to cast to ed25519.PublicKey")
+		}
+		sigMsg.PublicKeySSH = edPubKey
+	}
+
+	return sigMsg, nil
+}
+
+func (s *SSHTrigger) Execute() ([]byte, error) {
+	result, err := s.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext connects to the server until the authentication fails. The payload of the result is the
+//gob encoded SSHSignatureMessage
+func (s *SSHTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	//use a per connection copy of the config, to get the handshake record of exactly this connection
+	var record *ssh.HandshakeRecord
+	config := *s.config
+	config.HandshakeObserver = func(r *ssh.HandshakeRecord) {
+		if record == nil {
+			record = r
+		}
+	}
+
+	start := time.Now()
+	client, err := dialContext(ctx, s.addr, &config)
+	end := time.Now()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil && !strings.Contains(err.Error(), "unable to authenticate") {
+		return nil, fmt.Errorf("failed to dial : %v", err)
+	}
+	if client != nil {
+		defer func() {
+			if err := client.Close(); err != nil {
+				log.Printf("SSHTrigger failed to close client :%v", err)
+			}
+		}()
+	}
+	if record == nil {
+		return nil, fmt.Errorf("connection did not complete the key exchange")
+	}
+
+	sigMsg, err := newSSHSignatureMessage(record)
+	if err != nil {
+		return nil, err
 	}
 	buf := &bytes.Buffer{}
 	if err := gob.NewEncoder(buf).Encode(sigMsg); err != nil {
 		return nil, fmt.Errorf("failed to encode signature data : %v", err)
 	}
 
+	return &Result{
+		Payload: buf.Bytes(),
+		SSH:     record,
+		Start:   start,
+		End:     end,
+	}, nil
+}
+
+//dialContext is like ssh.Dial but aborts the connection setup if ctx is done
+func dialContext(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		if strings.Contains(err.Error(), "unable to authenticate") {
-			return buf.Bytes(), nil
-		}
-		return nil, fmt.Errorf("failed to dial : %v", err)
+		return nil, err
 	}
-	defer func() {
-		if err := client.Close(); err != nil {
-			log.Printf("SSHTrigger failed to close client :%v", err)
+
+	//closing the connection aborts a pending handshake
+	handshakeDone := make(chan struct{})
+	abortWatcherDone := make(chan struct{})
+	go func() {
+		defer close(abortWatcherDone)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
 		}
 	}()
 
-	return buf.Bytes(), nil
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(handshakeDone)
+	<-abortWatcherDone
+	if ctx.Err() != nil {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func NewSSHTrigger(user, addr string) Triggerer {
+//SSHOptions configure the key exchange and the authentication attempt of an SSHTrigger
+type SSHOptions struct {
+	//HostKeyAlgo is the host key algorithm that the server has to sign the key exchange with. If empty,
+	//ssh-ed25519 is used
+	HostKeyAlgo string
+	//KexAlgos restricts the key exchange algorithms offered to the server, in order of preference. If empty,
+	//the default algorithms are offered
+	KexAlgos []string
+	//Password is used for the authentication attempt. If empty, a password that is expected to fail is used
+	Password string
+}
+
+//NewSSHTrigger creates a Triggerer that connects to addr as user and requests the server to sign the key
+//exchange as configured by opts
+func NewSSHTrigger(user, addr string, opts SSHOptions) (Triggerer, error) {
 	/*
 			//we could use this to actually connect via unlocked key in agent
 			//however, for receiving the signature that we want, we do not
@@ -70,34 +277,46 @@ func NewSSHTrigger(user, addr string) Triggerer {
 			agentClient := agent.NewClient(conn)
 	*/
 
+	hostKeyAlgo := opts.HostKeyAlgo
+	if hostKeyAlgo == "" {
+		hostKeyAlgo = ssh.KeyAlgoED25519
+	}
+	wantKeyType, ok := sshHostKeyTypes[hostKeyAlgo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported host key algorithm %v", hostKeyAlgo)
+	}
+	for _, v := range opts.KexAlgos {
+		if !sshKexAlgos[v] {
+			return nil, fmt.Errorf("unsupported key exchange algorithm %v", v)
+		}
+	}
+
+	password := opts.Password
+	if password == "" {
+		password = "i will not pass"
+	}
+
 	sshTrigger := &SSHTrigger{
 		addr: addr,
 	}
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
-			ssh.Password("i will not pass"),
+			ssh.Password(password),
 			//ssh.PublicKeysCallback(agentClient.Signers),
 		},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			if key.Type() != ssh.KeyAlgoED25519 {
-				return fmt.Errorf("SSH server did not send ed25519 signature")
+			if key.Type() != wantKeyType {
+				return fmt.Errorf("SSH server sent %v host key, expected %v", key.Type(), wantKeyType)
 			}
-			cryptPubKey, ok := key.(ssh.CryptoPublicKey)
-			if !ok {
-				return fmt.Errorf("key did not implement ssh.CryptoPublicKey, cannot get raw key")
-			}
-			edPubKey, ok := cryptPubKey.CryptoPublicKey().(ed25519.PublicKey)
-			if !ok {
-				return fmt.Errorf("failed to cast to ed25519.PublicKey")
-			}
-			sshTrigger.marshalledPublicKey = edPubKey
-
 			return nil
 		},
-		HostKeyAlgorithms: []string{"ssh-ed25519"},
+		HostKeyAlgorithms: []string{hostKeyAlgo},
+	}
+	if len(opts.KexAlgos) > 0 {
+		config.KeyExchanges = opts.KexAlgos
 	}
 	sshTrigger.config = config
 
-	return sshTrigger
+	return sshTrigger, nil
 }
@@ -0,0 +1,202 @@
+package trigger
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+//startSSHServer starts an ssh server on localhost that rejects all authentication attempts.
+//Returns the address of the server
+func startSSHServer(t *testing.T, hostKey crypto.Signer) string {
+	signer, err := ssh.NewSignerFromSigner(hostKey)
+	if err != nil {
+		t.Fatalf("failed to create host key signer : %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestSSHTrigger_Execute(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key : %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ecdsa key : %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key : %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		hostKey     crypto.Signer
+		hostKeyAlgo string
+		wantErr     bool
+	}{
+		{"default is ed25519", edKey, "", false},
+		{"ed25519", edKey, ssh.KeyAlgoED25519, false},
+		{"ecdsa", ecKey, ssh.KeyAlgoECDSA384, false},
+		{"rsa-sha2-256", rsaKey, ssh.SigAlgoRSASHA2256, false},
+		{"rsa-sha2-512", rsaKey, ssh.SigAlgoRSASHA2512, false},
+		{"server lacks requested key", edKey, ssh.KeyAlgoECDSA256, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startSSHServer(t, tt.hostKey)
+			trigger, err := NewSSHTrigger("user", addr, SSHOptions{HostKeyAlgo: tt.hostKeyAlgo})
+			if err != nil {
+				t.Fatalf("NewSSHTrigger() error = %v", err)
+			}
+
+			result, err := trigger.Execute()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var sigMsg SSHSignatureMessage
+			if err := gob.NewDecoder(bytes.NewReader(result)).Decode(&sigMsg); err != nil {
+				t.Fatalf("failed to decode result : %v", err)
+			}
+			if err := sigMsg.Verify(); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			hostKey, err := sigMsg.PublicKey()
+			if err != nil {
+				t.Fatalf("PublicKey() error = %v", err)
+			}
+			wantHostKey, err := ssh.NewPublicKey(tt.hostKey.Public())
+			if err != nil {
+				t.Fatalf("failed to convert host key : %v", err)
+			}
+			if !bytes.Equal(hostKey.Marshal(), wantHostKey.Marshal()) {
+				t.Errorf("got host key %v, want %v", hostKey.Type(), wantHostKey.Type())
+			}
+			if hostKey.Type() == ssh.KeyAlgoED25519 && !bytes.Equal(sigMsg.PublicKeySSH, edKey.Public().(ed25519.PublicKey)) {
+				t.Errorf("PublicKeySSH does not match the ed25519 host key")
+			}
+
+			//a modified message must not verify
+			sigMsg.Message[0] ^= 1
+			if err := sigMsg.Verify(); err == nil {
+				t.Errorf("Verify() accepted signature for modified message")
+			}
+		})
+	}
+}
+
+func TestNewSSHTrigger_UnsupportedAlgo(t *testing.T) {
+	if _, err := NewSSHTrigger("user", "localhost:22", SSHOptions{HostKeyAlgo: "ssh-dss"}); err == nil {
+		t.Errorf("NewSSHTrigger() accepted unsupported host key algorithm")
+	}
+}
+
+func TestSSHTrigger_ExecuteKex(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key : %v", err)
+	}
+	addr := startSSHServer(t, edKey)
+
+	tests := []struct {
+		name          string
+		kexAlgos      []string
+		wantKex       string
+		ephemeralSize int
+	}{
+		{"curve25519", []string{"curve25519-sha256"}, "curve25519-sha256", 32},
+		{"ecdh p256", []string{"ecdh-sha2-nistp256"}, "ecdh-sha2-nistp256", 65},
+		{"dh group14 sha256", []string{"diffie-hellman-group14-sha256"}, "diffie-hellman-group14-sha256", 0},
+		{"first in list wins", []string{"ecdh-sha2-nistp384", "curve25519-sha256"}, "ecdh-sha2-nistp384", 97},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := NewSSHTrigger("user", addr, SSHOptions{KexAlgos: tt.kexAlgos})
+			if err != nil {
+				t.Fatalf("NewSSHTrigger() error = %v", err)
+			}
+			result, err := trigger.Execute()
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			var sigMsg SSHSignatureMessage
+			if err := gob.NewDecoder(bytes.NewReader(result)).Decode(&sigMsg); err != nil {
+				t.Fatalf("failed to decode result : %v", err)
+			}
+			if sigMsg.KexAlgorithm != tt.wantKex {
+				t.Errorf("got kex %v, want %v", sigMsg.KexAlgorithm, tt.wantKex)
+			}
+			if len(sigMsg.ClientEphemeral) == 0 || len(sigMsg.ServerEphemeral) == 0 {
+				t.Fatalf("ephemeral values missing")
+			}
+			if tt.ephemeralSize != 0 && (len(sigMsg.ClientEphemeral) != tt.ephemeralSize || len(sigMsg.ServerEphemeral) != tt.ephemeralSize) {
+				t.Errorf("got ephemeral sizes %v and %v, want %v", len(sigMsg.ClientEphemeral), len(sigMsg.ServerEphemeral), tt.ephemeralSize)
+			}
+			if err := sigMsg.Verify(); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewTriggerFromURI_SSH(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{"defaults", "ssh://user@localhost:22", false},
+		{"host key algo and kex", "ssh://user@localhost:22?hostKeyAlgo=rsa-sha2-512&kex=curve25519-sha256,diffie-hellman-group14-sha256", false},
+		{"unknown host key algo", "ssh://user@localhost:22?hostKeyAlgo=foo", true},
+		{"unknown kex", "ssh://user@localhost:22?kex=curve25519-sha256,foo", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTriggerFromURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewTriggerFromURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package trigger
+
+//Construct Triggerer for sshexec URIs, that run a command on an ssh server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	mustRegister(Scheme{
+		Name: "sshexec",
+		Description: "Logs in to an ssh server and runs a command, e.g. " +
+			"sshexec://user@host:22/?cmd=openssl%20version&key=/root/.ssh/id_ed25519",
+		Options: []Option{
+			{Name: "cmd", Description: "command to run"},
+			{Name: "key", Description: "path of an unencrypted private key"},
+			{Name: "agent", Description: "path of the ssh agent socket, default SSH_AUTH_SOCK. Used if neither key nor password are given"},
+			{Name: "knownHosts", Description: "path of a known_hosts file to check the host key against"},
+			{Name: "user", Description: "user name, overrides the user of the URI"},
+			{Name: "password", Description: "password, overrides the password of the URI. Used if no key is given"},
+		},
+		Factory: func(uri *url.URL, options url.Values) (Triggerer, error) {
+			user, password := sshUserAndPassword(uri, options)
+			return NewSSHExecTrigger(user, uri.Host, options.Get("cmd"), SSHExecOptions{
+				KeyPath:        options.Get("key"),
+				Password:       password,
+				AgentSocket:    options.Get("agent"),
+				KnownHostsPath: options.Get("knownHosts"),
+			})
+		},
+		ReadinessProbe: hostProbe("22", sshBanner),
+	})
+}
+
+//SSHExecTrigger authenticates to an ssh server and runs a command. The victim operation is the command execution
+type SSHExecTrigger struct {
+	config *ssh.ClientConfig
+	addr   string
+	cmd    string
+	//agentSocket is the path to the ssh agent socket. Only used if no key file was given
+	agentSocket string
+}
+
+//SSHExecOptions configure the authentication and host key verification of an SSHExecTrigger
+type SSHExecOptions struct {
+	//KeyPath is the path to an unencrypted private key. If empty, Password or the keys from the ssh agent are used
+	KeyPath string
+	//Password is used if no key file is given. If empty, the keys from the ssh agent are used
+	Password string
+	//AgentSocket is the path of the ssh agent socket. If empty, SSH_AUTH_SOCK is used
+	AgentSocket string
+	//KnownHostsPath is the path to a known_hosts file used to verify the host key. If empty, any host key is accepted
+	KnownHostsPath string
+}
+
+func (s *SSHExecTrigger) Execute() ([]byte, error) {
+	result, err := s.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext runs the command. The payload of the result is stdout. A non-zero exit status of the
+//command is reported in the result and does not lead to an error
+func (s *SSHExecTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	config := *s.config
+	if len(config.Auth) == 0 {
+		agentConn, err := net.Dial("unix", s.agentSocket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh agent at %v : %v", s.agentSocket, err)
+		}
+		defer agentConn.Close()
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)}
+	}
+
+	var record *ssh.HandshakeRecord
+	config.HandshakeObserver = func(r *ssh.HandshakeRecord) {
+		if record == nil {
+			record = r
+		}
+	}
+
+	client, err := dialContext(ctx, s.addr, &config)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial : %v", err)
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			log.Printf("SSHExecTrigger failed to close client :%v", err)
+		}
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session : %v", err)
+	}
+	defer session.Close()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	runErr := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		runErr <- session.Run(s.cmd)
+	}()
+
+	select {
+	case <-ctx.Done():
+		//best effort, not all servers support signals
+		session.Signal(ssh.SIGKILL)
+		return nil, ctx.Err()
+	case err = <-runErr:
+	}
+	end := time.Now()
+
+	exitStatus := 0
+	if err != nil {
+		exitErr, ok := err.(*ssh.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("failed to run %v : %v", s.cmd, err)
+		}
+		exitStatus = exitErr.ExitStatus()
+	}
+
+	return &Result{
+		Payload: stdout.Bytes(),
+		SSH:     record,
+		Exec: &ExecMetadata{
+			Stdout:     stdout.Bytes(),
+			Stderr:     stderr.Bytes(),
+			ExitStatus: exitStatus,
+		},
+		Start: start,
+		End:   end,
+	}, nil
+}
+
+//NewSSHExecTrigger creates a Triggerer that logs in to addr as user and runs cmd
+func NewSSHExecTrigger(user, addr, cmd string, opts SSHExecOptions) (Triggerer, error) {
+	if cmd == "" {
+		return nil, fmt.Errorf("command may not be empty")
+	}
+
+	sshExecTrigger := &SSHExecTrigger{
+		addr: addr,
+		cmd:  cmd,
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	if opts.KeyPath != "" {
+		rawKey, err := ioutil.ReadFile(opts.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file : %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file %v : %v", opts.KeyPath, err)
+		}
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+	} else if opts.Password != "" {
+		config.Auth = []ssh.AuthMethod{ssh.Password(opts.Password)}
+	} else {
+		sshExecTrigger.agentSocket = opts.AgentSocket
+		if sshExecTrigger.agentSocket == "" {
+			sshExecTrigger.agentSocket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if sshExecTrigger.agentSocket == "" {
+			return nil, fmt.Errorf("neither key file, password nor ssh agent socket given")
+		}
+	}
+
+	if opts.KnownHostsPath != "" {
+		callback, err := knownhosts.New(opts.KnownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse known hosts file : %v", err)
+		}
+		config.HostKeyCallback = callback
+	}
+
+	sshExecTrigger.config = config
+	return sshExecTrigger, nil
+}
@@ -0,0 +1,239 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+//startSSHExecServer starts an ssh server on localhost that only accepts clientKey. For "exec" requests, the server
+//writes the command to stdout and "err" to stderr. The exit status is the length of the command. The command
+//"sleep" never finishes. Returns the address of the server
+func startSSHExecServer(t *testing.T, clientKey ssh.PublicKey) string {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key : %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromSigner(hostKey)
+	if err != nil {
+		t.Fatalf("failed to create host key signer : %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHExec(conn, config)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSSHExec(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range chReqs {
+				if req.Type != "exec" || len(req.Payload) < 4 {
+					req.Reply(false, nil)
+					continue
+				}
+				cmd := string(req.Payload[4:])
+				req.Reply(true, nil)
+				if cmd == "sleep" {
+					continue
+				}
+				fmt.Fprint(ch, cmd)
+				fmt.Fprint(ch.Stderr(), "err")
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, uint32(len(cmd)))
+				ch.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+//writeClientKey creates a new ecdsa key, writes it to a file in PEM format and returns the path and the signer
+func writeClientKey(t *testing.T) (string, ssh.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key : %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal client key : %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write client key : %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("failed to create client signer : %v", err)
+	}
+	return path, signer
+}
+
+//startAgent serves an ssh agent holding key on a unix socket and returns the socket path
+func startAgent(t *testing.T, key interface{}) string {
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatalf("failed to add key to agent : %v", err)
+	}
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on agent socket : %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestSSHExecTrigger_ExecuteContext(t *testing.T) {
+	keyPath, signer := writeClientKey(t)
+	addr := startSSHExecServer(t, signer.PublicKey())
+
+	_, agentKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate agent key : %v", err)
+	}
+	agentSigner, err := ssh.NewSignerFromSigner(agentKey)
+	if err != nil {
+		t.Fatalf("failed to create agent signer : %v", err)
+	}
+	agentAddr := startSSHExecServer(t, agentSigner.PublicKey())
+	agentSocket := startAgent(t, agentKey)
+
+	tests := []struct {
+		name    string
+		addr    string
+		opts    SSHExecOptions
+		cmd     string
+		wantErr bool
+	}{
+		{"key file", addr, SSHExecOptions{KeyPath: keyPath}, "openssl version", false},
+		{"agent", agentAddr, SSHExecOptions{AgentSocket: agentSocket}, "./victim", false},
+		{"agent key not authorized", addr, SSHExecOptions{AgentSocket: agentSocket}, "./victim", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := NewSSHExecTrigger("user", tt.addr, tt.cmd, tt.opts)
+			if err != nil {
+				t.Fatalf("NewSSHExecTrigger() error = %v", err)
+			}
+			result, err := trigger.(ContextTriggerer).ExecuteContext(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExecuteContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if string(result.Payload) != tt.cmd || string(result.Exec.Stdout) != tt.cmd {
+				t.Errorf("got stdout %q, want %q", result.Exec.Stdout, tt.cmd)
+			}
+			if string(result.Exec.Stderr) != "err" {
+				t.Errorf("got stderr %q, want %q", result.Exec.Stderr, "err")
+			}
+			if result.Exec.ExitStatus != len(tt.cmd) {
+				t.Errorf("got exit status %v, want %v", result.Exec.ExitStatus, len(tt.cmd))
+			}
+			if result.SSH == nil {
+				t.Errorf("result does not contain the handshake record")
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		trigger, err := NewSSHExecTrigger("user", addr, "sleep", SSHExecOptions{KeyPath: keyPath})
+		if err != nil {
+			t.Fatalf("NewSSHExecTrigger() error = %v", err)
+		}
+		_, err = ExecuteWithTimeout(context.Background(), trigger.(ContextTriggerer), 100*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestNewTriggerFromURI_SSHExec(t *testing.T) {
+	keyPath, _ := writeClientKey(t)
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr string
+	}{
+		{"key file", "sshexec://user@localhost:22/?cmd=openssl%20version&key=" + keyPath, ""},
+		{"agent", "sshexec://user@localhost:22/?cmd=ls&agent=/tmp/agent.sock", ""},
+		{"missing cmd", "sshexec://user@localhost:22/?key=" + keyPath, "command may not be empty"},
+		{"missing key file", "sshexec://user@localhost:22/?cmd=ls&key=/does/not/exist", "failed to read key file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTriggerFromURI(tt.uri)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("NewTriggerFromURI() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("NewTriggerFromURI() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
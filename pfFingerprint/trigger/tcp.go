@@ -0,0 +1,199 @@
+package trigger
+
+//Construct Triggerer for tcp URIs, that send a payload and read the reply
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"time"
+)
+
+func init() {
+	mustRegister(Scheme{
+		Name: "tcp",
+		Description: "Sends a payload over a tcp connection and reads the reply until the delimiter, until the byte count " +
+			"has been read or until EOF, e.g. tcp://host:9000?payload=sign%0A&delimiter=%0A&readTimeout=5s",
+		Options: []Option{
+			{Name: "payload", Description: "payload to send"},
+			{Name: "payloadFile", Description: "path of a file with the payload to send"},
+			{Name: "delimiter", Description: "read the reply until this delimiter"},
+			{Name: "readBytes", Description: "read this many bytes of reply"},
+			{Name: "readTimeout", Description: "time limit for reading the reply, ends the reply when reading until EOF"},
+		},
+		Factory: func(uri *url.URL, options url.Values) (Triggerer, error) {
+			opts, err := parseTCPOptions(options)
+			if err != nil {
+				return nil, err
+			}
+			return NewTCPTrigger(uri.Host, opts)
+		},
+		ReadinessProbe: hostProbe("", ""),
+	})
+}
+
+//parseTCPOptions parses the query options of a tcp URI
+func parseTCPOptions(options url.Values) (TCPOptions, error) {
+	opts := TCPOptions{
+		Payload:   []byte(options.Get("payload")),
+		Delimiter: []byte(options.Get("delimiter")),
+	}
+	if payloadFile := options.Get("payloadFile"); payloadFile != "" {
+		if len(opts.Payload) > 0 {
+			return TCPOptions{}, fmt.Errorf("payload and payloadFile are mutually exclusive")
+		}
+		payload, err := ioutil.ReadFile(payloadFile)
+		if err != nil {
+			return TCPOptions{}, fmt.Errorf("failed to read payload file : %v", err)
+		}
+		opts.Payload = payload
+	}
+	var err error
+	if opts.ReadBytes, err = intOption(options, "readBytes", 0); err != nil {
+		return TCPOptions{}, err
+	}
+	if opts.ReadTimeout, err = durationOption(options, "readTimeout"); err != nil {
+		return TCPOptions{}, err
+	}
+	return opts, nil
+}
+
+//TCPTrigger sends a payload over a tcp connection and reads the reply. The victim operation ends once the
+//reply has been read
+type TCPTrigger struct {
+	addr string
+	opts TCPOptions
+}
+
+//TCPOptions configure the payload and the reply handling of a TCPTrigger. If neither Delimiter nor ReadBytes
+//is set, the reply is read until the server closes the connection or ReadTimeout expires
+type TCPOptions struct {
+	//Payload is sent after the connection has been established
+	Payload []byte
+	//Delimiter ends the reply. The delimiter is part of the payload of the result
+	Delimiter []byte
+	//ReadBytes is the length of the reply
+	ReadBytes int
+	//ReadTimeout limits the time for reading the reply. If zero, there is no limit. When reading until EOF,
+	//an expired timeout ends the reply, otherwise it is an error
+	ReadTimeout time.Duration
+}
+
+func (t *TCPTrigger) Execute() ([]byte, error) {
+	result, err := t.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext sends the payload and reads the reply. The payload of the result is the reply
+func (t *TCPTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial : %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil && ctx.Err() == nil {
+			log.Printf("TCPTrigger failed to close connection :%v", err)
+		}
+	}()
+
+	//closing the connection aborts pending reads and writes
+	exchangeDone := make(chan struct{})
+	abortWatcherDone := make(chan struct{})
+	go func() {
+		defer close(abortWatcherDone)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-exchangeDone:
+		}
+	}()
+
+	start := time.Now()
+	reply, err := t.exchange(conn)
+	end := time.Now()
+	close(exchangeDone)
+	<-abortWatcherDone
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Payload: reply,
+		Start:   start,
+		End:     end,
+	}, nil
+}
+
+//exchange sends the payload and reads the reply according to the options
+func (t *TCPTrigger) exchange(conn net.Conn) ([]byte, error) {
+	if _, err := conn.Write(t.opts.Payload); err != nil {
+		return nil, fmt.Errorf("failed to send payload : %v", err)
+	}
+	if t.opts.ReadTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(t.opts.ReadTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline : %v", err)
+		}
+	}
+
+	switch {
+	case t.opts.ReadBytes > 0:
+		reply := make([]byte, t.opts.ReadBytes)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, fmt.Errorf("failed to read %v bytes : %v", t.opts.ReadBytes, err)
+		}
+		return reply, nil
+	case len(t.opts.Delimiter) > 0:
+		reply := &bytes.Buffer{}
+		buf := make([]byte, 1)
+		for !bytes.HasSuffix(reply.Bytes(), t.opts.Delimiter) {
+			//read byte wise to not consume data after the delimiter
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return nil, fmt.Errorf("failed to read until delimiter : %v", err)
+			}
+			reply.Write(buf)
+		}
+		return reply.Bytes(), nil
+	default:
+		reply := &bytes.Buffer{}
+		_, err := io.Copy(reply, conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read reply : %v", err)
+		}
+		return reply.Bytes(), nil
+	}
+}
+
+//NewTCPTrigger creates a Triggerer that connects to addr, sends opts.Payload and reads the reply
+func NewTCPTrigger(addr string, opts TCPOptions) (Triggerer, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("failed to parse address %v : %v", addr, err)
+	}
+	if len(opts.Delimiter) > 0 && opts.ReadBytes > 0 {
+		return nil, fmt.Errorf("delimiter and byte count are mutually exclusive")
+	}
+	if opts.ReadBytes < 0 || opts.ReadTimeout < 0 {
+		return nil, fmt.Errorf("byte count and read timeout may not be negative")
+	}
+	return &TCPTrigger{
+		addr: addr,
+		opts: opts,
+	}, nil
+}
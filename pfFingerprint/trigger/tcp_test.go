@@ -0,0 +1,138 @@
+package trigger
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//startTCPServer starts a server on localhost that reads a line and answers with "reply\nextra". If the line is
+//"close", the connection is closed afterwards, otherwise it is kept open. Returns the address of the server
+func startTCPServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				conn.Write([]byte("reply\nextra"))
+				if line != "close\n" {
+					<-done
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestTCPTrigger_Execute(t *testing.T) {
+	addr := startTCPServer(t)
+
+	tests := []struct {
+		name    string
+		opts    TCPOptions
+		want    string
+		wantErr bool
+	}{
+		{"delimiter", TCPOptions{Payload: []byte("hold\n"), Delimiter: []byte("\n")}, "reply\n", false},
+		{"byte count", TCPOptions{Payload: []byte("hold\n"), ReadBytes: 3}, "rep", false},
+		{"eof", TCPOptions{Payload: []byte("close\n")}, "reply\nextra", false},
+		{"timeout ends eof read", TCPOptions{Payload: []byte("hold\n"), ReadTimeout: 100 * time.Millisecond}, "reply\nextra", false},
+		{"delimiter not found", TCPOptions{Payload: []byte("close\n"), Delimiter: []byte("END")}, "", true},
+		{"delimiter timeout", TCPOptions{Payload: []byte("hold\n"), Delimiter: []byte("END"), ReadTimeout: 100 * time.Millisecond}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := NewTCPTrigger(addr, tt.opts)
+			if err != nil {
+				t.Fatalf("NewTCPTrigger() error = %v", err)
+			}
+			got, err := trigger.Execute()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got reply %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("context timeout", func(t *testing.T) {
+		trigger, err := NewTCPTrigger(addr, TCPOptions{Payload: []byte("hold\n")})
+		if err != nil {
+			t.Fatalf("NewTCPTrigger() error = %v", err)
+		}
+		_, err = ExecuteWithTimeout(context.Background(), trigger.(ContextTriggerer), 100*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestNewTriggerFromURI_TCP(t *testing.T) {
+	addr := startTCPServer(t)
+	payloadFile := filepath.Join(t.TempDir(), "payload")
+	if err := ioutil.WriteFile(payloadFile, []byte("close\n"), 0600); err != nil {
+		t.Fatalf("failed to write payload file : %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		want    string
+		wantErr string
+	}{
+		{"inline payload", "tcp://" + addr + "?payload=hold%0A&delimiter=%0A", "reply\n", ""},
+		{"payload file", "tcp://" + addr + "?payloadFile=" + url.QueryEscape(payloadFile), "reply\nextra", ""},
+		{"byte count and timeout", "tcp://" + addr + "?payload=hold%0A&readBytes=5&readTimeout=1s", "reply", ""},
+		{"payload and payload file", "tcp://" + addr + "?payload=a&payloadFile=" + url.QueryEscape(payloadFile), "", "mutually exclusive"},
+		{"delimiter and byte count", "tcp://" + addr + "?delimiter=a&readBytes=5", "", "mutually exclusive"},
+		{"bad timeout", "tcp://" + addr + "?readTimeout=soon", "", "failed to parse readTimeout"},
+		{"missing port", "tcp://localhost", "", "failed to parse address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trigger, err := NewTriggerFromURI(tt.uri)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewTriggerFromURI() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTriggerFromURI() error = %v", err)
+			}
+			got, err := trigger.Execute()
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got reply %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package trigger
+
+//Construct Triggerer for tls URIs, that perform a TLS 1.3 handshake with X25519 key exchange
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	tlsRecordTypeHandshake   = 22
+	tlsHandshakeClientHello  = 1
+	tlsHandshakeServerHello  = 2
+	tlsExtensionKeyShare     = 51
+	tlsGroupX25519           = 0x001d
+	tlsRecordHeaderLength    = 5
+	tlsHandshakeHeaderLength = 4
+)
+
+//tlsHelloRetryRequestRandom is the fixed random value that marks a ServerHello as HelloRetryRequest (RFC 8446, 4.1.3)
+var tlsHelloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+func init() {
+	mustRegister(Scheme{
+		Name:        "tls",
+		Description: "Performs a TLS 1.3 handshake with X25519 and captures the key shares, e.g. tls://host:4433?serverName=victim.local&verify=true",
+		Options: []Option{
+			{Name: "serverName", Description: "SNI value, default is the host of the URI"},
+			{Name: "verify", Description: "verify the server certificate, default false"},
+		},
+		Factory: func(uri *url.URL, options url.Values) (Triggerer, error) {
+			verify, err := boolOption(options, "verify")
+			if err != nil {
+				return nil, err
+			}
+			return NewTLSTrigger(uri.Host, options.Get("serverName"), verify)
+		},
+		ReadinessProbe: hostProbe("443", ""),
+	})
+}
+
+//TLSTrigger performs a TLS 1.3 handshake that only offers X25519 for the key exchange. The victim operation
+//is the computation of the server's key share and the shared secret
+type TLSTrigger struct {
+	config *tls.Config
+	addr   string
+}
+
+//TLSHandshakeRecord contains the plaintext part of a TLS 1.3 handshake
+type TLSHandshakeRecord struct {
+	//Version and CipherSuite are the negotiated values, see the constants in crypto/tls
+	Version     uint16
+	CipherSuite uint16
+	//ClientHello and ServerHello are the raw handshake messages, including the handshake message header
+	ClientHello []byte
+	ServerHello []byte
+	//ClientKeyShare and ServerKeyShare are the 32 byte X25519 public keys from the key_share extensions
+	ClientKeyShare []byte
+	ServerKeyShare []byte
+	//ClientToServer and ServerToClient contain all bytes that were sent during the handshake, including the
+	//encrypted records
+	ClientToServer []byte
+	ServerToClient []byte
+}
+
+//MatchesServerScalar returns true if scalar is the private key belonging to ServerKeyShare. scalar is the 32 byte
+//little endian X25519 private key. It is clamped, so the values of the bits fixed by X25519 do not matter
+func (r *TLSHandshakeRecord) MatchesServerScalar(scalar []byte) (bool, error) {
+	pub, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return false, fmt.Errorf("failed to compute public key : %v", err)
+	}
+	return subtle.ConstantTimeCompare(pub, r.ServerKeyShare) == 1, nil
+}
+
+//recordingConn records all bytes that are read and written through it
+type recordingConn struct {
+	net.Conn
+	read    bytes.Buffer
+	written bytes.Buffer
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.read.Write(b[:n])
+	return n, err
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	r.written.Write(b[:n])
+	return n, err
+}
+
+//firstHandshakeMessage returns the first handshake message in stream, which must be of type msgType. Only the
+//plaintext handshake records at the start of stream are considered
+func firstHandshakeMessage(stream []byte, msgType uint8) ([]byte, error) {
+	//a handshake message may be fragmented over several records
+	handshakeData := make([]byte, 0)
+	for len(stream) >= tlsRecordHeaderLength && stream[0] == tlsRecordTypeHandshake {
+		length := int(stream[3])<<8 | int(stream[4])
+		if len(stream) < tlsRecordHeaderLength+length {
+			return nil, fmt.Errorf("truncated record")
+		}
+		handshakeData = append(handshakeData, stream[tlsRecordHeaderLength:tlsRecordHeaderLength+length]...)
+		stream = stream[tlsRecordHeaderLength+length:]
+	}
+
+	if len(handshakeData) < tlsHandshakeHeaderLength {
+		return nil, fmt.Errorf("no handshake message found")
+	}
+	if handshakeData[0] != msgType {
+		return nil, fmt.Errorf("expected handshake message of type %v, got %v", msgType, handshakeData[0])
+	}
+	length := int(handshakeData[1])<<16 | int(handshakeData[2])<<8 | int(handshakeData[3])
+	if len(handshakeData) < tlsHandshakeHeaderLength+length {
+		return nil, fmt.Errorf("truncated handshake message")
+	}
+	return handshakeData[:tlsHandshakeHeaderLength+length], nil
+}
+
+//helloExtension returns the data of the extension with the given type from a ClientHello or ServerHello message
+func helloExtension(msg []byte, extensionType uint16) ([]byte, error) {
+	s := cryptobyte.String(msg[tlsHandshakeHeaderLength:])
+	var legacyVersion uint16
+	var random, sessionID cryptobyte.String
+	if !s.ReadUint16(&legacyVersion) || !s.ReadBytes((*[]byte)(&random), 32) || !s.ReadUint8LengthPrefixed(&sessionID) {
+		return nil, fmt.Errorf("malformed hello message")
+	}
+	if msg[0] == tlsHandshakeServerHello {
+		if bytes.Equal(random, tlsHelloRetryRequestRandom) {
+			return nil, fmt.Errorf("server sent HelloRetryRequest")
+		}
+		var cipherSuite uint16
+		var compression uint8
+		if !s.ReadUint16(&cipherSuite) || !s.ReadUint8(&compression) {
+			return nil, fmt.Errorf("malformed ServerHello")
+		}
+	} else {
+		var cipherSuites, compressions cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&cipherSuites) || !s.ReadUint8LengthPrefixed(&compressions) {
+			return nil, fmt.Errorf("malformed ClientHello")
+		}
+	}
+
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, fmt.Errorf("hello message has no extensions")
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, fmt.Errorf("malformed extension")
+		}
+		if extType == extensionType {
+			return extData, nil
+		}
+	}
+	return nil, fmt.Errorf("extension %v not found", extensionType)
+}
+
+//x25519KeyShare parses a key share entry and checks that it is an X25519 key share
+func x25519KeyShare(entry *cryptobyte.String) ([]byte, error) {
+	var group uint16
+	var key cryptobyte.String
+	if !entry.ReadUint16(&group) || !entry.ReadUint16LengthPrefixed(&key) {
+		return nil, fmt.Errorf("malformed key share")
+	}
+	if group != tlsGroupX25519 {
+		return nil, fmt.Errorf("expected key share for group %x, got %x", tlsGroupX25519, group)
+	}
+	if len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("expected key share of length %v, got %v", curve25519.PointSize, len(key))
+	}
+	return key, nil
+}
+
+//newTLSHandshakeRecord extracts the hello messages and the key shares from the recorded handshake
+func newTLSHandshakeRecord(conn *recordingConn, state tls.ConnectionState) (*TLSHandshakeRecord, error) {
+	record := &TLSHandshakeRecord{
+		Version:        state.Version,
+		CipherSuite:    state.CipherSuite,
+		ClientToServer: append([]byte(nil), conn.written.Bytes()...),
+		ServerToClient: append([]byte(nil), conn.read.Bytes()...),
+	}
+
+	var err error
+	if record.ClientHello, err = firstHandshakeMessage(record.ClientToServer, tlsHandshakeClientHello); err != nil {
+		return nil, fmt.Errorf("failed to parse ClientHello : %v", err)
+	}
+	if record.ServerHello, err = firstHandshakeMessage(record.ServerToClient, tlsHandshakeServerHello); err != nil {
+		return nil, fmt.Errorf("failed to parse ServerHello : %v", err)
+	}
+
+	clientExt, err := helloExtension(record.ClientHello, tlsExtensionKeyShare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client key share : %v", err)
+	}
+	//the client only offers X25519, so there is exactly one entry
+	clientShares := cryptobyte.String(clientExt)
+	var entries cryptobyte.String
+	if !clientShares.ReadUint16LengthPrefixed(&entries) {
+		return nil, fmt.Errorf("malformed client key share extension")
+	}
+	if record.ClientKeyShare, err = x25519KeyShare(&entries); err != nil {
+		return nil, fmt.Errorf("failed to parse client key share : %v", err)
+	}
+
+	serverExt, err := helloExtension(record.ServerHello, tlsExtensionKeyShare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server key share : %v", err)
+	}
+	serverShare := cryptobyte.String(serverExt)
+	if record.ServerKeyShare, err = x25519KeyShare(&serverShare); err != nil {
+		return nil, fmt.Errorf("failed to parse server key share : %v", err)
+	}
+
+	return record, nil
+}
+
+func (t *TLSTrigger) Execute() ([]byte, error) {
+	result, err := t.ExecuteContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return result.Payload, nil
+}
+
+//ExecuteContext performs the handshake and closes the connection afterwards. The payload of the result is the
+//gob encoded TLSHandshakeRecord
+func (t *TLSTrigger) ExecuteContext(ctx context.Context) (*Result, error) {
+	dialer := net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial : %v", err)
+	}
+	conn := &recordingConn{Conn: rawConn}
+	tlsConn := tls.Client(conn, t.config)
+	defer func() {
+		if err := tlsConn.Close(); err != nil && ctx.Err() == nil {
+			log.Printf("TLSTrigger failed to close connection :%v", err)
+		}
+	}()
+
+	//closing the connection aborts a pending handshake
+	handshakeDone := make(chan struct{})
+	abortWatcherDone := make(chan struct{})
+	go func() {
+		defer close(abortWatcherDone)
+		select {
+		case <-ctx.Done():
+			rawConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	start := time.Now()
+	err = tlsConn.Handshake()
+	end := time.Now()
+	close(handshakeDone)
+	<-abortWatcherDone
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake failed : %v", err)
+	}
+
+	record, err := newTLSHandshakeRecord(conn, tlsConn.ConnectionState())
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(record); err != nil {
+		return nil, fmt.Errorf("failed to encode handshake record : %v", err)
+	}
+
+	return &Result{
+		Payload: buf.Bytes(),
+		TLS:     record,
+		Start:   start,
+		End:     end,
+	}, nil
+}
+
+//NewTLSTrigger creates a Triggerer that performs a TLS 1.3 handshake with addr, offering only X25519 for the
+//key exchange. serverName is sent via SNI. If it is empty, the host part of addr is used. The server
+//certificate is only verified if verify is true
+func NewTLSTrigger(addr, serverName string, verify bool) (Triggerer, error) {
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse address %v : %v", addr, err)
+		}
+		serverName = host
+	}
+	return &TLSTrigger{
+		addr: addr,
+		config: &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: !verify,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   []tls.CurveID{tls.X25519},
+		},
+	}, nil
+}
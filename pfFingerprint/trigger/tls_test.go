@@ -0,0 +1,171 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+//constantReader returns an infinite stream of the same byte
+type constantReader byte
+
+func (c constantReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(c)
+	}
+	return len(b), nil
+}
+
+//startTLSServer starts a TLS 1.3 server on localhost with a self signed certificate, that closes each connection
+//after the handshake. The server takes all randomness from random. Returns the address of the server
+func startTLSServer(t *testing.T, random constantReader) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate certificate key : %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "victim.local"},
+		DNSNames:     []string{"victim.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create certificate : %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS13,
+		Rand:         random,
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestTLSTrigger_Execute(t *testing.T) {
+	const serverRandom = constantReader(0x42)
+	addr := startTLSServer(t, serverRandom)
+	serverScalar := bytes.Repeat([]byte{byte(serverRandom)}, curve25519.ScalarSize)
+
+	trigger, err := NewTLSTrigger(addr, "victim.local", false)
+	if err != nil {
+		t.Fatalf("NewTLSTrigger() error = %v", err)
+	}
+	payload, err := trigger.Execute()
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	var record TLSHandshakeRecord
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+		t.Fatalf("failed to decode result : %v", err)
+	}
+
+	if record.Version != tls.VersionTLS13 {
+		t.Errorf("got version %x, want %x", record.Version, tls.VersionTLS13)
+	}
+	if len(record.ClientKeyShare) != curve25519.PointSize {
+		t.Errorf("got client key share of length %v", len(record.ClientKeyShare))
+	}
+	if !bytes.Contains(record.ClientToServer, record.ClientHello) || !bytes.Contains(record.ServerToClient, record.ServerHello) {
+		t.Errorf("hello messages are not part of the transcript")
+	}
+	matches, err := record.MatchesServerScalar(serverScalar)
+	if err != nil {
+		t.Fatalf("MatchesServerScalar() error = %v", err)
+	}
+	if !matches {
+		t.Errorf("server key share %x does not match the server scalar", record.ServerKeyShare)
+	}
+	otherScalar := bytes.Repeat([]byte{0x43}, curve25519.ScalarSize)
+	if matches, _ := record.MatchesServerScalar(otherScalar); matches {
+		t.Errorf("server key share matches a wrong scalar")
+	}
+
+	verifyingTrigger, err := NewTLSTrigger(addr, "victim.local", true)
+	if err != nil {
+		t.Fatalf("NewTLSTrigger() error = %v", err)
+	}
+	if _, err := verifyingTrigger.Execute(); err == nil {
+		t.Errorf("Execute() accepted self signed certificate")
+	}
+}
+
+func TestTLSTrigger_ExecuteContext(t *testing.T) {
+	//server that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen : %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	trigger, err := NewTLSTrigger(listener.Addr().String(), "", false)
+	if err != nil {
+		t.Fatalf("NewTLSTrigger() error = %v", err)
+	}
+	_, err = ExecuteWithTimeout(context.Background(), trigger.(ContextTriggerer), 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ExecuteContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewTriggerFromURI_TLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{"defaults", "tls://localhost:4433", false},
+		{"server name and verify", "tls://10.0.0.2:4433?serverName=victim.local&verify=true", false},
+		{"missing port", "tls://localhost", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTriggerFromURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewTriggerFromURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}